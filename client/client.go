@@ -0,0 +1,188 @@
+// Package client is a Go client of the key-value API of raftsvr, with
+// sessions, locks and leader elections built on its leases and txns.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fearblackcat/swiftRaft/raftsvr"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+// Config configures a Client.
+type Config struct {
+	// Endpoint is the URL of the key-value API of a member, such as
+	// http://127.0.0.1:12380.
+	Endpoint string
+	// Token is sent as a bearer token if set; see raftsvr.AuthenticatePath.
+	Token string
+	// HTTPClient sends the requests, http.DefaultClient if nil. Its
+	// transport carries the TLS configuration of the endpoint.
+	HTTPClient *http.Client
+}
+
+// Client sends requests to the key-value API of a member.
+type Client struct {
+	endpoint string
+	token    string
+	hc       *http.Client
+}
+
+// New returns a Client of cfg.
+func New(cfg Config) *Client {
+	hc := cfg.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &Client{endpoint: strings.TrimSuffix(cfg.Endpoint, "/"), token: cfg.Token, hc: hc}
+}
+
+// do sends a request on path and returns its response if it succeeded, or
+// the error of its body otherwise. The JSON form of v is sent as the body,
+// unless v is a string which is sent as is.
+func (c *Client) do(ctx context.Context, method, path string, v interface{}, header http.Header) (*http.Response, error) {
+	var body io.Reader
+	switch v := v.(type) {
+	case nil:
+	case string:
+		body = strings.NewReader(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err = raftsvr.DecodeError(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// doJSON sends a request and decodes the JSON body of its response in out.
+func (c *Client) doJSON(ctx context.Context, method, path string, v, out interface{}) error {
+	resp, err := c.do(ctx, method, path, v, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Get returns the latest version of key. It fails with E_KEY_NOT_FOUND if
+// the key does not exist.
+func (c *Client) Get(ctx context.Context, key string) (raftsvr.KeyValue, error) {
+	resp, err := c.do(ctx, "GET", key, nil, nil)
+	if err != nil {
+		return raftsvr.KeyValue{}, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return raftsvr.KeyValue{}, err
+	}
+	kv := raftsvr.KeyValue{Key: key, Value: string(b)}
+	kv.CreateRevision, _ = strconv.ParseUint(resp.Header.Get(raftsvr.CreateRevisionHeader), 10, 64)
+	kv.ModRevision, _ = strconv.ParseUint(resp.Header.Get(raftsvr.ModRevisionHeader), 10, 64)
+	kv.Version, _ = strconv.ParseInt(resp.Header.Get(raftsvr.VersionHeader), 10, 64)
+	kv.Lease, _ = strconv.ParseInt(resp.Header.Get(raftsvr.LeaseHeader), 10, 64)
+	return kv, nil
+}
+
+// Put writes value in key, attached to lease unless it is 0, and returns
+// the revision of the write once it is applied.
+func (c *Client) Put(ctx context.Context, key, value string, lease int64) (uint64, error) {
+	resp, err := c.Txn(ctx, &raftsvr.Txn{
+		Success: []raftsvr.Op{{Type: raftsvr.OpPut, Key: key, Value: value, Lease: lease}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Revision, nil
+}
+
+// Delete deletes key, and tells whether it existed.
+func (c *Client) Delete(ctx context.Context, key string) (bool, error) {
+	resp, err := c.Txn(ctx, &raftsvr.Txn{
+		Success: []raftsvr.Op{{Type: raftsvr.OpDelete, Key: key}},
+	})
+	if err != nil {
+		return false, err
+	}
+	return resp.Responses[0].Deleted > 0, nil
+}
+
+// Txn runs txn and returns its response once it is applied.
+func (c *Client) Txn(ctx context.Context, txn *raftsvr.Txn) (*raftsvr.TxnResponse, error) {
+	return c.txn(ctx, txn, nil)
+}
+
+func (c *Client) txn(ctx context.Context, txn *raftsvr.Txn, header http.Header) (*raftsvr.TxnResponse, error) {
+	resp, err := c.do(ctx, "POST", raftsvr.TxnPath, txn, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tr raftsvr.TxnResponse
+	if err = json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return nil, err
+	}
+	return &tr, nil
+}
+
+// Grant grants a lease of ttl seconds with a random ID.
+func (c *Client) Grant(ctx context.Context, ttl int64) (*raftsvr.LeaseResponse, error) {
+	var resp raftsvr.LeaseResponse
+	if err := c.doJSON(ctx, "POST", raftsvr.LeasePathPrefix, raftsvr.GrantRequest{TTL: ttl}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// KeepAlive restarts the TTL of lease id.
+func (c *Client) KeepAlive(ctx context.Context, id int64) (*raftsvr.LeaseResponse, error) {
+	var resp raftsvr.LeaseResponse
+	path := raftsvr.LeasePathPrefix + strconv.FormatInt(id, 10) + "/keepalive"
+	if err := c.doJSON(ctx, "POST", path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Revoke revokes lease id, which deletes the keys attached to it.
+func (c *Client) Revoke(ctx context.Context, id int64) (*raftsvr.LeaseResponse, error) {
+	var resp raftsvr.LeaseResponse
+	if err := c.doJSON(ctx, "DELETE", raftsvr.LeasePathPrefix+strconv.FormatInt(id, 10), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// isNotFound tells whether err is the error of a missing key or lease.
+func isNotFound(err error) bool {
+	code := errhandle.Code(err)
+	return code == errhandle.E_KEY_NOT_FOUND || code == errhandle.E_LEASE_NOT_FOUND
+}
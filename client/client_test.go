@@ -0,0 +1,262 @@
+package client
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/raftsvr"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+// newTestClient returns a client of a single member store whose proposals
+// are committed as they come, and which leads the cluster.
+func newTestClient(t *testing.T) (*Client, func()) {
+	proposeC := make(chan string)
+	commitC := make(chan *raftsvr.Commit)
+	donec := make(chan struct{})
+	s := &raftsvr.Kvstore{ProposeC: proposeC}
+	go func() {
+		defer close(commitC)
+		var index uint64
+		for {
+			select {
+			case p := <-proposeC:
+				index++
+				commitC <- &raftsvr.Commit{Data: p, Index: index, Term: 1}
+			case <-donec:
+				return
+			}
+		}
+	}()
+	go s.ReadCommits(commitC)
+	s.StartLeases(func() bool { return true }, donec)
+
+	srv := httptest.NewServer(&raftsvr.HttpKVAPI{Store: s})
+	return New(Config{Endpoint: srv.URL}), func() {
+		srv.Close()
+		close(donec)
+	}
+}
+
+func TestClientKV(t *testing.T) {
+	c, stop := newTestClient(t)
+	defer stop()
+	ctx := context.Background()
+
+	rev, err := c.Put(ctx, "/foo", "bar", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err := c.Get(ctx, "/foo")
+	if err != nil || kv.Value != "bar" || kv.ModRevision != rev || kv.Version != 1 {
+		t.Errorf("get = %+v, %v; want bar at revision %d", kv, err, rev)
+	}
+
+	w, err := c.Watch(ctx, "/foo", false, rev+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if ok, err := c.Delete(ctx, "/foo"); !ok || err != nil {
+		t.Errorf("delete = %v, %v; want true", ok, err)
+	}
+	ev, err := w.Next()
+	if err != nil || ev.Type != raftsvr.EventDelete || ev.Key != "/foo" {
+		t.Errorf("event = %+v, %v; want the delete of /foo", ev, err)
+	}
+	if _, err = c.Get(ctx, "/foo"); errhandle.Code(err) != errhandle.E_KEY_NOT_FOUND {
+		t.Errorf("get after delete error = %v, want code %d", err, errhandle.E_KEY_NOT_FOUND)
+	}
+}
+
+func TestSession(t *testing.T) {
+	c, stop := newTestClient(t)
+	defer stop()
+	ctx := context.Background()
+
+	s, err := NewSession(ctx, c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Put(ctx, "/session", "x", s.Lease()); err != nil {
+		t.Fatal(err)
+	}
+	// kept alive past its TTL
+	time.Sleep(2 * time.Second)
+	if kv, err := c.Get(ctx, "/session"); err != nil || kv.Lease != s.Lease() {
+		t.Errorf("key of a live session = %+v, %v", kv, err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Error("closed session is not done")
+	}
+	if _, err = c.Get(ctx, "/session"); errhandle.Code(err) != errhandle.E_KEY_NOT_FOUND {
+		t.Errorf("key of a closed session error = %v, want code %d", err, errhandle.E_KEY_NOT_FOUND)
+	}
+}
+
+func TestMutex(t *testing.T) {
+	c, stop := newTestClient(t)
+	defer stop()
+	ctx := context.Background()
+
+	s1, err := NewSession(ctx, c, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	s2, err := NewSession(ctx, c, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	m1, m2 := NewMutex(s1, "/lock"), NewMutex(s2, "/lock")
+	if err = m1.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan error, 1)
+	go func() { locked <- m2.Lock(ctx) }()
+	select {
+	case err = <-locked:
+		t.Fatalf("second lock = %v while the first is held", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a waiter gives up on its context without taking the lock
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	s3, err := NewSession(ctx, c, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s3.Close()
+	if err = NewMutex(s3, "/lock").Lock(tctx); err == nil {
+		t.Fatal("lock succeeded while held")
+	}
+
+	if err = m1.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second lock not taken after unlock")
+	}
+
+	// the lock is released when its session ends
+	locked = make(chan error, 1)
+	go func() { locked <- m1.Lock(ctx) }()
+	s2.Close()
+	select {
+	case err = <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not taken after the session holding it closed")
+	}
+}
+
+func TestElection(t *testing.T) {
+	c, stop := newTestClient(t)
+	defer stop()
+	ctx := context.Background()
+
+	s1, err := NewSession(ctx, c, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	s2, err := NewSession(ctx, c, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	e1, e2 := NewElection(s1, "/election"), NewElection(s2, "/election")
+
+	if _, err = e1.Leader(ctx); err != ErrElectionNoLeader {
+		t.Errorf("leader of an empty election error = %v, want %v", err, ErrElectionNoLeader)
+	}
+	if err = e1.Campaign(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = e1.Proclaim(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err = e2.Proclaim(ctx, "x"); err != ErrElectionNotLeader {
+		t.Errorf("proclaim of a candidate error = %v, want %v", err, ErrElectionNotLeader)
+	}
+	elected := make(chan error, 1)
+	go func() { elected <- e2.Campaign(ctx, "c") }()
+	if kv, err := e1.Leader(ctx); err != nil || kv.Value != "b" {
+		t.Errorf("leader = %+v, %v; want value b", kv, err)
+	}
+
+	if err = e1.Resign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-elected:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second candidate not elected after resign")
+	}
+	if kv, err := e1.Leader(ctx); err != nil || kv.Value != "c" {
+		t.Errorf("leader = %+v, %v; want value c", kv, err)
+	}
+}
+
+func TestSessionPut(t *testing.T) {
+	c, stop := newTestClient(t)
+	defer stop()
+	ctx := context.Background()
+
+	s, err := NewSession(ctx, c, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		if _, err = s.Put(ctx, "/counter", "x"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if kv, err := c.Get(ctx, "/counter"); err != nil || kv.Version != 3 {
+		t.Errorf("get = %+v, %v; want version 3", kv, err)
+	}
+	if s.seq != 3 {
+		t.Errorf("sequence = %d, want 3", s.seq)
+	}
+}
+
+func TestRetriable(t *testing.T) {
+	tests := []struct {
+		err error
+		w   bool
+	}{
+		{nil, false},
+		{context.DeadlineExceeded, true},
+		{errhandle.NewError(errhandle.E_TIMEOUT, nil), true},
+		{errhandle.NewError(errhandle.E_PROPOSAL_DROPPED, nil), true},
+		{errhandle.NewError(errhandle.E_TOO_MANY_REQUESTS, nil), true},
+		{errhandle.NewError(errhandle.E_CAS_MISMATCH, nil), false},
+		{errhandle.NewError(errhandle.E_STALE_SEQUENCE, nil), false},
+	}
+	for i, tt := range tests {
+		if g := retriable(tt.err); g != tt.w {
+			t.Errorf("#%d: retriable(%v) = %v, want %v", i, tt.err, g, tt.w)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fearblackcat/swiftRaft/raftsvr"
+)
+
+var (
+	// ErrElectionNotLeader is returned by Proclaim and Resign when the
+	// session does not lead the election.
+	ErrElectionNotLeader = errors.New("client: session is not the leader of the election")
+	// ErrElectionNoLeader is returned by Leader when the election has no
+	// leader.
+	ErrElectionNoLeader = errors.New("client: election has no leader")
+)
+
+// Election elects a leader among sessions. As with a Mutex, each candidate
+// owns a key under the prefix of the election and the oldest one leads;
+// the value of its key is the value proclaimed by the leader.
+type Election struct {
+	s   *Session
+	pfx string
+	key string
+	rev uint64
+}
+
+// NewElection returns the election of pfx for session s.
+func NewElection(s *Session, pfx string) *Election {
+	return &Election{s: s, pfx: pfx + "/"}
+}
+
+// Campaign waits until the session leads the election, or ctx is done, and
+// then proclaims value.
+func (e *Election) Campaign(ctx context.Context, value string) error {
+	key, rev, err := campaign(ctx, e.s, e.pfx, value)
+	if err != nil {
+		return err
+	}
+	e.key, e.rev = key, rev
+	// the key may have been created with another value by an earlier
+	// campaign of the session
+	return e.Proclaim(ctx, value)
+}
+
+// Proclaim changes the value of the leader without another election.
+func (e *Election) Proclaim(ctx context.Context, value string) error {
+	if e.key == "" {
+		return ErrElectionNotLeader
+	}
+	resp, err := e.s.c.Txn(ctx, e.ifLeader(raftsvr.Op{Type: raftsvr.OpPut, Key: e.key, Value: value, Lease: e.s.lease}))
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		e.key, e.rev = "", 0
+		return ErrElectionNotLeader
+	}
+	return nil
+}
+
+// Resign lets another candidate lead the election.
+func (e *Election) Resign(ctx context.Context) error {
+	if e.key == "" {
+		return nil
+	}
+	if _, err := e.s.c.Txn(ctx, e.ifLeader(raftsvr.Op{Type: raftsvr.OpDelete, Key: e.key})); err != nil {
+		return err
+	}
+	e.key, e.rev = "", 0
+	return nil
+}
+
+// ifLeader returns a txn running op if the key of the session is still the
+// one it was elected with.
+func (e *Election) ifLeader(op raftsvr.Op) *raftsvr.Txn {
+	return &raftsvr.Txn{
+		Compare: []raftsvr.Compare{{Key: e.key, Target: raftsvr.CompareCreateRevision, Result: raftsvr.CompareEqual, CreateRevision: e.rev}},
+		Success: []raftsvr.Op{op},
+	}
+}
+
+// Leader returns the key of the leader of the election, whose value is the
+// value it proclaimed.
+func (e *Election) Leader(ctx context.Context) (raftsvr.KeyValue, error) {
+	resp, err := e.s.c.Txn(ctx, &raftsvr.Txn{
+		Success: []raftsvr.Op{{Type: raftsvr.OpGet, Key: e.pfx, RangeEnd: raftsvr.PrefixEnd(e.pfx)}},
+	})
+	if err != nil {
+		return raftsvr.KeyValue{}, err
+	}
+	var leader *raftsvr.KeyValue
+	for i, kv := range resp.Responses[0].KVs {
+		if leader == nil || kv.CreateRevision < leader.CreateRevision {
+			leader = &resp.Responses[0].KVs[i]
+		}
+	}
+	if leader == nil {
+		return raftsvr.KeyValue{}, ErrElectionNoLeader
+	}
+	return *leader, nil
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fearblackcat/swiftRaft/raftsvr"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+// Mutex is a distributed lock. Each session waiting for it owns a key under
+// its prefix, attached to the lease of the session, and the session whose
+// key was created first holds the lock. The others each wait for the key
+// created just before their own to be deleted, so that an unlock wakes a
+// single waiter.
+type Mutex struct {
+	s   *Session
+	pfx string
+	key string
+	rev uint64
+}
+
+// NewMutex returns the lock of pfx for session s.
+func NewMutex(s *Session, pfx string) *Mutex {
+	return &Mutex{s: s, pfx: pfx + "/"}
+}
+
+// Lock waits until the session holds the lock, or ctx is done. The lock is
+// released if the session ends.
+func (m *Mutex) Lock(ctx context.Context) error {
+	key, rev, err := campaign(ctx, m.s, m.pfx, "")
+	if err != nil {
+		return err
+	}
+	m.key, m.rev = key, rev
+	return nil
+}
+
+// Unlock releases the lock.
+func (m *Mutex) Unlock(ctx context.Context) error {
+	if _, err := m.s.c.Delete(ctx, m.key); err != nil {
+		return err
+	}
+	m.key, m.rev = "", 0
+	return nil
+}
+
+// Key returns the key of the session under the prefix of the lock while it
+// holds it.
+func (m *Mutex) Key() string { return m.key }
+
+// campaign creates the key of session s under pfx with value, or finds it
+// if the session already created it, and waits until it is the oldest key
+// under pfx. It returns the key and its create revision, and deletes the
+// key if it fails.
+func campaign(ctx context.Context, s *Session, pfx, value string) (string, uint64, error) {
+	key := fmt.Sprintf("%s%x", pfx, s.lease)
+	resp, err := s.c.Txn(ctx, &raftsvr.Txn{
+		Compare: []raftsvr.Compare{{Key: key, Target: raftsvr.CompareVersion, Result: raftsvr.CompareEqual}},
+		Success: []raftsvr.Op{{Type: raftsvr.OpPut, Key: key, Value: value, Lease: s.lease}},
+		Failure: []raftsvr.Op{{Type: raftsvr.OpGet, Key: key}},
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	rev := resp.Revision
+	if !resp.Succeeded {
+		rev = resp.Responses[0].KVs[0].CreateRevision
+	}
+	if err = waitDeletes(ctx, s.c, pfx, rev); err != nil {
+		s.c.Delete(context.Background(), key)
+		return "", 0, err
+	}
+	return key, rev, nil
+}
+
+// waitDeletes waits until the keys under pfx created before rev are
+// deleted, by watching the latest of them until none is left.
+func waitDeletes(ctx context.Context, c *Client, pfx string, rev uint64) error {
+	for {
+		resp, err := c.Txn(ctx, &raftsvr.Txn{
+			Success: []raftsvr.Op{{Type: raftsvr.OpGet, Key: pfx, RangeEnd: raftsvr.PrefixEnd(pfx)}},
+		})
+		if err != nil {
+			return err
+		}
+		var last *raftsvr.KeyValue
+		for i, kv := range resp.Responses[0].KVs {
+			if kv.CreateRevision < rev && (last == nil || kv.CreateRevision > last.CreateRevision) {
+				last = &resp.Responses[0].KVs[i]
+			}
+		}
+		if last == nil {
+			return nil
+		}
+		err = waitDelete(ctx, c, last.Key, resp.Revision+1)
+		if err != nil && errhandle.Code(err) != errhandle.E_COMPACTED {
+			return err
+		}
+	}
+}
+
+// waitDelete waits until key is deleted at revision rev or later.
+func waitDelete(ctx context.Context, c *Client, key string, rev uint64) error {
+	w, err := c.Watch(ctx, key, false, rev)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for {
+		ev, err := w.Next()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if ev.Type == raftsvr.EventDelete {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/raftsvr"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+// retryInterval is the wait before retrying a request of a session.
+const retryInterval = 100 * time.Millisecond
+
+// Session keeps a lease alive until it is closed. The keys of the locks
+// and elections of a session are attached to its lease, so that they are
+// deleted if the process holding them dies. The lease is also the client
+// session of the txns run through the session, which are applied exactly
+// once.
+type Session struct {
+	c     *Client
+	lease int64
+	ttl   int64
+
+	mu  sync.Mutex // serializes the txns of the session
+	seq uint64
+
+	cancel context.CancelFunc
+	donec  chan struct{}
+	once   sync.Once
+}
+
+// NewSession grants a lease of ttl seconds and keeps it alive.
+func NewSession(ctx context.Context, c *Client, ttl int64) (*Session, error) {
+	resp, err := c.Grant(ctx, ttl)
+	if err != nil {
+		return nil, err
+	}
+	kctx, cancel := context.WithCancel(context.Background())
+	s := &Session{c: c, lease: resp.ID, ttl: ttl, cancel: cancel, donec: make(chan struct{})}
+	go s.keepAlive(kctx)
+	return s, nil
+}
+
+// keepAlive renews the lease three times per TTL until ctx is done or the
+// lease is gone.
+func (s *Session) keepAlive(ctx context.Context) {
+	defer close(s.donec)
+	ticker := time.NewTicker(time.Duration(s.ttl) * time.Second / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		rctx, cancel := context.WithTimeout(ctx, time.Duration(s.ttl)*time.Second/3)
+		_, err := s.c.KeepAlive(rctx, s.lease)
+		cancel()
+		if isNotFound(err) {
+			// expired or revoked: the keys of the session are gone
+			return
+		}
+	}
+}
+
+// Client returns the client of the session.
+func (s *Session) Client() *Client { return s.c }
+
+// Lease returns the ID of the lease of the session.
+func (s *Session) Lease() int64 { return s.lease }
+
+// Done is closed once the session ends, when it is closed or its lease is
+// found to be gone.
+func (s *Session) Done() <-chan struct{} { return s.donec }
+
+// Close stops keeping the lease alive and revokes it.
+func (s *Session) Close() error {
+	s.once.Do(s.cancel)
+	<-s.donec
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.ttl)*time.Second)
+	defer cancel()
+	if _, err := s.c.Revoke(ctx, s.lease); err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Txn runs txn exactly once: it is retried with the same sequence number
+// until ctx is done while it may not have been applied, and the server
+// answers a retry of an applied txn with its first response. The txns of a
+// session run one at a time.
+func (s *Session) Txn(ctx context.Context, txn *raftsvr.Txn) (*raftsvr.TxnResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	header := http.Header{}
+	header.Set(raftsvr.ClientIDHeader, strconv.FormatInt(s.lease, 10))
+	header.Set(raftsvr.SequenceHeader, strconv.FormatUint(s.seq, 10))
+	for {
+		resp, err := s.c.txn(ctx, txn, header)
+		if !retriable(err) {
+			return resp, err
+		}
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// Put writes value in key exactly once, and returns the revision of the
+// write; see Txn.
+func (s *Session) Put(ctx context.Context, key, value string) (uint64, error) {
+	resp, err := s.Txn(ctx, &raftsvr.Txn{
+		Success: []raftsvr.Op{{Type: raftsvr.OpPut, Key: key, Value: value}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Revision, nil
+}
+
+// retriable tells whether a request that failed with err may not have been
+// applied and can be sent again.
+func retriable(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch errhandle.Code(err) {
+	case 0, errhandle.E_TIMEOUT, errhandle.E_PROPOSAL_DROPPED, errhandle.E_TOO_MANY_REQUESTS:
+		return true
+	}
+	return false
+}
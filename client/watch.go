@@ -0,0 +1,80 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/fearblackcat/swiftRaft/raftsvr"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+// Watcher reads the events of a watch.
+type Watcher struct {
+	cancel context.CancelFunc
+	body   io.ReadCloser
+	r      *bufio.Reader
+}
+
+// Watch watches key, or the keys starting with key if prefix is set, from
+// revision index on, or from the next revision if index is 0.
+func (c *Client) Watch(ctx context.Context, key string, prefix bool, index uint64) (*Watcher, error) {
+	q := url.Values{}
+	if prefix {
+		q.Set("prefix", "true")
+	}
+	if index != 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+	}
+	path := raftsvr.WatchPath + key
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	resp, err := c.do(ctx, "GET", path, nil, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &Watcher{cancel: cancel, body: resp.Body, r: bufio.NewReader(resp.Body)}, nil
+}
+
+// Next returns the next event. It fails once the watch ends, with the error
+// the server ended it with if any.
+func (w *Watcher) Next() (raftsvr.Event, error) {
+	var typ, data string
+	for {
+		line, err := w.r.ReadString('\n')
+		if err != nil {
+			return raftsvr.Event{}, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && data != "":
+			if typ == "error" {
+				var body errhandle.Body
+				if err = json.Unmarshal([]byte(data), &body); err != nil {
+					return raftsvr.Event{}, err
+				}
+				return raftsvr.Event{}, body.Err()
+			}
+			var ev raftsvr.Event
+			err = json.Unmarshal([]byte(data), &ev)
+			return ev, err
+		}
+	}
+}
+
+// Close ends the watch.
+func (w *Watcher) Close() error {
+	w.cancel()
+	return w.body.Close()
+}
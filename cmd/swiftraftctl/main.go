@@ -0,0 +1,41 @@
+// swiftraftctl is an offline maintenance tool for the data directories of
+// a swiftRaft member. The member must be stopped while it runs.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+var commands = []command{
+	{"verify", "check WAL and snapshot files and optionally fix them", runVerify},
+	{"backup", "save a hashed snapshot of a running member to a file", runBackup},
+	{"restore", "write the data directory of a new cluster member from a backup", runRestore},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.usage)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			os.Exit(c.run(os.Args[2:]))
+		}
+	}
+	usage()
+	os.Exit(2)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/node"
+	"github.com/fearblackcat/swiftRaft/raftsvr"
+	"github.com/fearblackcat/swiftRaft/utils/api/snap"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/cryptutil"
+	pioutil "github.com/fearblackcat/swiftRaft/utils/pkg/ioutil"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/transport"
+)
+
+func runBackup(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	endpoint := fs.String("endpoint", "http://127.0.0.1:9121", "key-value API of a running member")
+	out := fs.String("out", "", "file to write the backup to")
+	var tlsInfo transport.TLSInfo
+	fs.StringVar(&tlsInfo.TrustedCAFile, "cacert", "", "CA file to verify an https endpoint")
+	fs.StringVar(&tlsInfo.CertFile, "cert", "", "client certificate file for an https endpoint")
+	fs.StringVar(&tlsInfo.KeyFile, "key", "", "client key file for an https endpoint")
+	token := fs.String("token", "", "bearer token of a root user if auth is enabled")
+	fs.Parse(args)
+
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "-out is required")
+		return 2
+	}
+
+	tr, err := transport.NewTransport(tlsInfo, 5*time.Second)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backup: %v\n", err)
+		return 1
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(*endpoint, "/")+raftsvr.SnapshotPath, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backup: %v\n", err)
+		return 1
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backup: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if err = raftsvr.DecodeError(resp); err != nil {
+		fmt.Fprintf(os.Stderr, "backup: %v\n", err)
+		return 1
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backup: %v\n", err)
+		return 1
+	}
+	// refuse to store a backup that could not be restored later
+	if _, err = snap.ReadBackup(b); err != nil {
+		fmt.Fprintf(os.Stderr, "backup: %v\n", err)
+		return 1
+	}
+	if err = pioutil.WriteAndSyncFile(*out, b, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "backup: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	backup := fs.String("backup", "", "backup file written by the backup command")
+	cluster := fs.String("cluster", "", "name=peerURL,... list of the new cluster")
+	name := fs.String("name", "", "name of the member to restore")
+	clusterID := fs.String("cluster-id", "", "hex cluster ID; derived from the new members if empty")
+	walDir := fs.String("wal-dir", "", "path of the new WAL directory; defaults to raft-<name>")
+	snapDir := fs.String("snap-dir", "", "path of the new snapshot directory; defaults to raft-<name>-snap")
+	keyFile := fs.String("key-file", "", "file of id=hexkey lines to encrypt the restored member with")
+	fs.Parse(args)
+
+	if *backup == "" || *cluster == "" || *name == "" {
+		fmt.Fprintln(os.Stderr, "-backup, -cluster and -name are required")
+		return 2
+	}
+	cfg := node.RestoreConfig{
+		Cluster:  *cluster,
+		NodeName: *name,
+		WALDir:   *walDir,
+		SnapDir:  *snapDir,
+	}
+	if *clusterID != "" {
+		id, err := strconv.ParseUint(*clusterID, 16, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -cluster-id: %v\n", err)
+			return 2
+		}
+		cfg.ClusterID = id
+	}
+	if *keyFile != "" {
+		keys, err := cryptutil.NewFileKeyProvider(*keyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -key-file: %v\n", err)
+			return 2
+		}
+		cfg.EncryptionKeys = keys
+	}
+
+	b, err := ioutil.ReadFile(*backup)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+		return 1
+	}
+	if err = node.Restore(logtool.RLog, b, cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/fearblackcat/swiftRaft/utils/api/verify"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+)
+
+// dataDirs resolves the WAL and snapshot directories either from explicit
+// flags or from the member name, using the layout of node.NewRaftNode.
+func dataDirs(name, walDir, snapDir string) (string, string, error) {
+	if name != "" {
+		if walDir == "" {
+			walDir = fmt.Sprintf("raft-%s", name)
+		}
+		if snapDir == "" {
+			snapDir = fmt.Sprintf("raft-%s-snap", name)
+		}
+	}
+	if walDir == "" || snapDir == "" {
+		return "", "", fmt.Errorf("either -name or both -wal-dir and -snap-dir are required")
+	}
+	return walDir, snapDir, nil
+}
+
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	name := fs.String("name", "", "member name; selects raft-<name> and raft-<name>-snap")
+	walDir := fs.String("wal-dir", "", "path to the WAL directory")
+	snapDir := fs.String("snap-dir", "", "path to the snapshot directory")
+	fix := fs.Bool("fix", false, "apply safe fixes: truncate a torn WAL tail, move orphaned snapshots aside, rename WAL segments")
+	fs.Parse(args)
+
+	wd, sd, err := dataDirs(*name, *walDir, *snapDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	report, err := verify.Verify(logtool.RLog, wd, sd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify: %v\n", err)
+		return 1
+	}
+
+	out := struct {
+		*verify.Report
+		Fixed []verify.Problem `json:"fixed,omitempty"`
+	}{Report: report}
+
+	if *fix {
+		if out.Fixed, err = verify.Fix(logtool.RLog, report); err != nil {
+			fmt.Fprintf(os.Stderr, "fix: %v\n", err)
+			return 1
+		}
+		if out.Report, err = verify.Verify(logtool.RLog, wd, sd); err != nil {
+			fmt.Fprintf(os.Stderr, "verify: %v\n", err)
+			return 1
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(out); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !out.Report.OK() {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,167 @@
+package swiftRaft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/node"
+	"github.com/fearblackcat/swiftRaft/raftsvr"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/types"
+)
+
+// TestForwardWrites runs a three member cluster whose followers redirect
+// writes to the leader, then stops two members so that the last one has no
+// leader.
+func TestForwardWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the data directories are relative to the working directory
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	names := []string{"n1", "n2", "n3"}
+	var peers []string
+	for _, name := range names {
+		peers = append(peers, fmt.Sprintf("%s=http://127.0.0.1:%d", name, freePort(t)))
+	}
+	cluster := strings.Join(peers, ",")
+	members, _, err := node.MemberList(cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	servers := make(map[string]*RaftServer)
+	urls := make(map[string]string)
+	for _, name := range names {
+		cfg := &Config{
+			Cluster:           cluster,
+			AdvertiseRaftAddr: members[name].Peer,
+			NodeName:          name,
+			KvPort:            freePort(t),
+			ElectedCh:         make(chan bool, 16),
+			ErrCh:             make(chan error, 1),
+			ForwardWrites:     raftsvr.ForwardRedirect,
+		}
+		r := NewRaftServer(cfg)
+		go r.Run()
+		servers[name] = r
+		urls[name] = fmt.Sprintf("http://127.0.0.1:%d", cfg.KvPort)
+	}
+	stop := func(name string) {
+		servers[name].fail(errhandle.NewError(errhandle.E_STOPPED, nil))
+	}
+	defer func() {
+		for _, name := range names {
+			stop(name)
+		}
+	}()
+
+	// wait for a leader and the registry of every member
+	var leader, follower string
+	for i := 0; leader == "" || follower == ""; i++ {
+		if i == 200 {
+			t.Fatal("no leader with a complete member registry")
+		}
+		time.Sleep(50 * time.Millisecond)
+		leader, follower = "", ""
+		for _, name := range names {
+			var mr raftsvr.MembersResponse
+			resp, err := http.Get(urls[name] + raftsvr.MembersPath)
+			if err != nil {
+				continue
+			}
+			err = json.NewDecoder(resp.Body).Decode(&mr)
+			resp.Body.Close()
+			if err != nil || mr.Leader == "" || len(mr.Members) != len(names) {
+				continue
+			}
+			if mr.Leader == types.ID(members[name].ID).String() {
+				leader = name
+			} else {
+				follower = name
+			}
+		}
+	}
+
+	put := func(c *http.Client, name, path, value string) *http.Response {
+		req, err := http.NewRequest("PUT", urls[name]+path, strings.NewReader(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp := put(noRedirect, follower, "/foo", "bar")
+	if wloc := urls[leader] + "/foo"; resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != wloc {
+		t.Errorf("PUT on follower = %d to %q, want %d to %q", resp.StatusCode, resp.Header.Get("Location"), http.StatusTemporaryRedirect, wloc)
+	}
+	// the redirect is followed with the body and conditions of the request
+	if resp = put(http.DefaultClient, follower, "/foo?prevValue=", "bar"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("conditional PUT on missing key = %d, want %d", resp.StatusCode, http.StatusPreconditionFailed)
+	}
+	if resp = put(http.DefaultClient, follower, "/foo", "bar"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("redirected PUT = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if resp = put(http.DefaultClient, follower, "/foo?prevValue=bar", "baz"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("redirected conditional PUT = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if v, _ := servers[leader].kvs.Lookup("/foo"); v != "baz" {
+		t.Errorf("/foo on the leader = %q, want baz", v)
+	}
+
+	// without a quorum the last member loses its leader
+	var last string
+	for _, name := range names {
+		if name != follower {
+			stop(name)
+		} else {
+			last = name
+		}
+	}
+	for i := 0; ; i++ {
+		if i == 200 {
+			t.Fatal("writes accepted without a leader")
+		}
+		time.Sleep(50 * time.Millisecond)
+		resp = put(noRedirect, last, "/foo", "lost")
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			break
+		}
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("503 without Retry-After")
+	}
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
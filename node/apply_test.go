@@ -0,0 +1,191 @@
+package node
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/raftsvr"
+	"github.com/fearblackcat/swiftRaft/utils/api/snap"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal"
+)
+
+// testMember is a single member cluster whose store applies commits
+// slowly, and snapshots in the background if started so.
+type testMember struct {
+	cfg   *RaftConfig
+	kvs   *raftsvr.Kvstore
+	stopc chan struct{}
+	errc  chan error
+}
+
+func startTestMember(t *testing.T, cluster string, applyDelay time.Duration, sync wal.SyncPolicy, background bool) *testMember {
+	members, peers, err := MemberList(cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &testMember{stopc: make(chan struct{}), errc: make(chan error, 2)}
+	proposeC := make(chan string)
+	m.cfg = &RaftConfig{
+		SelfPeer:      members["n1"].Peer,
+		NodeName:      "n1",
+		ProposeC:      proposeC,
+		ConfChangeC:   make(chan raftpb.ConfChange),
+		ElectedCh:     make(chan bool),
+		SnapshotReady: make(chan *snap.Snapshotter, 1),
+		CommitC:       make(chan *raftsvr.Commit),
+		ErrorC:        make(chan error),
+		StopC:         m.stopc,
+		WALSync:       sync,
+		WALSyncDelay:  time.Millisecond,
+	}
+	if background {
+		m.cfg.SnapshotView = func() (func() ([]byte, error), error) { return m.kvs.SnapshotView() }
+	}
+	// a slow store: commits reach it applyDelay after they are published
+	storeC := make(chan *raftsvr.Commit)
+	go func() {
+		defer close(storeC)
+		for {
+			select {
+			case c, ok := <-m.cfg.CommitC:
+				if !ok {
+					return
+				}
+				if c != nil && c.Applied == nil {
+					time.Sleep(applyDelay)
+				}
+				storeC <- c
+			case <-m.cfg.ElectedCh:
+			}
+		}
+	}()
+	NewRaftNode(members["n1"].ID, peers, members, func() ([]byte, error) { return m.kvs.SnapshotChunks() }, m.cfg)
+	var snapshotter *snap.Snapshotter
+	select {
+	case snapshotter = <-m.cfg.SnapshotReady:
+	case err := <-m.cfg.ErrorC:
+		t.Fatal(err)
+	}
+	m.kvs = raftsvr.NewKVStore(snapshotter, proposeC)
+	m.kvs.LoadDataToMap(storeC, m.errc)
+	return m
+}
+
+// stop stops the member abruptly, as its process would if it crashed
+// after the writes were acknowledged.
+func (m *testMember) stop(t *testing.T) {
+	close(m.stopc)
+	for err := range m.cfg.ErrorC {
+		t.Errorf("member error: %v", err)
+	}
+	select {
+	case err := <-m.errc:
+		t.Errorf("store error: %v", err)
+	default:
+	}
+}
+
+// waitKeys waits until the store holds /k0 to /k<n-1> with their index as
+// value.
+func (m *testMember) waitKeys(t *testing.T, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("/k%d", i)
+		for {
+			v, ok := m.kvs.Lookup(key)
+			if ok {
+				if v != strconv.Itoa(i) {
+					t.Fatalf("%s = %q, want %q", key, v, strconv.Itoa(i))
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s missing", key)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// TestApplyRestart writes through a member whose store applies slowly, so
+// that the applier lags the event loop and snapshots while it does, or
+// while its snapshot is saved in the background. Every write applied
+// before the member stops must be there after it restarts from its
+// snapshots and WAL.
+func TestApplyRestart(t *testing.T) {
+	for _, sync := range []wal.SyncPolicy{wal.SyncAlways, wal.SyncBatch} {
+		t.Run(sync.String(), func(t *testing.T) { testApplyRestart(t, sync, false) })
+		t.Run(sync.String()+"/background", func(t *testing.T) { testApplyRestart(t, sync, true) })
+	}
+}
+
+func testApplyRestart(t *testing.T, sync wal.SyncPolicy, background bool) {
+	dir, err := ioutil.TempDir("", "applyrestart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the data directories are relative to the working directory
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	defer func(n uint64) { defaultSnapshotCount = n }(defaultSnapshotCount)
+	defaultSnapshotCount = 20
+
+	cluster := fmt.Sprintf("n1=http://127.0.0.1:%d", freePort(t))
+	const writes = 100
+
+	m := startTestMember(t, cluster, time.Millisecond, sync, background)
+	for i := 0; i < writes; i++ {
+		if err := m.kvs.Propose(fmt.Sprintf("/k%d", i), strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.waitKeys(t, writes)
+	m.stop(t)
+
+	snaps, err := filepath.Glob(filepath.Join("raft-n1-snap", "*.snap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) == 0 {
+		t.Fatal("no snapshot was taken")
+	}
+
+	m = startTestMember(t, cluster, 0, sync, background)
+	defer m.stop(t)
+	m.waitKeys(t, writes)
+}
+
+func TestSlowFsyncAlarm(t *testing.T) {
+	rc := &raftNode{load: &raftsvr.NodeLoad{}}
+	tests := []struct {
+		slow   bool
+		walarm bool
+	}{
+		{false, false},
+		{true, true},
+		{true, true},
+		{false, false},
+	}
+	for i, tt := range tests {
+		rc.observeFsync(time.Millisecond, tt.slow)
+		if rc.slowFsync != tt.walarm {
+			t.Errorf("#%d: alarm = %v, want %v", i, rc.slowFsync, tt.walarm)
+		}
+	}
+	if d := rc.load.FsyncLatency(); d != time.Millisecond {
+		t.Errorf("fsync latency = %v, want 1ms", d)
+	}
+}
@@ -0,0 +1,57 @@
+package node
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchProposals(t *testing.T) {
+	big := strings.Repeat("x", maxSizePerMsg)
+	tests := []struct {
+		queued []string
+		window time.Duration
+		late   string // proposed after the batch started
+		close  bool
+
+		wlen  int
+		wopen bool
+	}{
+		{nil, 0, "", false, 1, true},
+		{[]string{"a", "b"}, 0, "", false, 3, true},
+		// at most maxBatch proposals
+		{[]string{"a", "b", "c", "d"}, 0, "", false, 3, true},
+		// and until they reach maxSizePerMsg bytes
+		{[]string{big, "b"}, 0, "", false, 2, true},
+		{[]string{"a"}, 0, "", true, 2, false},
+		// late proposals are only waited for within the window
+		{nil, 0, "b", false, 1, true},
+		{nil, time.Second, "b", true, 2, false},
+	}
+	for i, tt := range tests {
+		proposeC := make(chan string, len(tt.queued)+1)
+		for _, p := range tt.queued {
+			proposeC <- p
+		}
+		if tt.late == "" && tt.close {
+			close(proposeC)
+		}
+		if tt.late != "" {
+			go func(late string, closeAfter bool) {
+				time.Sleep(10 * time.Millisecond)
+				proposeC <- late
+				if closeAfter {
+					close(proposeC)
+				}
+			}(tt.late, tt.close)
+		}
+		rc := &raftNode{proposeC: proposeC, batchWindow: tt.window, maxBatch: 3}
+		batch, open := rc.batchProposals("first")
+		if len(batch) != tt.wlen || open != tt.wopen {
+			t.Errorf("#%d: batch of %d, open %v, want %d, %v", i, len(batch), open, tt.wlen, tt.wopen)
+		}
+		if string(batch[0]) != "first" {
+			t.Errorf("#%d: first = %q, want %q", i, batch[0], "first")
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/utils/api/verify"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/pbutil"
+)
+
+// checkForceNewCluster refuses to force a new cluster out of a data
+// directory that is missing or fails verification, since the result would
+// become the only copy of the cluster state.
+func (rc *raftNode) checkForceNewCluster() error {
+	logtool.RLog.Warn("forcing a new single-member cluster from local data; uncommitted entries are discarded and all other members are removed", map[string]interface{}{
+		"member id": rc.id,
+		"wal dir":   rc.waldir,
+		"snap dir":  rc.snapdir,
+	})
+	if !wal.Exist(rc.waldir) {
+		return errhandle.NewError(errhandle.E_DATA_DIR, fmt.Errorf("cannot force a new cluster without an existing wal in %s", rc.waldir))
+	}
+	report, err := verify.Verify(logtool.Logger(logtool.SubsystemWAL), rc.waldir, rc.snapdir)
+	if err != nil {
+		return errhandle.NewError(errhandle.E_DATA_DIR, err)
+	}
+	if !report.OK() {
+		logtool.RLog.Error("raft: data dir is inconsistent; refusing to force a new cluster", map[string]interface{}{
+			"problems": report.Problems,
+		})
+		return errhandle.NewError(errhandle.E_DATA_DIR, fmt.Errorf("data dir has %d problems; refusing to force a new cluster", len(report.Problems)))
+	}
+	return nil
+}
+
+// forceNewClusterEntries drops the entries past the commit index and
+// commits conf changes that remove every other member, so that the member
+// restarts as the only voter of its cluster. The conf changes are saved to
+// w and returned with the kept entries and the updated hard state.
+func (rc *raftNode) forceNewClusterEntries(w *wal.WAL, snapshot *raftpb.Snapshot, st raftpb.HardState, ents []raftpb.Entry) ([]raftpb.Entry, raftpb.HardState, error) {
+	for i, e := range ents {
+		if e.Index > st.Commit {
+			logtool.RLog.Warn("discarding uncommitted WAL entries", map[string]interface{}{
+				"commit index":    st.Commit,
+				"discarded count": len(ents) - i,
+			})
+			ents = ents[:i]
+			break
+		}
+	}
+
+	lastIndex := st.Commit
+	if snapshot != nil && snapshot.Metadata.Index > lastIndex {
+		lastIndex = snapshot.Metadata.Index
+	}
+	if len(ents) > 0 {
+		lastIndex = ents[len(ents)-1].Index
+	}
+
+	ccEnts := createConfChangeEnts(memberIDs(snapshot, ents), rc.id, st.Term, lastIndex)
+	if len(ccEnts) > 0 {
+		ents = append(ents, ccEnts...)
+		st.Commit = ccEnts[len(ccEnts)-1].Index
+		if err := w.Save(st, ccEnts); err != nil {
+			return nil, st, errhandle.NewError(errhandle.E_WAL_SAVE, err)
+		}
+	}
+	for _, e := range ccEnts {
+		var cc raftpb.ConfChange
+		pbutil.MustUnmarshal(&cc, e.Data)
+		logtool.RLog.Warn("forcing conf change", map[string]interface{}{
+			"type":      cc.Type.String(),
+			"member id": cc.NodeID,
+			"index":     e.Index,
+		})
+	}
+	return ents, st, nil
+}
+
+// memberIDs returns the sorted IDs of the members in the snapshot ConfState
+// after applying the conf changes among ents.
+func memberIDs(snapshot *raftpb.Snapshot, ents []raftpb.Entry) []uint64 {
+	ids := make(map[uint64]bool)
+	if snapshot != nil {
+		for _, id := range snapshot.Metadata.ConfState.Nodes {
+			ids[id] = true
+		}
+		for _, id := range snapshot.Metadata.ConfState.Learners {
+			ids[id] = true
+		}
+	}
+	for _, e := range ents {
+		if e.Type != raftpb.EntryConfChange {
+			continue
+		}
+		var cc raftpb.ConfChange
+		pbutil.MustUnmarshal(&cc, e.Data)
+		switch cc.Type {
+		case raftpb.ConfChangeAddNode, raftpb.ConfChangeAddLearnerNode:
+			ids[cc.NodeID] = true
+		case raftpb.ConfChangeRemoveNode:
+			delete(ids, cc.NodeID)
+		}
+	}
+	sids := make([]uint64, 0, len(ids))
+	for id := range ids {
+		sids = append(sids, id)
+	}
+	sort.Slice(sids, func(i, j int) bool { return sids[i] < sids[j] })
+	return sids
+}
+
+// createConfChangeEnts returns the entries, starting after index, that
+// remove every member but self and add self if it is not a member yet.
+func createConfChangeEnts(ids []uint64, self uint64, term, index uint64) []raftpb.Entry {
+	found := false
+	var ccs []raftpb.ConfChange
+	for _, id := range ids {
+		if id == self {
+			found = true
+			continue
+		}
+		ccs = append(ccs, raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: id})
+	}
+	if !found {
+		ccs = append(ccs, raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: self})
+	}
+
+	ents := make([]raftpb.Entry, 0, len(ccs))
+	for i := range ccs {
+		index++
+		ccs[i].ID = index
+		ents = append(ents, raftpb.Entry{
+			Type:  raftpb.EntryConfChange,
+			Term:  term,
+			Index: index,
+			Data:  pbutil.MustMarshal(&ccs[i]),
+		})
+	}
+	return ents
+}
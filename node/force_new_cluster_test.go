@@ -0,0 +1,74 @@
+package node
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/pbutil"
+)
+
+func TestMemberIDs(t *testing.T) {
+	addCC := &raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 4}
+	removeCC := &raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: 2}
+	snapshot := &raftpb.Snapshot{Metadata: raftpb.SnapshotMetadata{ConfState: raftpb.ConfState{Nodes: []uint64{1, 2, 3}}}}
+	ents := []raftpb.Entry{
+		{Type: raftpb.EntryConfChange, Data: pbutil.MustMarshal(addCC)},
+		{Type: raftpb.EntryNormal, Data: []byte("data")},
+		{Type: raftpb.EntryConfChange, Data: pbutil.MustMarshal(removeCC)},
+	}
+
+	tests := []struct {
+		snap *raftpb.Snapshot
+		ents []raftpb.Entry
+		w    []uint64
+	}{
+		{nil, nil, []uint64{}},
+		{snapshot, nil, []uint64{1, 2, 3}},
+		{snapshot, ents[:1], []uint64{1, 2, 3, 4}},
+		{snapshot, ents, []uint64{1, 3, 4}},
+		{nil, ents, []uint64{4}},
+	}
+	for i, tt := range tests {
+		if g := memberIDs(tt.snap, tt.ents); !reflect.DeepEqual(g, tt.w) {
+			t.Errorf("#%d: ids = %v, want %v", i, g, tt.w)
+		}
+	}
+}
+
+func TestCreateConfChangeEnts(t *testing.T) {
+	tests := []struct {
+		ids  []uint64
+		self uint64
+		w    []raftpb.ConfChange
+	}{
+		{[]uint64{1}, 1, nil},
+		{
+			[]uint64{1, 2, 3}, 2,
+			[]raftpb.ConfChange{
+				{ID: 11, Type: raftpb.ConfChangeRemoveNode, NodeID: 1},
+				{ID: 12, Type: raftpb.ConfChangeRemoveNode, NodeID: 3},
+			},
+		},
+		{
+			[]uint64{1}, 2,
+			[]raftpb.ConfChange{
+				{ID: 11, Type: raftpb.ConfChangeRemoveNode, NodeID: 1},
+				{ID: 12, Type: raftpb.ConfChangeAddNode, NodeID: 2},
+			},
+		},
+	}
+	for i, tt := range tests {
+		ents := createConfChangeEnts(tt.ids, tt.self, 5, 10)
+		if len(ents) != len(tt.w) {
+			t.Fatalf("#%d: len(ents) = %d, want %d", i, len(ents), len(tt.w))
+		}
+		for j, e := range ents {
+			var cc raftpb.ConfChange
+			pbutil.MustUnmarshal(&cc, e.Data)
+			if e.Term != 5 || e.Index != uint64(11+j) || !reflect.DeepEqual(cc, tt.w[j]) {
+				t.Errorf("#%d.%d: entry = %+v / %+v, want term 5, index %d, %+v", i, j, e, cc, 11+j, tt.w[j])
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package node
+
+import (
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/raft"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/types"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// warnApplyDuration is the amount of time allotted to applying one Ready
+// before logging a warning.
+const warnApplyDuration = 100 * time.Millisecond
+
+var (
+	hasLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "has_leader",
+		Help:      "Whether or not a leader exists. 1 is existence, 0 is not.",
+	})
+	isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "is_leader",
+		Help:      "Whether or not this member is a leader. 1 if is, 0 otherwise.",
+	})
+	leaderChanges = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "leader_changes_seen_total",
+		Help:      "The number of leader changes seen.",
+	})
+	currentTerm = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "term",
+		Help:      "The current raft term.",
+	})
+	commitIndex = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "commit_index",
+		Help:      "The index of the last committed entry.",
+	})
+	appliedIndex = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "applied_index",
+		Help:      "The index of the last applied entry.",
+	})
+	snapshotIndex = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "snapshot_index",
+		Help:      "The index of the last snapshot.",
+	})
+	proposalsCommitted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "proposals_committed_total",
+		Help:      "The total number of committed proposals published to the state machine.",
+	})
+	proposalsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "proposals_dropped_total",
+		Help:      "The total number of proposals rejected by raft.",
+	})
+	proposalsPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "proposals_pending",
+		Help:      "The current number of entries appended to the log but not yet applied.",
+	})
+	readyDurationSec = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "ready_duration_seconds",
+		Help:      "The latency distributions of handling one raft Ready, from receipt to Advance.",
+
+		// lowest bucket start of upper bound 0.001 sec (1 ms) with factor 2
+		// highest bucket start of 0.001 sec * 2^13 == 8.192 sec
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+	applyDurationSec = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "apply_duration_seconds",
+		Help:      "The latency distributions of applying the committed entries of one raft Ready.",
+
+		// lowest bucket start of upper bound 0.0001 sec (0.1 ms) with factor 2
+		// highest bucket start of 0.0001 sec * 2^15 == 3.2768 sec
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+	})
+	slowApplies = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "slow_apply_total",
+		Help:      "The total number of slow apply requests (likely overloaded from slow disk).",
+	})
+	proposalBatchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "proposal_batch_size",
+		Help:      "The number of proposals handed to raft together.",
+
+		// lowest bucket start of upper bound 1 with factor 2
+		// highest bucket start of 1 * 2^9 == 512
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+	followerMatchLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "follower_match_lag",
+		Help:      "The number of entries the leader has that a follower has not matched yet.",
+	},
+		[]string{"To"},
+	)
+	slowFsyncAlarm = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "slow_fsync_alarm",
+		Help:      "Whether the last WAL fsync was slower than the slow fsync threshold (1) or not (0).",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(hasLeader)
+	prometheus.MustRegister(isLeader)
+	prometheus.MustRegister(leaderChanges)
+	prometheus.MustRegister(currentTerm)
+	prometheus.MustRegister(commitIndex)
+	prometheus.MustRegister(appliedIndex)
+	prometheus.MustRegister(snapshotIndex)
+	prometheus.MustRegister(proposalsCommitted)
+	prometheus.MustRegister(proposalsDropped)
+	prometheus.MustRegister(proposalsPending)
+	prometheus.MustRegister(readyDurationSec)
+	prometheus.MustRegister(applyDurationSec)
+	prometheus.MustRegister(slowApplies)
+	prometheus.MustRegister(proposalBatchSize)
+	prometheus.MustRegister(followerMatchLag)
+	prometheus.MustRegister(slowFsyncAlarm)
+}
+
+// observeApply records how long applying one Ready took and warns if it
+// was slow.
+func observeApply(took time.Duration, ents int) {
+	applyDurationSec.Observe(took.Seconds())
+	if took > warnApplyDuration {
+		slowApplies.Inc()
+		logtool.RLog.Warn("apply entries took too long", map[string]interface{}{
+			"took":              took,
+			"expected-duration": warnApplyDuration,
+			"entries":           ents,
+		})
+	}
+}
+
+// updateStatusMetrics refreshes the gauges derived from the raft status,
+// including the match lag of every follower while this member leads, and
+// the follower lag of the node load.
+func (rc *raftNode) updateStatusMetrics() {
+	st := rc.node.Status()
+	currentTerm.Set(float64(st.Term))
+	commitIndex.Set(float64(st.Commit))
+	applied := rc.getAppliedIndex()
+	appliedIndex.Set(float64(applied))
+	snapshotIndex.Set(float64(rc.getSnapshotIndex()))
+
+	last, err := rc.raftStorage.LastIndex()
+	if err != nil {
+		return
+	}
+	if last >= applied {
+		proposalsPending.Set(float64(last - applied))
+	}
+
+	if st.RaftState != raft.StateLeader {
+		followerMatchLag.Reset()
+		rc.load.SetFollowerLag(0)
+		return
+	}
+	var maxLag uint64
+	for id, pr := range st.Progress {
+		if id == rc.id {
+			continue
+		}
+		var lag uint64
+		if last > pr.Match {
+			lag = last - pr.Match
+		}
+		followerMatchLag.WithLabelValues(types.ID(id).String()).Set(float64(lag))
+		// a follower that is down must not stop the writes to the others
+		if pr.RecentActive && lag > maxLag {
+			maxLag = lag
+		}
+	}
+	rc.load.SetFollowerLag(maxLag)
+}
@@ -2,12 +2,19 @@ package node
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"strconv"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fearblackcat/swiftRaft/raft"
@@ -20,7 +27,9 @@ import (
 	"github.com/fearblackcat/swiftRaft/utils/api/wal/walpb"
 	"github.com/fearblackcat/swiftRaft/utils/errhandle"
 	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/cryptutil"
 	"github.com/fearblackcat/swiftRaft/utils/pkg/fileutil"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/transport"
 	"github.com/fearblackcat/swiftRaft/utils/pkg/types"
 )
 
@@ -29,27 +38,106 @@ type MemberInfo struct {
 	Peer string
 }
 
+// Metadata is recorded at the head of every WAL segment of a member.
+type Metadata struct {
+	NodeID    uint64 `json:"nodeId"`
+	ClusterID uint64 `json:"clusterId"`
+}
+
+// MemberList parses a name=peerURL,... cluster string and derives the raft
+// ID of every member from its name and the full set of peer URLs.
+func MemberList(cluster string) (map[string]MemberInfo, []string, error) {
+	var peers []string
+
+	resmap := make(map[string]MemberInfo)
+	kvs := strings.Split(cluster, ",")
+	for _, v := range kvs {
+		kv := strings.Split(v, "=")
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, nil, fmt.Errorf("node: invalid cluster member %q, want name=peerURL", v)
+		}
+		peers = append(peers, kv[1])
+	}
+	sort.Strings(peers)
+	for _, v := range kvs {
+		kv := strings.Split(v, "=")
+		if _, ok := resmap[kv[0]]; ok {
+			return nil, nil, fmt.Errorf("node: duplicate cluster member %q", kv[0])
+		}
+		var b []byte
+		for _, p := range peers {
+			b = append(b, []byte(p)...)
+		}
+
+		b = append(b, []byte(kv[0])...)
+
+		hash := sha1.Sum(b)
+		id := binary.BigEndian.Uint64(hash[:8])
+		resmap[kv[0]] = MemberInfo{
+			ID:   id,
+			Peer: kv[1],
+		}
+	}
+
+	return resmap, peers, nil
+}
+
 // A key-value stream backed by raft
 type raftNode struct {
 	proposeC    <-chan string            // proposed messages (k,v)
+	droppedC    chan<- string            // proposals dropped by raft
 	confChangeC <-chan raftpb.ConfChange // proposed cluster config changes
-	commitC     chan<- *string           // entries committed to log (k,v)
+	commitC     chan<- *raftsvr.Commit   // entries committed to log (k,v)
 	errorC      chan<- error             // errors from raft session
 
 	nodeName    string
 	selfPeer    string
 	id          uint64   // client ID for raft session
+	clusterID   uint64   // cluster ID for peer request validation
 	peers       []string // raft peer URLs
 	members     map[string]MemberInfo
 	join        bool   // node is joining an existing cluster
+	forceNew    bool   // node discards other members and restarts alone
 	waldir      string // path to WAL directory
 	snapdir     string // path to snapshot directory
 	getSnapshot func() ([]byte, error)
 	lastIndex   uint64 // index of log at start
 
+	// snapshotView, if set, takes the snapshots in the background. It
+	// returns a point-in-time view of the store, as the function that
+	// serialises it.
+	snapshotView func() (func() ([]byte, error), error)
+	// expandSnapshot is handed to the transport.
+	expandSnapshot func(data []byte) ([]byte, error)
+	// snapDonec is closed once the snapshot taken in the background is
+	// saved, nil if none is; snapErr is read after it.
+	snapDonec chan struct{}
+	snapErr   error
+
+	// confState, snapshotIndex and appliedIndex are changed by the applier
+	// once the node runs, and snapshotIndex by the snapshot it takes in
+	// the background; the indexes are accessed atomically.
 	confState     raftpb.ConfState
 	snapshotIndex uint64
 	appliedIndex  uint64
+	lead          uint64 // last leader seen in a Ready
+
+	applyc     chan apply    // Readies handed to the applier
+	applying   bool          // the applier was started
+	applyStopc chan struct{} // stops the applier
+	applyDonec chan struct{} // closed once the applier returned
+	applyErr   error         // why the applier returned, read after applyDonec
+
+	persistc     chan persist  // Readies handed to the persister
+	persisting   bool          // the persister was started
+	persistStopc chan struct{} // stops the persister
+	persistDonec chan struct{} // closed once the persister returned
+	persistErr   error         // why the persister returned, read after persistDonec
+
+	walOpts   wal.Options
+	walSync   wal.SyncOptions
+	compress  bool
+	slowFsync bool // the slow fsync alarm is raised; accessed with the WAL locked
 
 	// raft backing for the commit/error channel
 	node        raft.Node
@@ -59,28 +147,116 @@ type raftNode struct {
 	snapshotter      *snap.Snapshotter
 	snapshotterReady chan *snap.Snapshotter // signals when snapshotter is ready
 
-	snapCount uint64
-	transport *rafthttp.Transport
-	stopc     chan struct{} // signals proposal channel closed
-	httpstopc chan struct{} // signals http server to shutdown
-	httpdonec chan struct{} // signals http server shutdown complete
+	snapCount           uint64
+	transport           *rafthttp.Transport
+	peerTLSInfo         transport.TLSInfo
+	serverStats         *stats.ServerStats
+	leaderStats         *stats.LeaderStats
+	load                *raftsvr.NodeLoad
+	maxUncommittedBytes uint64
+	batchWindow         time.Duration   // how long a proposal waits for others
+	maxBatch            int             // proposals per batch
+	fatalc              chan error      // errors of the goroutines started with the node
+	stopc               chan struct{}   // signals proposal channel closed
+	hoststopc           <-chan struct{} // signals the host stopped the node
+	httpstopc           chan struct{}   // signals http server to shutdown
+	httpdonec           chan struct{}   // signals http server shutdown complete
 }
 
 type RaftConfig struct {
-	SelfPeer      string
-	NodeName      string
-	Join          bool
-	ProposeC      <-chan string
-	ConfChangeC   <-chan raftpb.ConfChange
-	ElectedCh     chan bool
-	ErrCh         chan error
-	SnapshotReady chan *snap.Snapshotter
-	CommitC       chan *string
-	ErrorC        chan error
+	SelfPeer  string
+	NodeName  string
+	Join      bool
+	ClusterID uint64
+	// ForceNewCluster restarts the member from its local data as the only
+	// member of its cluster. It is meant for recovering from the loss of
+	// a majority and must not be left set once the cluster has recovered.
+	ForceNewCluster bool
+	ProposeC        <-chan string
+	ConfChangeC     <-chan raftpb.ConfChange
+	ElectedCh       chan bool
+	SnapshotReady   chan *snap.Snapshotter
+	// CommitC receives the committed entries. Its reader must close the
+	// Applied channel of a barrier once it applied the commits before it.
+	CommitC chan *raftsvr.Commit
+	// ErrorC receives the *errhandle.Error that stopped the node, after
+	// the transport and raft were stopped, the WAL was closed and CommitC
+	// was closed. It is closed without an error when the node stops
+	// otherwise.
+	ErrorC chan error
+	// StopC stops the node when closed.
+	StopC <-chan struct{}
+	// ServerStats and LeaderStats are filled in by the transport; new
+	// ones are created if they are nil.
+	ServerStats *stats.ServerStats
+	LeaderStats *stats.LeaderStats
+	// PeerTLSInfo secures the raft transport. It is required when the peer
+	// URLs are https, and used both to serve SelfPeer and to dial peers.
+	PeerTLSInfo transport.TLSInfo
+	// DroppedC receives the proposals dropped by raft, if not nil. A drop
+	// is not reported if DroppedC is not ready to receive it. It is closed
+	// after ProposeC.
+	DroppedC chan<- string
+	// Load is updated with the follower lag and WAL fsync latency of the
+	// node; a new one is created if it is nil.
+	Load *raftsvr.NodeLoad
+	// MaxUncommittedBytes bounds the size of the entries the leader has
+	// not committed yet, beyond which raft drops proposals;
+	// defaultMaxUncommittedBytes if 0.
+	MaxUncommittedBytes uint64
+	// ProposalBatchWindow is how long a proposal waits for others to be
+	// proposed to raft with it. The proposals already waiting are batched
+	// even if it is 0. A batch holds up to MaxProposalBatch proposals,
+	// defaultMaxProposalBatch if 0, and stops growing once it reaches
+	// maxSizePerMsg bytes.
+	ProposalBatchWindow time.Duration
+	MaxProposalBatch    int
+	// WALSync is how the WAL fsyncs, wal.SyncAlways by default. Under
+	// wal.SyncBatch the Readies saved within WALSyncDelay of each other
+	// share one fsync.
+	WALSync      wal.SyncPolicy
+	WALSyncDelay time.Duration
+	// SlowFsyncThreshold is the WAL fsync duration beyond which the slow
+	// fsync alarm is raised, 1s if 0. The next faster fsync clears it.
+	SlowFsyncThreshold time.Duration
+	// WALOptions sets the segment size, preallocation and file mode of
+	// the WAL of this node.
+	WALOptions wal.Options
+	// EncryptionKeys, if set, encrypts the WAL entries and the snapshots
+	// of this node, and overrides WALOptions.Keys.
+	EncryptionKeys cryptutil.KeyProvider
+	// Compression compresses the WAL entries and the snapshots of this
+	// node, and asks its peers to compress the entries they send it.
+	Compression bool
+	// SnapshotView, if set, replaces the getSnapshot of NewRaftNode: it
+	// returns a point-in-time view of the store, as the function that
+	// serialises it. The view is serialised and saved in the background
+	// while the entries after it are applied.
+	SnapshotView func() (func() ([]byte, error), error)
+	// ExpandSnapshot returns the data of a chunked snapshot in one piece,
+	// for the peers from before chunked snapshots; see
+	// rafthttp.Transport.ExpandSnapshot.
+	ExpandSnapshot func(data []byte) ([]byte, error)
 }
 
 var defaultSnapshotCount uint64 = 10000
 
+const (
+	// applyBacklog is the number of Readies the event loop hands to the
+	// applier before it waits for it.
+	applyBacklog = 64
+
+	defaultMaxUncommittedBytes uint64 = 1 << 30
+	defaultMaxProposalBatch           = 128
+	defaultSlowFsyncThreshold         = time.Second
+	maxSizePerMsg                     = 1024 * 1024
+)
+
+var setRaftLogger sync.Once
+
+// defaultClusterID is used by members whose WAL records no cluster ID.
+const defaultClusterID uint64 = 0x1000
+
 // newRaftNode initiates a raft instance and returns a committed log entry
 // channel and error channel. Proposals for log updates are sent over the
 // provided the proposal channel. All log entries are replayed over the
@@ -89,28 +265,88 @@ var defaultSnapshotCount uint64 = 10000
 func NewRaftNode(id uint64, peers []string, members map[string]MemberInfo, getSnapshot func() ([]byte, error), cfg *RaftConfig) {
 
 	rc := &raftNode{
-		proposeC:    cfg.ProposeC,
-		confChangeC: cfg.ConfChangeC,
-		commitC:     cfg.CommitC,
-		errorC:      cfg.ErrorC,
-		id:          id,
-		selfPeer:    cfg.SelfPeer,
-		nodeName:    cfg.NodeName,
-		peers:       peers,
-		members:     members,
-		join:        cfg.Join,
-		waldir:      fmt.Sprintf("raft-%s", cfg.NodeName),
-		snapdir:     fmt.Sprintf("raft-%s-snap", cfg.NodeName),
-		getSnapshot: getSnapshot,
-		snapCount:   defaultSnapshotCount,
-		stopc:       make(chan struct{}),
-		httpstopc:   make(chan struct{}),
-		httpdonec:   make(chan struct{}),
-
+		proposeC:     cfg.ProposeC,
+		droppedC:     cfg.DroppedC,
+		confChangeC:  cfg.ConfChangeC,
+		commitC:      cfg.CommitC,
+		errorC:       cfg.ErrorC,
+		id:           id,
+		clusterID:    cfg.ClusterID,
+		selfPeer:     cfg.SelfPeer,
+		nodeName:     cfg.NodeName,
+		peers:        peers,
+		members:      members,
+		join:         cfg.Join,
+		forceNew:     cfg.ForceNewCluster,
+		waldir:       fmt.Sprintf("raft-%s", cfg.NodeName),
+		snapdir:      fmt.Sprintf("raft-%s-snap", cfg.NodeName),
+		getSnapshot:  getSnapshot,
+		snapshotView: cfg.SnapshotView,
+		snapCount:    defaultSnapshotCount,
+		applyc:       make(chan apply, applyBacklog),
+		applyStopc:   make(chan struct{}),
+		applyDonec:   make(chan struct{}),
+		persistc:     make(chan persist, applyBacklog),
+		persistStopc: make(chan struct{}),
+		persistDonec: make(chan struct{}),
+		fatalc:       make(chan error),
+		stopc:        make(chan struct{}),
+		hoststopc:    cfg.StopC,
+		httpstopc:    make(chan struct{}),
+		httpdonec:    make(chan struct{}),
+		serverStats:  cfg.ServerStats,
+		leaderStats:  cfg.LeaderStats,
+		load:         cfg.Load,
+		peerTLSInfo:  cfg.PeerTLSInfo,
+
+		maxUncommittedBytes: cfg.MaxUncommittedBytes,
+		batchWindow:         cfg.ProposalBatchWindow,
+		maxBatch:            cfg.MaxProposalBatch,
+
+		walOpts:          cfg.WALOptions,
+		compress:         cfg.Compression,
+		expandSnapshot:   cfg.ExpandSnapshot,
 		snapshotterReady: cfg.SnapshotReady,
 		// rest of structure populated after WAL replay
 	}
-	go rc.startRaft(cfg.ElectedCh, cfg.ErrCh)
+	rc.walSync = wal.SyncOptions{
+		Policy:       cfg.WALSync,
+		MaxDelay:     cfg.WALSyncDelay,
+		WarnDuration: cfg.SlowFsyncThreshold,
+		OnSync:       rc.observeFsync,
+	}
+	if cfg.EncryptionKeys != nil {
+		rc.walOpts.Keys = cfg.EncryptionKeys
+	}
+	if cfg.Compression {
+		rc.walOpts.Compress = true
+	}
+	if rc.walSync.WarnDuration == 0 {
+		rc.walSync.WarnDuration = defaultSlowFsyncThreshold
+	}
+	if rc.clusterID == 0 {
+		rc.clusterID = defaultClusterID
+	}
+	logtool.SetMemberID(types.ID(id).String())
+	// the raft logger is process-wide, and members may start concurrently
+	// in tests
+	setRaftLogger.Do(func() { raft.SetLogger(logtool.NLog) })
+	if rc.serverStats == nil {
+		rc.serverStats = stats.NewServerStats(cfg.NodeName, types.ID(id).String())
+	}
+	if rc.leaderStats == nil {
+		rc.leaderStats = stats.NewLeaderStats(types.ID(id).String())
+	}
+	if rc.load == nil {
+		rc.load = &raftsvr.NodeLoad{}
+	}
+	if rc.maxUncommittedBytes == 0 {
+		rc.maxUncommittedBytes = defaultMaxUncommittedBytes
+	}
+	if rc.maxBatch <= 0 {
+		rc.maxBatch = defaultMaxProposalBatch
+	}
+	go rc.startRaft(cfg.ElectedCh)
 }
 
 func (rc *raftNode) saveSnap(snap raftpb.Snapshot) error {
@@ -130,25 +366,22 @@ func (rc *raftNode) saveSnap(snap raftpb.Snapshot) error {
 	return rc.wal.ReleaseLockTo(snap.Metadata.Index)
 }
 
-func (rc *raftNode) entriesToApply(ents []raftpb.Entry) (nents []raftpb.Entry) {
+func (rc *raftNode) entriesToApply(ents []raftpb.Entry) (nents []raftpb.Entry, err error) {
 	if len(ents) == 0 {
-		return
+		return nil, nil
 	}
 	firstIdx := ents[0].Index
 	if firstIdx > rc.appliedIndex+1 {
-		logtool.RLog.Fatal("first index of committed entry should <= progress.appliedIndex+1", map[string]interface{}{
-			"entry":                 firstIdx,
-			"progress.appliedIndex": rc.appliedIndex,
-		})
+		return nil, errhandle.NewError(errhandle.E_APPLY, fmt.Errorf("first index of committed entry %d should <= progress.appliedIndex %d + 1", firstIdx, rc.appliedIndex))
 	}
 	if rc.appliedIndex-firstIdx+1 < uint64(len(ents)) {
 		nents = ents[rc.appliedIndex-firstIdx+1:]
 	}
-	return nents
+	return nents, nil
 }
 
 // publishEntries writes committed log entries to commit channel and returns
-// whether all entries could be published.
+// whether all entries could be published. It runs on the applier.
 func (rc *raftNode) publishEntries(ents []raftpb.Entry) bool {
 	for i := range ents {
 		switch ents[i].Type {
@@ -157,39 +390,59 @@ func (rc *raftNode) publishEntries(ents []raftpb.Entry) bool {
 				// ignore empty messages
 				break
 			}
-			s := string(ents[i].Data)
+			c := &raftsvr.Commit{Data: string(ents[i].Data), Index: ents[i].Index, Term: ents[i].Term}
 			select {
-			case rc.commitC <- &s:
-			case <-rc.stopc:
+			case rc.commitC <- c:
+			case <-rc.applyStopc:
 				return false
 			}
+			proposalsCommitted.Inc()
 
 		case raftpb.EntryConfChange:
 			var cc raftpb.ConfChange
 			cc.Unmarshal(ents[i].Data)
-			rc.confState = *rc.node.ApplyConfChange(cc)
-			switch cc.Type {
-			case raftpb.ConfChangeAddNode:
+			err := validateConfChange(rc.confState, cc)
+			applied := cc
+			if err != nil {
+				// a refused change is applied as a no-op
+				applied.NodeID = raft.None
+			}
+			rc.confState = *rc.node.ApplyConfChange(applied)
+			removed := false
+			switch {
+			case err != nil:
+			case cc.Type == raftpb.ConfChangeAddNode:
 				if len(cc.Context) > 0 {
 					rc.transport.AddPeer(types.ID(cc.NodeID), []string{string(cc.Context)})
 				}
-			case raftpb.ConfChangeRemoveNode:
-				if cc.NodeID == uint64(rc.id) {
-					logtool.RLog.Info("I've been removed from the cluster! Shutting down.", map[string]interface{}{})
-					return false
+			case cc.Type == raftpb.ConfChangeRemoveNode:
+				removed = cc.NodeID == uint64(rc.id)
+				// a forced new cluster removes members the transport never knew
+				if !removed && rc.transport.Get(types.ID(cc.NodeID)) != nil {
+					rc.transport.RemovePeer(types.ID(cc.NodeID))
 				}
-				rc.transport.RemovePeer(types.ID(cc.NodeID))
+			}
+			// the proposer is told the result
+			c := &raftsvr.Commit{Index: ents[i].Index, Term: ents[i].Term, ConfChange: &cc, ConfChangeErr: err}
+			select {
+			case rc.commitC <- c:
+			case <-rc.applyStopc:
+				return false
+			}
+			if removed {
+				logtool.RLog.Info("I've been removed from the cluster! Shutting down.", map[string]interface{}{})
+				return false
 			}
 		}
 
 		// after commit, update appliedIndex
-		rc.appliedIndex = ents[i].Index
+		rc.setAppliedIndex(ents[i].Index)
 
 		// special nil commit to signal replay has finished
 		if ents[i].Index == rc.lastIndex {
 			select {
 			case rc.commitC <- nil:
-			case <-rc.stopc:
+			case <-rc.applyStopc:
 				return false
 			}
 		}
@@ -197,30 +450,56 @@ func (rc *raftNode) publishEntries(ents []raftpb.Entry) bool {
 	return true
 }
 
-func (rc *raftNode) loadSnapshot() *raftpb.Snapshot {
+// validateConfChange returns the error of a conf change that cannot be
+// applied to cs: adding a voter twice, removing a member that is not there
+// or removing the last voter. Every member refuses the same changes, since
+// they all apply them to the same ConfState.
+func validateConfChange(cs raftpb.ConfState, cc raftpb.ConfChange) error {
+	voter, learner := false, false
+	for _, id := range cs.Nodes {
+		voter = voter || id == cc.NodeID
+	}
+	for _, id := range cs.Learners {
+		learner = learner || id == cc.NodeID
+	}
+	switch cc.Type {
+	case raftpb.ConfChangeAddNode:
+		if voter {
+			return errhandle.NewError(errhandle.E_MEMBER_EXISTS, nil)
+		}
+	case raftpb.ConfChangeRemoveNode:
+		if !voter && !learner {
+			return errhandle.NewError(errhandle.E_MEMBER_NOT_FOUND, nil)
+		}
+		if voter && len(cs.Nodes) == 1 {
+			return errhandle.NewError(errhandle.E_UNSAFE_CONF_CHANGE, errors.New("cannot remove the last voter"))
+		}
+	}
+	return nil
+}
+
+func (rc *raftNode) loadSnapshot() (*raftpb.Snapshot, error) {
 	snapshot, err := rc.snapshotter.Load()
 	if err != nil && err != snap.ErrNoSnapshot {
-		logtool.RLog.Fatal("raft: error loading snapshot", map[string]interface{}{
-			"error": err,
-		})
+		return nil, errhandle.NewError(errhandle.E_DATA_DIR, err)
 	}
-	return snapshot
+	return snapshot, nil
 }
 
 // openWAL returns a WAL ready for reading.
-func (rc *raftNode) openWAL(snapshot *raftpb.Snapshot) *wal.WAL {
+func (rc *raftNode) openWAL(snapshot *raftpb.Snapshot) (*wal.WAL, error) {
 	if !wal.Exist(rc.waldir) {
 		if err := os.Mkdir(rc.waldir, 0750); err != nil {
-			logtool.RLog.Fatal("raft: cannot create dir for wal ", map[string]interface{}{
-				"error": err,
-			})
+			return nil, errhandle.NewError(errhandle.E_DATA_DIR, err)
 		}
 
-		w, err := wal.Create(logtool.RLog, rc.waldir, nil)
+		md, err := json.Marshal(Metadata{NodeID: rc.id, ClusterID: rc.clusterID})
+		if err != nil {
+			return nil, errhandle.NewError(errhandle.E_DATA_DIR, err)
+		}
+		w, err := wal.CreateWithOptions(logtool.Logger(logtool.SubsystemWAL), rc.waldir, md, rc.walOpts)
 		if err != nil {
-			logtool.RLog.Fatal("raft: create wal error ", map[string]interface{}{
-				"error": err,
-			})
+			return nil, errhandle.NewError(errhandle.E_DATA_DIR, err)
 		}
 		w.Close()
 	}
@@ -233,75 +512,136 @@ func (rc *raftNode) openWAL(snapshot *raftpb.Snapshot) *wal.WAL {
 		"term":  walsnap.Term,
 		"index": walsnap.Index,
 	})
-	w, err := wal.Open(logtool.RLog, rc.waldir, walsnap)
+	w, err := wal.OpenWithOptions(logtool.Logger(logtool.SubsystemWAL), rc.waldir, walsnap, rc.walOpts)
 	if err != nil {
-		logtool.RLog.Fatal("raft: error loading wal (%v)", map[string]interface{}{
-			"error": err,
-		})
+		return nil, errhandle.NewError(errhandle.E_DATA_DIR, err)
 	}
+	w.SetSyncOptions(rc.walSync)
 
-	return w
+	return w, nil
 }
 
 // replayWAL replays WAL entries into the raft instance.
-func (rc *raftNode) replayWAL() *wal.WAL {
+func (rc *raftNode) replayWAL() (*wal.WAL, error) {
 	logtool.RLog.Info("replaying WAL of member", map[string]interface{}{
 		"member id": rc.id,
 	})
-	snapshot := rc.loadSnapshot()
-	w := rc.openWAL(snapshot)
-	_, st, ents, err := w.ReadAll()
+	snapshot, err := rc.loadSnapshot()
 	if err != nil {
-		logtool.RLog.Fatal("raft: failed to read WAL ", map[string]interface{}{
-			"error": err,
-		})
+		return nil, err
+	}
+	w, err := rc.openWAL(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if err = rc.replay(w, snapshot); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (rc *raftNode) replay(w *wal.WAL, snapshot *raftpb.Snapshot) error {
+	md, st, ents, err := w.ReadAll()
+	if err != nil {
+		return errhandle.NewError(errhandle.E_DATA_DIR, err)
+	}
+	if err = rc.readMetadata(md); err != nil {
+		return err
+	}
+	logtool.SetTerm(st.Term)
+	if rc.forceNew {
+		if ents, st, err = rc.forceNewClusterEntries(w, snapshot, st, ents); err != nil {
+			return err
+		}
 	}
 	rc.raftStorage = raft.NewMemoryStorage()
 	if snapshot != nil {
-		rc.raftStorage.ApplySnapshot(*snapshot)
+		if err = rc.raftStorage.ApplySnapshot(*snapshot); err != nil {
+			return errhandle.NewError(errhandle.E_STORAGE, err)
+		}
 	}
 	rc.raftStorage.SetHardState(st)
 
 	// append to storage so raft starts at the right place in log
-	rc.raftStorage.Append(ents)
+	if err = rc.raftStorage.Append(ents); err != nil {
+		return errhandle.NewError(errhandle.E_STORAGE, err)
+	}
 	// send nil once lastIndex is published so client knows commit channel is current
 	if len(ents) > 0 {
 		rc.lastIndex = ents[len(ents)-1].Index
 	} else {
 		rc.commitC <- nil
 	}
-	return w
+	return nil
 }
 
-func (rc *raftNode) writeError(err error) {
-	rc.stopHTTP()
+// readMetadata adopts the cluster ID recorded in the WAL. WALs written
+// before metadata was recorded carry none and keep the configured one.
+func (rc *raftNode) readMetadata(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	var md Metadata
+	if err := json.Unmarshal(b, &md); err != nil {
+		return errhandle.NewError(errhandle.E_DATA_DIR, err)
+	}
+	if md.NodeID != rc.id {
+		return errhandle.NewError(errhandle.E_DATA_DIR, fmt.Errorf("wal belongs to member %x, not %x", md.NodeID, rc.id))
+	}
+	rc.clusterID = md.ClusterID
+	return nil
+}
+
+// fail stops a running node after an error it cannot recover from: the
+// transport and raft are stopped, commitC is closed and err is reported on
+// errorC.
+func (rc *raftNode) fail(err error) {
+	logtool.RLog.Error("raft: member stopped after a fatal error", map[string]interface{}{
+		"error": err,
+	})
+	rc.shutdown()
+	rc.errorC <- err
+	close(rc.errorC)
+}
+
+// failStart reports an error that stopped the node before raft started.
+func (rc *raftNode) failStart(err error) {
+	logtool.RLog.Error("raft: member failed to start", map[string]interface{}{
+		"error": err,
+	})
 	close(rc.commitC)
 	rc.errorC <- err
 	close(rc.errorC)
-	rc.node.Stop()
 }
 
-func (rc *raftNode) startRaft(electedCh chan bool, errCh chan error) {
+func (rc *raftNode) startRaft(electedCh chan bool) {
 	if !fileutil.Exist(rc.snapdir) {
 		if err := os.Mkdir(rc.snapdir, 0750); err != nil {
-			logtool.RLog.Fatal("raft: cannot create dir for snapshot", map[string]interface{}{
-				"error": err,
-			})
+			rc.failStart(errhandle.NewError(errhandle.E_DATA_DIR, err))
+			return
 		}
 	}
-	rc.snapshotter = snap.New(logtool.RLog, rc.snapdir)
+	rc.snapshotter = snap.NewWithOptions(logtool.Logger(logtool.SubsystemSnap), rc.snapdir, snap.Options{
+		Keys:     rc.walOpts.Keys,
+		Compress: rc.compress,
+	})
 	rc.snapshotterReady <- rc.snapshotter
 
-	hostname, err := os.Hostname()
-	if err != nil {
-		logtool.NLog.Fatal(err.Error())
+	if rc.forceNew {
+		if err := rc.checkForceNewCluster(); err != nil {
+			rc.failStart(err)
+			return
+		}
 	}
-	logtool.InitRaftLogger("debug", hostname)
-
-	logtool.InitNodeMsgLogger("debug", hostname)
 
 	oldwal := wal.Exist(rc.waldir)
-	rc.wal = rc.replayWAL()
+	w, err := rc.replayWAL()
+	if err != nil {
+		rc.failStart(err)
+		return
+	}
+	rc.wal = w
 
 	rpeers := make([]raft.Peer, len(rc.peers))
 	var i = 0
@@ -314,10 +654,10 @@ func (rc *raftNode) startRaft(electedCh chan bool, errCh chan error) {
 		ElectionTick:              10,
 		HeartbeatTick:             1,
 		Storage:                   rc.raftStorage,
-		MaxSizePerMsg:             1024 * 1024,
+		MaxSizePerMsg:             maxSizePerMsg,
 		MaxInflightMsgs:           256,
-		MaxUncommittedEntriesSize: 1 << 30,
-		Logger: logtool.NLog,
+		MaxUncommittedEntriesSize: rc.maxUncommittedBytes,
+		Logger:                    logtool.NLog,
 	}
 
 	if oldwal {
@@ -331,35 +671,115 @@ func (rc *raftNode) startRaft(electedCh chan bool, errCh chan error) {
 	}
 
 	rc.transport = &rafthttp.Transport{
-		Logger:      logtool.RLog,
+		Logger:      logtool.Logger(logtool.SubsystemTransport),
 		ID:          types.ID(rc.id),
-		ClusterID:   0x1000,
+		ClusterID:   types.ID(rc.clusterID),
 		Raft:        rc,
-		ServerStats: stats.NewServerStats("", ""),
-		LeaderStats: stats.NewLeaderStats(strconv.FormatUint(rc.id, 10)),
-		ErrorC:      make(chan error),
+		ServerStats: rc.serverStats,
+		LeaderStats: rc.leaderStats,
+		TLSInfo:     rc.peerTLSInfo,
+		ErrorC:      rc.fatalc,
+
+		Snapshotter:     rc.snapshotter,
+		CompressStreams: rc.compress,
+		ExpandSnapshot:  rc.expandSnapshot,
 	}
 
-	rc.transport.Start()
+	err = rc.transport.Start()
+	if err == nil && strings.HasPrefix(rc.selfPeer, "https://") && rc.peerTLSInfo.Empty() {
+		err = fmt.Errorf("peer url %s needs a certificate and key", rc.selfPeer)
+	}
+	if err != nil {
+		rc.node.Stop()
+		rc.failStart(errhandle.NewError(errhandle.E_TLS, err))
+		return
+	}
 	for k, v := range rc.members {
-		if k != rc.nodeName {
+		if k != rc.nodeName && !rc.forceNew {
 			rc.transport.AddPeer(types.ID(v.ID), []string{v.Peer})
 		}
 	}
 
 	rsvr := raftsvr.NewServerAttach(rc.waldir, rc.snapdir, rc.stopc, rc.httpdonec)
+	rsvr.ErrorC = rc.fatalc
+	rsvr.Snapshotter = rc.snapshotter
 
 	go rc.serveRaft()
-	go rc.serveChannels(electedCh, errCh)
+	go rc.serveChannels(electedCh)
 	go rsvr.GoAttach(rsvr.PurgeFile)
 }
 
 // stop closes http, closes all channels, and stops raft.
 func (rc *raftNode) stop() {
-	rc.stopHTTP()
-	close(rc.commitC)
+	rc.shutdown()
 	close(rc.errorC)
+}
+
+// shutdown stops the applier, the transport and raft, and releases the
+// WAL before it closes commitC, so that the member can be started again
+// once errorC is closed.
+func (rc *raftNode) shutdown() {
+	rc.stopApply()
+	rc.stopPersist()
+	rc.stopHTTP()
 	rc.node.Stop()
+	rc.wal.Close()
+	close(rc.commitC)
+}
+
+// batchProposals returns first with the proposals that follow it on
+// proposeC, until none is waiting or batchWindow passed, maxBatch of them
+// are taken or they reach maxSizePerMsg bytes. open is false if proposeC
+// was closed meanwhile.
+func (rc *raftNode) batchProposals(first string) (batch [][]byte, open bool) {
+	batch = [][]byte{[]byte(first)}
+	size := len(first)
+	var window <-chan time.Time
+	if rc.batchWindow > 0 {
+		t := time.NewTimer(rc.batchWindow)
+		defer t.Stop()
+		window = t.C
+	}
+	for len(batch) < rc.maxBatch && size < maxSizePerMsg {
+		var (
+			prop string
+			ok   bool
+		)
+		if window == nil {
+			select {
+			case prop, ok = <-rc.proposeC:
+			default:
+				return batch, true
+			}
+		} else {
+			select {
+			case prop, ok = <-rc.proposeC:
+			case <-window:
+				return batch, true
+			}
+		}
+		if !ok {
+			return batch, false
+		}
+		batch = append(batch, []byte(prop))
+		size += len(prop)
+	}
+	return batch, true
+}
+
+// reportDropped sends a proposal dropped by raft to droppedC, unless no one
+// is ready to receive it.
+func (rc *raftNode) reportDropped(prop string) {
+	if rc.droppedC == nil {
+		return
+	}
+	select {
+	case rc.droppedC <- prop:
+	default:
+		logtool.RLog.Debug("dropped proposal not reported", map[string]interface{}{
+			"size": len(prop),
+		})
+	}
 }
 
 func (rc *raftNode) stopHTTP() {
@@ -368,82 +788,411 @@ func (rc *raftNode) stopHTTP() {
 	<-rc.httpdonec
 }
 
-func (rc *raftNode) publishSnapshot(snapshotToSave raftpb.Snapshot) {
+func (rc *raftNode) publishSnapshot(snapshotToSave raftpb.Snapshot) error {
 	if raft.IsEmptySnap(snapshotToSave) {
-		return
+		return nil
 	}
 
 	logtool.RLog.Info("publishing snapshot at index", map[string]interface{}{
-		"index": rc.snapshotIndex,
+		"index": snapshotToSave.Metadata.Index,
 	})
 
 	defer logtool.RLog.Info("finished publishing snapshot at index", map[string]interface{}{
-		"index": rc.snapshotIndex,
+		"index": snapshotToSave.Metadata.Index,
 	})
 
 	if snapshotToSave.Metadata.Index <= rc.appliedIndex {
-		logtool.RLog.Fatal("snapshot index should > progress.appliedIndex ", map[string]interface{}{
-			"index":                 snapshotToSave.Metadata.Index,
-			"progress.appliedIndex": rc.appliedIndex,
-		})
+		return errhandle.NewError(errhandle.E_APPLY, fmt.Errorf("snapshot index %d should > progress.appliedIndex %d", snapshotToSave.Metadata.Index, rc.appliedIndex))
+	}
+	// trigger kvstore to load snapshot
+	select {
+	case rc.commitC <- nil:
+	case <-rc.applyStopc:
+		return nil
 	}
-	rc.commitC <- nil // trigger kvstore to load snapshot
 
 	rc.confState = snapshotToSave.Metadata.ConfState
-	rc.snapshotIndex = snapshotToSave.Metadata.Index
-	rc.appliedIndex = snapshotToSave.Metadata.Index
+	rc.setSnapshotIndex(snapshotToSave.Metadata.Index)
+	rc.setAppliedIndex(snapshotToSave.Metadata.Index)
+	return nil
 }
 
 var snapshotCatchUpEntriesN uint64 = 10000
 
-func (rc *raftNode) maybeTriggerSnapshot() {
+// maybeTriggerSnapshot snapshots the store once snapCount entries were
+// applied since the last snapshot. It runs on the applier, which applied
+// the entries of ap; the snapshot waits until they are persisted and
+// applied by the store, so that it holds no entry a crash could lose from
+// the WAL and misses none before its index. With a snapshotView, the
+// snapshot is saved in the background and the next one is not taken
+// before it is. It returns false if the applier was stopped meanwhile.
+func (rc *raftNode) maybeTriggerSnapshot(ap apply) (bool, error) {
+	if rc.snapDonec != nil {
+		select {
+		case <-rc.snapDonec:
+			if err := rc.waitSnapshot(); err != nil {
+				return false, err
+			}
+		default:
+			return true, nil
+		}
+	}
 	if rc.appliedIndex-rc.snapshotIndex <= rc.snapCount {
-		return
+		return true, nil
+	}
+	if !rc.waitApply(ap.notifyc) || !rc.flushCommits() {
+		return false, nil
 	}
 
 	logtool.RLog.Info("start snapshot [applied index | last snapshot index]", map[string]interface{}{
 		"applied index":  rc.appliedIndex,
 		"snapshot index": rc.snapshotIndex,
 	})
-	data, err := rc.getSnapshot()
+	if rc.snapshotView == nil {
+		data, err := rc.getSnapshot()
+		if err != nil {
+			return false, errhandle.NewError(errhandle.E_SNAPSHOT_CREATE, err)
+		}
+		if err = rc.createSnapshot(rc.appliedIndex, rc.confState, data); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	serialise, err := rc.snapshotView()
 	if err != nil {
-		log.Panic(err)
+		return false, errhandle.NewError(errhandle.E_SNAPSHOT_CREATE, err)
+	}
+	index, cs := rc.appliedIndex, rc.confState
+	donec := make(chan struct{})
+	rc.snapDonec = donec
+	go func() {
+		defer close(donec)
+		start := time.Now()
+		data, err := serialise()
+		if err != nil {
+			rc.snapErr = errhandle.NewError(errhandle.E_SNAPSHOT_CREATE, err)
+			return
+		}
+		rc.snapErr = rc.createSnapshot(index, cs, data)
+		logtool.RLog.Info("saved snapshot in the background", map[string]interface{}{
+			"index": index,
+			"took":  time.Since(start).String(),
+		})
+	}()
+	return true, nil
+}
+
+// createSnapshot saves the snapshot data of the store at index, and
+// compacts raftStorage up to snapshotCatchUpEntriesN entries before it.
+func (rc *raftNode) createSnapshot(index uint64, cs raftpb.ConfState, data []byte) error {
+	snap, err := rc.raftStorage.CreateSnapshot(index, &cs, data)
+	if err == raft.ErrSnapOutOfDate {
+		// the event loop applied a newer snapshot from the leader, which
+		// the applier publishes next
+		return nil
 	}
-	snap, err := rc.raftStorage.CreateSnapshot(rc.appliedIndex, &rc.confState, data)
 	if err != nil {
-		panic(err)
+		return errhandle.NewError(errhandle.E_STORAGE, err)
 	}
 	if err := rc.saveSnap(snap); err != nil {
-		panic(err)
+		return errhandle.NewError(errhandle.E_SNAPSHOT_SAVE, err)
 	}
 
 	compactIndex := uint64(1)
-	if rc.appliedIndex > snapshotCatchUpEntriesN {
-		compactIndex = rc.appliedIndex - snapshotCatchUpEntriesN
+	if index > snapshotCatchUpEntriesN {
+		compactIndex = index - snapshotCatchUpEntriesN
 	}
-	if err := rc.raftStorage.Compact(compactIndex); err != nil {
-		panic(err)
+	if err := rc.raftStorage.Compact(compactIndex); err != nil && err != raft.ErrCompacted {
+		return errhandle.NewError(errhandle.E_STORAGE, err)
 	}
 
 	logtool.RLog.Info("compacted log at index ", map[string]interface{}{
 		"index": compactIndex,
 	})
-	rc.snapshotIndex = rc.appliedIndex
+	rc.setSnapshotIndex(index)
+	return nil
+}
+
+// waitSnapshot waits until the snapshot taken in the background, if any,
+// is saved, and returns why it failed.
+func (rc *raftNode) waitSnapshot() error {
+	if rc.snapDonec == nil {
+		return nil
+	}
+	<-rc.snapDonec
+	rc.snapDonec = nil
+	return rc.snapErr
+}
+
+// apply is the part of a Ready handled by the applier.
+type apply struct {
+	entries  []raftpb.Entry
+	snapshot raftpb.Snapshot
+	// notifyc is closed once the entries and the snapshot of the Ready
+	// are persisted and in raftStorage.
+	notifyc chan struct{}
+	// waitPersist is set if some of the committed entries are persisted
+	// with the Ready, as a single member commits them. They are applied
+	// once notifyc is closed, so that no acknowledged write is lost in a
+	// crash.
+	waitPersist bool
+	// appliedc is closed once the applier is done with them.
+	appliedc chan struct{}
+}
+
+// startApply starts the applier, which applies the committed entries of
+// the Readies handed over applyc in order, apart from the event loop, so
+// that a slow apply does not hold up ticks, heartbeats and appends.
+func (rc *raftNode) startApply() {
+	rc.applying = true
+	go func() {
+		defer close(rc.applyDonec)
+		defer func() {
+			// the snapshot saves to the WAL, which is closed next
+			if err := rc.waitSnapshot(); err != nil && rc.applyErr == nil {
+				rc.applyErr = err
+			}
+		}()
+		for {
+			select {
+			case ap := <-rc.applyc:
+				ok, err := rc.applyReady(ap)
+				close(ap.appliedc)
+				if err != nil {
+					rc.applyErr = err
+				}
+				if !ok {
+					return
+				}
+			case <-rc.applyStopc:
+				return
+			}
+		}
+	}()
+}
+
+// applyReady publishes the snapshot and the committed entries of ap to the
+// store, applies its configuration changes and snapshots the store if it
+// is due. It returns false if the applier must stop: after an error, once
+// this member is removed, or if it was stopped.
+func (rc *raftNode) applyReady(ap apply) (bool, error) {
+	applyStart := time.Now()
+	if !raft.IsEmptySnap(ap.snapshot) {
+		// the store loads the snapshot from disk
+		if !rc.waitApply(ap.notifyc) {
+			return false, nil
+		}
+		// an older snapshot saved in the background must not lower the
+		// snapshot index of this one
+		if err := rc.waitSnapshot(); err != nil {
+			return false, err
+		}
+		if err := rc.publishSnapshot(ap.snapshot); err != nil {
+			return false, err
+		}
+	}
+	ents, err := rc.entriesToApply(ap.entries)
+	if err != nil {
+		return false, err
+	}
+	if ap.waitPersist && !rc.waitApply(ap.notifyc) {
+		return false, nil
+	}
+	if ok := rc.publishEntries(ents); !ok {
+		return false, nil
+	}
+	observeApply(time.Since(applyStart), len(ap.entries))
+	return rc.maybeTriggerSnapshot(ap)
+}
+
+// waitApply waits on the applier until ch is closed, and returns false if
+// the applier is stopped first.
+func (rc *raftNode) waitApply(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	case <-rc.applyStopc:
+		return false
+	}
+}
+
+// flushCommits waits until the store applied the commits published so far,
+// and returns false if the applier is stopped first.
+func (rc *raftNode) flushCommits() bool {
+	c := &raftsvr.Commit{Applied: make(chan struct{})}
+	select {
+	case rc.commitC <- c:
+	case <-rc.applyStopc:
+		return false
+	}
+	return rc.waitApply(c.Applied)
+}
+
+// stopApply stops the applier and waits for it to return, so that commitC
+// can be closed.
+func (rc *raftNode) stopApply() {
+	if !rc.applying {
+		return
+	}
+	select {
+	case <-rc.applyDonec:
+	default:
+		close(rc.applyStopc)
+		<-rc.applyDonec
+	}
+}
+
+// applierStopped stops the node after the applier returned on its own.
+func (rc *raftNode) applierStopped() {
+	if rc.applyErr != nil {
+		rc.fail(rc.applyErr)
+		return
+	}
+	rc.stop()
+}
+
+// persist is the part of a Ready handled by the persister.
+type persist struct {
+	// syncc receives the result of the WAL fsync of the Ready.
+	syncc <-chan error
+	// notifyc is closed once the Ready is synced.
+	notifyc chan struct{}
+	// msgs are the messages of a follower or candidate, sent once the
+	// Ready is synced.
+	msgs []raftpb.Message
+	// appliedc, if set, is waited on before sending msgs: the committed
+	// configuration changes are applied first, so that a removed member's
+	// votes are not counted.
+	appliedc chan struct{}
+}
+
+// startPersist starts the persister, which waits for the WAL to sync the
+// Readies handed over persistc, in order, then lets the applier apply them
+// and sends their messages. The event loop goes on with the next Ready
+// meanwhile, so that the Readies saved during an fsync can share the next
+// one under wal.SyncBatch.
+func (rc *raftNode) startPersist() {
+	rc.persisting = true
+	go func() {
+		defer close(rc.persistDonec)
+		for {
+			select {
+			case p := <-rc.persistc:
+				if ok, err := rc.persistReady(p); !ok {
+					rc.persistErr = err
+					return
+				}
+			case <-rc.persistStopc:
+				return
+			}
+		}
+	}()
+}
+
+// persistReady waits for p to be synced. It returns false after a failed
+// fsync, or if the persister was stopped.
+func (rc *raftNode) persistReady(p persist) (bool, error) {
+	select {
+	case err := <-p.syncc:
+		if err != nil {
+			return false, errhandle.NewError(errhandle.E_WAL_SAVE, err)
+		}
+	case <-rc.persistStopc:
+		return false, nil
+	}
+	close(p.notifyc)
+	if p.appliedc != nil {
+		select {
+		case <-p.appliedc:
+		case <-rc.applyDonec:
+			// the event loop stops the node
+			return true, nil
+		case <-rc.persistStopc:
+			return false, nil
+		}
+	}
+	rc.transport.Send(p.msgs)
+	return true, nil
+}
+
+// stopPersist stops the persister and waits for it to return.
+func (rc *raftNode) stopPersist() {
+	if !rc.persisting {
+		return
+	}
+	select {
+	case <-rc.persistDonec:
+	default:
+		close(rc.persistStopc)
+		<-rc.persistDonec
+	}
+}
+
+// observeFsync is called by the WAL after each fsync. It raises the slow
+// fsync alarm on a slow one, and clears it on the next one that is not.
+func (rc *raftNode) observeFsync(took time.Duration, slow bool) {
+	rc.load.ObserveFsync(took)
+	if slow == rc.slowFsync {
+		return
+	}
+	rc.slowFsync = slow
+	if slow {
+		slowFsyncAlarm.Set(1)
+		logtool.RLog.Warn("raised the slow fsync alarm", map[string]interface{}{
+			"took":      took,
+			"threshold": rc.walSync.WarnDuration,
+		})
+		return
+	}
+	slowFsyncAlarm.Set(0)
+	logtool.RLog.Info("cleared the slow fsync alarm", map[string]interface{}{
+		"took": took,
+	})
 }
 
-func (rc *raftNode) serveChannels(electedCh chan bool, errCh chan error) {
+func (rc *raftNode) getAppliedIndex() uint64 {
+	return atomic.LoadUint64(&rc.appliedIndex)
+}
+
+func (rc *raftNode) setAppliedIndex(i uint64) {
+	atomic.StoreUint64(&rc.appliedIndex, i)
+}
+
+func (rc *raftNode) getSnapshotIndex() uint64 {
+	return atomic.LoadUint64(&rc.snapshotIndex)
+}
+
+func (rc *raftNode) setSnapshotIndex(i uint64) {
+	atomic.StoreUint64(&rc.snapshotIndex, i)
+}
+
+// hasConfChange tells whether ents hold a configuration change.
+func hasConfChange(ents []raftpb.Entry) bool {
+	for i := range ents {
+		if ents[i].Type == raftpb.EntryConfChange {
+			return true
+		}
+	}
+	return false
+}
+
+func (rc *raftNode) serveChannels(electedCh chan bool) {
 	snap, err := rc.raftStorage.Snapshot()
 	if err != nil {
-		panic(err)
+		rc.fail(errhandle.NewError(errhandle.E_STORAGE, err))
+		return
 	}
 	rc.confState = snap.Metadata.ConfState
-	rc.snapshotIndex = snap.Metadata.Index
-	rc.appliedIndex = snap.Metadata.Index
+	rc.setSnapshotIndex(snap.Metadata.Index)
+	rc.setAppliedIndex(snap.Metadata.Index)
 
-	defer rc.wal.Close()
+	rc.startApply()
+	rc.startPersist()
 
 	ticker := time.NewTicker(100 * time.Millisecond)
 	defer ticker.Stop()
+	islead := false
 
 	// send proposals over raft
 	go func() {
@@ -455,21 +1204,37 @@ func (rc *raftNode) serveChannels(electedCh chan bool, errCh chan error) {
 				if !ok {
 					rc.proposeC = nil
 				} else {
+					batch, open := rc.batchProposals(prop)
+					if !open {
+						rc.proposeC = nil
+					}
+					proposalBatchSize.Observe(float64(len(batch)))
 					// blocks until accepted by raft state machine
-					rc.node.Propose(context.TODO(), []byte(prop))
+					if err := rc.node.ProposeBatch(context.TODO(), batch); err != nil {
+						proposalsDropped.Add(float64(len(batch)))
+						for _, p := range batch {
+							rc.reportDropped(string(p))
+						}
+					}
 				}
 
 			case cc, ok := <-rc.confChangeC:
 				if !ok {
 					rc.confChangeC = nil
 				} else {
-					confChangeCount++
-					cc.ID = confChangeCount
+					// the proposer waits for the result by ID
+					if cc.ID == 0 {
+						confChangeCount++
+						cc.ID = confChangeCount
+					}
 					rc.node.ProposeConfChange(context.TODO(), cc)
 				}
 			}
 		}
 		// client closed channel; shutdown raft if not already
+		if rc.droppedC != nil {
+			close(rc.droppedC)
+		}
 		close(rc.stopc)
 	}()
 
@@ -478,9 +1243,15 @@ func (rc *raftNode) serveChannels(electedCh chan bool, errCh chan error) {
 		select {
 		case <-ticker.C:
 			rc.node.Tick()
+			rc.updateStatusMetrics()
 
 		// store raft entries to wal, then publish over commit channel
 		case rd := <-rc.node.Ready():
+			readyStart := time.Now()
+			if rd.SoftState != nil {
+				rc.observeLeader(rd.SoftState.Lead)
+				islead = rd.SoftState.RaftState == raft.StateLeader
+			}
 			if rd.SoftState != nil && rd.SoftState.Lead != raft.None {
 				logtool.RLog.Info("node ready get message", map[string]interface{}{
 					"leader id": rd.SoftState.Lead,
@@ -498,57 +1269,164 @@ func (rc *raftNode) serveChannels(electedCh chan bool, errCh chan error) {
 					"errmsg": errhandle.Msg[errhandle.E_LEADER_DOWN],
 				})
 			}
-			rc.wal.Save(rd.HardState, rd.Entries)
+			if !raft.IsEmptyHardState(rd.HardState) {
+				logtool.SetTerm(rd.HardState.Term)
+			}
+			ap := apply{
+				entries:  rd.CommittedEntries,
+				snapshot: rd.Snapshot,
+				notifyc:  make(chan struct{}),
+				appliedc: make(chan struct{}),
+			}
+			if n := len(rd.CommittedEntries); n > 0 && len(rd.Entries) > 0 {
+				ap.waitPersist = rd.CommittedEntries[n-1].Index >= rd.Entries[0].Index
+			}
+			select {
+			case rc.applyc <- ap:
+			case <-rc.applyDonec:
+				rc.applierStopped()
+				return
+			case <-rc.stopc:
+				rc.stop()
+				return
+			case <-rc.hoststopc:
+				rc.stop()
+				return
+			}
+			// the leader writes to its disk in parallel with replicating
+			// to the followers, which write to theirs (§10.2.1 of the
+			// Raft thesis)
+			if islead {
+				rc.transport.Send(rd.Messages)
+			}
+			if err := rc.wal.Save(rd.HardState, rd.Entries); err != nil {
+				rc.fail(errhandle.NewError(errhandle.E_WAL_SAVE, err))
+				return
+			}
 			if !raft.IsEmptySnap(rd.Snapshot) {
-				rc.saveSnap(rd.Snapshot)
-				rc.raftStorage.ApplySnapshot(rd.Snapshot)
-				rc.publishSnapshot(rd.Snapshot)
+				if err := rc.saveSnap(rd.Snapshot); err != nil {
+					rc.fail(errhandle.NewError(errhandle.E_SNAPSHOT_SAVE, err))
+					return
+				}
+				if err := rc.raftStorage.ApplySnapshot(rd.Snapshot); err != nil {
+					rc.fail(errhandle.NewError(errhandle.E_STORAGE, err))
+					return
+				}
 			}
-			rc.raftStorage.Append(rd.Entries)
-			rc.transport.Send(rd.Messages)
-			if ok := rc.publishEntries(rc.entriesToApply(rd.CommittedEntries)); !ok {
+			if err := rc.raftStorage.Append(rd.Entries); err != nil {
+				rc.fail(errhandle.NewError(errhandle.E_STORAGE, err))
+				return
+			}
+			p := persist{syncc: rc.wal.Sync(), notifyc: ap.notifyc}
+			if !islead {
+				p.msgs = rd.Messages
+				if hasConfChange(rd.CommittedEntries) {
+					p.appliedc = ap.appliedc
+				}
+			}
+			select {
+			case rc.persistc <- p:
+			case <-rc.persistDonec:
+				rc.fail(rc.persistErr)
+				return
+			case <-rc.stopc:
+				rc.stop()
+				return
+			case <-rc.hoststopc:
 				rc.stop()
 				return
 			}
-			rc.maybeTriggerSnapshot()
 			rc.node.Advance()
+			readyDurationSec.Observe(time.Since(readyStart).Seconds())
+
+		case <-rc.applyDonec:
+			rc.applierStopped()
+			return
 
-		case err := <-rc.transport.ErrorC:
-			rc.writeError(err)
-			errCh <- err
+		case <-rc.persistDonec:
+			rc.fail(rc.persistErr)
+			return
+
+		case err := <-rc.fatalc:
+			if errhandle.Code(err) == 0 {
+				err = errhandle.NewError(errhandle.E_TRANSPORT, err)
+			}
+			rc.fail(err)
 			return
 
 		case <-rc.stopc:
 			rc.stop()
 			return
+
+		case <-rc.hoststopc:
+			rc.stop()
+			return
 		}
 	}
 }
 
+// observeLeader updates the leader metrics from the soft state of a Ready.
+func (rc *raftNode) observeLeader(lead uint64) {
+	if lead != rc.lead && lead != raft.None {
+		leaderChanges.Inc()
+	}
+	rc.lead = lead
+	if lead != raft.None {
+		hasLeader.Set(1)
+	} else {
+		hasLeader.Set(0)
+	}
+	if lead == rc.id {
+		isLeader.Set(1)
+		if !rc.serverStats.IsLeader() {
+			rc.serverStats.BecomeLeader()
+		}
+	} else {
+		isLeader.Set(0)
+		leader := ""
+		if lead != raft.None {
+			leader = types.ID(lead).String()
+		}
+		rc.serverStats.FollowLeader(leader)
+	}
+}
+
 func (rc *raftNode) serveRaft() {
+	err := rc.listenAndServeRaft()
+	close(rc.httpdonec)
+	if err != nil {
+		select {
+		case rc.fatalc <- errhandle.NewError(errhandle.E_TRANSPORT, err):
+		case <-rc.httpstopc:
+		}
+	}
+}
+
+// listenAndServeRaft serves the peer transport until httpstopc is closed.
+func (rc *raftNode) listenAndServeRaft() error {
 	url, err := url.Parse(rc.selfPeer)
 	if err != nil {
-		logtool.RLog.Fatal("raft: Failed parsing URL", map[string]interface{}{
-			"error": err,
-		})
+		return err
 	}
 
-	ln, err := raftsvr.NewStoppableListener(url.Host, rc.httpstopc)
+	var ln net.Listener
+	ln, err = raftsvr.NewStoppableListener(url.Host, rc.httpstopc)
 	if err != nil {
-		logtool.RLog.Fatal("raft: Failed to listen rafthttp", map[string]interface{}{
-			"error": err,
-		})
+		return err
+	}
+	if url.Scheme == "https" {
+		if ln, err = transport.NewTLSListener(ln, &rc.peerTLSInfo); err != nil {
+			return err
+		}
 	}
 
 	err = (&http.Server{Handler: rc.transport.Handler()}).Serve(ln)
 	select {
 	case <-rc.httpstopc:
+		return nil
 	default:
-		logtool.RLog.Fatal("raft: Failed to serve rafthttp", map[string]interface{}{
-			"error": err,
-		})
+		return err
 	}
-	close(rc.httpdonec)
 }
 
 func (rc *raftNode) Process(ctx context.Context, m raftpb.Message) error {
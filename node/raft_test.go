@@ -0,0 +1,50 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	stats "github.com/fearblackcat/swiftRaft/utils/api/v2stats"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+func TestObserveLeader(t *testing.T) {
+	rc := &raftNode{id: 1, serverStats: stats.NewServerStats("n1", "1")}
+
+	// a follower records the leader of its soft state
+	rc.observeLeader(2)
+	if rc.serverStats.IsLeader() || rc.serverStats.Leader() != "2" {
+		t.Errorf("leader = %q, want follower of 2", rc.serverStats.Leader())
+	}
+	rc.observeLeader(0)
+	if rc.serverStats.Leader() != "" {
+		t.Errorf("leader = %q, want none", rc.serverStats.Leader())
+	}
+	rc.observeLeader(1)
+	if !rc.serverStats.IsLeader() {
+		t.Error("IsLeader = false, want true")
+	}
+}
+
+func TestValidateConfChange(t *testing.T) {
+	cs := raftpb.ConfState{Nodes: []uint64{1, 2}, Learners: []uint64{3}}
+	tests := []struct {
+		cs    raftpb.ConfState
+		cc    raftpb.ConfChange
+		wcode int
+	}{
+		{cs, raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 4}, 0},
+		{cs, raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 2}, errhandle.E_MEMBER_EXISTS},
+		// a learner is promoted
+		{cs, raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 3}, 0},
+		{cs, raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: 2}, 0},
+		{cs, raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: 3}, 0},
+		{cs, raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: 4}, errhandle.E_MEMBER_NOT_FOUND},
+		{raftpb.ConfState{Nodes: []uint64{1}}, raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: 1}, errhandle.E_UNSAFE_CONF_CHANGE},
+	}
+	for i, tt := range tests {
+		if code := errhandle.Code(validateConfChange(tt.cs, tt.cc)); code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, code, tt.wcode)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package node
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/raftsvr"
+	"github.com/fearblackcat/swiftRaft/utils/api/snap"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal/walpb"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/cryptutil"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/fileutil"
+)
+
+// RestoreConfig describes the member a backup is restored into.
+type RestoreConfig struct {
+	// Cluster is the name=peerURL,... list of the new cluster, as passed
+	// to every member in Config.Cluster.
+	Cluster  string
+	NodeName string
+	// ClusterID defaults to an ID derived from the new member IDs, so that
+	// every member restored with the same Cluster agrees on it.
+	ClusterID uint64
+	// WALDir and SnapDir default to the directories NewRaftNode uses for
+	// NodeName.
+	WALDir  string
+	SnapDir string
+	// EncryptionKeys, if set, encrypts the restored snapshot, as it does
+	// for the member in Config.EncryptionKeys.
+	EncryptionKeys cryptutil.KeyProvider
+}
+
+// Restore checks the hash of a backup served by the snapshot endpoint and
+// writes fresh WAL and snapshot directories for cfg.NodeName. The state
+// machine is restored into a snapshot at term 1 whose ConfState holds the
+// members of cfg.Cluster, so nothing of the old membership survives. The
+// snapshot index is the revision of the backup, so that the revisions of
+// the entries after it keep going up.
+func Restore(lg *logtool.RLogHandle, backup []byte, cfg RestoreConfig) error {
+	data, err := snap.ReadBackup(backup)
+	if err != nil {
+		return err
+	}
+	rev, err := raftsvr.SnapshotRevision(data)
+	if err != nil {
+		return fmt.Errorf("node: malformed backup: %v", err)
+	}
+
+	members, _, err := MemberList(cfg.Cluster)
+	if err != nil {
+		return err
+	}
+	self, ok := members[cfg.NodeName]
+	if !ok {
+		return fmt.Errorf("node: member %q is not part of the cluster", cfg.NodeName)
+	}
+	if cfg.WALDir == "" {
+		cfg.WALDir = fmt.Sprintf("raft-%s", cfg.NodeName)
+	}
+	if cfg.SnapDir == "" {
+		cfg.SnapDir = fmt.Sprintf("raft-%s-snap", cfg.NodeName)
+	}
+	if fileutil.Exist(cfg.WALDir) || fileutil.Exist(cfg.SnapDir) {
+		return fmt.Errorf("node: data directory of %q already exists", cfg.NodeName)
+	}
+
+	ids := make([]uint64, 0, len(members))
+	for _, m := range members {
+		ids = append(ids, m.ID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if cfg.ClusterID == 0 {
+		cfg.ClusterID = genClusterID(ids)
+	}
+
+	md, err := json.Marshal(Metadata{NodeID: self.ID, ClusterID: cfg.ClusterID})
+	if err != nil {
+		return err
+	}
+	index := uint64(len(ids))
+	if rev > index {
+		index = rev
+	}
+	snapshot := raftpb.Snapshot{
+		Data: data,
+		Metadata: raftpb.SnapshotMetadata{
+			Index:     index,
+			Term:      1,
+			ConfState: raftpb.ConfState{Nodes: ids},
+		},
+	}
+
+	// the member is written next to its directories and renamed into
+	// them once complete, so that a failed restore leaves none behind
+	walTmp, err := ioutil.TempDir(filepath.Dir(filepath.Clean(cfg.WALDir)), filepath.Base(cfg.WALDir)+".restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(walTmp)
+	snapTmp, err := ioutil.TempDir(filepath.Dir(filepath.Clean(cfg.SnapDir)), filepath.Base(cfg.SnapDir)+".restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(snapTmp)
+	if err = os.Chmod(snapTmp, 0750); err != nil {
+		return err
+	}
+	walPath := filepath.Join(walTmp, "wal")
+	if err = writeRestoredWAL(lg, walPath, md, snapshot, cfg.EncryptionKeys); err != nil {
+		return err
+	}
+	if err = snap.NewWithKeys(lg, snapTmp, cfg.EncryptionKeys).SaveSnap(snapshot); err != nil {
+		return err
+	}
+
+	// the WAL goes last: a member without one starts afresh
+	if err = os.Rename(snapTmp, cfg.SnapDir); err != nil {
+		return err
+	}
+	if err = os.Rename(walPath, cfg.WALDir); err != nil {
+		os.RemoveAll(cfg.SnapDir)
+		return err
+	}
+	for _, dir := range []string{cfg.SnapDir, cfg.WALDir} {
+		if err = syncDir(filepath.Dir(filepath.Clean(dir))); err != nil {
+			return err
+		}
+	}
+
+	if lg != nil {
+		lg.Info("restored member from backup", map[string]interface{}{
+			"member id":  fmt.Sprintf("%x", self.ID),
+			"cluster id": fmt.Sprintf("%x", cfg.ClusterID),
+			"members":    len(ids),
+			"index":      index,
+			"wal dir":    cfg.WALDir,
+			"snap dir":   cfg.SnapDir,
+		})
+	}
+	return nil
+}
+
+// writeRestoredWAL creates the WAL of a member restored from snapshot in
+// dir, with the snapshot marker and the commit of its index.
+func writeRestoredWAL(lg *logtool.RLogHandle, dir string, md []byte, snapshot raftpb.Snapshot, keys cryptutil.KeyProvider) error {
+	w, err := wal.CreateWithOptions(lg, dir, md, wal.Options{Keys: keys})
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	// same order as saveSnap: the WAL marker goes first
+	walSnap := walpb.Snapshot{Index: snapshot.Metadata.Index, Term: snapshot.Metadata.Term}
+	if err = w.SaveSnapshot(walSnap); err != nil {
+		return err
+	}
+	return w.Save(raftpb.HardState{Term: 1, Commit: walSnap.Index}, nil)
+}
+
+// syncDir fsyncs the directory dir, so that the renames into it persist.
+func syncDir(dir string) error {
+	d, err := fileutil.OpenDir(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return fileutil.Fsync(d)
+}
+
+// genClusterID derives a cluster ID from the sorted member IDs.
+func genClusterID(ids []uint64) uint64 {
+	b := make([]byte, 8*len(ids))
+	for i, id := range ids {
+		binary.BigEndian.PutUint64(b[8*i:], id)
+	}
+	hash := sha1.Sum(b)
+	return binary.BigEndian.Uint64(hash[:8])
+}
@@ -0,0 +1,204 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/utils/api/snap"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal/walpb"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/cryptutil"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/fileutil"
+)
+
+func TestRestore(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "restoretest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	var backup bytes.Buffer
+	data := []byte(`{"foo":"bar"}`)
+	if _, err = snap.WriteBackup(&backup, data); err != nil {
+		t.Fatal(err)
+	}
+
+	cluster := "n1=http://127.0.0.1:2380,n2=http://127.0.0.1:2381,n3=http://127.0.0.1:2382"
+	cfg := RestoreConfig{
+		Cluster:  cluster,
+		NodeName: "n2",
+		WALDir:   filepath.Join(p, "wal"),
+		SnapDir:  filepath.Join(p, "snap"),
+	}
+	if err = Restore(logtool.RLog, backup.Bytes(), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := snap.New(logtool.RLog, cfg.SnapDir).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s.Data, data) {
+		t.Errorf("data = %q, want %q", s.Data, data)
+	}
+	members, _, err := MemberList(cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Metadata.ConfState.Nodes) != len(members) {
+		t.Fatalf("voters = %v, want %d members", s.Metadata.ConfState.Nodes, len(members))
+	}
+
+	w, err := wal.Open(logtool.RLog, cfg.WALDir, walpb.Snapshot{Index: s.Metadata.Index, Term: s.Metadata.Term})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	b, st, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Commit != s.Metadata.Index || len(ents) != 0 {
+		t.Errorf("commit = %d, len(ents) = %d, want %d, 0", st.Commit, len(ents), s.Metadata.Index)
+	}
+	var md Metadata
+	if err = json.Unmarshal(b, &md); err != nil {
+		t.Fatal(err)
+	}
+	want := Metadata{NodeID: members["n2"].ID, ClusterID: genClusterID(s.Metadata.ConfState.Nodes)}
+	if !reflect.DeepEqual(md, want) {
+		t.Errorf("metadata = %+v, want %+v", md, want)
+	}
+
+	// restoring over existing data is refused
+	if err = Restore(logtool.RLog, backup.Bytes(), cfg); err == nil {
+		t.Error("err = nil, want error for existing data directory")
+	}
+}
+
+func TestRestoreHashMismatch(t *testing.T) {
+	var backup bytes.Buffer
+	if _, err := snap.WriteBackup(&backup, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	b := backup.Bytes()
+	b[0] ^= 0xff
+	cfg := RestoreConfig{Cluster: "n1=http://127.0.0.1:2380", NodeName: "n1"}
+	if err := Restore(logtool.RLog, b, cfg); err != snap.ErrBackupHashMismatch {
+		t.Fatalf("err = %v, want %v", err, snap.ErrBackupHashMismatch)
+	}
+}
+
+// failingKeys fails to encrypt anything.
+type failingKeys struct{}
+
+func (failingKeys) CurrentKey() (string, []byte, error) { return "", nil, errors.New("no key") }
+func (failingKeys) Key(string) ([]byte, error)          { return nil, cryptutil.ErrKeyNotFound }
+
+func TestRestoreFailure(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "restoretest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	var backup bytes.Buffer
+	if _, err = snap.WriteBackup(&backup, []byte(`{"foo":"bar"}`)); err != nil {
+		t.Fatal(err)
+	}
+	cfg := RestoreConfig{
+		Cluster:        "n1=http://127.0.0.1:2380",
+		NodeName:       "n1",
+		WALDir:         filepath.Join(p, "wal"),
+		SnapDir:        filepath.Join(p, "snap"),
+		EncryptionKeys: failingKeys{},
+	}
+	if err = Restore(logtool.RLog, backup.Bytes(), cfg); err == nil {
+		t.Fatal("err = nil, want error without an encryption key")
+	}
+	// nothing is left behind, so that the restore can be retried
+	if names, _ := fileutil.ReadDir(p); len(names) != 0 {
+		t.Fatalf("files = %v, want none after a failed restore", names)
+	}
+	cfg.EncryptionKeys = nil
+	if err = Restore(logtool.RLog, backup.Bytes(), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Cluster = "n1=http://127.0.0.1:2380,n2"
+	if err = Restore(logtool.RLog, backup.Bytes(), cfg); err == nil {
+		t.Error("err = nil, want error for a malformed cluster")
+	}
+}
+
+// TestRestoreRevision writes to a member restored from a backup and reads
+// the keys back at the revisions of the backup and of the write.
+func TestRestoreRevision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restorerev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the data directories are relative to the working directory
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	const rev = 100
+	data := fmt.Sprintf(`{"kv":{"revision":%d,"keys":{"/k":[{"key":"/k","value":"old","createRevision":%d,"modRevision":%d,"version":1}]}}}`, rev, rev, rev)
+	var backup bytes.Buffer
+	if _, err = snap.WriteBackup(&backup, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	cluster := fmt.Sprintf("n1=http://127.0.0.1:%d", freePort(t))
+	if err = Restore(logtool.RLog, backup.Bytes(), RestoreConfig{Cluster: cluster, NodeName: "n1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := startTestMember(t, cluster, 0, wal.SyncAlways, false)
+	defer m.stop(t)
+	if err = m.kvs.Propose("/k", "new"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if v, _ := m.kvs.Lookup("/k"); v == "new" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("write not applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	kv, _, err := m.kvs.Get("/k", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv.ModRevision <= rev {
+		t.Fatalf("revision of the write = %d, want above the backup revision %d", kv.ModRevision, rev)
+	}
+	if cur, _ := m.kvs.Revisions(); cur != kv.ModRevision {
+		t.Errorf("store revision = %d, want %d", cur, kv.ModRevision)
+	}
+	if old, _, err := m.kvs.Get("/k", rev); err != nil || old.Value != "old" {
+		t.Errorf("/k at revision %d = %+v, %v; want old", rev, old, err)
+	}
+	if cur, _, err := m.kvs.Get("/k", kv.ModRevision); err != nil || cur.Value != "new" {
+		t.Errorf("/k at revision %d = %+v, %v; want new", kv.ModRevision, cur, err)
+	}
+}
@@ -0,0 +1,137 @@
+package node
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/raftsvr"
+	"github.com/fearblackcat/swiftRaft/utils/api/snap"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/testutil"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/transport"
+)
+
+// TestPeerTLS runs two members over mutual TLS. They elect a leader when
+// both certificates are allowed, and cannot when one is not.
+func TestPeerTLS(t *testing.T) {
+	tests := []struct {
+		cns     []string
+		elected bool
+	}{
+		{[]string{"n1", "n2"}, true},
+		{[]string{"n1", "intruder"}, false},
+	}
+	for i, tt := range tests {
+		if elected := runTLSCluster(t, tt.cns); elected != tt.elected {
+			t.Errorf("#%d: elected = %v, want %v", i, elected, tt.elected)
+		}
+	}
+}
+
+// runTLSCluster starts a two member cluster whose members present
+// certificates with the given CNs and accept only n1 and n2. It reports
+// whether a leader was elected.
+func runTLSCluster(t *testing.T, cns []string) bool {
+	dir, err := ioutil.TempDir("", "tlscluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the data directories are relative to the working directory
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	ca, err := testutil.NewCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"n1", "n2"}
+	cluster := ""
+	for i, name := range names {
+		if i > 0 {
+			cluster += ","
+		}
+		cluster += fmt.Sprintf("%s=https://127.0.0.1:%d", name, freePort(t))
+	}
+	members, peers, err := MemberList(cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	electedc := make(chan string, len(names))
+	stopc := make(chan struct{})
+	var cfgs []*RaftConfig
+	for i, name := range names {
+		cert, key, err := ca.Issue(name, cns[i], "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := &RaftConfig{
+			SelfPeer:      members[name].Peer,
+			NodeName:      name,
+			ProposeC:      make(chan string),
+			ConfChangeC:   make(chan raftpb.ConfChange),
+			ElectedCh:     make(chan bool),
+			SnapshotReady: make(chan *snap.Snapshotter, 1),
+			CommitC:       make(chan *raftsvr.Commit),
+			ErrorC:        make(chan error),
+			StopC:         stopc,
+			PeerTLSInfo: transport.TLSInfo{
+				CertFile:       cert,
+				KeyFile:        key,
+				TrustedCAFile:  ca.CertFile,
+				ClientCertAuth: true,
+				AllowedCNs:     names,
+			},
+		}
+		go func(name string, cfg *RaftConfig) {
+			for {
+				select {
+				case <-cfg.CommitC:
+				case elected := <-cfg.ElectedCh:
+					if elected {
+						electedc <- name
+					}
+				case <-stopc:
+					return
+				}
+			}
+		}(name, cfg)
+		NewRaftNode(members[name].ID, peers, members, func() ([]byte, error) { return nil, nil }, cfg)
+		cfgs = append(cfgs, cfg)
+	}
+	defer func() {
+		close(stopc)
+		for _, cfg := range cfgs {
+			for err := range cfg.ErrorC {
+				t.Errorf("member error: %v", err)
+			}
+		}
+	}()
+
+	select {
+	case <-electedc:
+		return true
+	case <-time.After(5 * time.Second):
+		return false
+	}
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
@@ -117,6 +117,10 @@ type Node interface {
 	Campaign(ctx context.Context) error
 	// Propose proposes that data be appended to the log.
 	Propose(ctx context.Context, data []byte) error
+	// ProposeBatch proposes that each of data be appended to the log, as
+	// consecutive entries of a single proposal. The entries are accepted
+	// or dropped together.
+	ProposeBatch(ctx context.Context, data [][]byte) error
 	// ProposeConfChange proposes config change.
 	// At most one ConfChange can be in the process of going through consensus.
 	// Application needs to call ApplyConfChange when applying EntryConfChange type entry.
@@ -426,6 +430,22 @@ func (n *node) Propose(ctx context.Context, data []byte) error {
 	return n.stepWait(ctx, pb.Message{Type: pb.MsgProp, Entries: []pb.Entry{{Data: data}}})
 }
 
+func (n *node) ProposeBatch(ctx context.Context, data [][]byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return n.stepWait(ctx, pb.Message{Type: pb.MsgProp, Entries: batchEntries(data)})
+}
+
+// batchEntries returns the normal entries of data.
+func batchEntries(data [][]byte) []pb.Entry {
+	ents := make([]pb.Entry, len(data))
+	for i := range data {
+		ents[i].Data = data[i]
+	}
+	return ents
+}
+
 func (n *node) Step(ctx context.Context, m pb.Message) error {
 	// ignore unexpected local messages receiving over network
 	if IsLocalMsg(m.Type) {
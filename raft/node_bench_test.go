@@ -2,6 +2,7 @@ package raft
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 )
@@ -35,3 +36,47 @@ func BenchmarkOneNode(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkOneNodeProposeBatch(b *testing.B) {
+	for _, size := range []int{1, 8, 64, 256} {
+		b.Run(fmt.Sprintf("batch-%d", size), func(b *testing.B) {
+			benchmarkOneNodeProposeBatch(b, size)
+		})
+	}
+}
+
+// benchmarkOneNodeProposeBatch proposes b.N entries in batches of size.
+func benchmarkOneNodeProposeBatch(b *testing.B, size int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := newNode()
+	s := NewMemoryStorage()
+	r := newTestRaft(1, []uint64{1}, 10, 1, s)
+	go n.run(r)
+
+	defer n.Stop()
+
+	n.Campaign(ctx)
+	go func() {
+		batch := make([][]byte, 0, size)
+		for i := 0; i < b.N; i++ {
+			batch = append(batch, []byte("foo"))
+			if len(batch) == size || i == b.N-1 {
+				n.ProposeBatch(ctx, batch)
+				batch = make([][]byte, 0, size)
+			}
+		}
+	}()
+
+	for {
+		rd := <-n.Ready()
+		s.Append(rd.Entries)
+		// a reasonable disk sync latency
+		time.Sleep(1 * time.Millisecond)
+		n.Advance()
+		if rd.HardState.Commit == uint64(b.N+1) {
+			return
+		}
+	}
+}
@@ -146,6 +146,57 @@ func TestNodePropose(t *testing.T) {
 	}
 }
 
+// TestNodeProposeBatch ensures that node.ProposeBatch sends the given data
+// to the underlying raft as the entries of a single MsgProp.
+func TestNodeProposeBatch(t *testing.T) {
+	msgs := []raftpb.Message{}
+	appendStep := func(r *raft, m raftpb.Message) error {
+		msgs = append(msgs, m)
+		return nil
+	}
+
+	n := newNode()
+	s := NewMemoryStorage()
+	r := newTestRaft(1, []uint64{1}, 10, 1, s)
+	go n.run(r)
+	n.Campaign(context.TODO())
+	for {
+		rd := <-n.Ready()
+		s.Append(rd.Entries)
+		// change the step function to appendStep until this raft becomes leader
+		if rd.SoftState.Lead == r.id {
+			r.step = appendStep
+			n.Advance()
+			break
+		}
+		n.Advance()
+	}
+	data := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	if err := n.ProposeBatch(context.TODO(), data); err != nil {
+		t.Fatal(err)
+	}
+	// an empty batch is not proposed
+	if err := n.ProposeBatch(context.TODO(), nil); err != nil {
+		t.Fatal(err)
+	}
+	n.Stop()
+
+	if len(msgs) != 1 {
+		t.Fatalf("len(msgs) = %d, want %d", len(msgs), 1)
+	}
+	if msgs[0].Type != raftpb.MsgProp {
+		t.Errorf("msg type = %d, want %d", msgs[0].Type, raftpb.MsgProp)
+	}
+	if len(msgs[0].Entries) != len(data) {
+		t.Fatalf("len(entries) = %d, want %d", len(msgs[0].Entries), len(data))
+	}
+	for i, e := range msgs[0].Entries {
+		if !bytes.Equal(e.Data, data[i]) {
+			t.Errorf("#%d: data = %v, want %v", i, e.Data, data[i])
+		}
+	}
+}
+
 // TestNodeReadIndex ensures that node.ReadIndex sends the MsgReadIndex message to the underlying raft.
 // It also ensures that ReadState can be read out through ready chan.
 func TestNodeReadIndex(t *testing.T) {
@@ -135,6 +135,19 @@ func (rn *RawNode) Propose(data []byte) error {
 		}})
 }
 
+// ProposeBatch proposes each of data be appended to the raft log, as
+// consecutive entries of a single proposal.
+func (rn *RawNode) ProposeBatch(data [][]byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return rn.raft.Step(pb.Message{
+		Type:    pb.MsgProp,
+		From:    rn.raft.id,
+		Entries: batchEntries(data),
+	})
+}
+
 // ProposeConfChange proposes a config change.
 func (rn *RawNode) ProposeConfChange(cc pb.ConfChange) error {
 	data, err := cc.Marshal()
@@ -531,3 +531,57 @@ func TestRawNodeBoundedLogGrowthWithPartition(t *testing.T) {
 	rawNode.Advance(rd)
 	checkUncommitted(0)
 }
+
+// TestRawNodeProposeBatch ensures that the entries of a batch are appended
+// together, and dropped together once they would exceed
+// MaxUncommittedEntriesSize.
+func TestRawNodeProposeBatch(t *testing.T) {
+	data := []byte("testdata")
+	maxEntrySize := uint64(4 * PayloadSize(raftpb.Entry{Data: data}))
+
+	s := NewMemoryStorage()
+	cfg := newTestConfig(1, []uint64{1}, 10, 1, s)
+	cfg.MaxUncommittedEntriesSize = maxEntrySize
+	rawNode, err := NewRawNode(cfg, []Peer{{ID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd := rawNode.Ready()
+	s.Append(rd.Entries)
+	rawNode.Advance(rd)
+
+	rawNode.Campaign()
+	for {
+		rd = rawNode.Ready()
+		s.Append(rd.Entries)
+		if rd.SoftState.Lead == rawNode.raft.id {
+			rawNode.Advance(rd)
+			break
+		}
+		rawNode.Advance(rd)
+	}
+
+	lastIndex := rawNode.raft.raftLog.lastIndex()
+	if err := rawNode.ProposeBatch([][]byte{data, data, data}); err != nil {
+		t.Fatal(err)
+	}
+	// a batch that does not fit is dropped as a whole
+	if err := rawNode.ProposeBatch([][]byte{data, data}); err != ErrProposalDropped {
+		t.Fatalf("err = %v, want %v", err, ErrProposalDropped)
+	}
+	if err := rawNode.ProposeBatch([][]byte{data}); err != nil {
+		t.Fatal(err)
+	}
+
+	rd = rawNode.Ready()
+	if len(rd.Entries) != 4 {
+		t.Fatalf("len(entries) = %d, want 4", len(rd.Entries))
+	}
+	for i, e := range rd.Entries {
+		if e.Index != lastIndex+uint64(i)+1 || !bytes.Equal(e.Data, data) {
+			t.Errorf("#%d: entry = %+v, want index %d and data %q", i, e, lastIndex+uint64(i)+1, data)
+		}
+	}
+	s.Append(rd.Entries)
+	rawNode.Advance(rd)
+}
@@ -24,6 +24,8 @@ var ErrUnavailable = errors.New("requested entry at index is unavailable")
 // snapshot is temporarily unavailable.
 var ErrSnapshotTemporarilyUnavailable = errors.New("snapshot is temporarily unavailable")
 
+var storageLog = logtool.Logger(logtool.SubsystemRaft)
+
 // Storage is an interface that may be implemented by the application
 // to retrieve log entries from storage.
 //
@@ -100,7 +102,7 @@ func (ms *MemoryStorage) Entries(lo, hi, maxSize uint64) ([]pb.Entry, error) {
 		return nil, ErrCompacted
 	}
 	if hi > ms.lastIndex()+1 {
-		logtool.RLog.Error("entries' hi is out of bound lastindex", map[string]interface{}{
+		storageLog.Error("entries' hi is out of bound lastindex", map[string]interface{}{
 			"hi":        hi,
 			"lastindex": ms.lastIndex(),
 		})
@@ -188,7 +190,7 @@ func (ms *MemoryStorage) CreateSnapshot(i uint64, cs *pb.ConfState, data []byte)
 
 	offset := ms.ents[0].Index
 	if i > ms.lastIndex() {
-		logtool.RLog.Error("snapshot is out of bound lastindex", map[string]interface{}{
+		storageLog.Error("snapshot is out of bound lastindex", map[string]interface{}{
 			"snpashot":  i,
 			"lastindex": ms.lastIndex(),
 		})
@@ -214,7 +216,7 @@ func (ms *MemoryStorage) Compact(compactIndex uint64) error {
 		return ErrCompacted
 	}
 	if compactIndex > ms.lastIndex() {
-		logtool.RLog.Error("compact is out of bound lastindex", map[string]interface{}{
+		storageLog.Error("compact is out of bound lastindex", map[string]interface{}{
 			"compact":   compactIndex,
 			"lastindex": ms.lastIndex(),
 		})
@@ -260,7 +262,7 @@ func (ms *MemoryStorage) Append(entries []pb.Entry) error {
 	case uint64(len(ms.ents)) == offset:
 		ms.ents = append(ms.ents, entries...)
 	default:
-		logtool.RLog.Error("missing log entry [last, append at]",
+		storageLog.Error("missing log entry [last, append at]",
 			map[string]interface{}{"last": ms.lastIndex(), "append at": entries[0].Index})
 	}
 	return nil
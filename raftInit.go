@@ -1,19 +1,29 @@
 package swiftRaft
 
 import (
-	"crypto/sha1"
-	"encoding/binary"
+	"context"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"runtime/debug"
-	"sort"
-	"strings"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/fearblackcat/swiftRaft/node"
 	"github.com/fearblackcat/swiftRaft/raft/raftpb"
 	"github.com/fearblackcat/swiftRaft/raftsvr"
 	"github.com/fearblackcat/swiftRaft/utils/api/snap"
+	stats "github.com/fearblackcat/swiftRaft/utils/api/v2stats"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
 	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/cryptutil"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/transport"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/types"
 )
 
 type Config struct {
@@ -23,7 +33,87 @@ type Config struct {
 	JoinCluster       bool
 	KvPort            int
 	ElectedCh         chan bool
-	ErrCh             chan error
+	// ErrCh receives the *errhandle.Error that stopped the server, once.
+	// By then proposals are no longer accepted and the raft transport is
+	// stopped; restarting or exiting is up to the host.
+	ErrCh chan error
+	// ClusterID is only used when the data directory does not record one
+	// yet, e.g. when joining a cluster restored from a backup.
+	ClusterID uint64
+	// ForceNewCluster restarts this member from its data directory as a
+	// single-member cluster; see node.RaftConfig.
+	ForceNewCluster bool
+	// LogLevel is the level of every log subsystem missing from
+	// LogLevels; "info" if empty. LogLevels is keyed by the
+	// logtool.Subsystem* names.
+	LogLevel  string
+	LogLevels map[string]string
+	// LogFormat is "text" (the default) or "json".
+	LogFormat string
+	// PeerTLSInfo secures the raft transport between members whose peer
+	// URLs are https. With TrustedCAFile and ClientCertAuth the members
+	// authenticate each other, and AllowedCNs and AllowedHostnames limit
+	// which certificates are accepted. The certificate, key and CA files
+	// are read again for new connections, so they can be replaced in place.
+	PeerTLSInfo transport.TLSInfo
+	// PeerAutoTLS creates a self-signed peer certificate in the data
+	// directory if PeerTLSInfo has none. It is meant for development:
+	// members do not verify each other.
+	PeerAutoTLS bool
+	// ClientTLSInfo serves the key-value API over HTTPS; see PeerTLSInfo.
+	ClientTLSInfo transport.TLSInfo
+	// ClientAutoTLS is PeerAutoTLS for the key-value API.
+	ClientAutoTLS bool
+	// AdvertiseClientAddr is the URL of the key-value API of this member
+	// published to the others. It defaults to the host of
+	// AdvertiseRaftAddr with KvPort, over https if the API is served over
+	// TLS.
+	AdvertiseClientAddr string
+	// ForwardWrites is what this member does with the writes it receives
+	// while it follows another: raftsvr.ForwardLocal (the default),
+	// raftsvr.ForwardRedirect or raftsvr.ForwardProxy.
+	ForwardWrites string
+	// ProposalQueueDepth and ProposalQueueBytes bound the proposals
+	// waiting to be handed to raft; see raftsvr.Kvstore.
+	ProposalQueueDepth int
+	ProposalQueueBytes int64
+	// MaxUncommittedBytes bounds the size of the entries the leader has
+	// not committed yet, beyond which proposals are dropped. 1 GiB if 0.
+	MaxUncommittedBytes uint64
+	// ProposalBatchWindow is how long a proposal waits for others to be
+	// proposed to raft with it, and MaxProposalBatch how many proposals
+	// are batched at most; see node.RaftConfig.
+	ProposalBatchWindow time.Duration
+	MaxProposalBatch    int
+	// WALSync is how the WAL fsyncs: wal.SyncAlways (the default),
+	// wal.SyncBatch, which shares an fsync between the writes saved within
+	// WALSyncDelay of each other, or wal.SyncNone, for tests only.
+	WALSync      wal.SyncPolicy
+	WALSyncDelay time.Duration
+	// SlowFsyncThreshold is the WAL fsync duration that raises the slow
+	// fsync alarm, 1s if 0.
+	SlowFsyncThreshold time.Duration
+	// WALOptions sets the segment size (64 MB by default), preallocation
+	// and file mode of the WAL. A member may be restarted with other ones.
+	WALOptions wal.Options
+	// EncryptionKeys encrypts the WAL entries and the snapshots at rest,
+	// for example with a cryptutil.FileKeyProvider. The keys a member was
+	// written with must be kept for as long as it may read that data.
+	EncryptionKeys cryptutil.KeyProvider
+	// AuthTokenKeys signs the bearer tokens of the users, for example with
+	// a cryptutil.FileKeyProvider. Members given the same keys accept each
+	// other's tokens; without them, the tokens of a member are only valid
+	// on it, until it restarts. The keys are never replicated, so the WAL,
+	// snapshots and backups cannot be used to forge tokens.
+	AuthTokenKeys cryptutil.KeyProvider
+	// Compression compresses the WAL entries, the snapshots and the
+	// entries sent to this member by its peers, which fall back to plain
+	// streams if they cannot. Compressed data is read whatever Compression,
+	// so it can be turned on or off by restarting a member.
+	Compression bool
+	// Admission limits the writes of each client and rejects writes while
+	// the followers or the WAL fall behind; see raftsvr.AdmissionConfig.
+	Admission raftsvr.AdmissionConfig
 }
 
 type RaftServer struct {
@@ -31,12 +121,28 @@ type RaftServer struct {
 	nodeID      uint64
 	electedCh   chan bool
 	errCh       chan error
+	fatalC      chan error
+	failOnce    sync.Once
 	shutdownCh  chan struct{}
 	proposeC    chan string
 	confCHangeC chan raftpb.ConfChange
 	kvs         *raftsvr.Kvstore
+	kvSrv       *http.Server
 }
 
+const (
+	// publishTimeout bounds each attempt to publish the member, and
+	// publishRetry separates them.
+	publishTimeout = 5 * time.Second
+	publishRetry   = 500 * time.Millisecond
+	// proxyDialTimeout bounds the connections of the writes proxied to
+	// the leader.
+	proxyDialTimeout = 5 * time.Second
+	// droppedBuffer is the number of dropped proposals the raft node can
+	// report before the key-value store reads them.
+	droppedBuffer = 128
+)
+
 func NewRaftServer(cfg *Config) *RaftServer {
 	if cfg == nil || cfg.ElectedCh == nil ||
 		cfg.ErrCh == nil || len(cfg.Cluster) == 0 ||
@@ -46,12 +152,30 @@ func NewRaftServer(cfg *Config) *RaftServer {
 		fmt.Fprint(os.Stderr, "manditory fields of configuration is empty \n")
 		return nil
 	}
+	err := logtool.Configure(logtool.Config{
+		Level:  cfg.LogLevel,
+		Levels: cfg.LogLevels,
+		Format: cfg.LogFormat,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid log configuration: %v\n", err)
+		return nil
+	}
+	switch cfg.ForwardWrites {
+	case raftsvr.ForwardLocal, raftsvr.ForwardRedirect, raftsvr.ForwardProxy:
+	default:
+		fmt.Fprintf(os.Stderr, "invalid write forwarding mode %q\n", cfg.ForwardWrites)
+		return nil
+	}
 
 	r := &RaftServer{}
 
 	r.cfg = cfg
 	r.electedCh = make(chan bool)
-	r.errCh = make(chan error)
+	// fail sends once and must not wait for Run
+	r.errCh = make(chan error, 1)
+	// the key-value store and API each send at most one error
+	r.fatalC = make(chan error, 2)
 	r.shutdownCh = make(chan struct{})
 	r.proposeC = make(chan string)
 	r.confCHangeC = make(chan raftpb.ConfChange)
@@ -61,81 +185,219 @@ func NewRaftServer(cfg *Config) *RaftServer {
 	return r
 }
 
-func (r *RaftServer) genMemberList(cluster string) (map[string]node.MemberInfo, []string) {
-	var peers []string
-
-	resmap := make(map[string]node.MemberInfo)
-	kvs := strings.Split(cluster, ",")
-	for _, v := range kvs {
-		kv := strings.Split(v, "=")
-		peers = append(peers, kv[1])
-	}
-	for _, v := range kvs {
-		kv := strings.Split(v, "=")
-		var b []byte
-		sort.Strings(peers)
-		for _, p := range peers {
-			b = append(b, []byte(p)...)
-		}
-
-		b = append(b, []byte(kv[0])...)
-
-		hash := sha1.Sum(b)
-		id := binary.BigEndian.Uint64(hash[:8])
-		resmap[kv[0]] = node.MemberInfo{
-			ID:   id,
-			Peer: kv[1],
-		}
-	}
-
-	return resmap, peers
-}
-
 func (r *RaftServer) setupRaft() {
 	if r == nil {
 		return
 	}
 
-	resMap, peers := r.genMemberList(r.cfg.Cluster)
+	resMap, peers, err := node.MemberList(r.cfg.Cluster)
+	if err != nil {
+		r.fail(err)
+		return
+	}
 
 	id := resMap[r.cfg.NodeName].ID
 
 	r.nodeID = id
 
+	peerTLS, clientTLS, err := r.tlsInfo()
+	if err != nil {
+		r.fail(errhandle.NewError(errhandle.E_TLS, err))
+		return
+	}
+
+	// the key-value store reads the drops once it is created
+	droppedC := make(chan string, droppedBuffer)
 	cfg := node.RaftConfig{
-		SelfPeer:      r.cfg.AdvertiseRaftAddr,
-		NodeName:      r.cfg.NodeName,
-		Join:          r.cfg.JoinCluster,
-		ProposeC:      r.proposeC,
-		ConfChangeC:   r.confCHangeC,
-		ElectedCh:     r.electedCh,
-		ErrCh:         r.errCh,
-		SnapshotReady: make(chan *snap.Snapshotter, 1),
-		CommitC:       make(chan *string),
-		ErrorC:        make(chan error),
+		SelfPeer:            r.cfg.AdvertiseRaftAddr,
+		NodeName:            r.cfg.NodeName,
+		Join:                r.cfg.JoinCluster,
+		ClusterID:           r.cfg.ClusterID,
+		ForceNewCluster:     r.cfg.ForceNewCluster,
+		ProposeC:            r.proposeC,
+		ConfChangeC:         r.confCHangeC,
+		ElectedCh:           r.electedCh,
+		SnapshotReady:       make(chan *snap.Snapshotter, 1),
+		CommitC:             make(chan *raftsvr.Commit),
+		ErrorC:              make(chan error),
+		StopC:               r.shutdownCh,
+		ServerStats:         stats.NewServerStats(r.cfg.NodeName, types.ID(id).String()),
+		LeaderStats:         stats.NewLeaderStats(types.ID(id).String()),
+		PeerTLSInfo:         peerTLS,
+		DroppedC:            droppedC,
+		Load:                &raftsvr.NodeLoad{},
+		MaxUncommittedBytes: r.cfg.MaxUncommittedBytes,
+		ProposalBatchWindow: r.cfg.ProposalBatchWindow,
+		MaxProposalBatch:    r.cfg.MaxProposalBatch,
+		WALSync:             r.cfg.WALSync,
+		WALSyncDelay:        r.cfg.WALSyncDelay,
+		SlowFsyncThreshold:  r.cfg.SlowFsyncThreshold,
+		WALOptions:          r.cfg.WALOptions,
+		EncryptionKeys:      r.cfg.EncryptionKeys,
+		Compression:         r.cfg.Compression,
+		// the store is snapshotted apart from the applier
+		SnapshotView:   func() (func() ([]byte, error), error) { return r.kvs.SnapshotView() },
+		ExpandSnapshot: func(data []byte) ([]byte, error) { return r.kvs.ExpandSnapshot(data) },
 	}
 
-	logtool.NLog.Debug("gointo the raft setup")
+	genSnapshot := func() ([]byte, error) { return r.kvs.SnapshotChunks() }
 
-	logtool.NLog.Debug("new KV store")
+	logtool.RLog.Debug("starting raft node", map[string]interface{}{
+		"name":      r.cfg.NodeName,
+		"member id": types.ID(id).String(),
+	})
 
-	genSnapshot := func() ([]byte, error) { return r.kvs.GetSnapshot() }
+	node.NewRaftNode(id, peers, resMap, genSnapshot, &cfg)
 
-	logtool.NLog.Debug("ready to new raft node")
+	var snapshotter *snap.Snapshotter
+	select {
+	case snapshotter = <-cfg.SnapshotReady:
+	case err := <-cfg.ErrorC:
+		r.fail(err)
+		return
+	}
+	r.kvs = raftsvr.NewKVStore(snapshotter, r.proposeC)
+	r.kvs.QueueDepth = r.cfg.ProposalQueueDepth
+	r.kvs.QueueBytes = r.cfg.ProposalQueueBytes
+	r.kvs.ReadDropped(droppedC)
+
+	api := &raftsvr.HttpKVAPI{
+		Store:       r.kvs,
+		ConfChangeC: r.confCHangeC,
+		ServerStats: cfg.ServerStats,
+		LeaderStats: cfg.LeaderStats,
+		Forward:     r.cfg.ForwardWrites,
+		Admission:   r.cfg.Admission,
+		Load:        cfg.Load,
+		TokenKeys:   r.cfg.AuthTokenKeys,
+	}
+	if !clientTLS.Empty() {
+		// the leader is reached like any client reaches it
+		if api.ProxyTransport, err = transport.NewTransport(clientTLS, proxyDialTimeout); err != nil {
+			r.fail(errhandle.NewError(errhandle.E_TLS, err))
+			return
+		}
+	}
+	r.kvSrv = raftsvr.ServeHttpKVAPI(api, r.cfg.KvPort, clientTLS, r.fatalC)
 
-	node.NewRaftNode(id, peers, resMap, genSnapshot, &cfg)
+	logtool.RLog.Debug("serving key-value API", map[string]interface{}{
+		"port": r.cfg.KvPort,
+	})
 
-	logtool.NLog.Debug("ready to load data to map")
+	go r.watchErrors(cfg.ErrorC)
+	r.kvs.LoadDataToMap(cfg.CommitC, r.fatalC)
+	r.kvs.StartLeases(cfg.ServerStats.IsLeader, r.shutdownCh)
+	go r.publish(raftsvr.Member{ID: id, Name: r.cfg.NodeName, ClientURL: r.clientURL(clientTLS)})
+}
 
-	r.kvs = raftsvr.NewKVStore(<-cfg.SnapshotReady, r.proposeC)
+// clientURL returns the URL of the key-value API advertised to the other
+// members.
+func (r *RaftServer) clientURL(clientTLS transport.TLSInfo) string {
+	if r.cfg.AdvertiseClientAddr != "" {
+		return r.cfg.AdvertiseClientAddr
+	}
+	scheme := "http"
+	if !clientTLS.Empty() {
+		scheme = "https"
+	}
+	host := "127.0.0.1"
+	if u, err := url.Parse(r.cfg.AdvertiseRaftAddr); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(r.cfg.KvPort)))
+}
 
-	go raftsvr.ServeHttpKVAPI(r.kvs, r.cfg.KvPort, r.confCHangeC, cfg.ErrorC)
+// publish publishes m in the member registry, retrying until it is applied
+// or the server stops. Proposals are dropped while the cluster has no
+// leader.
+func (r *RaftServer) publish(m raftsvr.Member) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		err := r.kvs.Publish(ctx, m)
+		cancel()
+		if err == nil {
+			return
+		}
+		logtool.RLog.Debug("failed to publish member, retrying", map[string]interface{}{
+			"error": err,
+		})
+		select {
+		case <-time.After(publishRetry):
+		case <-r.shutdownCh:
+			return
+		}
+	}
+}
 
-	r.kvs.LoadDataToMap(cfg.CommitC, cfg.ErrorC)
+// tlsInfo returns the peer and client TLS configuration, with self-signed
+// certificates in place of missing ones if auto TLS is on. It fails if a
+// configured certificate or CA cannot be loaded.
+func (r *RaftServer) tlsInfo() (peer, client transport.TLSInfo, err error) {
+	peer, client = r.cfg.PeerTLSInfo, r.cfg.ClientTLSInfo
+	u, err := url.Parse(r.cfg.AdvertiseRaftAddr)
+	if err != nil {
+		return peer, client, err
+	}
+	tlsdir := fmt.Sprintf("raft-%s-tls", r.cfg.NodeName)
+	if r.cfg.PeerAutoTLS && peer.Empty() {
+		if peer, err = transport.SelfCert(nil, filepath.Join(tlsdir, "peer"), []string{u.Hostname()}); err != nil {
+			return peer, client, err
+		}
+	}
+	if r.cfg.ClientAutoTLS && client.Empty() {
+		hosts := []string{"localhost", "127.0.0.1", u.Hostname()}
+		if client, err = transport.SelfCert(nil, filepath.Join(tlsdir, "client"), hosts); err != nil {
+			return peer, client, err
+		}
+	}
+	for _, info := range []transport.TLSInfo{peer, client} {
+		if info.Empty() {
+			continue
+		}
+		if _, err = info.ServerConfig(); err != nil {
+			return peer, client, err
+		}
+	}
+	return peer, client, nil
+}
 
-	logtool.NLog.Debug("ready to serve http kv")
+// watchErrors fails the server on the first error of the raft node, the
+// key-value store or its API, until the raft node stops.
+func (r *RaftServer) watchErrors(raftErrorC <-chan error) {
+	for {
+		select {
+		case err, ok := <-raftErrorC:
+			if !ok {
+				return
+			}
+			r.fail(err)
+		case err := <-r.fatalC:
+			r.fail(err)
+		}
+	}
+}
 
-	logtool.NLog.Debugf("raftKvPort=%d", r.cfg.KvPort)
+// fail stops accepting requests and stops the raft node, then reports err
+// on the error channel. Only the first error is reported; the others are
+// logged.
+func (r *RaftServer) fail(err error) {
+	reported := false
+	r.failOnce.Do(func() {
+		reported = true
+		logtool.RLog.Error("server stopped after a fatal error", map[string]interface{}{
+			"error": err,
+		})
+		if r.kvSrv != nil {
+			r.kvSrv.Close()
+		}
+		close(r.shutdownCh)
+		r.errCh <- err
+	})
+	if !reported {
+		logtool.RLog.Error("fatal error after the server stopped", map[string]interface{}{
+			"error": err,
+		})
+	}
 }
 
 // Leader election routine
@@ -143,10 +405,13 @@ func (r *RaftServer) Run() {
 	if r == nil {
 		return
 	}
-	logtool.NLog.Info("agent: Running for election")
+	logtool.RLog.Info("running for election", map[string]interface{}{})
 	defer func() {
 		if panicErr := recover(); panicErr != nil {
-			logtool.NLog.Errorf("op=runForElection||panic=%s||stack=%s", panicErr, string(debug.Stack()))
+			logtool.RLog.Error("panic running for election", map[string]interface{}{
+				"panic": panicErr,
+				"stack": string(debug.Stack()),
+			})
 		}
 	}()
 
@@ -154,9 +419,9 @@ func (r *RaftServer) Run() {
 		select {
 		case isElected := <-r.electedCh:
 			if isElected {
-				logtool.NLog.Info("agent: Cluster leadership acquired")
+				logtool.RLog.Info("cluster leadership acquired", map[string]interface{}{})
 			} else {
-				logtool.NLog.Info("agent: Cluster leadership lost")
+				logtool.RLog.Info("cluster leadership lost", map[string]interface{}{})
 			}
 			go func() {
 				r.cfg.ElectedCh <- isElected
@@ -164,7 +429,9 @@ func (r *RaftServer) Run() {
 
 		case err := <-r.errCh:
 			if err != nil {
-				logtool.NLog.Infof("err=%s||eader election failed, channel is probably closed", err.Error())
+				logtool.RLog.Info("leaving the election after a fatal error", map[string]interface{}{
+					"error": err,
+				})
 			}
 			go func() {
 				r.cfg.ErrCh <- err
@@ -0,0 +1,311 @@
+package raftsvr
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Defaults of Kvstore.QueueDepth and Kvstore.QueueBytes.
+const (
+	DefaultQueueDepth       = 1024
+	DefaultQueueBytes int64 = 64 * 1024 * 1024
+)
+
+const (
+	// overloadRetryAfter is the Retry-After of the responses to requests
+	// rejected with E_TOO_MANY_REQUESTS, in seconds.
+	overloadRetryAfter = 1
+	// fsyncWindow is how long a WAL fsync counts in the average latency
+	// watched by admission control.
+	fsyncWindow = time.Second
+	// limiterSweepInterval is how often the rate limiter forgets the
+	// clients whose bucket is full again.
+	limiterSweepInterval = time.Minute
+)
+
+var (
+	proposalQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "proposal_queue_depth",
+		Help:      "The number of proposals waiting to be handed to raft.",
+	})
+	proposalQueueBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "proposal_queue_bytes",
+		Help:      "The size of the proposals waiting to be handed to raft.",
+	})
+	admissionRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "etcd",
+		Subsystem: "server",
+		Name:      "admission_rejected_total",
+		Help:      "The total number of requests rejected as too many, by the limit they exceeded.",
+	},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(proposalQueueDepth)
+	prometheus.MustRegister(proposalQueueBytes)
+	prometheus.MustRegister(admissionRejected)
+}
+
+// tooManyRequests counts a request rejected for reason and returns its
+// error.
+func tooManyRequests(reason string, format string, a ...interface{}) error {
+	admissionRejected.WithLabelValues(reason).Inc()
+	return errhandle.NewError(errhandle.E_TOO_MANY_REQUESTS, fmt.Errorf(format, a...))
+}
+
+// AdmissionConfig limits the writes of HttpKVAPI, which rejects the writes
+// beyond them with E_TOO_MANY_REQUESTS. Zero values disable the limits.
+type AdmissionConfig struct {
+	// ClientRate is the number of writes per second allowed to each
+	// client, in bursts of up to ClientBurst writes, 1 if 0. Clients are
+	// told apart by user once auth is enabled, and by address otherwise.
+	ClientRate  float64
+	ClientBurst int
+	// MaxFollowerLag rejects writes on the leader while an active follower
+	// misses more entries than it.
+	MaxFollowerLag uint64
+	// MaxFsyncLatency rejects writes while the WAL fsyncs of the last
+	// second took longer than it on average.
+	MaxFsyncLatency time.Duration
+}
+
+// NodeLoad is the load of a raft node watched by admission control. The
+// node updates it and HttpKVAPI reads it.
+type NodeLoad struct {
+	followerLag uint64 // accessed atomically
+
+	mu sync.Mutex
+	// the fsyncs of the current and the previous window
+	start     time.Time
+	cur, prev fsyncWindowStats
+}
+
+type fsyncWindowStats struct {
+	total time.Duration
+	n     int
+}
+
+// SetFollowerLag records the number of entries missed by the active
+// follower that lags the most, 0 if this member does not lead.
+func (l *NodeLoad) SetFollowerLag(lag uint64) {
+	atomic.StoreUint64(&l.followerLag, lag)
+}
+
+// FollowerLag returns the lag last set by SetFollowerLag.
+func (l *NodeLoad) FollowerLag() uint64 {
+	return atomic.LoadUint64(&l.followerLag)
+}
+
+// ObserveFsync records a WAL fsync that took d.
+func (l *NodeLoad) ObserveFsync(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.roll(time.Now())
+	l.cur.total += d
+	l.cur.n++
+}
+
+// FsyncLatency returns the average latency of the WAL fsyncs of the last
+// one or two fsyncWindow, 0 if there were none.
+func (l *NodeLoad) FsyncLatency() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.roll(time.Now())
+	n := l.cur.n + l.prev.n
+	if n == 0 {
+		return 0
+	}
+	return (l.cur.total + l.prev.total) / time.Duration(n)
+}
+
+// roll starts a new window if the current one ended before now, so that
+// the fsyncs of a slow spell stop counting once writes stop.
+func (l *NodeLoad) roll(now time.Time) {
+	switch elapsed := now.Sub(l.start); {
+	case elapsed < fsyncWindow:
+		return
+	case elapsed < 2*fsyncWindow:
+		l.prev = l.cur
+	default:
+		l.prev = fsyncWindowStats{}
+	}
+	l.cur = fsyncWindowStats{}
+	l.start = now
+}
+
+// rateLimiter keeps a token bucket per client.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from the bucket of client, which fills at rate tokens
+// per second up to burst, and reports whether there was one.
+func (l *rateLimiter) allow(client string, rate float64, burst int, now time.Time) bool {
+	if burst < 1 {
+		burst = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	if now.Sub(l.lastSweep) >= limiterSweepInterval {
+		l.sweep(rate, burst, now)
+	}
+	b := l.buckets[client]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets the buckets that are full again, which a new bucket would
+// be too.
+func (l *rateLimiter) sweep(rate float64, burst int, now time.Time) {
+	for c, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst) {
+			delete(l.buckets, c)
+		}
+	}
+	l.lastSweep = now
+}
+
+// proposalQueue counts the proposals waiting to be handed to raft, so that
+// they can be bounded.
+type proposalQueue struct {
+	mu    sync.Mutex
+	depth int
+	bytes int64
+}
+
+// acquire adds a proposal of size bytes, or fails with E_TOO_MANY_REQUESTS
+// if the queue holds maxDepth proposals or would hold more than maxBytes.
+// A proposal larger than maxBytes is admitted into an empty queue.
+func (q *proposalQueue) acquire(size int, maxDepth int, maxBytes int64) error {
+	if maxDepth <= 0 {
+		maxDepth = DefaultQueueDepth
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultQueueBytes
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.depth >= maxDepth {
+		return tooManyRequests("queue_depth", "%d proposals are waiting for raft", q.depth)
+	}
+	if q.depth > 0 && q.bytes+int64(size) > maxBytes {
+		return tooManyRequests("queue_bytes", "%d bytes of proposals are waiting for raft", q.bytes)
+	}
+	q.depth++
+	q.bytes += int64(size)
+	proposalQueueDepth.Inc()
+	proposalQueueBytes.Add(float64(size))
+	return nil
+}
+
+// release removes a proposal of size bytes once raft took it.
+func (q *proposalQueue) release(size int) {
+	q.mu.Lock()
+	q.depth--
+	q.bytes -= int64(size)
+	q.mu.Unlock()
+	proposalQueueDepth.Dec()
+	proposalQueueBytes.Sub(float64(size))
+}
+
+// admit fails with E_TOO_MANY_REQUESTS the write r if it exceeds the limits
+// of h.Admission.
+func (h *HttpKVAPI) admit(r *http.Request) error {
+	a := h.Admission
+	if a.ClientRate > 0 {
+		client := h.client(r)
+		if !h.limiter.allow(client, a.ClientRate, a.ClientBurst, time.Now()) {
+			return tooManyRequests("client_rate", "client %s exceeds %g writes per second", client, a.ClientRate)
+		}
+	}
+	if h.Load == nil {
+		return nil
+	}
+	if a.MaxFollowerLag > 0 {
+		if lag := h.Load.FollowerLag(); lag > a.MaxFollowerLag {
+			return tooManyRequests("follower_lag", "a follower misses %d entries", lag)
+		}
+	}
+	if a.MaxFsyncLatency > 0 {
+		if d := h.Load.FsyncLatency(); d > a.MaxFsyncLatency {
+			return tooManyRequests("fsync_latency", "WAL fsyncs take %v", d)
+		}
+	}
+	return nil
+}
+
+// client names the client of r for the rate limits: its user once auth is
+// enabled, or its address. The address of a request proxied by another
+// member is the last one the proxy added to X-Forwarded-For; the header is
+// ignored on the requests of anyone else, who could set it at will.
+func (h *HttpKVAPI) client(r *http.Request) string {
+	if h.authEnabled() {
+		if user, err := h.authenticate(r); err == nil {
+			return "user " + user
+		}
+	}
+	addr := r.RemoteAddr
+	if h.fromMember(r) {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			hops := strings.Split(fwd, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// fromMember reports whether r was proxied by a member: the CN of its
+// verified TLS client certificate names the registered member whose ID is
+// in its ForwardedHeader.
+func (h *HttpKVAPI) fromMember(r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return false
+	}
+	id, err := strconv.ParseUint(r.Header.Get(ForwardedHeader), 16, 64)
+	if err != nil {
+		return false
+	}
+	m, ok := h.Store.Member(id)
+	return ok && m.Name == r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
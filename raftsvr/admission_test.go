@@ -0,0 +1,251 @@
+package raftsvr
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	now := time.Now()
+	tests := []struct {
+		client string
+		after  time.Duration
+		w      bool
+	}{
+		{"a", 0, true},
+		{"a", 0, true},
+		{"a", 0, false},
+		// buckets are per client
+		{"b", 0, true},
+		// 2 writes per second refill a token in 500ms
+		{"a", 400 * time.Millisecond, false},
+		{"a", 100 * time.Millisecond, true},
+		{"a", 0, false},
+		// the bucket does not fill beyond the burst
+		{"a", 10 * time.Second, true},
+		{"a", 0, true},
+		{"a", 0, false},
+	}
+	for i, tt := range tests {
+		now = now.Add(tt.after)
+		if g := l.allow(tt.client, 2, 2, now); g != tt.w {
+			t.Errorf("#%d: allow(%s) = %v, want %v", i, tt.client, g, tt.w)
+		}
+	}
+
+	l.sweep(2, 2, now.Add(time.Second))
+	if len(l.buckets) != 0 {
+		t.Errorf("buckets after sweep = %v, want none", l.buckets)
+	}
+}
+
+func TestNodeLoadFsyncLatency(t *testing.T) {
+	var l NodeLoad
+	if d := l.FsyncLatency(); d != 0 {
+		t.Fatalf("latency = %v, want 0", d)
+	}
+	l.ObserveFsync(10 * time.Millisecond)
+	l.ObserveFsync(30 * time.Millisecond)
+	if d := l.FsyncLatency(); d != 20*time.Millisecond {
+		t.Fatalf("latency = %v, want 20ms", d)
+	}
+
+	// the fsyncs of the previous window still count
+	l.mu.Lock()
+	l.start = l.start.Add(-fsyncWindow)
+	l.mu.Unlock()
+	l.ObserveFsync(50 * time.Millisecond)
+	if d := l.FsyncLatency(); d != 30*time.Millisecond {
+		t.Fatalf("latency = %v, want 30ms", d)
+	}
+
+	// and no longer once writes stopped
+	l.mu.Lock()
+	l.start = l.start.Add(-2 * fsyncWindow)
+	l.mu.Unlock()
+	if d := l.FsyncLatency(); d != 0 {
+		t.Fatalf("latency = %v, want 0", d)
+	}
+}
+
+func queueDepth(s *Kvstore) int {
+	s.queue.mu.Lock()
+	defer s.queue.mu.Unlock()
+	return s.queue.depth
+}
+
+func TestProposalQueue(t *testing.T) {
+	proposeC := make(chan string)
+	s := &Kvstore{ProposeC: proposeC, QueueDepth: 2}
+	for i := 0; i < 2; i++ {
+		if err := s.ProposeAsync("/foo", "bar"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.ProposeAsync("/foo", "bar"); errhandle.Code(err) != errhandle.E_TOO_MANY_REQUESTS {
+		t.Fatalf("err = %v, want E_TOO_MANY_REQUESTS", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := s.Txn(ctx, &Txn{Success: []Op{{Type: OpPut, Key: "/foo", Value: "bar"}}}); errhandle.Code(err) != errhandle.E_TOO_MANY_REQUESTS {
+		t.Fatalf("err = %v, want E_TOO_MANY_REQUESTS", err)
+	}
+
+	// raft taking a proposal frees its place
+	<-proposeC
+	for queueDepth(s) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.ProposeAsync("/foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	<-proposeC
+	<-proposeC
+	for queueDepth(s) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a proposal larger than the byte limit is admitted alone
+	s.QueueBytes = 10
+	if err := s.ProposeAsync("/foo", strings.Repeat("x", 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ProposeAsync("/foo", "bar"); errhandle.Code(err) != errhandle.E_TOO_MANY_REQUESTS {
+		t.Fatalf("err = %v, want E_TOO_MANY_REQUESTS", err)
+	}
+	<-proposeC
+}
+
+func TestProposeAsyncStop(t *testing.T) {
+	s := &Kvstore{ProposeC: make(chan string)}
+	if err := s.ProposeAsync("/foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	// nothing takes the proposal once the store stopped
+	s.stop()
+	for queueDepth(s) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReadDropped(t *testing.T) {
+	proposeC := make(chan string)
+	droppedC := make(chan string)
+	defer close(droppedC)
+	s := &Kvstore{ProposeC: proposeC}
+	s.ReadDropped(droppedC)
+	go func() { droppedC <- <-proposeC }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.Txn(ctx, &Txn{Success: []Op{{Type: OpPut, Key: "/foo", Value: "bar"}}})
+	if errhandle.Code(err) != errhandle.E_PROPOSAL_DROPPED {
+		t.Fatalf("err = %v, want E_PROPOSAL_DROPPED", err)
+	}
+}
+
+func TestAdmissionClient(t *testing.T) {
+	s := &Kvstore{}
+	s.applyMember(&Member{ID: 0x2, Name: "n2"})
+	h := &HttpKVAPI{Store: s}
+	cert := func(cn string) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+	}
+	tests := []struct {
+		forwardedBy string
+		tls         *tls.ConnectionState
+		w           string
+	}{
+		{"", nil, "10.0.0.1"},
+		// anyone can set the headers
+		{"2", nil, "10.0.0.1"},
+		{"2", cert("alice"), "10.0.0.1"},
+		{"3", cert("n2"), "10.0.0.1"},
+		// but only a member proxies
+		{"2", cert("n2"), "10.0.0.9"},
+	}
+	for i, tt := range tests {
+		req := httptest.NewRequest("PUT", "/foo", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.TLS = tt.tls
+		if tt.forwardedBy != "" {
+			req.Header.Set(ForwardedHeader, tt.forwardedBy)
+		}
+		req.Header.Set("X-Forwarded-For", "10.0.0.8, 10.0.0.9")
+		if g := h.client(req); g != tt.w {
+			t.Errorf("#%d: client = %q, want %q", i, g, tt.w)
+		}
+	}
+}
+
+func TestServeAdmission(t *testing.T) {
+	// not closed: proposals are taken in the background
+	proposeC := make(chan string)
+	go func() {
+		for range proposeC {
+		}
+	}()
+	store := newTestKVStore("/foo", "bar")
+	store.ProposeC = proposeC
+
+	tests := []struct {
+		admission AdmissionConfig
+		lag       uint64
+		fsync     time.Duration
+
+		wstatus []int
+	}{
+		{AdmissionConfig{}, 100, time.Second, []int{http.StatusNoContent, http.StatusNoContent}},
+		{AdmissionConfig{ClientRate: 0.1}, 0, 0, []int{http.StatusNoContent, http.StatusTooManyRequests}},
+		{AdmissionConfig{ClientRate: 0.1, ClientBurst: 2}, 0, 0, []int{http.StatusNoContent, http.StatusNoContent, http.StatusTooManyRequests}},
+		{AdmissionConfig{MaxFollowerLag: 10}, 10, 0, []int{http.StatusNoContent}},
+		{AdmissionConfig{MaxFollowerLag: 10}, 11, 0, []int{http.StatusTooManyRequests}},
+		{AdmissionConfig{MaxFsyncLatency: 10 * time.Millisecond}, 0, 5 * time.Millisecond, []int{http.StatusNoContent}},
+		{AdmissionConfig{MaxFsyncLatency: 10 * time.Millisecond}, 0, 50 * time.Millisecond, []int{http.StatusTooManyRequests}},
+	}
+	for i, tt := range tests {
+		load := &NodeLoad{}
+		load.SetFollowerLag(tt.lag)
+		if tt.fsync > 0 {
+			load.ObserveFsync(tt.fsync)
+		}
+		srv := httptest.NewServer(&HttpKVAPI{Store: store, Admission: tt.admission, Load: load})
+		for j, w := range tt.wstatus {
+			req, err := http.NewRequest("PUT", srv.URL+"/foo", strings.NewReader("baz"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != w {
+				t.Errorf("#%d.%d: status = %d, want %d", i, j, resp.StatusCode, w)
+			}
+			if w == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "1" {
+				t.Errorf("#%d.%d: Retry-After = %q, want 1", i, j, resp.Header.Get("Retry-After"))
+			}
+		}
+		// reads are not limited
+		resp, err := http.Get(srv.URL + "/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("#%d: GET status = %d, want %d", i, resp.StatusCode, http.StatusOK)
+		}
+		srv.Close()
+	}
+}
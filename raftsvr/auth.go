@@ -0,0 +1,275 @@
+package raftsvr
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+// RootRole grants every permission, including member changes and the
+// management of users and roles. It cannot be changed, and auth can only be
+// enabled while a user has it.
+const RootRole = "root"
+
+// Permission allows reading and/or writing the keys starting with Prefix.
+type Permission struct {
+	Prefix string `json:"prefix"`
+	Read   bool   `json:"read"`
+	Write  bool   `json:"write"`
+}
+
+type User struct {
+	Name string `json:"name"`
+	// Password is the bcrypt hash of the password of the user.
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+	// TokenGen is the generation of the tokens of the user. It is raised
+	// by a new password and by AuthRevokeTokens, which revokes the tokens
+	// issued before.
+	TokenGen uint64 `json:"tokenGen,omitempty"`
+}
+
+type Role struct {
+	Name        string       `json:"name"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// Operations of an AuthRequest.
+const (
+	AuthEnable     = "enable"
+	AuthDisable    = "disable"
+	AuthPutUser    = "putUser"
+	AuthDeleteUser = "deleteUser"
+	AuthPutRole    = "putRole"
+	AuthDeleteRole = "deleteRole"
+	// AuthRevokeTokens revokes the tokens of the user Name.
+	AuthRevokeTokens = "revokeTokens"
+)
+
+// AuthRequest changes the auth status, users or roles. It is proposed and
+// applied through raft like the key-value pairs.
+type AuthRequest struct {
+	Op string
+	// User is created or replaced by AuthPutUser; an empty Password keeps
+	// the current one.
+	User *User
+	// Role is created or replaced by AuthPutRole.
+	Role *Role
+	// Name is the user or role to delete.
+	Name string
+}
+
+// authState is the replicated auth data of a Kvstore.
+type authState struct {
+	Enabled bool             `json:"enabled"`
+	Users   map[string]*User `json:"users,omitempty"`
+	Roles   map[string]*Role `json:"roles,omitempty"`
+}
+
+func (a *authState) empty() bool {
+	return !a.Enabled && len(a.Users) == 0 && len(a.Roles) == 0
+}
+
+func invalidAuth(msg string) error {
+	return errhandle.NewError(errhandle.E_INVALID_REQUEST, errors.New(msg))
+}
+
+// check returns the error applying req would fail with. Requests are
+// checked before they are proposed and again when they are applied, since
+// the state may have changed in between.
+func (a *authState) check(req *AuthRequest) error {
+	switch req.Op {
+	case AuthEnable:
+		if !a.hasRoot("") {
+			return invalidAuth("auth needs a user with the root role")
+		}
+	case AuthDisable:
+	case AuthPutUser:
+		u := req.User
+		if u == nil || u.Name == "" {
+			return invalidAuth("user name is empty")
+		}
+		if u.Password == "" && a.Users[u.Name] == nil {
+			return invalidAuth("a new user needs a password")
+		}
+		for _, r := range u.Roles {
+			if r != RootRole && a.Roles[r] == nil {
+				return errhandle.NewError(errhandle.E_ROLE_NOT_FOUND, errors.New(r))
+			}
+		}
+		if a.Enabled && !hasRole(u.Roles, RootRole) && !a.hasRoot(u.Name) {
+			return invalidAuth("cannot revoke the root role of the last root user")
+		}
+	case AuthRevokeTokens:
+		if a.Users[req.Name] == nil {
+			return errhandle.NewError(errhandle.E_USER_NOT_FOUND, errors.New(req.Name))
+		}
+	case AuthDeleteUser:
+		if a.Users[req.Name] == nil {
+			return errhandle.NewError(errhandle.E_USER_NOT_FOUND, errors.New(req.Name))
+		}
+		if a.Enabled && !a.hasRoot(req.Name) {
+			return invalidAuth("cannot delete the last root user")
+		}
+	case AuthPutRole:
+		r := req.Role
+		if r == nil || r.Name == "" {
+			return invalidAuth("role name is empty")
+		}
+		if r.Name == RootRole {
+			return invalidAuth("the root role cannot be changed")
+		}
+		for _, p := range r.Permissions {
+			if !strings.HasPrefix(p.Prefix, "/") {
+				return invalidAuth("permission prefixes must start with /")
+			}
+		}
+	case AuthDeleteRole:
+		if req.Name == RootRole {
+			return invalidAuth("the root role cannot be deleted")
+		}
+		if a.Roles[req.Name] == nil {
+			return errhandle.NewError(errhandle.E_ROLE_NOT_FOUND, errors.New(req.Name))
+		}
+	default:
+		return invalidAuth("unknown auth operation " + req.Op)
+	}
+	return nil
+}
+
+// apply applies a request that passed check.
+func (a *authState) apply(req *AuthRequest) {
+	switch req.Op {
+	case AuthEnable:
+		a.Enabled = true
+	case AuthDisable:
+		a.Enabled = false
+	case AuthPutUser:
+		u := *req.User
+		u.Roles = append([]string(nil), u.Roles...)
+		u.TokenGen = 0
+		if old := a.Users[u.Name]; old != nil {
+			u.TokenGen = old.TokenGen
+			if u.Password == "" {
+				u.Password = old.Password
+			} else {
+				u.TokenGen++
+			}
+		}
+		if a.Users == nil {
+			a.Users = make(map[string]*User)
+		}
+		a.Users[u.Name] = &u
+	case AuthRevokeTokens:
+		u := *a.Users[req.Name]
+		u.TokenGen++
+		a.Users[u.Name] = &u
+	case AuthDeleteUser:
+		delete(a.Users, req.Name)
+	case AuthPutRole:
+		r := *req.Role
+		r.Permissions = append([]Permission(nil), r.Permissions...)
+		if a.Roles == nil {
+			a.Roles = make(map[string]*Role)
+		}
+		a.Roles[r.Name] = &r
+	case AuthDeleteRole:
+		delete(a.Roles, req.Name)
+		for name, u := range a.Users {
+			if !hasRole(u.Roles, req.Name) {
+				continue
+			}
+			nu := *u
+			nu.Roles = nil
+			for _, r := range u.Roles {
+				if r != req.Name {
+					nu.Roles = append(nu.Roles, r)
+				}
+			}
+			a.Users[name] = &nu
+		}
+	}
+}
+
+// hasRoot reports whether a user other than except has the root role.
+func (a *authState) hasRoot(except string) bool {
+	for name, u := range a.Users {
+		if name != except && hasRole(u.Roles, RootRole) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *authState) isRoot(user string) bool {
+	u := a.Users[user]
+	return u != nil && hasRole(u.Roles, RootRole)
+}
+
+// ownsLease reports whether user may keep alive, revoke and attach keys to
+// lease l: its owner and root may, and anyone while auth is disabled. An
+// empty user is the store itself, which revokes expired leases.
+func (a *authState) ownsLease(user string, l *Lease) bool {
+	return !a.Enabled || user == "" || user == l.Owner || a.isRoot(user)
+}
+
+// permitted reports whether user may read, or write, key.
+func (a *authState) permitted(user, key string, write bool) bool {
+	return a.permittedRange(user, key, "", write)
+}
+
+// permittedRange reports whether user may read, or write, every key from
+// key up to end excluded, or key alone if end is empty.
+func (a *authState) permittedRange(user, key, end string, write bool) bool {
+	u := a.Users[user]
+	if u == nil {
+		return false
+	}
+	for _, name := range u.Roles {
+		if name == RootRole {
+			return true
+		}
+		r := a.Roles[name]
+		if r == nil {
+			continue
+		}
+		for _, p := range r.Permissions {
+			if !strings.HasPrefix(key, p.Prefix) || (end != "" && end > PrefixEnd(p.Prefix)) {
+				continue
+			}
+			if (write && p.Write) || (!write && p.Read) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *authState) userNames() []string {
+	names := make([]string, 0, len(a.Users))
+	for name := range a.Users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (a *authState) roleNames() []string {
+	names := make([]string, 0, len(a.Roles))
+	for name := range a.Roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,384 @@
+package raftsvr
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/cryptutil"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthCheck(t *testing.T) {
+	a := &authState{}
+	reader := &Role{Name: "reader", Permissions: []Permission{{Prefix: "/pub", Read: true}}}
+	root := &User{Name: "root", Password: "hash", Roles: []string{RootRole}}
+	alice := &User{Name: "alice", Password: "hash", Roles: []string{"reader"}}
+
+	tests := []struct {
+		req   AuthRequest
+		wcode int
+	}{
+		{AuthRequest{Op: AuthEnable}, errhandle.E_INVALID_REQUEST},
+		{AuthRequest{Op: AuthPutUser, User: alice}, errhandle.E_ROLE_NOT_FOUND},
+		{AuthRequest{Op: AuthPutRole, Role: &Role{Name: RootRole}}, errhandle.E_INVALID_REQUEST},
+		{AuthRequest{Op: AuthPutRole, Role: &Role{Name: "bad", Permissions: []Permission{{Prefix: "pub"}}}}, errhandle.E_INVALID_REQUEST},
+		{AuthRequest{Op: AuthPutRole, Role: reader}, 0},
+		{AuthRequest{Op: AuthPutUser, User: alice}, 0},
+		{AuthRequest{Op: AuthPutUser, User: &User{Name: "bob"}}, errhandle.E_INVALID_REQUEST},
+		{AuthRequest{Op: AuthPutUser, User: root}, 0},
+		{AuthRequest{Op: AuthEnable}, 0},
+		{AuthRequest{Op: AuthDeleteUser, Name: "root"}, errhandle.E_INVALID_REQUEST},
+		{AuthRequest{Op: AuthPutUser, User: &User{Name: "root"}}, errhandle.E_INVALID_REQUEST},
+		{AuthRequest{Op: AuthDeleteUser, Name: "bob"}, errhandle.E_USER_NOT_FOUND},
+		{AuthRequest{Op: AuthRevokeTokens, Name: "bob"}, errhandle.E_USER_NOT_FOUND},
+		{AuthRequest{Op: AuthDeleteRole, Name: RootRole}, errhandle.E_INVALID_REQUEST},
+		{AuthRequest{Op: AuthDeleteRole, Name: "reader"}, 0},
+	}
+	for i, tt := range tests {
+		err := a.check(&tt.req)
+		if errhandle.Code(err) != tt.wcode {
+			t.Fatalf("#%d: %s error = %v, want code %d", i, tt.req.Op, err, tt.wcode)
+		}
+		if err == nil {
+			a.apply(&tt.req)
+		}
+	}
+	if !a.Enabled || len(a.Users["alice"].Roles) != 0 || a.Users["root"].Password != "hash" {
+		t.Errorf("state = %+v", a)
+	}
+}
+
+func TestAuthPermitted(t *testing.T) {
+	a := &authState{
+		Users: map[string]*User{
+			"root":  {Name: "root", Roles: []string{RootRole}},
+			"alice": {Name: "alice", Roles: []string{"reader", "writer"}},
+		},
+		Roles: map[string]*Role{
+			"reader": {Name: "reader", Permissions: []Permission{{Prefix: "/pub", Read: true}}},
+			"writer": {Name: "writer", Permissions: []Permission{{Prefix: "/pub/alice", Write: true}}},
+		},
+	}
+	tests := []struct {
+		user, key string
+		write     bool
+		w         bool
+	}{
+		{"root", "/any", true, true},
+		{"alice", "/pub/x", false, true},
+		{"alice", "/pub/x", true, false},
+		{"alice", "/pub/alice/x", true, true},
+		{"alice", "/private", false, false},
+		{"bob", "/pub/x", false, false},
+	}
+	for i, tt := range tests {
+		if g := a.permitted(tt.user, tt.key, tt.write); g != tt.w {
+			t.Errorf("#%d: permitted(%s, %s, %v) = %v, want %v", i, tt.user, tt.key, tt.write, g, tt.w)
+		}
+	}
+}
+
+func TestAuthSnapshot(t *testing.T) {
+	s := newTestKVStore("/foo", "bar")
+	s.auth.apply(&AuthRequest{Op: AuthPutUser, User: &User{Name: "root", Password: "hash", Roles: []string{RootRole}}})
+	s.auth.apply(&AuthRequest{Op: AuthEnable})
+	want := s.auth
+
+	data, err := s.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Kvstore{}
+	if err = r.RecoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.kv, s.kv) {
+		t.Errorf("store = %+v, want %+v", r.kv, s.kv)
+	}
+	if !reflect.DeepEqual(r.auth, want) {
+		t.Errorf("auth = %+v, want %+v", r.auth, want)
+	}
+}
+
+// newTestServer serves a store whose proposals are committed as soon as
+// they are made.
+func newTestServer(t *testing.T) (*HttpKVAPI, *httptest.Server, func()) {
+	bcryptCost = bcrypt.MinCost
+	proposeC := make(chan string)
+	commitC := make(chan *Commit)
+	confChangeC := make(chan raftpb.ConfChange)
+	donec := make(chan struct{})
+	s := &Kvstore{ProposeC: proposeC}
+	go func() {
+		defer close(commitC)
+		var index uint64
+		for {
+			select {
+			case p := <-proposeC:
+				index++
+				commitC <- &Commit{Data: p, Index: index, Term: 1}
+			case cc := <-confChangeC:
+				index++
+				commitC <- &Commit{ConfChange: &cc, Index: index, Term: 1}
+			case <-donec:
+				return
+			}
+		}
+	}()
+	go s.ReadCommits(commitC)
+
+	h := &HttpKVAPI{Store: s, ConfChangeC: confChangeC}
+	srv := httptest.NewServer(h)
+	return h, srv, func() {
+		srv.Close()
+		close(donec)
+	}
+}
+
+func TestServeAuth(t *testing.T) {
+	h, srv, stop := newTestServer(t)
+	defer stop()
+
+	do := func(method, path, token string, body interface{}) (int, []byte) {
+		var b []byte
+		if body != nil {
+			var err error
+			if b, err = json.Marshal(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out bytes.Buffer
+		out.ReadFrom(resp.Body)
+		return resp.StatusCode, out.Bytes()
+	}
+	expect := func(method, path, token string, body interface{}, wcode int) []byte {
+		code, b := do(method, path, token, body)
+		if code != wcode {
+			t.Fatalf("%s %s = %d %s, want %d", method, path, code, b, wcode)
+		}
+		return b
+	}
+	// proposals are answered before they are applied
+	waitApplied := func(cond func(a *authState) bool) {
+		for i := 0; i < 100; i++ {
+			h.Store.Mu.RLock()
+			ok := cond(&h.Store.auth)
+			h.Store.Mu.RUnlock()
+			if ok {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("auth request not applied")
+	}
+	login := func(name, password string) string {
+		var resp AuthenticateResponse
+		b := expect("POST", AuthenticatePath, "", AuthenticateRequest{Name: name, Password: password}, http.StatusOK)
+		if err := json.Unmarshal(b, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Token
+	}
+
+	// everything is allowed until auth is enabled
+	expect("PUT", "/foo", "", nil, http.StatusNoContent)
+	expect("PUT", AuthEnablePath, "", nil, http.StatusBadRequest)
+	expect("PUT", AuthRolesPath+"/reader", "", RoleRequest{Permissions: []Permission{{Prefix: "/pub", Read: true}}}, http.StatusNoContent)
+	waitApplied(func(a *authState) bool { return a.Roles["reader"] != nil })
+	expect("PUT", AuthUsersPath+"/alice", "", UserRequest{Password: "alicepw", Roles: []string{"reader"}}, http.StatusNoContent)
+	expect("PUT", AuthUsersPath+"/root", "", UserRequest{Password: "rootpw", Roles: []string{RootRole}}, http.StatusNoContent)
+	waitApplied(func(a *authState) bool { return a.Users["root"] != nil })
+	expect("PUT", AuthEnablePath, "", nil, http.StatusNoContent)
+	waitApplied(func(a *authState) bool { return a.Enabled })
+
+	expect("GET", "/pub/x", "", nil, http.StatusUnauthorized)
+	expect("GET", MetricsPath, "", nil, http.StatusOK)
+	expect("POST", AuthenticatePath, "", AuthenticateRequest{Name: "alice", Password: "wrong"}, http.StatusUnauthorized)
+
+	alice := login("alice", "alicepw")
+	expect("GET", "/pub/x", alice, nil, http.StatusNotFound)
+	expect("GET", "/foo", alice, nil, http.StatusForbidden)
+	expect("PUT", "/pub/x", alice, nil, http.StatusForbidden)
+	expect("DELETE", MembersPath+"/2", alice, nil, http.StatusForbidden)
+	expect("GET", SnapshotPath, alice, nil, http.StatusForbidden)
+	expect("GET", AuthUsersPath, alice, nil, http.StatusForbidden)
+	expect("GET", "/pub/x", "bogus", nil, http.StatusUnauthorized)
+
+	root := login("root", "rootpw")
+	expect("DELETE", MembersPath+"/2", root, nil, http.StatusNoContent)
+	expect("GET", "/foo", root, nil, http.StatusOK)
+	var users []string
+	if err := json.Unmarshal(expect("GET", AuthUsersPath, root, nil, http.StatusOK), &users); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(users, []string{"alice", "root"}) {
+		t.Errorf("users = %v", users)
+	}
+	expect("DELETE", AuthUsersPath+"/root", root, nil, http.StatusBadRequest)
+
+	// a new password revokes the tokens issued for the old one
+	expect("PUT", AuthUsersPath+"/alice", root, UserRequest{Password: "newpw", Roles: []string{"reader"}}, http.StatusNoContent)
+	waitApplied(func(a *authState) bool {
+		return bcrypt.CompareHashAndPassword([]byte(a.Users["alice"].Password), []byte("newpw")) == nil
+	})
+	expect("GET", "/pub/x", alice, nil, http.StatusUnauthorized)
+
+	// and so does revoking them
+	alice = login("alice", "newpw")
+	expect("DELETE", AuthUsersPath+"/alice/tokens", alice, nil, http.StatusForbidden)
+	expect("GET", AuthUsersPath+"/alice/tokens", root, nil, http.StatusMethodNotAllowed)
+	expect("DELETE", AuthUsersPath+"/bob/tokens", root, nil, http.StatusNotFound)
+	expect("DELETE", AuthUsersPath+"/alice/tokens", root, nil, http.StatusNoContent)
+	waitApplied(func(a *authState) bool { return a.Users["alice"].TokenGen == 2 })
+	expect("GET", "/pub/x", alice, nil, http.StatusUnauthorized)
+	expect("GET", "/pub/x", login("alice", "newpw"), nil, http.StatusNotFound)
+
+	// the CN of a verified client certificate names the user
+	req := httptest.NewRequest("GET", "/foo", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "root"}}}}}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET with root certificate = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	expect("PUT", AuthDisablePath, root, nil, http.StatusNoContent)
+	waitApplied(func(a *authState) bool { return !a.Enabled })
+	expect("PUT", "/foo", "", nil, http.StatusNoContent)
+}
+
+func TestAuthPermittedRange(t *testing.T) {
+	a := &authState{
+		Users: map[string]*User{"alice": {Name: "alice", Roles: []string{"app"}}},
+		Roles: map[string]*Role{"app": {Name: "app", Permissions: []Permission{{Prefix: "/app/", Read: true, Write: true}}}},
+	}
+	tests := []struct {
+		key, end string
+		w        bool
+	}{
+		{"/app/a", "/app/b", true},
+		{"/app/", PrefixEnd("/app/"), true},
+		{"/app/", "/apq", false},
+		{"/ap", "/app/b", false},
+	}
+	for i, tt := range tests {
+		if g := a.permittedRange("alice", tt.key, tt.end, true); g != tt.w {
+			t.Errorf("#%d: permittedRange(%s, %s) = %v, want %v", i, tt.key, tt.end, g, tt.w)
+		}
+	}
+}
+
+func TestAuthToken(t *testing.T) {
+	a := &authState{Users: map[string]*User{"alice": {Name: "alice", Password: "hash", TokenGen: 1}}}
+	keys, other := &memberTokenKeys{}, &memberTokenKeys{}
+	now := time.Now()
+	issue := func(keys *memberTokenKeys, u *User, expires time.Time) string {
+		tok, err := issueToken(keys, u, expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	tok := issue(keys, a.Users["alice"], now.Add(time.Minute))
+
+	tests := []struct {
+		token string
+		now   time.Time
+		w     bool
+	}{
+		{tok, now, true},
+		{tok, now.Add(time.Minute), false},
+		{issue(other, a.Users["alice"], now.Add(time.Minute)), now, false},
+		{issue(keys, &User{Name: "alice"}, now.Add(time.Minute)), now, false},
+		{issue(keys, &User{Name: "bob", TokenGen: 1}, now.Add(time.Minute)), now, false},
+		{tok[:len(tok)-1], now, false},
+		{"alice", now, false},
+	}
+	for i, tt := range tests {
+		if user, ok := a.tokenUser(keys, tt.token, tt.now); ok != tt.w || (ok && user != "alice") {
+			t.Errorf("#%d: tokenUser = %q, %v; want %v", i, user, ok, tt.w)
+		}
+	}
+
+	a.apply(&AuthRequest{Op: AuthRevokeTokens, Name: "alice"})
+	if _, ok := a.tokenUser(keys, tok, now); ok {
+		t.Error("revoked token accepted")
+	}
+}
+
+// staticKeys signs with its only key.
+type staticKeys map[string][]byte
+
+func (k staticKeys) CurrentKey() (string, []byte, error) {
+	for id, key := range k {
+		return id, key, nil
+	}
+	return "", nil, cryptutil.ErrNoKey
+}
+
+func (k staticKeys) Key(id string) ([]byte, error) {
+	if key, ok := k[id]; ok {
+		return key, nil
+	}
+	return nil, cryptutil.ErrKeyNotFound
+}
+
+// TestAuthTokenBackup checks that what a backup holds cannot be used to
+// forge a token.
+func TestAuthTokenBackup(t *testing.T) {
+	s := newTestKVStore()
+	s.auth.apply(&AuthRequest{Op: AuthPutUser, User: &User{Name: "root", Password: "hash", Roles: []string{RootRole}}})
+	s.auth.apply(&AuthRequest{Op: AuthEnable})
+	h := &HttpKVAPI{Store: s}
+	data, err := s.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a member restored from the backup signs with keys of its own
+	r := &Kvstore{}
+	if err = r.RecoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	restored := &HttpKVAPI{Store: r}
+	u := r.auth.Users["root"]
+	forged, err := issueToken(restored.tokenKeys(), u, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// and the password hash is no key
+	hashed, err := issueToken(staticKeys{memberKeyID: []byte(u.Password)}, u, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tok := range []string{forged, hashed} {
+		req := httptest.NewRequest("GET", "/foo", nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		if _, err := h.authenticate(req); err == nil {
+			t.Errorf("token %q forged from a backup accepted", tok)
+		}
+	}
+}
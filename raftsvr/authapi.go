@@ -0,0 +1,481 @@
+package raftsvr
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/cryptutil"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Auth paths. The keys starting with AuthPathPrefix are reserved for them.
+const (
+	AuthPathPrefix = "/auth/"
+	// AuthenticatePath returns a bearer token for the user and password of
+	// an AuthenticateRequest.
+	AuthenticatePath = "/auth/authenticate"
+	// AuthStatusPath tells whether auth is enabled.
+	AuthStatusPath = "/auth/status"
+	// AuthEnablePath and AuthDisablePath turn auth on and off on PUT.
+	AuthEnablePath  = "/auth/enable"
+	AuthDisablePath = "/auth/disable"
+	// AuthUsersPath lists the users; AuthUsersPath/<name> serves a user on
+	// GET, PUT (a UserRequest) and DELETE, and a DELETE of
+	// AuthUsersPath/<name>/tokens revokes the tokens of the user.
+	AuthUsersPath = "/auth/users"
+	// AuthRolesPath lists the roles; AuthRolesPath/<name> serves a role on
+	// GET, PUT (a RoleRequest) and DELETE.
+	AuthRolesPath = "/auth/roles"
+)
+
+// tokenTTL is how long a bearer token stays valid after it is issued.
+const tokenTTL = 10 * time.Minute
+
+// bcryptCost is the cost of the password hashes, lowered by tests.
+var bcryptCost = bcrypt.DefaultCost
+
+type AuthenticateRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type AuthenticateResponse struct {
+	Token string `json:"token"`
+}
+
+type AuthStatus struct {
+	Enabled bool `json:"enabled"`
+}
+
+// UserRequest creates or replaces a user. Password may be left empty to
+// keep the password of an existing user; Roles replaces its roles.
+type UserRequest struct {
+	Password string   `json:"password,omitempty"`
+	Roles    []string `json:"roles"`
+}
+
+// UserResponse describes a user, without its password.
+type UserResponse struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// RoleRequest creates or replaces a role.
+type RoleRequest struct {
+	Permissions []Permission `json:"permissions"`
+}
+
+var (
+	errAuthFailed       = errhandle.NewError(errhandle.E_AUTH_FAILED, nil)
+	errPermissionDenied = errhandle.NewError(errhandle.E_PERMISSION_DENIED, nil)
+)
+
+// memberKeyID is the ID of the token key of a member without TokenKeys.
+const memberKeyID = "member"
+
+// memberTokenKeys is the token key of a member without TokenKeys: a random
+// key of its own, generated when it is first needed and lost on restart.
+type memberTokenKeys struct {
+	once sync.Once
+	key  []byte
+	err  error
+}
+
+func (k *memberTokenKeys) CurrentKey() (string, []byte, error) {
+	k.once.Do(func() {
+		k.key = make([]byte, 32)
+		_, k.err = rand.Read(k.key)
+	})
+	return memberKeyID, k.key, k.err
+}
+
+func (k *memberTokenKeys) Key(id string) ([]byte, error) {
+	if id != memberKeyID {
+		return nil, cryptutil.ErrKeyNotFound
+	}
+	_, key, err := k.CurrentKey()
+	return key, err
+}
+
+// tokenKeys returns the keys the tokens of h are signed with.
+func (h *HttpKVAPI) tokenKeys() cryptutil.KeyProvider {
+	if h.TokenKeys != nil {
+		return h.TokenKeys
+	}
+	return &h.memberKeys
+}
+
+// issueToken returns a bearer token of user u valid until expires. A token
+// is "<user>.<generation>.<expiry>.<key id>.<signature>", with the user
+// name and the key ID in base64, the expiry in Unix seconds, and an HMAC
+// signature with the current key of keys. The keys are kept out of the
+// replicated state, so that its WAL, snapshots and backups cannot forge
+// tokens; the generation is the TokenGen of the user, so that a new
+// password or AuthRevokeTokens revokes the tokens issued before.
+func issueToken(keys cryptutil.KeyProvider, u *User, expires time.Time) (string, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return "", err
+	}
+	payload := strings.Join([]string{
+		base64.RawURLEncoding.EncodeToString([]byte(u.Name)),
+		strconv.FormatUint(u.TokenGen, 10),
+		strconv.FormatInt(expires.Unix(), 10),
+		base64.RawURLEncoding.EncodeToString([]byte(id)),
+	}, ".")
+	return payload + "." + tokenSignature(key, payload), nil
+}
+
+func tokenSignature(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// tokenUser returns the user of token t if it is signed with one of keys
+// and valid for the users of a at now.
+func (a *authState) tokenUser(keys cryptutil.KeyProvider, t string, now time.Time) (string, bool) {
+	parts := strings.Split(t, ".")
+	if len(parts) != 5 {
+		return "", false
+	}
+	id, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", false
+	}
+	key, err := keys.Key(string(id))
+	if err != nil {
+		return "", false
+	}
+	payload := strings.Join(parts[:4], ".")
+	if !hmac.Equal([]byte(parts[4]), []byte(tokenSignature(key, payload))) {
+		return "", false
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	gen, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	exp, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || now.Unix() >= exp {
+		return "", false
+	}
+	u := a.Users[string(name)]
+	if u == nil || u.TokenGen != gen {
+		return "", false
+	}
+	return u.Name, true
+}
+
+// permission is what a request needs from its user while auth is enabled.
+type permission int
+
+const (
+	permNone permission = iota
+	permRead
+	permWrite
+	permRoot
+)
+
+// requiredPermission returns the permission of a request on the key-value
+// API. Metrics, stats, log levels, revisions and members can be read by
+// anyone.
+func requiredPermission(method, key string) permission {
+	switch method {
+	case "GET":
+		switch key {
+		case MetricsPath, StatsSelfPath, StatsLeaderPath, LogLevelPath, CompactionPath, MembersPath:
+			return permNone
+		}
+		return permRead
+	case "PUT":
+		if key == LogLevelPath || key == CompactionPath {
+			return permRoot
+		}
+		return permWrite
+	case "POST":
+		// only TxnPath, checked for each key of the txn
+		return permNone
+	case "DELETE":
+		return permWrite
+	}
+	return permNone
+}
+
+// authenticate returns the user of r: the owner of its bearer token or,
+// without an Authorization header, the user named by the CN of its verified
+// TLS client certificate.
+func (h *HttpKVAPI) authenticate(r *http.Request) (string, error) {
+	h.Store.Mu.RLock()
+	defer h.Store.Mu.RUnlock()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return "", errAuthFailed
+		}
+		user, ok := h.Store.auth.tokenUser(h.tokenKeys(), strings.TrimPrefix(auth, "Bearer "), time.Now())
+		if !ok {
+			return "", errAuthFailed
+		}
+		return user, nil
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if h.Store.auth.Users[cn] != nil {
+			return cn, nil
+		}
+	}
+	return "", errAuthFailed
+}
+
+// authorize fails unless the user of r has permission p on key. Every
+// request is allowed while auth is disabled.
+func (h *HttpKVAPI) authorize(r *http.Request, key string, p permission) error {
+	if p == permNone {
+		return nil
+	}
+	return h.authorizeFunc(r, func(a *authState, user string) bool {
+		if p == permRoot {
+			return a.isRoot(user)
+		}
+		return a.permitted(user, key, p == permWrite)
+	})
+}
+
+// authorizeTxn fails unless the user of r may read the keys compared and
+// read by txn, and write the keys it writes.
+func (h *HttpKVAPI) authorizeTxn(r *http.Request, txn *Txn) error {
+	return h.authorizeFunc(r, func(a *authState, user string) bool {
+		for _, c := range txn.Compare {
+			if !a.permitted(user, c.Key, false) {
+				return false
+			}
+		}
+		for _, ops := range [][]Op{txn.Success, txn.Failure} {
+			for _, op := range ops {
+				if !a.permittedRange(user, op.Key, op.RangeEnd, op.Type != OpGet) {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+// userKey is the context key of the user of the requests proposed to the
+// store.
+type userKey struct{}
+
+// withUser returns ctx with the user of r while auth is enabled, so that
+// the store checks the requests it proposes for r against that user again
+// when they are applied.
+func (h *HttpKVAPI) withUser(ctx context.Context, r *http.Request) (context.Context, error) {
+	if !h.authEnabled() {
+		return ctx, nil
+	}
+	user, err := h.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	return context.WithValue(ctx, userKey{}, user), nil
+}
+
+// authorizeFunc fails unless allowed returns true for the user of r. Every
+// request is allowed while auth is disabled.
+func (h *HttpKVAPI) authorizeFunc(r *http.Request, allowed func(a *authState, user string) bool) error {
+	if !h.authEnabled() {
+		return nil
+	}
+	user, err := h.authenticate(r)
+	if err != nil {
+		return err
+	}
+	h.Store.Mu.RLock()
+	defer h.Store.Mu.RUnlock()
+	if !allowed(&h.Store.auth, user) {
+		return errPermissionDenied
+	}
+	return nil
+}
+
+func (h *HttpKVAPI) authEnabled() bool {
+	h.Store.Mu.RLock()
+	defer h.Store.Mu.RUnlock()
+	return h.Store.auth.Enabled
+}
+
+// serveAuth serves the paths under AuthPathPrefix. All of them but
+// AuthenticatePath and AuthStatusPath need the root role once auth is
+// enabled.
+func (h *HttpKVAPI) serveAuth(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case path == AuthenticatePath && r.Method == "POST":
+		h.serveAuthenticate(w, r)
+		return
+	case path == AuthStatusPath && r.Method == "GET":
+		h.Store.Mu.RLock()
+		st := AuthStatus{Enabled: h.Store.auth.Enabled}
+		h.Store.Mu.RUnlock()
+		writeJSON(w, st)
+		return
+	}
+	if err := h.authorize(r, path, permRoot); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	switch {
+	case path == AuthEnablePath && r.Method == "PUT":
+		h.proposeAuth(w, r, &AuthRequest{Op: AuthEnable})
+	case path == AuthDisablePath && r.Method == "PUT":
+		h.proposeAuth(w, r, &AuthRequest{Op: AuthDisable})
+	case path == AuthUsersPath && r.Method == "GET":
+		h.Store.Mu.RLock()
+		names := h.Store.auth.userNames()
+		h.Store.Mu.RUnlock()
+		writeJSON(w, names)
+	case path == AuthRolesPath && r.Method == "GET":
+		h.Store.Mu.RLock()
+		names := h.Store.auth.roleNames()
+		h.Store.Mu.RUnlock()
+		writeJSON(w, names)
+	case strings.HasPrefix(path, AuthUsersPath+"/"):
+		h.serveUser(w, r, strings.TrimPrefix(path, AuthUsersPath+"/"))
+	case strings.HasPrefix(path, AuthRolesPath+"/"):
+		h.serveRole(w, r, strings.TrimPrefix(path, AuthRolesPath+"/"))
+	default:
+		writeError(w, errhandle.NewError(errhandle.E_METHOD_NOT_ALLOWED, nil))
+	}
+}
+
+func (h *HttpKVAPI) serveAuthenticate(w http.ResponseWriter, r *http.Request) {
+	var req AuthenticateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, err))
+		return
+	}
+	h.Store.Mu.RLock()
+	u := h.Store.auth.Users[req.Name]
+	h.Store.Mu.RUnlock()
+	if u == nil || bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(req.Password)) != nil {
+		kvLog.Warn("authentication failed", map[string]interface{}{
+			"user": req.Name,
+		})
+		writeError(w, errAuthFailed)
+		return
+	}
+	token, err := issueToken(h.tokenKeys(), u, time.Now().Add(tokenTTL))
+	if err != nil {
+		writeError(w, errhandle.NewError(errhandle.E_INTERNAL, err))
+		return
+	}
+	writeJSON(w, AuthenticateResponse{Token: token})
+}
+
+func (h *HttpKVAPI) serveUser(w http.ResponseWriter, r *http.Request, name string) {
+	if strings.HasSuffix(name, "/tokens") {
+		if r.Method != "DELETE" {
+			writeError(w, errhandle.NewError(errhandle.E_METHOD_NOT_ALLOWED, nil))
+			return
+		}
+		h.proposeAuth(w, r, &AuthRequest{Op: AuthRevokeTokens, Name: strings.TrimSuffix(name, "/tokens")})
+		return
+	}
+	switch r.Method {
+	case "GET":
+		h.Store.Mu.RLock()
+		u := h.Store.auth.Users[name]
+		h.Store.Mu.RUnlock()
+		if u == nil {
+			writeError(w, errhandle.NewError(errhandle.E_USER_NOT_FOUND, nil))
+			return
+		}
+		writeJSON(w, UserResponse{Name: u.Name, Roles: u.Roles})
+	case "PUT":
+		var req UserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, err))
+			return
+		}
+		u := &User{Name: name, Roles: req.Roles}
+		if req.Password != "" {
+			hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptCost)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			u.Password = string(hash)
+		}
+		h.proposeAuth(w, r, &AuthRequest{Op: AuthPutUser, User: u})
+	case "DELETE":
+		h.proposeAuth(w, r, &AuthRequest{Op: AuthDeleteUser, Name: name})
+	default:
+		writeError(w, errhandle.NewError(errhandle.E_METHOD_NOT_ALLOWED, nil))
+	}
+}
+
+func (h *HttpKVAPI) serveRole(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case "GET":
+		h.Store.Mu.RLock()
+		role := h.Store.auth.Roles[name]
+		h.Store.Mu.RUnlock()
+		if role == nil {
+			writeError(w, errhandle.NewError(errhandle.E_ROLE_NOT_FOUND, nil))
+			return
+		}
+		writeJSON(w, role)
+	case "PUT":
+		var req RoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, err))
+			return
+		}
+		h.proposeAuth(w, r, &AuthRequest{Op: AuthPutRole, Role: &Role{Name: name, Permissions: req.Permissions}})
+	case "DELETE":
+		h.proposeAuth(w, r, &AuthRequest{Op: AuthDeleteRole, Name: name})
+	default:
+		writeError(w, errhandle.NewError(errhandle.E_METHOD_NOT_ALLOWED, nil))
+	}
+}
+
+// proposeAuth checks req against the current auth state and proposes it.
+// Like key-value PUTs, it answers before the request is committed.
+func (h *HttpKVAPI) proposeAuth(w http.ResponseWriter, r *http.Request, req *AuthRequest) {
+	h.Store.Mu.RLock()
+	err := h.Store.auth.check(req)
+	h.Store.Mu.RUnlock()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err = h.Store.ProposeAuth(r.Context(), req); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,236 @@
+package raftsvr
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"sort"
+
+	"github.com/fearblackcat/swiftRaft/utils/api/snap"
+)
+
+const (
+	// chunkBoundary ends a chunk of a snapshot after the keys whose hash is
+	// a multiple of it, so that a chunk holds chunkBoundary keys on
+	// average and its bounds depend on its own keys only: a write changes
+	// the chunk of its key, not the chunks after it.
+	chunkBoundary = 512
+	// maxChunkBytes ends a chunk that grew beyond it before a boundary.
+	maxChunkBytes = 4 * 1024 * 1024
+)
+
+// keyChunk is a chunk of the keys of the last chunked snapshot, by its
+// first key.
+type keyChunk struct {
+	last string
+	ref  snap.ChunkRef
+}
+
+// SnapshotChunks saves the store in chunks with its Snapshotter, and
+// returns the data of a chunked snapshot: the snap.Manifest naming them.
+// The first chunk holds the store but its keys, and the next ones hold the
+// keys in order. The chunks whose keys were not written since the last call
+// are neither marshaled nor saved again. Without a Snapshotter, it returns
+// GetSnapshot.
+func (s *Kvstore) SnapshotChunks() ([]byte, error) {
+	view, err := s.SnapshotView()
+	if err != nil {
+		return nil, err
+	}
+	return view()
+}
+
+// SnapshotView takes a point-in-time view of the store, and returns the
+// function that saves it as SnapshotChunks does. It holds Mu only to take
+// the view, so that the store goes on applying while the view is saved:
+// the keys are shared with the store, which copies them before its next
+// write. The function must be called once, and before the next view is
+// taken.
+func (s *Kvstore) SnapshotView() (func() ([]byte, error), error) {
+	if s.Snapshotter == nil {
+		data, err := s.GetSnapshot()
+		return func() ([]byte, error) { return data, err }, nil
+	}
+	s.snapMu.Lock()
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	meta := kvSnapshot{KV: &mvccStore{Rev: s.kv.Rev, Compacted: s.kv.Compacted}, Leases: s.leases, Sessions: s.sessions, Members: s.members}
+	if !s.auth.empty() {
+		meta.Auth = &s.auth
+	}
+	b, err := json.Marshal(&meta)
+	if err != nil {
+		s.snapMu.Unlock()
+		return nil, err
+	}
+	v := &snapshotView{s: s, meta: b, keys: s.kv.Keys, changed: s.kv.changed}
+	s.kv.changed = make(map[string]struct{})
+	s.kv.shared = true
+	return v.save, nil
+}
+
+// snapshotView is a point-in-time view of a Kvstore, saved in chunks.
+type snapshotView struct {
+	s    *Kvstore
+	meta []byte                // the store but its keys, in JSON
+	keys map[string][]KeyValue // shared with the store until its next write
+	// changed holds the keys written since the last chunked snapshot; nil
+	// if any key may have changed.
+	changed map[string]struct{}
+}
+
+func (v *snapshotView) save() (data []byte, err error) {
+	s := v.s
+	defer s.snapMu.Unlock()
+	defer func() {
+		s.Mu.Lock()
+		// the store owns its keys again, unless it copied them already or
+		// recovered others from a snapshot
+		s.kv.shared = false
+		if err != nil {
+			// the writes since the last chunked snapshot are forgotten
+			s.kv.changed, s.chunks = nil, nil
+		}
+		s.Mu.Unlock()
+	}()
+
+	cache := s.chunks
+	if v.changed == nil {
+		cache = nil
+	}
+	s.chunks = make(map[string]keyChunk)
+	dirty := make([]string, 0, len(v.changed))
+	for k := range v.changed {
+		dirty = append(dirty, k)
+	}
+	sort.Strings(dirty)
+
+	ref, err := s.Snapshotter.SaveChunk(v.meta)
+	if err != nil {
+		return nil, err
+	}
+	m := snap.Manifest{Chunks: []snap.ChunkRef{ref}}
+
+	keys := make([]string, 0, len(v.keys))
+	for k := range v.keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i := 0; i < len(keys); {
+		j, size := i, 0
+		for j < len(keys) {
+			size += chunkKeyBytes(v.keys[keys[j]])
+			j++
+			if size >= maxChunkBytes || isChunkBoundary(keys[j-1]) {
+				break
+			}
+		}
+		first, last := keys[i], keys[j-1]
+		// a cached chunk is kept from PurgeChunks, or saved again if it
+		// was purged
+		if c, ok := cache[first]; ok && c.last == last && !changedIn(dirty, first, last) && s.Snapshotter.KeepChunk(c.ref) {
+			ref = c.ref
+		} else {
+			part := make(map[string][]KeyValue, j-i)
+			for _, k := range keys[i:j] {
+				part[k] = v.keys[k]
+			}
+			b, err := json.Marshal(part)
+			if err != nil {
+				return nil, err
+			}
+			if ref, err = s.Snapshotter.SaveChunk(b); err != nil {
+				return nil, err
+			}
+		}
+		s.chunks[first] = keyChunk{last: last, ref: ref}
+		m.Chunks = append(m.Chunks, ref)
+		i = j
+	}
+	if err = s.Snapshotter.SyncChunks(); err != nil {
+		return nil, err
+	}
+	return m.Marshal(), nil
+}
+
+func isChunkBoundary(key string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()%chunkBoundary == 0
+}
+
+// chunkKeyBytes estimates the bytes versions take in a chunk.
+func chunkKeyBytes(versions []KeyValue) int {
+	n := 0
+	for _, kv := range versions {
+		n += 2*len(kv.Key) + len(kv.Value) + 100
+	}
+	return n
+}
+
+// changedIn reports whether a key of the sorted dirty is within [first,
+// last].
+func changedIn(dirty []string, first, last string) bool {
+	i := sort.SearchStrings(dirty, first)
+	return i < len(dirty) && dirty[i] <= last
+}
+
+// recoverFromChunks reads the store from the chunks of a chunked snapshot.
+func (s *Kvstore) recoverFromChunks(data []byte) error {
+	snapshot, err := s.readChunks(data)
+	if err != nil {
+		return err
+	}
+	s.restore(*snapshot.KV, *snapshot.Auth, snapshot.Leases, snapshot.Sessions, snapshot.Members)
+	return nil
+}
+
+// ExpandSnapshot returns the data of a chunked snapshot in the format of
+// GetSnapshot, for the members from before chunked snapshots.
+func (s *Kvstore) ExpandSnapshot(data []byte) ([]byte, error) {
+	snapshot, err := s.readChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.Auth.empty() {
+		snapshot.Auth = nil
+	}
+	return json.Marshal(snapshot)
+}
+
+// readChunks reads the chunks of a chunked snapshot.
+func (s *Kvstore) readChunks(data []byte) (*kvSnapshot, error) {
+	if s.Snapshotter == nil {
+		return nil, errors.New("raftsvr: chunked snapshot without a snapshotter")
+	}
+	m, err := snap.ParseManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Chunks) == 0 {
+		return nil, errors.New("raftsvr: chunked snapshot without chunks")
+	}
+	b, err := s.Snapshotter.ReadChunk(m.Chunks[0])
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &kvSnapshot{KV: &mvccStore{}, Auth: &authState{}}
+	if err = json.Unmarshal(b, snapshot); err != nil {
+		return nil, err
+	}
+	snapshot.KV.Keys = make(map[string][]KeyValue)
+	for _, c := range m.Chunks[1:] {
+		if b, err = s.Snapshotter.ReadChunk(c); err != nil {
+			return nil, err
+		}
+		var part map[string][]KeyValue
+		if err = json.Unmarshal(b, &part); err != nil {
+			return nil, err
+		}
+		for k, vs := range part {
+			snapshot.KV.Keys[k] = vs
+		}
+	}
+	return snapshot, nil
+}
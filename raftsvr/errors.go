@@ -0,0 +1,69 @@
+package raftsvr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/fearblackcat/swiftRaft/raft"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+// apiError returns err as an *errhandle.Error, giving the raft errors that
+// can reach a request their own code.
+func apiError(err error) *errhandle.Error {
+	if e, ok := err.(*errhandle.Error); ok {
+		return e
+	}
+	code := errhandle.E_INTERNAL
+	switch err {
+	case raft.ErrProposalDropped:
+		code = errhandle.E_PROPOSAL_DROPPED
+	case raft.ErrStopped:
+		code = errhandle.E_STOPPED
+	case raft.ErrCompacted:
+		code = errhandle.E_COMPACTED
+	case raft.ErrSnapOutOfDate:
+		code = errhandle.E_SNAPSHOT_OUT_OF_DATE
+	case context.DeadlineExceeded, context.Canceled:
+		code = errhandle.E_TIMEOUT
+	}
+	return errhandle.NewError(code, err)
+}
+
+// writeError writes err as a JSON error body with the status of its code.
+func writeError(w http.ResponseWriter, err error) {
+	e := apiError(err)
+	status := errhandle.HTTPStatus(e.Code)
+	if status == http.StatusInternalServerError {
+		kvLog.Warn("request failed", map[string]interface{}{
+			"error": e,
+		})
+	}
+	if e.Code == errhandle.E_TOO_MANY_REQUESTS {
+		w.Header().Set("Retry-After", strconv.Itoa(overloadRetryAfter))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e.Body())
+}
+
+// DecodeError returns the error of a key-value API response, an
+// *errhandle.Error if its body carries one, or nil if it succeeded.
+func DecodeError(resp *http.Response) error {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var body errhandle.Body
+	if err = json.Unmarshal(b, &body); err != nil || body.ErrorCode == 0 {
+		return fmt.Errorf("unexpected status %s: %q", resp.Status, b)
+	}
+	return body.Err()
+}
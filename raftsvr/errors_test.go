@@ -0,0 +1,69 @@
+package raftsvr
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fearblackcat/swiftRaft/raft"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		err   error
+		wcode int
+	}{
+		{raft.ErrProposalDropped, errhandle.E_PROPOSAL_DROPPED},
+		{raft.ErrStopped, errhandle.E_STOPPED},
+		{raft.ErrCompacted, errhandle.E_COMPACTED},
+		{raft.ErrSnapOutOfDate, errhandle.E_SNAPSHOT_OUT_OF_DATE},
+		{context.DeadlineExceeded, errhandle.E_TIMEOUT},
+		{errhandle.NewError(errhandle.E_CAS_MISMATCH, nil), errhandle.E_CAS_MISMATCH},
+		{errors.New("boom"), errhandle.E_INTERNAL},
+	}
+	for i, tt := range tests {
+		if code := apiError(tt.err).Code; code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, code, tt.wcode)
+		}
+	}
+}
+
+func TestWriteAndDecodeError(t *testing.T) {
+	e := errhandle.NewError(errhandle.E_NOT_LEADER, errors.New("lost election"))
+	e.Leader = "8e9e05c52164694d"
+	rec := httptest.NewRecorder()
+	writeError(rec, e)
+
+	resp := rec.Result()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	err := DecodeError(resp)
+	got, ok := err.(*errhandle.Error)
+	if !ok {
+		t.Fatalf("error = %v, want *errhandle.Error", err)
+	}
+	if got.Code != e.Code || got.Leader != e.Leader || got.Cause == nil || got.Cause.Error() != "lost election" {
+		t.Errorf("error = %+v, want %+v", got, e)
+	}
+}
+
+func TestDecodeErrorNotJSON(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusBadGateway,
+		Status:     "502 Bad Gateway",
+		Body:       ioutil.NopCloser(strings.NewReader("upstream down")),
+	}
+	err := DecodeError(resp)
+	if err == nil || errhandle.Code(err) != 0 {
+		t.Errorf("error = %v, want a plain error", err)
+	}
+	if err := DecodeError(&http.Response{StatusCode: http.StatusNoContent}); err != nil {
+		t.Errorf("error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,109 @@
+package raftsvr
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+// Modes of HttpKVAPI.Forward, which say what a follower does with the
+// requests that write to the replicated state.
+const (
+	// ForwardLocal proposes them on the follower, which leaves forwarding
+	// the proposals to raft.
+	ForwardLocal = ""
+	// ForwardRedirect answers them with a 307 to the same path on the
+	// client URL of the leader.
+	ForwardRedirect = "redirect"
+	// ForwardProxy sends them to the leader and relays its response.
+	ForwardProxy = "proxy"
+)
+
+// ForwardedHeader marks the requests proxied to the leader, with the ID of
+// the member they were proxied by. They are never forwarded again, so that
+// members that disagree on the leader cannot pass a request around.
+const ForwardedHeader = "X-Forwarded-By"
+
+// noLeaderRetryAfter is the Retry-After of the responses to writes made
+// while the cluster has no leader, in seconds.
+const noLeaderRetryAfter = 1
+
+// isWrite tells whether r changes the replicated state. The log levels and
+// the authentication of users belong to each member.
+func isWrite(r *http.Request) bool {
+	switch r.Method {
+	case "PUT", "POST", "DELETE":
+	default:
+		return false
+	}
+	switch r.URL.Path {
+	case LogLevelPath, AuthenticatePath:
+		return false
+	}
+	return true
+}
+
+// forward sends a write made on a follower to the leader as configured by
+// h.Forward, or fails it while there is no leader. It returns false if r
+// is to be served here.
+func (h *HttpKVAPI) forward(w http.ResponseWriter, r *http.Request) bool {
+	if h.ServerStats == nil || !isWrite(r) || h.ServerStats.IsLeader() {
+		return false
+	}
+	leader := h.ServerStats.Leader()
+	if leader == "" {
+		writeNoLeader(w)
+		return true
+	}
+	if h.Forward == ForwardLocal || r.Header.Get(ForwardedHeader) != "" {
+		return false
+	}
+	id, err := strconv.ParseUint(leader, 16, 64)
+	if err != nil {
+		writeError(w, errhandle.NewError(errhandle.E_INTERNAL, err))
+		return true
+	}
+	m, ok := h.Store.Member(id)
+	if !ok {
+		// the leader has not published its client URL yet
+		writeNoLeader(w)
+		return true
+	}
+	target, err := url.Parse(m.ClientURL)
+	if err != nil {
+		writeError(w, errhandle.NewError(errhandle.E_INTERNAL, err))
+		return true
+	}
+	switch h.Forward {
+	case ForwardRedirect:
+		u := *target
+		u.Path, u.RawPath, u.RawQuery = r.URL.Path, r.URL.RawPath, r.URL.RawQuery
+		http.Redirect(w, r, u.String(), http.StatusTemporaryRedirect)
+	case ForwardProxy:
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.Transport = h.ProxyTransport
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			kvLog.Warn("failed to proxy request to the leader", map[string]interface{}{
+				"leader": leader,
+				"url":    m.ClientURL,
+				"error":  err,
+			})
+			writeNoLeader(w)
+		}
+		r.Header.Set(ForwardedHeader, h.ServerStats.ID)
+		proxy.ServeHTTP(w, r)
+	default:
+		return false
+	}
+	return true
+}
+
+// writeNoLeader fails a write made while the cluster has no leader, or none
+// this member can reach.
+func writeNoLeader(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(noLeaderRetryAfter))
+	writeError(w, errhandle.NewError(errhandle.E_NO_LEADER, nil))
+}
@@ -0,0 +1,208 @@
+package raftsvr
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	stats "github.com/fearblackcat/swiftRaft/utils/api/v2stats"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+func TestForward(t *testing.T) {
+	var (
+		gotBody      string
+		gotForwarded string
+	)
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		gotBody, gotForwarded = string(b), r.Header.Get(ForwardedHeader)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer leader.Close()
+
+	store := newTestKVStore("/foo", "bar")
+	store.members = map[uint64]*Member{1: {ID: 1, Name: "n1", ClientURL: leader.URL}}
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	tests := []struct {
+		forward string
+		leader  string
+		method  string
+		path    string
+		header  string
+
+		wstatus   int
+		wlocation string
+		wproxied  bool
+	}{
+		// no leader: writes fail, reads and member-local writes are served
+		{ForwardRedirect, "", "PUT", "/foo", "", http.StatusServiceUnavailable, "", false},
+		{ForwardLocal, "", "DELETE", "/foo", "", http.StatusServiceUnavailable, "", false},
+		{ForwardRedirect, "", "GET", "/foo", "", http.StatusOK, "", false},
+		{ForwardRedirect, "", "PUT", LogLevelPath, "", http.StatusBadRequest, "", false},
+		// the leader has not published its URL
+		{ForwardRedirect, "3", "PUT", "/foo", "", http.StatusServiceUnavailable, "", false},
+		{ForwardRedirect, "1", "PUT", "/foo?prevValue=bar", "", http.StatusTemporaryRedirect, leader.URL + "/foo?prevValue=bar", false},
+		{ForwardRedirect, "1", "GET", "/foo", "", http.StatusOK, "", false},
+		{ForwardProxy, "1", "PUT", "/foo", "", http.StatusNoContent, "", true},
+		{ForwardProxy, "1", "POST", TxnPath, "", http.StatusNoContent, "", true},
+		// proxied once already, or left to raft: proposed here
+		{ForwardProxy, "1", "PUT", "/foo", "3", http.StatusNoContent, "", false},
+		{ForwardLocal, "1", "PUT", "/foo", "", http.StatusNoContent, "", false},
+	}
+	for i, tt := range tests {
+		ss := stats.NewServerStats("n2", "2")
+		ss.FollowLeader(tt.leader)
+		srv := httptest.NewServer(&HttpKVAPI{Store: store, ServerStats: ss, Forward: tt.forward})
+		gotBody, gotForwarded = "", ""
+
+		req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader("baz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.header != "" {
+			req.Header.Set(ForwardedHeader, tt.header)
+		}
+		resp, err := noRedirect.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		srv.Close()
+		if resp.StatusCode != tt.wstatus {
+			t.Errorf("#%d: %s %s = %d, want %d", i, tt.method, tt.path, resp.StatusCode, tt.wstatus)
+		}
+		if g := resp.Header.Get("Location"); g != tt.wlocation {
+			t.Errorf("#%d: location = %q, want %q", i, g, tt.wlocation)
+		}
+		if tt.wstatus == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") == "" {
+			t.Errorf("#%d: no Retry-After", i)
+		}
+		if proxied := gotBody != ""; proxied != tt.wproxied {
+			t.Errorf("#%d: proxied = %v, want %v", i, proxied, tt.wproxied)
+		}
+		if tt.wproxied && (gotBody != "baz" || gotForwarded != "2") {
+			t.Errorf("#%d: leader got %q forwarded by %q, want baz by 2", i, gotBody, gotForwarded)
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	h, srv, stop := newTestServer(t)
+	defer stop()
+	s := h.Store
+	ctx := context.Background()
+
+	if err := s.Publish(ctx, Member{ID: 1}); errhandle.Code(err) != errhandle.E_INVALID_REQUEST {
+		t.Errorf("publish without URL error = %v, want code %d", err, errhandle.E_INVALID_REQUEST)
+	}
+	for _, m := range []Member{
+		{ID: 2, Name: "n2", ClientURL: "http://b"},
+		{ID: 1, Name: "n1", ClientURL: "http://a"},
+		{ID: 2, Name: "n2", ClientURL: "http://c"},
+	} {
+		if err := s.Publish(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m, ok := s.Member(2); !ok || m.ClientURL != "http://c" {
+		t.Errorf("member 2 = %+v, %v; want the last URL published", m, ok)
+	}
+
+	data, err := s.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r Kvstore
+	if err = r.RecoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if ms := r.Members(); len(ms) != 2 || ms[0].ID != 1 || ms[1].ClientURL != "http://c" {
+		t.Errorf("recovered members = %+v", ms)
+	}
+
+	resp, err := http.Get(srv.URL + MembersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(b), `"clientURL":"http://a"`) {
+		t.Errorf("GET %s = %d %s", MembersPath, resp.StatusCode, b)
+	}
+}
+
+func TestServeMemberChanges(t *testing.T) {
+	commitC := make(chan *Commit)
+	defer close(commitC)
+	confChangeC := make(chan raftpb.ConfChange)
+	s := &Kvstore{}
+	go s.ReadCommits(commitC)
+	// member 3 is not part of the cluster
+	applied := make(chan raftpb.ConfChange, 1)
+	go func() {
+		for cc := range confChangeC {
+			c := &Commit{ConfChange: &cc}
+			if cc.NodeID == 3 {
+				c.ConfChangeErr = errhandle.NewError(errhandle.E_MEMBER_NOT_FOUND, nil)
+			}
+			applied <- cc
+			commitC <- c
+		}
+	}()
+	defer close(confChangeC)
+	srv := httptest.NewServer(&HttpKVAPI{Store: s, ConfChangeC: confChangeC})
+	defer srv.Close()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+
+		wstatus int
+		wcode   int
+		wcc     *raftpb.ConfChange
+	}{
+		{"POST", "/members/2", "http://127.0.0.1:2380", http.StatusNoContent, 0,
+			&raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 2, Context: []byte("http://127.0.0.1:2380")}},
+		{"DELETE", "/members/0x2", "", http.StatusNoContent, 0,
+			&raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: 2}},
+		{"DELETE", "/members/3", "", http.StatusNotFound, errhandle.E_MEMBER_NOT_FOUND,
+			&raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: 3}},
+		{"POST", "/members/2", "", http.StatusBadRequest, errhandle.E_INVALID_REQUEST, nil},
+		{"DELETE", "/members/0", "", http.StatusBadRequest, errhandle.E_INVALID_REQUEST, nil},
+		{"PUT", "/members/2", "", http.StatusMethodNotAllowed, errhandle.E_METHOD_NOT_ALLOWED, nil},
+	}
+	for i, tt := range tests {
+		req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = DecodeError(resp)
+		resp.Body.Close()
+		if resp.StatusCode != tt.wstatus || errhandle.Code(err) != tt.wcode {
+			t.Errorf("#%d: %s %s = %d %v, want %d with code %d", i, tt.method, tt.path, resp.StatusCode, err, tt.wstatus, tt.wcode)
+		}
+		select {
+		case cc := <-applied:
+			if tt.wcc == nil || cc.Type != tt.wcc.Type || cc.NodeID != tt.wcc.NodeID || string(cc.Context) != string(tt.wcc.Context) || cc.ID == 0 {
+				t.Errorf("#%d: conf change = %+v, want %+v with an ID", i, cc, tt.wcc)
+			}
+		default:
+			if tt.wcc != nil {
+				t.Errorf("#%d: no conf change, want %+v", i, tt.wcc)
+			}
+		}
+	}
+}
@@ -1,114 +1,421 @@
 package raftsvr
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	"runtime/debug"
 	"strconv"
+	"strings"
 
 	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/utils/api/snap"
+	stats "github.com/fearblackcat/swiftRaft/utils/api/v2stats"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/cryptutil"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/transport"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Admin paths served on GET instead of the key of the same name. Such keys
+// can still be written, but not read back over HTTP, except LogLevelPath
+// and CompactionPath which are also served on PUT.
+const (
+	// MetricsPath serves the Prometheus metrics of the process.
+	MetricsPath = "/metrics"
+	// StatsSelfPath serves the v2 stats of this member.
+	StatsSelfPath = "/stats/self"
+	// StatsLeaderPath serves the v2 stats of the followers of this member
+	// while it leads the cluster.
+	StatsLeaderPath = "/stats/leader"
+	// LogLevelPath serves the log level of every subsystem on GET and
+	// changes them on PUT; see LogLevelRequest.
+	LogLevelPath = "/loglevel"
+	// CompactionPath serves the current and compacted revisions of the
+	// store on GET, and compacts it on PUT; see CompactionRequest.
+	CompactionPath = "/compaction"
+	// MembersPath serves the member registry and the leader; see
+	// MembersResponse. The keys starting with MembersPath/ are reserved for
+	// member changes; see serveMember.
+	MembersPath = "/members"
+)
+
+// Root-only paths. The keys starting with AdminPathPrefix are reserved for
+// them.
+const (
+	AdminPathPrefix = "/admin/"
+	// SnapshotPath serves a backup of the key-value store on GET.
+	SnapshotPath = "/admin/snapshot"
+)
+
+// Headers of the responses to a GET on a key. RevisionHeader is the
+// revision of the store when the key was read, the others describe the
+// version of the key that was read.
+const (
+	RevisionHeader       = "X-Revision"
+	CreateRevisionHeader = "X-Create-Revision"
+	ModRevisionHeader    = "X-Mod-Revision"
+	VersionHeader        = "X-Version"
 )
 
+// CompactionRequest is the body of a PUT on CompactionPath. The versions
+// replaced at or before Revision are dropped, so that keys can no longer be
+// read before it.
+type CompactionRequest struct {
+	Revision uint64 `json:"revision"`
+}
+
+// CompactionStatus is the body of a GET on CompactionPath.
+type CompactionStatus struct {
+	Revision  uint64 `json:"revision"`
+	Compacted uint64 `json:"compacted"`
+}
+
+// LogLevelRequest is the body of a PUT on LogLevelPath. An empty Subsystem
+// sets the level of all subsystems.
+type LogLevelRequest struct {
+	Subsystem string `json:"subsystem"`
+	Level     string `json:"level"`
+}
+
+var metricsHandler = promhttp.Handler()
+
 // Handler for a http based key-value store backed by raft
 type HttpKVAPI struct {
 	Store       *Kvstore
 	ConfChangeC chan<- raftpb.ConfChange
+	ServerStats *stats.ServerStats
+	LeaderStats *stats.LeaderStats
+	// Forward is what a follower does with writes; see ForwardLocal,
+	// ForwardRedirect and ForwardProxy. It takes the leader from
+	// ServerStats and its URL from the member registry.
+	Forward string
+	// ProxyTransport sends the writes proxied to the leader,
+	// http.DefaultTransport if nil.
+	ProxyTransport http.RoundTripper
+	// Admission limits the writes served here. Load is the load of the
+	// raft node, read for the follower lag and fsync latency limits.
+	Admission AdmissionConfig
+	Load      *NodeLoad
+	// TokenKeys signs the bearer tokens of the users. Members sharing the
+	// same keys accept each other's tokens, which lets proxied and
+	// redirected writes keep theirs. Without it, each member signs with a
+	// random key of its own, so its tokens are only valid on it and until
+	// it restarts.
+	TokenKeys cryptutil.KeyProvider
+
+	limiter    rateLimiter
+	memberKeys memberTokenKeys
 }
 
-func (h *HttpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	key := r.RequestURI
+func (h *HttpKVAPI) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	key := r.URL.EscapedPath()
+	w := &responseWriter{ResponseWriter: rw}
 	defer func() {
 		if err := recover(); err != nil {
-			log.Printf("PANIC:%s\n%s", err, debug.Stack())
+			kvLog.Error("panic serving request", map[string]interface{}{
+				"error": err,
+				"stack": string(debug.Stack()),
+			})
+			// the client is told unless it already has a response
+			if !w.wroteHeader {
+				writeError(w, errhandle.NewError(errhandle.E_INTERNAL, fmt.Errorf("panic: %v", err)))
+			}
 		}
 	}()
+	if h.forward(w, r) {
+		return
+	}
+	if isWrite(r) {
+		if err := h.admit(r); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if strings.HasPrefix(r.URL.Path, AuthPathPrefix) {
+		h.serveAuth(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, AdminPathPrefix) {
+		h.serveAdmin(w, r, key)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, MembersPath+"/") {
+		h.serveMember(w, r, key)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, LeasePathPrefix) {
+		h.serveLease(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, WatchPath+"/") && r.Method == "GET" {
+		h.serveWatch(w, r)
+		return
+	}
+	if err := h.authorize(r, key, requiredPermission(r.Method, key)); err != nil {
+		writeError(w, err)
+		return
+	}
 	switch {
+	case key == LogLevelPath && (r.Method == "GET" || r.Method == "PUT"):
+		h.serveLogLevel(w, r)
+	case key == CompactionPath && (r.Method == "GET" || r.Method == "PUT"):
+		h.serveCompaction(w, r)
 	case r.Method == "PUT":
 		v, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.Printf("Failed to read on PUT (%v)\n", err)
-			http.Error(w, "Failed on PUT", http.StatusBadRequest)
+			kvLog.Warn("failed to read request body", map[string]interface{}{
+				"method": r.Method,
+				"error":  err,
+			})
+			writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, err))
+			return
+		}
+		cmps, err := conditions(r, key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		var lease int64
+		if s := r.URL.Query().Get("lease"); s != "" {
+			if lease, err = strconv.ParseInt(s, 10, 64); err != nil {
+				writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, err))
+				return
+			}
+		}
+		if len(cmps) > 0 || lease != 0 || r.Header.Get(ClientIDHeader) != "" {
+			h.serveConditionalPut(w, r, key, string(v), lease, cmps)
 			return
 		}
 
-		go h.Store.Propose(key, string(v))
+		if err := h.Store.ProposeAsync(key, string(v)); err != nil {
+			writeError(w, err)
+			return
+		}
 
 		// Optimistic-- no waiting for ack from raft. Value is not yet
 		// committed so a subsequent GET on the key may return old value
 		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET" && key == MetricsPath:
+		metricsHandler.ServeHTTP(w, r)
+	case r.Method == "GET" && key == StatsSelfPath:
+		h.serveStatsSelf(w)
+	case r.Method == "GET" && key == StatsLeaderPath:
+		h.serveStatsLeader(w)
+	case r.Method == "GET" && key == MembersPath:
+		h.serveMembers(w)
 	case r.Method == "GET":
-		if v, ok := h.Store.Lookup(key); ok {
-			w.Write([]byte(v))
-		} else {
-			http.Error(w, "Failed to GET", http.StatusNotFound)
-		}
-	case r.Method == "POST":
-		url, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			log.Printf("Failed to read on POST (%v)\n", err)
-			http.Error(w, "Failed on POST", http.StatusBadRequest)
+		h.serveGet(w, r, key)
+	case r.Method == "POST" && key == TxnPath:
+		h.serveTxn(w, r)
+	case r.Method == "DELETE":
+		h.serveDelete(w, r, key)
+	default:
+		w.Header().Set("Allow", "PUT")
+		w.Header().Add("Allow", "GET")
+		w.Header().Add("Allow", "DELETE")
+		writeError(w, errhandle.NewError(errhandle.E_METHOD_NOT_ALLOWED, nil))
+	}
+}
+
+// responseWriter records whether the response headers were written.
+type responseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flushes the response for the watches streamed through w.
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// serveGet serves the value of key, at the revision of the rev query
+// parameter if it is set.
+func (h *HttpKVAPI) serveGet(w http.ResponseWriter, r *http.Request, key string) {
+	var rev uint64
+	if s := r.URL.Query().Get("rev"); s != "" {
+		var err error
+		if rev, err = strconv.ParseUint(s, 10, 64); err != nil {
+			writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, err))
 			return
 		}
+	}
+	kv, storeRev, err := h.Store.Get(key, rev)
+	w.Header().Set(RevisionHeader, strconv.FormatUint(storeRev, 10))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set(CreateRevisionHeader, strconv.FormatUint(kv.CreateRevision, 10))
+	w.Header().Set(ModRevisionHeader, strconv.FormatUint(kv.ModRevision, 10))
+	w.Header().Set(VersionHeader, strconv.FormatInt(kv.Version, 10))
+	w.Header().Set("ETag", etag(kv.ModRevision))
+	if kv.Lease != 0 {
+		w.Header().Set(LeaseHeader, strconv.FormatInt(kv.Lease, 10))
+	}
+	w.Write([]byte(kv.Value))
+}
 
-		nodeId, err := strconv.ParseUint(key[1:], 0, 64)
-		if err != nil {
-			log.Printf("Failed to convert ID for conf change (%v)\n", err)
-			http.Error(w, "Failed on POST", http.StatusBadRequest)
+func (h *HttpKVAPI) serveCompaction(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		var req CompactionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, err))
 			return
 		}
-
-		cc := raftpb.ConfChange{
-			Type:    raftpb.ConfChangeAddNode,
-			NodeID:  nodeId,
-			Context: url,
+		if err := h.Store.ProposeCompaction(r.Context(), req.Revision); err != nil {
+			writeError(w, err)
+			return
 		}
-		h.ConfChangeC <- cc
-
-		// As above, optimistic that raft will apply the conf change
+		// As with PUTs on keys, the compaction is not applied yet
 		w.WriteHeader(http.StatusNoContent)
-	case r.Method == "DELETE":
-		nodeId, err := strconv.ParseUint(key[1:], 0, 64)
-		if err != nil {
-			log.Printf("Failed to convert ID for conf change (%v)\n", err)
-			http.Error(w, "Failed on DELETE", http.StatusBadRequest)
+		return
+	}
+	rev, compacted := h.Store.Revisions()
+	writeJSON(w, CompactionStatus{Revision: rev, Compacted: compacted})
+}
+
+// serveAdmin serves the paths under AdminPathPrefix to root.
+func (h *HttpKVAPI) serveAdmin(w http.ResponseWriter, r *http.Request, key string) {
+	if err := h.authorize(r, key, permRoot); err != nil {
+		writeError(w, err)
+		return
+	}
+	switch {
+	case key == SnapshotPath && r.Method == "GET":
+		h.serveSnapshot(w)
+	case key == SnapshotPath:
+		w.Header().Set("Allow", "GET")
+		writeError(w, errhandle.NewError(errhandle.E_METHOD_NOT_ALLOWED, nil))
+	default:
+		writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, fmt.Errorf("unknown admin path %q", key)))
+	}
+}
+
+// serveSnapshot streams a consistent snapshot of the store followed by its
+// sha256 hash, in the format read back by snap.ReadBackup.
+func (h *HttpKVAPI) serveSnapshot(w http.ResponseWriter) {
+	data, err := h.Store.GetSnapshot()
+	if err != nil {
+		kvLog.Error("failed to take snapshot", map[string]interface{}{
+			"error": err,
+		})
+		writeError(w, errhandle.NewError(errhandle.E_SNAPSHOT_CREATE, err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(snap.BackupSize(len(data)), 10))
+	if _, err = snap.WriteBackup(w, data); err != nil {
+		kvLog.Warn("failed to send snapshot", map[string]interface{}{
+			"error": err,
+		})
+	}
+}
+
+var errStatsUnavailable = errhandle.NewError(errhandle.E_INTERNAL, errors.New("stats are not available"))
+
+func (h *HttpKVAPI) serveStatsSelf(w http.ResponseWriter) {
+	if h.ServerStats == nil {
+		writeError(w, errStatsUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(h.ServerStats.JSON())
+}
+
+// serveStatsLeader only answers on the leader, whose follower stats are the
+// only ones kept up to date.
+func (h *HttpKVAPI) serveStatsLeader(w http.ResponseWriter) {
+	if h.ServerStats == nil || h.LeaderStats == nil {
+		writeError(w, errStatsUnavailable)
+		return
+	}
+	if !h.ServerStats.IsLeader() {
+		leader := h.ServerStats.Leader()
+		if leader == "" {
+			writeError(w, errhandle.NewError(errhandle.E_NO_LEADER, nil))
 			return
 		}
+		e := errhandle.NewError(errhandle.E_NOT_LEADER, nil)
+		e.Leader = leader
+		writeError(w, e)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(h.LeaderStats.JSON())
+}
 
-		cc := raftpb.ConfChange{
-			Type:   raftpb.ConfChangeRemoveNode,
-			NodeID: nodeId,
+func (h *HttpKVAPI) serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		var req LogLevelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, err))
+			return
 		}
-		h.ConfChangeC <- cc
-
-		// As above, optimistic that raft will apply the conf change
-		w.WriteHeader(http.StatusNoContent)
-	default:
-		w.Header().Set("Allow", "PUT")
-		w.Header().Add("Allow", "GET")
-		w.Header().Add("Allow", "POST")
-		w.Header().Add("Allow", "DELETE")
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		if err := logtool.SetLevel(req.Subsystem, req.Level); err != nil {
+			writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, err))
+			return
+		}
+		kvLog.Info("changed log level", map[string]interface{}{
+			"subsystem": req.Subsystem,
+			"level":     req.Level,
+		})
+	}
+	b, err := json.Marshal(logtool.Levels())
+	if err != nil {
+		writeError(w, err)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
 }
 
-// serveHttpKVAPI starts a key-value server with a GET/PUT API and listens.
-func ServeHttpKVAPI(kv *Kvstore, port int, confChangeC chan<- raftpb.ConfChange, errorC <-chan error) {
-	srv := http.Server{
-		Addr: ":" + strconv.Itoa(port),
-		Handler: &HttpKVAPI{
-			Store:       kv,
-			ConfChangeC: confChangeC,
-		},
+// ServeHttpKVAPI starts a key-value server with a GET/PUT API in the
+// background, over HTTPS if tlsInfo has a certificate. An error serving it is
+// sent to errorC; closing the returned server stops it without one.
+func ServeHttpKVAPI(h *HttpKVAPI, port int, tlsInfo transport.TLSInfo, errorC chan<- error) *http.Server {
+	srv := &http.Server{
+		Addr:    ":" + strconv.Itoa(port),
+		Handler: h,
 	}
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Fatal(err)
+		if err := listenAndServe(srv, tlsInfo); err != nil && err != http.ErrServerClosed {
+			errorC <- errhandle.NewError(errhandle.E_KV_SERVE, err)
 		}
 	}()
+	return srv
+}
 
-	// exit when raft goes down
-	if err, ok := <-errorC; ok {
-		log.Fatal(err)
+func listenAndServe(srv *http.Server, tlsInfo transport.TLSInfo) error {
+	if tlsInfo.Empty() {
+		return srv.ListenAndServe()
+	}
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	tln, err := transport.NewTLSListener(ln, &tlsInfo)
+	if err != nil {
+		ln.Close()
+		return err
 	}
+	return srv.Serve(tln)
 }
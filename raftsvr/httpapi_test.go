@@ -0,0 +1,277 @@
+package raftsvr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/utils/api/snap"
+	stats "github.com/fearblackcat/swiftRaft/utils/api/v2stats"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/testutil"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/transport"
+)
+
+func TestServeSnapshot(t *testing.T) {
+	s := newTestKVStore("/foo", "bar")
+	srv := httptest.NewServer(&HttpKVAPI{Store: s})
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + SnapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := snap.ReadBackup(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := s.GetSnapshot()
+	if !bytes.Equal(data, want) {
+		t.Errorf("snapshot = %q, want %q", data, want)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	srv := httptest.NewServer(&HttpKVAPI{Store: &Kvstore{}})
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(b), "go_goroutines") {
+		t.Errorf("status = %d, body = %q, want Prometheus metrics", resp.StatusCode, b)
+	}
+}
+
+func TestServeStats(t *testing.T) {
+	ss := stats.NewServerStats("n1", "1")
+	ls := stats.NewLeaderStats("1")
+	ls.Follower("2").Succ(time.Millisecond)
+	srv := httptest.NewServer(&HttpKVAPI{
+		Store:       &Kvstore{},
+		ServerStats: ss,
+		LeaderStats: ls,
+	})
+	defer srv.Close()
+
+	get := func(path string) (int, []byte) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, b
+	}
+
+	code, b := get(StatsSelfPath)
+	var self struct {
+		Name string `json:"name"`
+		ID   string `json:"id"`
+	}
+	if err := json.Unmarshal(b, &self); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || self.Name != "n1" || self.ID != "1" {
+		t.Errorf("self stats = %d %q, want name n1 and id 1", code, b)
+	}
+
+	if code, b = get(StatsLeaderPath); code != http.StatusServiceUnavailable {
+		t.Errorf("leader stats without leader = %d %q, want %d", code, b, http.StatusServiceUnavailable)
+	}
+	ss.RecvAppendReq("2", 0)
+	code, b = get(StatsLeaderPath)
+	var body errhandle.Body
+	if err := json.Unmarshal(b, &body); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusForbidden || body.ErrorCode != errhandle.E_NOT_LEADER || body.Leader != "2" {
+		t.Errorf("leader stats on follower = %d %q, want %d with leader 2", code, b, http.StatusForbidden)
+	}
+
+	ss.BecomeLeader()
+	code, b = get(StatsLeaderPath)
+	var leader struct {
+		Followers map[string]json.RawMessage `json:"followers"`
+	}
+	if err := json.Unmarshal(b, &leader); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := leader.Followers["2"]; code != http.StatusOK || !ok {
+		t.Errorf("leader stats = %d %q, want follower 2", code, b)
+	}
+}
+
+func TestServeLogLevel(t *testing.T) {
+	defer logtool.Configure(logtool.Config{})
+	srv := httptest.NewServer(&HttpKVAPI{Store: &Kvstore{}})
+	defer srv.Close()
+
+	body := strings.NewReader(`{"subsystem": "wal", "level": "debug"}`)
+	req, err := http.NewRequest("PUT", srv.URL+LogLevelPath, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var levels map[string]string
+	if err = json.NewDecoder(resp.Body).Decode(&levels); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || levels[logtool.SubsystemWAL] != "debug" {
+		t.Errorf("levels = %d %v, want wal at debug", resp.StatusCode, levels)
+	}
+
+	req, _ = http.NewRequest("PUT", srv.URL+LogLevelPath, strings.NewReader(`{"subsystem": "disk", "level": "debug"}`))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown subsystem code = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	srv := httptest.NewServer(&HttpKVAPI{Store: &Kvstore{}})
+	defer srv.Close()
+
+	tests := []struct {
+		method string
+		path   string
+
+		wstatus int
+		wcode   int
+	}{
+		{"GET", "/missing", http.StatusNotFound, errhandle.E_KEY_NOT_FOUND},
+		{"POST", "/foo", http.StatusMethodNotAllowed, errhandle.E_METHOD_NOT_ALLOWED},
+		{"POST", MembersPath + "/notanid", http.StatusBadRequest, errhandle.E_INVALID_REQUEST},
+		{"POST", TxnPath, http.StatusBadRequest, errhandle.E_INVALID_REQUEST},
+		{"PATCH", "/foo", http.StatusMethodNotAllowed, errhandle.E_METHOD_NOT_ALLOWED},
+	}
+	for i, tt := range tests {
+		req, err := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = DecodeError(resp)
+		resp.Body.Close()
+		if resp.StatusCode != tt.wstatus || errhandle.Code(err) != tt.wcode {
+			t.Errorf("#%d: %s %s = %d %v, want %d with code %d", i, tt.method, tt.path, resp.StatusCode, err, tt.wstatus, tt.wcode)
+		}
+	}
+}
+
+func TestServePanic(t *testing.T) {
+	// without a store, serving a key panics
+	srv := httptest.NewServer(&HttpKVAPI{})
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DecodeError(resp)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || errhandle.Code(err) != errhandle.E_INTERNAL {
+		t.Errorf("GET = %d %v, want %d with code %d", resp.StatusCode, err, http.StatusInternalServerError, errhandle.E_INTERNAL)
+	}
+}
+
+func TestServeHttpKVAPITLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, err := testutil.NewCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key, err := ca.Issue("server", "server", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccert, ckey, err := ca.Issue("client", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	errorC := make(chan error, 1)
+	srvTLS := transport.TLSInfo{CertFile: cert, KeyFile: key, TrustedCAFile: ca.CertFile, ClientCertAuth: true}
+	srv := ServeHttpKVAPI(&HttpKVAPI{Store: newTestKVStore("/foo", "bar")}, port, srvTLS, errorC)
+	defer srv.Close()
+
+	get := func(info transport.TLSInfo) (string, error) {
+		tr, err := transport.NewTransport(info, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tr.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: tr}).Get(fmt.Sprintf("https://127.0.0.1:%d/foo", port))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	var v string
+	for i := 0; i < 50; i++ {
+		if v, err = get(transport.TLSInfo{CertFile: ccert, KeyFile: ckey, TrustedCAFile: ca.CertFile}); err == nil {
+			break
+		}
+		// the server may not listen yet
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil || v != "bar" {
+		t.Fatalf("get with client certificate = %q, %v, want bar", v, err)
+	}
+	if _, err = get(transport.TLSInfo{TrustedCAFile: ca.CertFile}); err == nil {
+		t.Error("get without client certificate succeeded")
+	}
+	select {
+	case err = <-errorC:
+		t.Errorf("serve error: %v", err)
+	default:
+	}
+}
@@ -2,101 +2,814 @@ package raftsvr
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"math/big"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/fearblackcat/swiftRaft/raft"
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
 	"github.com/fearblackcat/swiftRaft/utils/api/snap"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/wait"
 )
 
+var kvLog = logtool.Logger(logtool.SubsystemKV)
+
 // a key-value store backed by raft
 type Kvstore struct {
 	ProposeC    chan<- string // channel for proposing updates
 	Mu          sync.RWMutex
-	KvStore     map[string]string // current committed key-value pairs
 	Snapshotter *snap.Snapshotter
+	// QueueDepth and QueueBytes bound the proposals waiting to be handed
+	// to raft, DefaultQueueDepth and DefaultQueueBytes if 0. Proposals
+	// beyond them fail with E_TOO_MANY_REQUESTS.
+	QueueDepth int
+	QueueBytes int64
+
+	kv     mvccStore        // committed versions of the keys, guarded by Mu
+	auth   authState        // committed users and roles, guarded by Mu
+	leases map[int64]*Lease // committed leases, guarded by Mu
+	// sessions are the last requests applied for the client sessions,
+	// guarded by Mu.
+	sessions map[int64]*clientSession
+	members  map[uint64]*Member // member registry, guarded by Mu
+	lessor   lessor
+	watches  watchHub
+	queue    proposalQueue
+
+	// snapMu is held from SnapshotView until its view is saved, and guards
+	// chunks: the key chunks of the last chunked snapshot.
+	snapMu sync.Mutex
+	chunks map[string]keyChunk
+
+	initOnce sync.Once
+	// w returns the results of applied requests to their proposers, by ID.
+	w wait.Wait
+	// reqID is the ID of the last request proposed by this member. It
+	// starts at a random value so that the IDs of the members do not meet.
+	reqID uint64
+	// stopc is closed once the store stops reading commits, which stops
+	// the proposals handed to raft in the background.
+	stopc    chan struct{}
+	stopOnce sync.Once
+}
+
+// Commit is a committed raft entry published to the store.
+type Commit struct {
+	Data  string
+	Index uint64
+	Term  uint64
+	// Applied is set instead of Data by a barrier. The store closes it
+	// once it applied the commits published before it.
+	Applied chan struct{}
+	// ConfChange is set instead of Data by an applied conf change, with
+	// ConfChangeErr if it was refused. The store tells its proposer.
+	ConfChange    *raftpb.ConfChange
+	ConfChangeErr error
 }
 
 type Kv struct {
 	Key string
 	Val string
+	// Auth is set instead of Key and Val by ProposeAuth.
+	Auth *AuthRequest
+	// Compact is set instead of Key and Val by ProposeCompaction.
+	Compact uint64
+	// Txn is set instead of Key and Val by Txn, and Lease by the lease
+	// operations. Their result is returned to the proposer of ID.
+	Txn   *Txn
+	Lease *LeaseRequest
+	ID    uint64
+	// Client and Seq are set by SessionTxn to apply Txn at most once.
+	Client int64
+	Seq    uint64
+	// Member is set instead of Key and Val by Publish.
+	Member *Member
+	// User is the authenticated user that proposed Txn or Lease, checked
+	// again when they are applied; see withUser.
+	User string
 }
 
+// kvSnapshot is the JSON form of a Kvstore in snapshots.
+type kvSnapshot struct {
+	KV       *mvccStore               `json:"kv"`
+	Auth     *authState               `json:"auth,omitempty"`
+	Leases   map[int64]*Lease         `json:"leases,omitempty"`
+	Sessions map[int64]*clientSession `json:"sessions,omitempty"`
+	Members  map[uint64]*Member       `json:"members,omitempty"`
+}
+
+// authSnapshotKey holds the auth state in snapshots taken before the store
+// kept versions, which map every key to its value. Keys of the API start
+// with "/", so it cannot be taken by one.
+const authSnapshotKey = "auth"
+
 func NewKVStore(snapshotter *snap.Snapshotter, proposeC chan<- string) *Kvstore {
-	s := &Kvstore{ProposeC: proposeC, KvStore: make(map[string]string), Snapshotter: snapshotter}
+	s := &Kvstore{ProposeC: proposeC, Snapshotter: snapshotter}
 
 	return s
 }
 
-func (s *Kvstore) LoadDataToMap(commitC <-chan *string, errorC <-chan error) {
+// LoadDataToMap recovers the latest snapshot and replays the log after it
+// into the key-value map, then keeps reading commits in the background
+// until commitC is closed. An error applying a commit stops the reading
+// and is sent to errorC.
+func (s *Kvstore) LoadDataToMap(commitC <-chan *Commit, errorC chan<- error) {
+	if _, err := s.loadSnapshot(); err != nil {
+		errorC <- err
+		return
+	}
 	// replay log into key-value map
-	s.ReadCommits(commitC, errorC)
+	if err := s.ReadCommits(commitC); err != nil {
+		errorC <- err
+		return
+	}
 	// read commits from raft into kvStore map until error
-	go s.ReadCommits(commitC, errorC)
+	go func() {
+		err := s.readCommits(commitC, false)
+		s.stop()
+		s.watches.stop(errhandle.NewError(errhandle.E_STOPPED, err))
+		if err != nil {
+			errorC <- err
+		}
+	}()
+}
+
+// ReadDropped fails the proposals raft dropped, read from droppedC until
+// it is closed, with E_PROPOSAL_DROPPED instead of letting their proposers
+// wait for them until they time out.
+func (s *Kvstore) ReadDropped(droppedC <-chan string) {
+	s.init()
+	go func() {
+		for data := range droppedC {
+			var kv Kv
+			if err := gob.NewDecoder(bytes.NewBufferString(data)).Decode(&kv); err != nil {
+				kvLog.Warn("failed to decode dropped proposal", map[string]interface{}{
+					"error": err,
+				})
+				continue
+			}
+			if kv.ID != 0 {
+				s.w.Trigger(kv.ID, errhandle.NewError(errhandle.E_PROPOSAL_DROPPED, raft.ErrProposalDropped))
+			}
+		}
+	}()
 }
 
 func (s *Kvstore) Lookup(key string) (string, bool) {
+	kv, _, err := s.Get(key, 0)
+	return kv.Value, err == nil
+}
+
+// Get returns the version of key at revision rev, or its latest version if
+// rev is 0, and the current revision of the store.
+func (s *Kvstore) Get(key string, rev uint64) (KeyValue, uint64, error) {
 	s.Mu.RLock()
-	v, ok := s.KvStore[key]
-	s.Mu.RUnlock()
-	return v, ok
+	defer s.Mu.RUnlock()
+	kv, err := s.kv.get(key, rev)
+	return kv, s.kv.Rev, err
 }
 
-func (s *Kvstore) Propose(k string, v string) {
+// Revisions returns the current and the compacted revision of the store.
+func (s *Kvstore) Revisions() (rev, compacted uint64) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+	return s.kv.Rev, s.kv.Compacted
+}
+
+// encode returns the proposal of kv.
+func encode(kv Kv) (string, error) {
 	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(Kv{k, v}); err != nil {
-		log.Fatal(err)
+	if err := gob.NewEncoder(&buf).Encode(kv); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// send hands the proposal data to raft through the proposal queue. It fails
+// with E_TOO_MANY_REQUESTS if the queue is full, and with E_TIMEOUT if ctx
+// is done before raft takes data.
+func (s *Kvstore) send(ctx context.Context, data string) error {
+	if err := s.queue.acquire(len(data), s.QueueDepth, s.QueueBytes); err != nil {
+		return err
+	}
+	defer s.queue.release(len(data))
+	select {
+	case s.ProposeC <- data:
+		return nil
+	case <-ctx.Done():
+		return errhandle.NewError(errhandle.E_TIMEOUT, ctx.Err())
+	}
+}
+
+// Propose proposes to put v in k and waits until raft takes the proposal.
+func (s *Kvstore) Propose(k string, v string) error {
+	data, err := encode(Kv{Key: k, Val: v})
+	if err != nil {
+		return err
 	}
-	s.ProposeC <- buf.String()
+	return s.send(context.Background(), data)
 }
 
-func (s *Kvstore) ReadCommits(commitC <-chan *string, errorC <-chan error) {
-	for data := range commitC {
-		if data == nil {
-			// done replaying log; new data incoming
-			// OR signaled to load snapshot
-			snapshot, err := s.Snapshotter.Load()
-			if err == snap.ErrNoSnapshot {
+// ProposeAsync is Propose without waiting for raft, which takes the
+// proposal in the background unless the store stops first. It fails with
+// E_TOO_MANY_REQUESTS if the proposal queue is full.
+func (s *Kvstore) ProposeAsync(k string, v string) error {
+	data, err := encode(Kv{Key: k, Val: v})
+	if err != nil {
+		return err
+	}
+	if err := s.queue.acquire(len(data), s.QueueDepth, s.QueueBytes); err != nil {
+		return err
+	}
+	s.init()
+	go func() {
+		defer s.queue.release(len(data))
+		select {
+		case s.ProposeC <- data:
+		case <-s.stopc:
+		}
+	}()
+	return nil
+}
+
+// ProposeAuth proposes a change to the auth state, and fails with
+// E_TIMEOUT if ctx is done before raft takes it. It is applied only if it
+// still passes the checks of the state it is applied to.
+func (s *Kvstore) ProposeAuth(ctx context.Context, req *AuthRequest) error {
+	data, err := encode(Kv{Auth: req})
+	if err != nil {
+		return err
+	}
+	return s.send(ctx, data)
+}
+
+// ProposeCompaction proposes to drop the versions replaced at or before
+// revision rev. It fails if rev cannot be compacted now or with E_TIMEOUT
+// if ctx is done before raft takes it, and is skipped when applied if rev
+// no longer can be compacted.
+func (s *Kvstore) ProposeCompaction(ctx context.Context, rev uint64) error {
+	s.Mu.RLock()
+	err := s.kv.checkCompact(rev)
+	s.Mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	data, err := encode(Kv{Compact: rev})
+	if err != nil {
+		return err
+	}
+	return s.send(ctx, data)
+}
+
+func (s *Kvstore) init() {
+	s.initOnce.Do(func() {
+		s.w = wait.New()
+		s.stopc = make(chan struct{})
+		var b [8]byte
+		rand.Read(b[:])
+		s.reqID = binary.BigEndian.Uint64(b[:])
+	})
+}
+
+// stop stops the proposals waiting for raft in the background.
+func (s *Kvstore) stop() {
+	s.init()
+	s.stopOnce.Do(func() { close(s.stopc) })
+}
+
+// propose proposes kv with a new ID and waits until it is applied. It
+// returns the result of kv, and fails with E_TIMEOUT if ctx is done first,
+// in which case kv may still be applied. It fails with E_TOO_MANY_REQUESTS
+// if the proposal queue is full, and with E_PROPOSAL_DROPPED if raft drops
+// kv and the drop is reported to ReadDropped.
+func (s *Kvstore) propose(ctx context.Context, kv Kv) (interface{}, error) {
+	s.init()
+	kv.ID = atomic.AddUint64(&s.reqID, 1)
+	kv.User, _ = ctx.Value(userKey{}).(string)
+	data, err := encode(kv)
+	if err != nil {
+		return nil, err
+	}
+	ch := s.w.Register(kv.ID)
+	if err := s.send(ctx, data); err != nil {
+		s.w.Trigger(kv.ID, nil)
+		return nil, err
+	}
+	select {
+	case x := <-ch:
+		if err, ok := x.(error); ok {
+			return nil, err
+		}
+		return x, nil
+	case <-ctx.Done():
+		s.w.Trigger(kv.ID, nil)
+		return nil, errhandle.NewError(errhandle.E_TIMEOUT, ctx.Err())
+	}
+}
+
+// Txn proposes txn and waits until it is applied; see propose.
+func (s *Kvstore) Txn(ctx context.Context, txn *Txn) (*TxnResponse, error) {
+	if err := txn.validate(); err != nil {
+		return nil, err
+	}
+	x, err := s.propose(ctx, Kv{Txn: txn})
+	if err != nil {
+		return nil, err
+	}
+	return x.(*TxnResponse), nil
+}
+
+// SessionTxn is Txn for request seq of the client session of lease client.
+// The txn is applied at most once however many times it is proposed, and
+// proposing it again returns the response of its first application. A
+// session has one request at a time, so seq must be above the sequence
+// numbers of the requests whose responses were received.
+func (s *Kvstore) SessionTxn(ctx context.Context, client int64, seq uint64, txn *Txn) (*TxnResponse, error) {
+	if err := txn.validate(); err != nil {
+		return nil, err
+	}
+	if client <= 0 || seq == 0 {
+		return nil, errhandle.NewError(errhandle.E_INVALID_REQUEST, errors.New("client session needs a lease ID and a sequence number"))
+	}
+	x, err := s.propose(ctx, Kv{Txn: txn, Client: client, Seq: seq})
+	if err != nil {
+		return nil, err
+	}
+	return x.(*TxnResponse), nil
+}
+
+func (s *Kvstore) proposeLease(ctx context.Context, req *LeaseRequest) (*LeaseResponse, error) {
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	x, err := s.propose(ctx, Kv{Lease: req})
+	if err != nil {
+		return nil, err
+	}
+	return x.(*LeaseResponse), nil
+}
+
+// Grant grants a lease of ttl seconds. A random ID is chosen if id is 0.
+func (s *Kvstore) Grant(ctx context.Context, id, ttl int64) (*LeaseResponse, error) {
+	if id == 0 {
+		n, err := rand.Int(rand.Reader, big.NewInt(1<<63-1))
+		if err != nil {
+			return nil, err
+		}
+		id = n.Int64() + 1
+	}
+	return s.proposeLease(ctx, &LeaseRequest{Op: LeaseGrant, ID: id, TTL: ttl})
+}
+
+// KeepAlive restarts the TTL of lease id.
+func (s *Kvstore) KeepAlive(ctx context.Context, id int64) (*LeaseResponse, error) {
+	return s.proposeLease(ctx, &LeaseRequest{Op: LeaseKeepAlive, ID: id})
+}
+
+// Revoke revokes lease id and deletes the keys attached to it.
+func (s *Kvstore) Revoke(ctx context.Context, id int64) (*LeaseResponse, error) {
+	return s.proposeLease(ctx, &LeaseRequest{Op: LeaseRevoke, ID: id})
+}
+
+// LeaseStatus describes a lease.
+type LeaseStatus struct {
+	ID  int64 `json:"id"`
+	TTL int64 `json:"ttl"`
+	// Owner is the user that granted the lease; see Lease.
+	Owner string `json:"owner,omitempty"`
+	// Remaining is the number of seconds left before the lease expires, on
+	// the clock of this member. Only the clock of the leader counts.
+	Remaining int64 `json:"remaining"`
+	// Keys are the keys attached to the lease.
+	Keys []string `json:"keys"`
+}
+
+// Lease returns the status of lease id.
+func (s *Kvstore) Lease(id int64) (LeaseStatus, error) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+	l := s.leases[id]
+	if l == nil {
+		return LeaseStatus{}, leaseNotFound(id)
+	}
+	return LeaseStatus{
+		ID:        l.ID,
+		TTL:       l.TTL,
+		Owner:     l.Owner,
+		Remaining: int64((s.lessor.remaining(id) + time.Second - 1) / time.Second),
+		Keys:      s.kv.leaseKeys(id),
+	}, nil
+}
+
+// LeaseIDs returns the IDs of the leases, in no particular order.
+func (s *Kvstore) LeaseIDs() []int64 {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+	ids := make([]int64, 0, len(s.leases))
+	for id := range s.leases {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// StartLeases revokes the expired leases while isLeader reports that this
+// member leads the cluster, until stopc is closed. Each time it becomes the
+// leader it restarts the TTL of every lease, since the expiry times of the
+// previous leader are lost with it.
+func (s *Kvstore) StartLeases(isLeader func() bool, stopc <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(leaseCheckInterval)
+		defer ticker.Stop()
+		leader := false
+		for {
+			select {
+			case <-ticker.C:
+			case <-stopc:
 				return
 			}
+			if !isLeader() {
+				leader = false
+				continue
+			}
+			if !leader {
+				leader = true
+				s.Mu.RLock()
+				s.lessor.reset(s.leases)
+				n := len(s.leases)
+				s.Mu.RUnlock()
+				kvLog.Info("restarted lease TTLs as leader", map[string]interface{}{
+					"leases": n,
+				})
+			}
+			for _, id := range s.lessor.expired(time.Now()) {
+				data, err := encode(Kv{Lease: &LeaseRequest{Op: LeaseRevoke, ID: id}})
+				if err != nil {
+					kvLog.Warn("failed to propose lease revoke", map[string]interface{}{
+						"lease": id,
+						"error": err,
+					})
+					continue
+				}
+				select {
+				case s.ProposeC <- data:
+					kvLog.Debug("proposed to revoke expired lease", map[string]interface{}{
+						"lease": id,
+					})
+				case <-stopc:
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Delete deletes key and reports whether it existed.
+func (s *Kvstore) Delete(ctx context.Context, key string) (bool, error) {
+	n, err := s.DeleteRange(ctx, key, "")
+	return n > 0, err
+}
+
+// DeleteRange deletes the keys from key up to end excluded, or key alone if
+// end is empty, and returns the number of keys deleted.
+func (s *Kvstore) DeleteRange(ctx context.Context, key, end string) (int, error) {
+	resp, err := s.Txn(ctx, &Txn{Success: []Op{{Type: OpDelete, Key: key, RangeEnd: end}}})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Responses[0].Deleted, nil
+}
+
+// CompareAndSwap puts value in key if cmp holds on key, and fails with
+// E_CAS_MISMATCH otherwise. It returns the revision of the put.
+func (s *Kvstore) CompareAndSwap(ctx context.Context, key string, cmp Compare, value string) (uint64, error) {
+	cmp.Key = key
+	resp, err := s.Txn(ctx, &Txn{
+		Compare: []Compare{cmp},
+		Success: []Op{{Type: OpPut, Key: key, Value: value}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Succeeded {
+		return 0, errhandle.NewError(errhandle.E_CAS_MISMATCH, nil)
+	}
+	return resp.Revision, nil
+}
+
+// loadSnapshot recovers the map from the latest snapshot if it is ahead of
+// the map, and reports whether it did. A snapshot the map already caught up
+// with is not loaded again, so that the commits applied after it are kept.
+func (s *Kvstore) loadSnapshot() (bool, error) {
+	if s.Snapshotter == nil {
+		return false, nil
+	}
+	snapshot, err := s.Snapshotter.Load()
+	if err == snap.ErrNoSnapshot {
+		return false, nil
+	}
+	if err != nil {
+		return false, errhandle.NewError(errhandle.E_APPLY, err)
+	}
+	s.Mu.RLock()
+	rev := s.kv.Rev
+	s.Mu.RUnlock()
+	if snapshot.Metadata.Index <= rev {
+		return false, nil
+	}
+	kvLog.Info("loading snapshot", map[string]interface{}{
+		"term":  snapshot.Metadata.Term,
+		"index": snapshot.Metadata.Index,
+	})
+	if err := s.RecoverFromSnapshot(snapshot.Data); err != nil {
+		return false, errhandle.NewError(errhandle.E_APPLY, err)
+	}
+	s.Mu.Lock()
+	if s.kv.Rev < snapshot.Metadata.Index {
+		s.kv.Rev = snapshot.Metadata.Index
+	}
+	s.Mu.Unlock()
+	s.watches.reset(snapshot.Metadata.Index)
+	return true, nil
+}
+
+// ReadCommits applies commits to the map until the log is replayed or
+// commitC is closed. It fails with an *errhandle.Error on a commit it
+// cannot apply.
+func (s *Kvstore) ReadCommits(commitC <-chan *Commit) error {
+	return s.readCommits(commitC, true)
+}
+
+// readCommits is ReadCommits, which returns at the end of the replay only
+// if replay is set. Once the log is replayed, a nil commit only signals a
+// snapshot to load, which is skipped if the store already caught up with
+// it.
+func (s *Kvstore) readCommits(commitC <-chan *Commit, replay bool) error {
+	for c := range commitC {
+		if c == nil {
+			// signaled to load snapshot
+			// OR done replaying log; new data incoming
+			loaded, err := s.loadSnapshot()
 			if err != nil {
-				log.Panic(err)
+				return err
 			}
-			log.Printf("loading snapshot at term %d and index %d", snapshot.Metadata.Term, snapshot.Metadata.Index)
-			if err := s.RecoverFromSnapshot(snapshot.Data); err != nil {
-				log.Panic(err)
+			if !loaded && replay {
+				return nil
+			}
+			continue
+		}
+		if c.Applied != nil {
+			close(c.Applied)
+			continue
+		}
+		if c.ConfChange != nil {
+			if c.ConfChange.ID != 0 {
+				s.init()
+				s.w.Trigger(c.ConfChange.ID, c.ConfChangeErr)
 			}
 			continue
 		}
 
 		var dataKv Kv
-		dec := gob.NewDecoder(bytes.NewBufferString(*data))
+		dec := gob.NewDecoder(bytes.NewBufferString(c.Data))
 		if err := dec.Decode(&dataKv); err != nil {
-			log.Fatalf("raft: could not decode message (%v)", err)
+			return errhandle.NewError(errhandle.E_APPLY, err)
 		}
 		s.Mu.Lock()
-		s.KvStore[dataKv.Key] = dataKv.Val
+		var result interface{}
+		switch {
+		case dataKv.Auth != nil:
+			s.applyAuth(dataKv.Auth)
+		case dataKv.Compact != 0:
+			s.applyCompaction(dataKv.Compact)
+		case dataKv.Txn != nil && dataKv.Client != 0:
+			result = s.applySessionTxn(&dataKv, c)
+		case dataKv.Txn != nil:
+			result = s.applyTxn(dataKv.Txn, dataKv.User, c)
+		case dataKv.Lease != nil:
+			result = s.applyLease(dataKv.Lease, dataKv.User, c)
+		case dataKv.Member != nil:
+			s.applyMember(dataKv.Member)
+		default:
+			ev := Event{Type: EventPut, Index: c.Index, Term: c.Term, Key: dataKv.Key, Value: dataKv.Val}
+			if prev := s.kv.put(dataKv.Key, dataKv.Val, 0, c.Index); prev != nil {
+				ev.OldValue = &prev.Value
+			}
+			s.watches.publish(ev)
+		}
+		if s.kv.Rev < c.Index {
+			s.kv.Rev = c.Index
+		}
 		s.Mu.Unlock()
+		if dataKv.ID != 0 {
+			s.init()
+			s.w.Trigger(dataKv.ID, result)
+		}
+	}
+	return nil
+}
+
+// applyAuth applies a committed auth request with Mu held.
+func (s *Kvstore) applyAuth(req *AuthRequest) {
+	if err := s.auth.check(req); err != nil {
+		kvLog.Warn("skipping auth request", map[string]interface{}{
+			"op":    req.Op,
+			"error": err,
+		})
+		return
+	}
+	s.auth.apply(req)
+	kvLog.Info("applied auth request", map[string]interface{}{
+		"op":           req.Op,
+		"auth enabled": s.auth.Enabled,
+	})
+}
+
+// applyTxn applies a committed txn with Mu held and returns its response,
+// or the error it is skipped with. Txns are validated before they are
+// proposed, so an invalid one can only come from a corrupt log.
+func (s *Kvstore) applyTxn(txn *Txn, user string, c *Commit) interface{} {
+	if err := txn.validate(); err != nil {
+		kvLog.Warn("skipping txn", map[string]interface{}{
+			"index": c.Index,
+			"error": err,
+		})
+		return err
+	}
+	// keys are only attached to the leases of their writer
+	for _, ops := range [][]Op{txn.Success, txn.Failure} {
+		for _, op := range ops {
+			if l := s.leases[op.Lease]; op.Type == OpPut && l != nil && !s.auth.ownsLease(user, l) {
+				return errPermissionDenied
+			}
+		}
+	}
+	resp, evs, err := s.kv.txn(txn, c.Index, s.leases)
+	if err != nil {
+		return err
+	}
+	for _, ev := range evs {
+		ev.Term = c.Term
+		s.watches.publish(ev)
+	}
+	return resp
+}
+
+// applyLease applies a committed lease request with Mu held and returns
+// its response, or the error it is skipped with.
+func (s *Kvstore) applyLease(req *LeaseRequest, user string, c *Commit) interface{} {
+	if err := req.validate(); err != nil {
+		kvLog.Warn("skipping lease request", map[string]interface{}{
+			"index": c.Index,
+			"error": err,
+		})
+		return err
+	}
+	l := s.leases[req.ID]
+	switch {
+	case req.Op == LeaseGrant && l != nil:
+		return errhandle.NewError(errhandle.E_LEASE_EXISTS, fmt.Errorf("lease %d", req.ID))
+	case req.Op != LeaseGrant && l == nil:
+		return leaseNotFound(req.ID)
+	case req.Op != LeaseGrant && !s.auth.ownsLease(user, l):
+		return errPermissionDenied
+	}
+	resp := &LeaseResponse{ID: req.ID, Revision: c.Index}
+	switch req.Op {
+	case LeaseGrant:
+		l = &Lease{ID: req.ID, TTL: req.TTL}
+		if s.auth.Enabled {
+			l.Owner = user
+		}
+		if s.leases == nil {
+			s.leases = make(map[int64]*Lease)
+		}
+		s.leases[l.ID] = l
+		s.lessor.renew(l.ID, l.TTL)
+	case LeaseKeepAlive:
+		s.lessor.renew(l.ID, l.TTL)
+	case LeaseRevoke:
+		for _, k := range s.kv.leaseKeys(l.ID) {
+			prev := s.kv.del(k, c.Index)
+			s.watches.publish(Event{Type: EventDelete, Index: c.Index, Term: c.Term, Key: k, OldValue: &prev.Value})
+			resp.Deleted++
+		}
+		delete(s.leases, l.ID)
+		delete(s.sessions, l.ID)
+		s.lessor.remove(l.ID)
+		kvLog.Info("revoked lease", map[string]interface{}{
+			"lease":        l.ID,
+			"deleted keys": resp.Deleted,
+		})
 	}
-	if err, ok := <-errorC; ok {
-		log.Fatal(err)
+	resp.TTL = l.TTL
+	return resp
+}
+
+// applyCompaction applies a committed compaction with Mu held.
+func (s *Kvstore) applyCompaction(rev uint64) {
+	if err := s.kv.checkCompact(rev); err != nil {
+		kvLog.Warn("skipping compaction", map[string]interface{}{
+			"revision": rev,
+			"error":    err,
+		})
+		return
 	}
+	s.kv.compact(rev)
+	kvLog.Info("compacted store", map[string]interface{}{
+		"revision": rev,
+	})
 }
 
+// GetSnapshot returns the versions of the keys since the last compaction
+// and the auth state.
 func (s *Kvstore) GetSnapshot() ([]byte, error) {
 	s.Mu.RLock()
 	defer s.Mu.RUnlock()
-	return json.Marshal(s.KvStore)
+	data := kvSnapshot{KV: &s.kv, Leases: s.leases, Sessions: s.sessions, Members: s.members}
+	if !s.auth.empty() {
+		data.Auth = &s.auth
+	}
+	return json.Marshal(&data)
 }
 
+// RecoverFromSnapshot replaces the store with a snapshot. Snapshots taken
+// before the store kept versions are still read: their keys get a single
+// version at revision 0.
 func (s *Kvstore) RecoverFromSnapshot(snapshot []byte) error {
-	var store map[string]string
-	if err := json.Unmarshal(snapshot, &store); err != nil {
+	if snap.IsManifest(snapshot) {
+		return s.recoverFromChunks(snapshot)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(snapshot, &raw); err != nil {
 		return err
 	}
+	var kv mvccStore
+	var auth authState
+	var leases map[int64]*Lease
+	var sessions map[int64]*clientSession
+	var members map[uint64]*Member
+	if _, ok := raw["kv"]; ok {
+		data := kvSnapshot{KV: &kv, Auth: &auth}
+		if err := json.Unmarshal(snapshot, &data); err != nil {
+			return err
+		}
+		leases, sessions, members = data.Leases, data.Sessions, data.Members
+	} else {
+		var store map[string]string
+		if err := json.Unmarshal(snapshot, &store); err != nil {
+			return err
+		}
+		if data, ok := store[authSnapshotKey]; ok {
+			if err := json.Unmarshal([]byte(data), &auth); err != nil {
+				return err
+			}
+			delete(store, authSnapshotKey)
+		}
+		for k, v := range store {
+			kv.put(k, v, 0, 0)
+		}
+	}
+	s.restore(kv, auth, leases, sessions, members)
+	return nil
+}
+
+// SnapshotRevision returns the revision of the store in snapshot data as
+// returned by GetSnapshot, or 0 for a snapshot from before the store kept
+// versions. The raft index a store is restored at must not be below it, or
+// its next revisions would go back in time.
+func SnapshotRevision(snapshot []byte) (uint64, error) {
+	var data struct {
+		KV *struct {
+			Rev uint64 `json:"revision"`
+		} `json:"kv"`
+	}
+	if err := json.Unmarshal(snapshot, &data); err != nil {
+		return 0, err
+	}
+	if data.KV == nil {
+		return 0, nil
+	}
+	return data.KV.Rev, nil
+}
+
+// restore replaces the state of the store with the state of a snapshot.
+func (s *Kvstore) restore(kv mvccStore, auth authState, leases map[int64]*Lease, sessions map[int64]*clientSession, members map[uint64]*Member) {
 	s.Mu.Lock()
-	s.KvStore = store
+	s.kv = kv
+	s.auth = auth
+	s.leases = leases
+	s.sessions = sessions
+	s.members = members
+	s.lessor.reset(leases)
 	s.Mu.Unlock()
-	return nil
 }
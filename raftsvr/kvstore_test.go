@@ -1,16 +1,34 @@
 package raftsvr
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/utils/api/snap"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
 )
 
+// newTestKVStore returns a store with the given keys and values, written
+// at revisions 1, 2...
+func newTestKVStore(kvs ...string) *Kvstore {
+	s := &Kvstore{}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		s.kv.put(kvs[i], kvs[i+1], 0, uint64(i/2+1))
+	}
+	return s
+}
+
 func Test_kvstore_snapshot(t *testing.T) {
-	tm := map[string]string{"foo": "bar"}
-	s := &Kvstore{KvStore: tm}
+	s := newTestKVStore("foo", "bar", "foo", "baz")
 
 	v, _ := s.Lookup("foo")
-	if v != "bar" {
+	if v != "baz" {
 		t.Fatalf("foo has unexpected value, got %s", v)
 	}
 
@@ -18,16 +36,260 @@ func Test_kvstore_snapshot(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	s.KvStore = nil
+	want := s.kv
+	s.kv = mvccStore{}
 
 	if err := s.RecoverFromSnapshot(data); err != nil {
 		t.Fatal(err)
 	}
 	v, _ = s.Lookup("foo")
-	if v != "bar" {
+	if v != "baz" {
 		t.Fatalf("foo has unexpected value, got %s", v)
 	}
-	if !reflect.DeepEqual(s.KvStore, tm) {
-		t.Fatalf("store expected %+v, got %+v", tm, s.KvStore)
+	if !reflect.DeepEqual(s.kv, want) {
+		t.Fatalf("store expected %+v, got %+v", want, s.kv)
+	}
+}
+
+func TestSnapshotChunks(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "snapchunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestKVStore()
+	s.Snapshotter = snap.New(nil, dir)
+	for i := 0; i < 5000; i++ {
+		s.kv.put(fmt.Sprintf("/k%04d", i), "v", 0, uint64(i+1))
+	}
+	data, err := s.SnapshotChunks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := snap.ParseManifest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Chunks) < 3 {
+		t.Fatalf("chunks = %d, want the keys split", len(first.Chunks))
+	}
+
+	s.kv.put("/k0100", "w", 0, 5001)
+	if data, err = s.SnapshotChunks(); err != nil {
+		t.Fatal(err)
+	}
+	second, err := snap.ParseManifest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second.Chunks) != len(first.Chunks) {
+		t.Fatalf("chunks = %d, want %d", len(second.Chunks), len(first.Chunks))
+	}
+	changed := 0
+	for i := range first.Chunks {
+		if first.Chunks[i] != second.Chunks[i] {
+			changed++
+		}
+	}
+	// the chunk of the store and the chunk of /k0100
+	if changed != 2 {
+		t.Errorf("changed chunks = %d, want 2", changed)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "chunks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(first.Chunks)+2 {
+		t.Errorf("chunk files = %d, want %d", len(files), len(first.Chunks)+2)
+	}
+
+	r := &Kvstore{Snapshotter: s.Snapshotter}
+	if err = r.RecoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if r.kv.Rev != s.kv.Rev || !reflect.DeepEqual(r.kv.Keys, s.kv.Keys) {
+		t.Errorf("recovered store differs at revision %d, want %d", r.kv.Rev, s.kv.Rev)
+	}
+	// as it does in one piece, on a member without chunks
+	whole, err := s.ExpandSnapshot(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = &Kvstore{}
+	if err = r.RecoverFromSnapshot(whole); err != nil {
+		t.Fatal(err)
+	}
+	if r.kv.Rev != s.kv.Rev || !reflect.DeepEqual(r.kv.Keys, s.kv.Keys) {
+		t.Errorf("expanded store differs at revision %d, want %d", r.kv.Rev, s.kv.Rev)
+	}
+	r.Snapshotter = s.Snapshotter
+
+	// a compaction may change any chunk
+	s.kv.compact(10)
+	if data, err = s.SnapshotChunks(); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.RecoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if r.kv.Compacted != 10 || !reflect.DeepEqual(r.kv.Keys, s.kv.Keys) {
+		t.Errorf("recovered compacted store differs")
+	}
+}
+
+// TestSnapshotView checks that a view holds the store as it was when it
+// was taken, while the store is written before it is saved.
+func TestSnapshotView(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "snapview")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestKVStore("/a", "1", "/b", "1", "/a", "2")
+	s.Snapshotter = snap.New(nil, dir)
+	want := make(map[string][]KeyValue)
+	for k, vs := range s.kv.Keys {
+		want[k] = append([]KeyValue(nil), vs...)
+	}
+	save, err := s.SnapshotView()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.kv.put("/a", "3", 0, 4)
+	s.kv.put("/c", "1", 0, 5)
+	s.kv.compact(4)
+	data, err := save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.kv.shared {
+		t.Error("store still shares its keys once the view is saved")
+	}
+
+	r := &Kvstore{Snapshotter: s.Snapshotter}
+	if err = r.RecoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if r.kv.Rev != 3 || !reflect.DeepEqual(r.kv.Keys, want) {
+		t.Errorf("view = %+v at %d, want %+v at 3", r.kv.Keys, r.kv.Rev, want)
+	}
+	// the writes during the save are in the next snapshot
+	if data, err = s.SnapshotChunks(); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.RecoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.kv.Keys, s.kv.Keys) {
+		t.Errorf("store = %+v, want %+v", r.kv.Keys, s.kv.Keys)
+	}
+}
+
+func TestRecoverFromLegacySnapshot(t *testing.T) {
+	s := &Kvstore{}
+	if err := s.RecoverFromSnapshot([]byte(`{"/foo":"bar","auth":"{\"enabled\":false,\"roles\":{\"r\":{\"name\":\"r\"}}}"}`)); err != nil {
+		t.Fatal(err)
+	}
+	kv, _, err := s.Get("/foo", 0)
+	if err != nil || kv.Value != "bar" || kv.Version != 1 {
+		t.Errorf("/foo = %+v, %v; want bar at version 1", kv, err)
+	}
+	if s.auth.Roles["r"] == nil {
+		t.Errorf("auth = %+v, want role r", s.auth)
+	}
+}
+
+func TestReadCommitsDecodeError(t *testing.T) {
+	s := &Kvstore{}
+	commitC := make(chan *Commit, 1)
+	commitC <- &Commit{Data: "not gob", Index: 1, Term: 1}
+	close(commitC)
+
+	errorC := make(chan error, 1)
+	s.LoadDataToMap(commitC, errorC)
+	select {
+	case err := <-errorC:
+		if errhandle.Code(err) != errhandle.E_APPLY {
+			t.Errorf("error = %v, want code %d", err, errhandle.E_APPLY)
+		}
+	default:
+		t.Fatal("no error reported for an undecodable commit")
+	}
+}
+
+func TestReadCommitsClosed(t *testing.T) {
+	proposeC := make(chan string, 1)
+	s := &Kvstore{ProposeC: proposeC}
+	if err := s.Propose("/foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	commitC := make(chan *Commit, 1)
+	commitC <- &Commit{Data: <-proposeC, Index: 1, Term: 1}
+	close(commitC)
+
+	if err := s.ReadCommits(commitC); err != nil {
+		t.Errorf("error = %v, want nil", err)
+	}
+	if v, _ := s.Lookup("/foo"); v != "bar" {
+		t.Errorf("/foo = %q, want %q", v, "bar")
+	}
+}
+
+// TestReadCommitsStaleSnapshot checks that the store keeps applying commits
+// after it is signaled a snapshot it already caught up with.
+func TestReadCommitsStaleSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "stalesnap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := newTestKVStore("/a", "1", "/b", "2").GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Kvstore{Snapshotter: snap.New(nil, dir)}
+	if err = s.Snapshotter.SaveSnap(raftpb.Snapshot{Data: data, Metadata: raftpb.SnapshotMetadata{Index: 2, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	put := func(k string, index uint64) *Commit {
+		data, err := encode(Kv{Key: k, Val: "v"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Commit{Data: data, Index: index, Term: 1}
+	}
+
+	commitC := make(chan *Commit)
+	errorC := make(chan error, 1)
+	go s.LoadDataToMap(commitC, errorC)
+	send := func(c *Commit) {
+		select {
+		case commitC <- c:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the store stopped reading commits")
+		}
+	}
+	send(put("/c", 3))
+	// the end of the replay, then the snapshot at index 2 again
+	send(nil)
+	send(nil)
+	send(put("/d", 4))
+	applied := make(chan struct{})
+	send(&Commit{Applied: applied})
+	<-applied
+	close(commitC)
+
+	for _, k := range []string{"/a", "/c", "/d"} {
+		if _, ok := s.Lookup(k); !ok {
+			t.Errorf("%s missing", k)
+		}
+	}
+	select {
+	case err := <-errorC:
+		t.Errorf("error = %v, want none", err)
+	default:
 	}
 }
@@ -0,0 +1,137 @@
+package raftsvr
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+const (
+	// leaseCheckInterval is how often the leader looks for expired leases.
+	leaseCheckInterval = 500 * time.Millisecond
+	// leaseRevokeRetry is how long the leader waits for the revoke of an
+	// expired lease to be applied before proposing it again.
+	leaseRevokeRetry = 3 * time.Second
+)
+
+// Lease keeps the keys attached to it until it is revoked, which the leader
+// does once TTL seconds passed since the lease was granted or last kept
+// alive.
+type Lease struct {
+	ID  int64 `json:"id"`
+	TTL int64 `json:"ttl"`
+	// Owner is the user that granted the lease, empty if auth was
+	// disabled. Only the owner and root may keep it alive, revoke it or
+	// attach keys to it while auth is enabled.
+	Owner string `json:"owner,omitempty"`
+}
+
+// Operations of a LeaseRequest.
+const (
+	LeaseGrant     = "grant"
+	LeaseKeepAlive = "keepAlive"
+	LeaseRevoke    = "revoke"
+)
+
+// LeaseRequest grants, keeps alive or revokes a lease. It is proposed and
+// applied through raft like the key-value pairs.
+type LeaseRequest struct {
+	Op  string
+	ID  int64
+	TTL int64
+}
+
+// LeaseResponse is the result of an applied LeaseRequest.
+type LeaseResponse struct {
+	ID  int64 `json:"id"`
+	TTL int64 `json:"ttl"`
+	// Revision is the revision the request was applied at.
+	Revision uint64 `json:"revision"`
+	// Deleted is the number of keys deleted by a revoke.
+	Deleted int `json:"deleted,omitempty"`
+}
+
+func leaseNotFound(id int64) error {
+	return errhandle.NewError(errhandle.E_LEASE_NOT_FOUND, fmt.Errorf("lease %d", id))
+}
+
+func (req *LeaseRequest) validate() error {
+	switch req.Op {
+	case LeaseGrant:
+		if req.TTL < 1 {
+			return errhandle.NewError(errhandle.E_INVALID_REQUEST, errors.New("lease TTL must be at least 1 second"))
+		}
+	case LeaseKeepAlive, LeaseRevoke:
+	default:
+		return errhandle.NewError(errhandle.E_INVALID_REQUEST, errors.New("unknown lease operation "+req.Op))
+	}
+	if req.ID <= 0 {
+		return errhandle.NewError(errhandle.E_INVALID_REQUEST, errors.New("lease ID must be positive"))
+	}
+	return nil
+}
+
+// lessor tracks when the leases expire on the clock of this member. Only
+// the leader acts on it, by proposing to revoke expired leases. Expiry times
+// are not replicated: every member restarts the TTL of a lease when it
+// applies its grant or keep-alive, and a new leader gives every lease its
+// full TTL again.
+type lessor struct {
+	mu     sync.Mutex
+	expiry map[int64]time.Time
+}
+
+// renew makes lease id expire ttl seconds from now.
+func (l *lessor) renew(id, ttl int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.expiry == nil {
+		l.expiry = make(map[int64]time.Time)
+	}
+	l.expiry[id] = time.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+func (l *lessor) remove(id int64) {
+	l.mu.Lock()
+	delete(l.expiry, id)
+	l.mu.Unlock()
+}
+
+// reset renews every lease and forgets the others.
+func (l *lessor) reset(leases map[int64]*Lease) {
+	l.mu.Lock()
+	l.expiry = make(map[int64]time.Time, len(leases))
+	l.mu.Unlock()
+	for _, ls := range leases {
+		l.renew(ls.ID, ls.TTL)
+	}
+}
+
+// remaining returns how long lease id has left on this member's clock.
+func (l *lessor) remaining(id int64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d := time.Until(l.expiry[id])
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// expired returns the leases expired at now, and gives them leaseRevokeRetry
+// more so that they are not returned again while their revoke is pending.
+func (l *lessor) expired(now time.Time) []int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var ids []int64
+	for id, t := range l.expiry {
+		if !now.Before(t) {
+			ids = append(ids, id)
+			l.expiry[id] = now.Add(leaseRevokeRetry)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,305 @@
+package raftsvr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+func TestLessor(t *testing.T) {
+	var l lessor
+	l.renew(1, 10)
+	l.renew(2, 100)
+	if d := l.remaining(1); d <= 9*time.Second || d > 10*time.Second {
+		t.Errorf("remaining = %v, want about 10s", d)
+	}
+	if ids := l.expired(time.Now()); len(ids) != 0 {
+		t.Errorf("expired = %v, want none", ids)
+	}
+	now := time.Now().Add(time.Minute)
+	if ids := l.expired(now); !reflect.DeepEqual(ids, []int64{1}) {
+		t.Errorf("expired after a minute = %v, want [1]", ids)
+	}
+	// a pending revoke is not returned again until it is retried
+	if ids := l.expired(now); len(ids) != 0 {
+		t.Errorf("expired again = %v, want none", ids)
+	}
+	if ids := l.expired(now.Add(leaseRevokeRetry)); !reflect.DeepEqual(ids, []int64{1}) {
+		t.Errorf("expired after the retry delay = %v, want [1]", ids)
+	}
+
+	l.remove(1)
+	l.reset(map[int64]*Lease{2: {ID: 2, TTL: 5}, 3: {ID: 3, TTL: 5}})
+	if d := l.remaining(2); d > 5*time.Second {
+		t.Errorf("remaining after reset = %v, want at most 5s", d)
+	}
+	if d := l.remaining(1); d != 0 {
+		t.Errorf("remaining of a removed lease = %v, want 0", d)
+	}
+}
+
+func TestKvstoreLeases(t *testing.T) {
+	h, _, stop := newTestServer(t)
+	defer stop()
+	s := h.Store
+	ctx := context.Background()
+
+	resp, err := s.Grant(ctx, 0, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := resp.ID
+	if id <= 0 || resp.TTL != 60 {
+		t.Errorf("grant = %+v, want a positive ID and TTL 60", resp)
+	}
+	if _, err = s.Grant(ctx, id, 60); errhandle.Code(err) != errhandle.E_LEASE_EXISTS {
+		t.Errorf("second grant error = %v, want code %d", err, errhandle.E_LEASE_EXISTS)
+	}
+	if _, err = s.KeepAlive(ctx, id+1); errhandle.Code(err) != errhandle.E_LEASE_NOT_FOUND {
+		t.Errorf("keep-alive of a missing lease error = %v, want code %d", err, errhandle.E_LEASE_NOT_FOUND)
+	}
+
+	if _, err = s.Txn(ctx, &Txn{Success: []Op{
+		{Type: OpPut, Key: "/a", Value: "1", Lease: id},
+		{Type: OpPut, Key: "/b", Value: "2", Lease: id},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	// the put fails as a whole on a missing lease
+	if _, err = s.Txn(ctx, &Txn{Success: []Op{
+		{Type: OpPut, Key: "/c", Value: "3"},
+		{Type: OpPut, Key: "/d", Value: "4", Lease: id + 1},
+	}}); errhandle.Code(err) != errhandle.E_LEASE_NOT_FOUND {
+		t.Errorf("put with a missing lease error = %v, want code %d", err, errhandle.E_LEASE_NOT_FOUND)
+	}
+	if _, ok := s.Lookup("/c"); ok {
+		t.Error("/c was put along with a missing lease")
+	}
+	// a put without the lease detaches the key
+	if _, err = s.Txn(ctx, &Txn{Success: []Op{{Type: OpPut, Key: "/b", Value: "3"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := s.Lease(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(st.Keys, []string{"/a"}) || st.Remaining < 59 || st.Remaining > 60 {
+		t.Errorf("lease status = %+v, want key /a and about 60s left", st)
+	}
+	if _, err = s.KeepAlive(ctx, id); err != nil {
+		t.Error(err)
+	}
+
+	// leases survive snapshots
+	data, err := s.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r Kvstore
+	if err = r.RecoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := r.Lease(id); err != nil || st.TTL != 60 || len(st.Keys) != 1 {
+		t.Errorf("recovered lease = %+v, %v", st, err)
+	}
+
+	if resp, err = s.Revoke(ctx, id); err != nil || resp.Deleted != 1 {
+		t.Errorf("revoke = %+v, %v; want 1 key deleted", resp, err)
+	}
+	if _, ok := s.Lookup("/a"); ok {
+		t.Error("/a survived the revoke of its lease")
+	}
+	if v, _ := s.Lookup("/b"); v != "3" {
+		t.Errorf("/b = %q, want the detached value 3", v)
+	}
+	if _, err = s.Lease(id); errhandle.Code(err) != errhandle.E_LEASE_NOT_FOUND {
+		t.Errorf("revoked lease error = %v, want code %d", err, errhandle.E_LEASE_NOT_FOUND)
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	h, _, stop := newTestServer(t)
+	defer stop()
+	s := h.Store
+	stopc := make(chan struct{})
+	defer close(stopc)
+	s.StartLeases(func() bool { return true }, stopc)
+
+	ctx := context.Background()
+	resp, err := s.Grant(ctx, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Txn(ctx, &Txn{Success: []Op{{Type: OpPut, Key: "/ephemeral", Value: "x", Lease: resp.ID}}}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := s.Lookup("/ephemeral"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("key of an expired lease was not deleted")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, err = s.Lease(resp.ID); errhandle.Code(err) != errhandle.E_LEASE_NOT_FOUND {
+		t.Errorf("expired lease error = %v, want code %d", err, errhandle.E_LEASE_NOT_FOUND)
+	}
+}
+
+func TestServeLeases(t *testing.T) {
+	_, srv, stop := newTestServer(t)
+	defer stop()
+
+	do := func(method, path, body string, wstatus int, v interface{}) {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wstatus {
+			t.Fatalf("%s %s = %d, want %d", method, path, resp.StatusCode, wstatus)
+		}
+		if v != nil {
+			if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var lr LeaseResponse
+	do("POST", LeasePathPrefix, `{"id": 7, "ttl": 30}`, http.StatusOK, &lr)
+	if lr.ID != 7 || lr.TTL != 30 {
+		t.Errorf("grant = %+v, want lease 7 with TTL 30", lr)
+	}
+	do("POST", LeasePathPrefix, `{"id": 7, "ttl": 30}`, http.StatusConflict, nil)
+	do("POST", LeasePathPrefix, `{"ttl": 0}`, http.StatusBadRequest, nil)
+
+	do("PUT", "/foo?lease=7", "bar", http.StatusNoContent, nil)
+	do("PUT", "/foo?lease=8", "bar", http.StatusNotFound, nil)
+	do("PUT", "/foo?lease=x", "bar", http.StatusBadRequest, nil)
+	resp, err := http.Get(srv.URL + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if g := resp.Header.Get(LeaseHeader); g != "7" {
+		t.Errorf("%s = %q, want 7", LeaseHeader, g)
+	}
+
+	var ids []int64
+	do("GET", LeasePathPrefix, "", http.StatusOK, &ids)
+	if !reflect.DeepEqual(ids, []int64{7}) {
+		t.Errorf("leases = %v, want [7]", ids)
+	}
+	var st LeaseStatus
+	do("GET", LeasePathPrefix+"7", "", http.StatusOK, &st)
+	if st.ID != 7 || !reflect.DeepEqual(st.Keys, []string{"/foo"}) {
+		t.Errorf("lease status = %+v, want lease 7 with key /foo", st)
+	}
+	do("POST", LeasePathPrefix+"7/keepalive", "", http.StatusOK, &lr)
+	do("POST", LeasePathPrefix+"8/keepalive", "", http.StatusNotFound, nil)
+	do("GET", LeasePathPrefix+"x", "", http.StatusBadRequest, nil)
+
+	do("DELETE", LeasePathPrefix+"7", "", http.StatusOK, &lr)
+	if lr.Deleted != 1 {
+		t.Errorf("revoke = %+v, want 1 key deleted", lr)
+	}
+	do("GET", "/foo", "", http.StatusNotFound, nil)
+	do("DELETE", LeasePathPrefix+"7", "", http.StatusNotFound, nil)
+}
+
+func TestServeLeaseOwners(t *testing.T) {
+	h, srv, stop := newTestServer(t)
+	defer stop()
+
+	do := func(method, path, token, body string, wstatus int, v interface{}) {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wstatus {
+			t.Fatalf("%s %s = %d, want %d", method, path, resp.StatusCode, wstatus)
+		}
+		if v != nil {
+			if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	do("PUT", AuthRolesPath+"/app", "", `{"permissions": [{"prefix": "/app/", "read": true, "write": true}]}`, http.StatusNoContent, nil)
+	do("PUT", AuthUsersPath+"/alice", "", `{"password": "alicepw", "roles": ["app"]}`, http.StatusNoContent, nil)
+	do("PUT", AuthUsersPath+"/bob", "", `{"password": "bobpw", "roles": ["app"]}`, http.StatusNoContent, nil)
+	do("PUT", AuthUsersPath+"/root", "", `{"password": "rootpw", "roles": ["root"]}`, http.StatusNoContent, nil)
+	for i := 0; ; i++ {
+		h.Store.Mu.RLock()
+		ok := h.Store.auth.Users["root"] != nil
+		h.Store.Mu.RUnlock()
+		if ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("users not applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	do("PUT", AuthEnablePath, "", "", http.StatusNoContent, nil)
+	for !h.authEnabled() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	login := func(name string) string {
+		var resp AuthenticateResponse
+		do("POST", AuthenticatePath, "", `{"name": "`+name+`", "password": "`+name+`pw"}`, http.StatusOK, &resp)
+		return resp.Token
+	}
+	alice, bob, root := login("alice"), login("bob"), login("root")
+
+	var lr LeaseResponse
+	do("POST", LeasePathPrefix, alice, `{"id": 7, "ttl": 30}`, http.StatusOK, &lr)
+	do("PUT", "/app/a?lease=7", alice, "1", http.StatusNoContent, nil)
+	do("PUT", "/secret?lease=7", root, "1", http.StatusNoContent, nil)
+	// others cannot attach keys to the lease, keep it alive or revoke it
+	do("PUT", "/app/b?lease=7", bob, "1", http.StatusForbidden, nil)
+	do("POST", LeasePathPrefix+"7/keepalive", bob, "", http.StatusForbidden, nil)
+	do("DELETE", LeasePathPrefix+"7", bob, "", http.StatusForbidden, nil)
+	do("POST", LeasePathPrefix+"7/keepalive", alice, "", http.StatusOK, nil)
+
+	// the status lists the keys its reader may read
+	var st LeaseStatus
+	do("GET", LeasePathPrefix+"7", alice, "", http.StatusOK, &st)
+	if st.Owner != "alice" || !reflect.DeepEqual(st.Keys, []string{"/app/a"}) {
+		t.Errorf("lease status for alice = %+v, want owner alice and key /app/a", st)
+	}
+	do("GET", LeasePathPrefix+"7", root, "", http.StatusOK, &st)
+	if !reflect.DeepEqual(st.Keys, []string{"/app/a", "/secret"}) {
+		t.Errorf("lease status for root = %+v, want both keys", st)
+	}
+
+	do("DELETE", LeasePathPrefix+"7", alice, "", http.StatusOK, &lr)
+	if lr.Deleted != 2 {
+		t.Errorf("revoke = %+v, want 2 keys deleted", lr)
+	}
+	// root may revoke any lease
+	do("POST", LeasePathPrefix, bob, `{"id": 8, "ttl": 30}`, http.StatusOK, nil)
+	do("DELETE", LeasePathPrefix+"8", root, "", http.StatusOK, nil)
+}
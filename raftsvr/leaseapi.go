@@ -0,0 +1,116 @@
+package raftsvr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+// LeasePathPrefix serves the lease API. The keys starting with it are
+// reserved for it:
+//
+//	GET    /leases/                  lists the IDs of the leases
+//	POST   /leases/                  grants the lease of a GrantRequest
+//	GET    /leases/<id>              serves the LeaseStatus of a lease
+//	POST   /leases/<id>/keepalive    restarts the TTL of a lease
+//	DELETE /leases/<id>              revokes a lease and deletes its keys
+//
+// A key is attached to a lease by a PUT with the lease query parameter, or
+// by a put of a txn with a Lease.
+const LeasePathPrefix = "/leases/"
+
+// LeaseHeader is the lease of the key read by a GET, if it has one.
+const LeaseHeader = "X-Lease"
+
+// GrantRequest is the body of a POST on LeasePathPrefix. A random ID is
+// chosen if ID is 0.
+type GrantRequest struct {
+	ID  int64 `json:"id,omitempty"`
+	TTL int64 `json:"ttl"`
+}
+
+// serveLease serves the paths under LeasePathPrefix. Any authenticated user
+// may grant a lease, which only they and root may then keep alive, revoke
+// or attach keys to. The status of a lease lists the keys its reader may
+// read.
+func (h *HttpKVAPI) serveLease(w http.ResponseWriter, r *http.Request) {
+	ctx, err := h.withUser(r.Context(), r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	r = r.WithContext(ctx)
+	path := strings.TrimPrefix(r.URL.Path, LeasePathPrefix)
+	if path == "" {
+		switch r.Method {
+		case "GET":
+			writeJSON(w, h.Store.LeaseIDs())
+		case "POST":
+			var req GrantRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, err))
+				return
+			}
+			h.serveLeaseResponse(w, r, func(ctx context.Context) (*LeaseResponse, error) {
+				return h.Store.Grant(ctx, req.ID, req.TTL)
+			})
+		default:
+			writeError(w, errhandle.NewError(errhandle.E_METHOD_NOT_ALLOWED, nil))
+		}
+		return
+	}
+
+	keepAlive := strings.HasSuffix(path, "/keepalive")
+	id, err := strconv.ParseInt(strings.TrimSuffix(path, "/keepalive"), 10, 64)
+	if err != nil {
+		writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, err))
+		return
+	}
+	switch {
+	case keepAlive && r.Method == "POST":
+		h.serveLeaseResponse(w, r, func(ctx context.Context) (*LeaseResponse, error) {
+			return h.Store.KeepAlive(ctx, id)
+		})
+	case !keepAlive && r.Method == "GET":
+		st, err := h.Store.Lease(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if user, ok := ctx.Value(userKey{}).(string); ok {
+			h.Store.Mu.RLock()
+			keys := make([]string, 0, len(st.Keys))
+			for _, k := range st.Keys {
+				if h.Store.auth.permitted(user, k, false) {
+					keys = append(keys, k)
+				}
+			}
+			h.Store.Mu.RUnlock()
+			st.Keys = keys
+		}
+		writeJSON(w, st)
+	case !keepAlive && r.Method == "DELETE":
+		h.serveLeaseResponse(w, r, func(ctx context.Context) (*LeaseResponse, error) {
+			return h.Store.Revoke(ctx, id)
+		})
+	default:
+		writeError(w, errhandle.NewError(errhandle.E_METHOD_NOT_ALLOWED, nil))
+	}
+}
+
+// serveLeaseResponse answers with the response of the lease request made
+// by propose once it is applied.
+func (h *HttpKVAPI) serveLeaseResponse(w http.ResponseWriter, r *http.Request, propose func(ctx context.Context) (*LeaseResponse, error)) {
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	resp, err := propose(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,170 @@
+package raftsvr
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+// Member is the entry of a member in the member registry. Each member
+// publishes its own entry through raft when it starts, so that the others
+// can send it the requests of their clients.
+type Member struct {
+	ID   uint64 `json:"id"`
+	Name string `json:"name"`
+	// ClientURL is the URL of the key-value API of the member.
+	ClientURL string `json:"clientURL"`
+}
+
+// MembersResponse is the body of a GET on MembersPath.
+type MembersResponse struct {
+	// Leader is the ID of the leader in hexadecimal, as in the stats, or
+	// empty while the cluster has none.
+	Leader  string   `json:"leader,omitempty"`
+	Members []Member `json:"members"`
+}
+
+// Publish proposes the registry entry of m and waits until it is applied.
+func (s *Kvstore) Publish(ctx context.Context, m Member) error {
+	if m.ID == 0 || m.ClientURL == "" {
+		return errhandle.NewError(errhandle.E_INVALID_REQUEST, errors.New("member needs an ID and a client URL"))
+	}
+	_, err := s.propose(ctx, Kv{Member: &m})
+	return err
+}
+
+// Member returns the registry entry of member id.
+func (s *Kvstore) Member(id uint64) (Member, bool) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+	m := s.members[id]
+	if m == nil {
+		return Member{}, false
+	}
+	return *m, true
+}
+
+// Members returns the member registry sorted by ID.
+func (s *Kvstore) Members() []Member {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+	ms := make([]Member, 0, len(s.members))
+	for _, m := range s.members {
+		ms = append(ms, *m)
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].ID < ms[j].ID })
+	return ms
+}
+
+// applyMember applies a committed registry entry with Mu held.
+func (s *Kvstore) applyMember(m *Member) {
+	if s.members == nil {
+		s.members = make(map[uint64]*Member)
+	}
+	if old := s.members[m.ID]; old != nil && *old == *m {
+		return
+	}
+	s.members[m.ID] = m
+	kvLog.Info("published member", map[string]interface{}{
+		"member id":  m.ID,
+		"name":       m.Name,
+		"client url": m.ClientURL,
+	})
+}
+
+func (h *HttpKVAPI) serveMembers(w http.ResponseWriter) {
+	resp := MembersResponse{Members: h.Store.Members()}
+	if h.ServerStats != nil {
+		resp.Leader = h.ServerStats.Leader()
+	}
+	writeJSON(w, resp)
+}
+
+// serveMember serves the member changes on MembersPath/<id> to root: a POST
+// with the peer URL of a new member as its body adds it to the cluster, and
+// a DELETE removes it. Both answer once the change is applied, or with
+// E_MEMBER_EXISTS, E_MEMBER_NOT_FOUND or E_UNSAFE_CONF_CHANGE if it was
+// refused.
+func (h *HttpKVAPI) serveMember(w http.ResponseWriter, r *http.Request, key string) {
+	if err := h.authorize(r, key, permRoot); err != nil {
+		writeError(w, err)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, MembersPath+"/"), 0, 64)
+	if err == nil && id == 0 {
+		err = errors.New("member ID 0")
+	}
+	if err != nil {
+		writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, err))
+		return
+	}
+	cc := raftpb.ConfChange{NodeID: id}
+	switch r.Method {
+	case "POST":
+		peer, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, err))
+			return
+		}
+		if _, err = url.ParseRequestURI(string(peer)); err != nil {
+			writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, err))
+			return
+		}
+		cc.Type = raftpb.ConfChangeAddNode
+		cc.Context = peer
+	case "DELETE":
+		cc.Type = raftpb.ConfChangeRemoveNode
+	default:
+		w.Header().Set("Allow", "POST")
+		w.Header().Add("Allow", "DELETE")
+		writeError(w, errhandle.NewError(errhandle.E_METHOD_NOT_ALLOWED, nil))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	if err = h.proposeConfChange(ctx, cc); err != nil {
+		writeError(w, err)
+		return
+	}
+	kvLog.Info("applied member change", map[string]interface{}{
+		"type":      cc.Type.String(),
+		"member id": id,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// proposeConfChange proposes cc with a new ID and waits until it is
+// applied, as propose does for the requests of the store. It fails with the
+// error of a refused change, or with E_TIMEOUT if ctx is done first.
+func (h *HttpKVAPI) proposeConfChange(ctx context.Context, cc raftpb.ConfChange) error {
+	s := h.Store
+	s.init()
+	cc.ID = atomic.AddUint64(&s.reqID, 1)
+	ch := s.w.Register(cc.ID)
+	select {
+	case h.ConfChangeC <- cc:
+	case <-ctx.Done():
+		s.w.Trigger(cc.ID, nil)
+		return errhandle.NewError(errhandle.E_TIMEOUT, ctx.Err())
+	}
+	select {
+	case x := <-ch:
+		if err, ok := x.(error); ok {
+			return err
+		}
+		return nil
+	case <-ctx.Done():
+		s.w.Trigger(cc.ID, nil)
+		return errhandle.NewError(errhandle.E_TIMEOUT, ctx.Err())
+	}
+}
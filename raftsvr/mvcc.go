@@ -0,0 +1,218 @@
+package raftsvr
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+// KeyValue is a version of a key.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// CreateRevision is the revision the key was created at, ModRevision
+	// the one this version was written at.
+	CreateRevision uint64 `json:"createRevision"`
+	ModRevision    uint64 `json:"modRevision"`
+	// Version counts the writes of the key, from 1 for its creation. It is
+	// 0 for the tombstone written when the key is deleted.
+	Version int64 `json:"version"`
+	// Lease is the ID of the lease the version is attached to, if any.
+	Lease int64 `json:"lease,omitempty"`
+}
+
+func (kv *KeyValue) deleted() bool {
+	return kv.Version == 0
+}
+
+// mvccStore keeps the versions of every key by revision. The revision of a
+// version is the raft index of the entry that wrote it, so that every
+// member agrees on it.
+type mvccStore struct {
+	// Rev is the revision of the last applied entry.
+	Rev uint64 `json:"revision"`
+	// Compacted is the revision of the last compaction: the versions
+	// replaced at or before it are dropped, so reads before it fail.
+	Compacted uint64 `json:"compacted"`
+	// Keys holds the versions of each key, oldest first.
+	Keys map[string][]KeyValue `json:"keys"`
+
+	// changed holds the keys written since the last chunked snapshot, whose
+	// chunks must be marshaled again; nil if any key may have changed.
+	changed map[string]struct{}
+	// shared is set while Keys is shared with a snapshot view: the next
+	// write copies it first. The versions themselves are never modified.
+	shared bool
+}
+
+// put writes a version of key attached to lease, or to none if lease is 0,
+// at rev, which must not be below the revision of the store. It returns the
+// version it replaces, if any.
+func (m *mvccStore) put(key, value string, lease int64, rev uint64) *KeyValue {
+	kv := KeyValue{Key: key, Value: value, CreateRevision: rev, ModRevision: rev, Version: 1, Lease: lease}
+	prev := m.latest(key)
+	if prev != nil {
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+	}
+	m.append(kv)
+	return prev
+}
+
+// del writes a tombstone of key at rev and returns the version it deletes,
+// or nil if the key does not exist.
+func (m *mvccStore) del(key string, rev uint64) *KeyValue {
+	prev := m.latest(key)
+	if prev != nil {
+		m.append(KeyValue{Key: key, ModRevision: rev})
+	}
+	return prev
+}
+
+func (m *mvccStore) append(kv KeyValue) {
+	m.own()
+	if m.Keys == nil {
+		m.Keys = make(map[string][]KeyValue)
+	}
+	m.Keys[kv.Key] = append(m.Keys[kv.Key], kv)
+	m.Rev = kv.ModRevision
+	if m.changed != nil {
+		m.changed[kv.Key] = struct{}{}
+	}
+}
+
+// latest returns a copy of the latest version of key, or nil if the key
+// does not exist.
+func (m *mvccStore) latest(key string) *KeyValue {
+	vs := m.Keys[key]
+	if len(vs) == 0 || vs[len(vs)-1].deleted() {
+		return nil
+	}
+	kv := vs[len(vs)-1]
+	return &kv
+}
+
+// keys returns the existing keys from key up to end excluded, in order. An
+// empty end only matches key itself.
+func (m *mvccStore) keys(key, end string) []string {
+	if end == "" {
+		if m.latest(key) == nil {
+			return nil
+		}
+		return []string{key}
+	}
+	var keys []string
+	for k := range m.Keys {
+		if k >= key && k < end && m.latest(k) != nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// leaseKeys returns the existing keys attached to lease, in order.
+func (m *mvccStore) leaseKeys(lease int64) []string {
+	var keys []string
+	for k := range m.Keys {
+		if kv := m.latest(k); kv != nil && kv.Lease == lease {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// PrefixEnd returns the end of the range of the keys starting with prefix,
+// which must not be made of 0xff bytes only. The keys of the API start with
+// "/".
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return prefix
+}
+
+// get returns the version of key at revision rev, or its latest version if
+// rev is 0.
+func (m *mvccStore) get(key string, rev uint64) (KeyValue, error) {
+	if err := m.checkRev(rev); err != nil {
+		return KeyValue{}, err
+	}
+	vs := m.Keys[key]
+	i := len(vs)
+	if rev != 0 {
+		i = sort.Search(len(vs), func(i int) bool { return vs[i].ModRevision > rev })
+	}
+	if i == 0 || vs[i-1].deleted() {
+		return KeyValue{}, errhandle.NewError(errhandle.E_KEY_NOT_FOUND, nil)
+	}
+	return vs[i-1], nil
+}
+
+// checkRev fails unless the store can be read at revision rev.
+func (m *mvccStore) checkRev(rev uint64) error {
+	switch {
+	case rev == 0:
+		return nil
+	case rev < m.Compacted:
+		return errhandle.NewError(errhandle.E_COMPACTED, fmt.Errorf("revision %d is compacted, the oldest is %d", rev, m.Compacted))
+	case rev > m.Rev:
+		return errhandle.NewError(errhandle.E_FUTURE_REV, fmt.Errorf("revision %d is ahead of %d", rev, m.Rev))
+	}
+	return nil
+}
+
+// checkCompact returns the error compacting at rev would fail with.
+func (m *mvccStore) checkCompact(rev uint64) error {
+	switch {
+	case rev <= m.Compacted:
+		return errhandle.NewError(errhandle.E_COMPACTED, fmt.Errorf("revision %d is already compacted", rev))
+	case rev > m.Rev:
+		return errhandle.NewError(errhandle.E_FUTURE_REV, fmt.Errorf("revision %d is ahead of %d", rev, m.Rev))
+	}
+	return nil
+}
+
+// compact drops the versions replaced at or before rev, and the tombstones
+// written at or before it. Reads at rev and later return what they did
+// before.
+func (m *mvccStore) compact(rev uint64) {
+	m.own()
+	for key, vs := range m.Keys {
+		i := sort.Search(len(vs), func(i int) bool { return vs[i].ModRevision > rev })
+		if i == 0 {
+			continue
+		}
+		if vs[i-1].deleted() {
+			i++
+		}
+		switch {
+		case i-1 >= len(vs):
+			delete(m.Keys, key)
+		case i > 1:
+			m.Keys[key] = append([]KeyValue(nil), vs[i-1:]...)
+		}
+	}
+	m.Compacted = rev
+	m.changed = nil
+}
+
+// own copies Keys if a snapshot view shares it, before it is written. The
+// slices of versions are shared still: they are only appended to, beyond
+// the versions the view holds.
+func (m *mvccStore) own() {
+	if !m.shared {
+		return
+	}
+	keys := make(map[string][]KeyValue, len(m.Keys))
+	for k, vs := range m.Keys {
+		keys[k] = vs
+	}
+	m.Keys, m.shared = keys, false
+}
@@ -0,0 +1,173 @@
+package raftsvr
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+func TestMVCCGet(t *testing.T) {
+	var m mvccStore
+	m.put("/a", "1", 0, 2)
+	m.put("/b", "x", 0, 3)
+	m.put("/a", "2", 0, 5)
+	m.Rev = 6
+
+	tests := []struct {
+		key   string
+		rev   uint64
+		w     KeyValue
+		wcode int
+	}{
+		{"/a", 0, KeyValue{Key: "/a", Value: "2", CreateRevision: 2, ModRevision: 5, Version: 2}, 0},
+		{"/a", 4, KeyValue{Key: "/a", Value: "1", CreateRevision: 2, ModRevision: 2, Version: 1}, 0},
+		{"/a", 5, KeyValue{Key: "/a", Value: "2", CreateRevision: 2, ModRevision: 5, Version: 2}, 0},
+		{"/a", 1, KeyValue{}, errhandle.E_KEY_NOT_FOUND},
+		{"/b", 2, KeyValue{}, errhandle.E_KEY_NOT_FOUND},
+		{"/c", 0, KeyValue{}, errhandle.E_KEY_NOT_FOUND},
+		{"/a", 7, KeyValue{}, errhandle.E_FUTURE_REV},
+	}
+	for i, tt := range tests {
+		kv, err := m.get(tt.key, tt.rev)
+		if errhandle.Code(err) != tt.wcode {
+			t.Errorf("#%d: error = %v, want code %d", i, err, tt.wcode)
+		}
+		if kv != tt.w {
+			t.Errorf("#%d: kv = %+v, want %+v", i, kv, tt.w)
+		}
+	}
+}
+
+func TestMVCCCompact(t *testing.T) {
+	var m mvccStore
+	m.put("/a", "1", 0, 1)
+	m.put("/a", "2", 0, 2)
+	m.put("/b", "x", 0, 3)
+	m.put("/a", "3", 0, 4)
+
+	if err := m.checkCompact(5); errhandle.Code(err) != errhandle.E_FUTURE_REV {
+		t.Errorf("compact ahead of the store error = %v, want code %d", err, errhandle.E_FUTURE_REV)
+	}
+	if err := m.checkCompact(3); err != nil {
+		t.Fatal(err)
+	}
+	m.compact(3)
+	if err := m.checkCompact(3); errhandle.Code(err) != errhandle.E_COMPACTED {
+		t.Errorf("compact twice error = %v, want code %d", err, errhandle.E_COMPACTED)
+	}
+
+	if n := len(m.Keys["/a"]); n != 2 {
+		t.Errorf("/a has %d versions, want 2", n)
+	}
+	if kv, err := m.get("/a", 3); err != nil || kv.Value != "2" {
+		t.Errorf("/a at 3 = %+v, %v; want 2", kv, err)
+	}
+	if kv, err := m.get("/b", 3); err != nil || kv.Value != "x" {
+		t.Errorf("/b at 3 = %+v, %v; want x", kv, err)
+	}
+	if _, err := m.get("/a", 2); errhandle.Code(err) != errhandle.E_COMPACTED {
+		t.Errorf("/a at 2 error = %v, want code %d", err, errhandle.E_COMPACTED)
+	}
+	if kv, _ := m.get("/a", 0); kv.Version != 3 || kv.CreateRevision != 1 {
+		t.Errorf("/a = %+v, want version 3 created at 1", kv)
+	}
+}
+
+func TestServeRevisions(t *testing.T) {
+	h, srv, stop := newTestServer(t)
+	defer stop()
+
+	do := func(method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	// writes are answered before they are applied
+	waitRev := func(rev uint64) {
+		for i := 0; i < 100; i++ {
+			if r, _ := h.Store.Revisions(); r >= rev {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("revision %d not applied", rev)
+	}
+
+	do("PUT", "/foo", "1")
+	do("PUT", "/bar", "x")
+	do("PUT", "/foo", "2")
+	waitRev(3)
+
+	tests := []struct {
+		path    string
+		wstatus int
+		wheader map[string]string
+	}{
+		{"/foo", http.StatusOK, map[string]string{RevisionHeader: "3", CreateRevisionHeader: "1", ModRevisionHeader: "3", VersionHeader: "2"}},
+		{"/foo?rev=2", http.StatusOK, map[string]string{RevisionHeader: "3", ModRevisionHeader: "1", VersionHeader: "1"}},
+		{"/bar?rev=1", http.StatusNotFound, map[string]string{RevisionHeader: "3"}},
+		{"/foo?rev=4", http.StatusBadRequest, nil},
+		{"/foo?rev=x", http.StatusBadRequest, nil},
+	}
+	for i, tt := range tests {
+		resp := do("GET", tt.path, "")
+		if resp.StatusCode != tt.wstatus {
+			t.Errorf("#%d: GET %s = %d, want %d", i, tt.path, resp.StatusCode, tt.wstatus)
+		}
+		for k, v := range tt.wheader {
+			if g := resp.Header.Get(k); g != v {
+				t.Errorf("#%d: %s = %q, want %q", i, k, g, v)
+			}
+		}
+	}
+
+	if resp := do("PUT", CompactionPath, `{"revision": 4}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("compact ahead of the store = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if resp := do("PUT", CompactionPath, `{"revision": 2}`); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("compact = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	for i := 0; ; i++ {
+		if _, compacted := h.Store.Revisions(); compacted == 2 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("compaction not applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if resp := do("GET", "/foo?rev=1", ""); resp.StatusCode != http.StatusGone {
+		t.Errorf("GET at a compacted revision = %d, want %d", resp.StatusCode, http.StatusGone)
+	}
+	if resp := do("GET", "/foo?rev=2", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET at the compacted revision = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp := do("PUT", CompactionPath, `{"revision": 2}`); resp.StatusCode != http.StatusGone {
+		t.Errorf("compact twice = %d, want %d", resp.StatusCode, http.StatusGone)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+CompactionPath, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var st CompactionStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if st != (CompactionStatus{Revision: 4, Compacted: 2}) {
+		t.Errorf("status = %+v, want revision 4 compacted at 2", st)
+	}
+}
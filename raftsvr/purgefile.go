@@ -4,6 +4,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/fearblackcat/swiftRaft/utils/api/snap"
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
 	"github.com/fearblackcat/swiftRaft/utils/logtool"
 	"github.com/fearblackcat/swiftRaft/utils/pkg/fileutil"
 )
@@ -24,6 +26,11 @@ type ServerAttach struct {
 	Done         chan struct{}
 	WgMu         sync.RWMutex
 	Wg           sync.WaitGroup
+	// ErrorC receives the error that stopped purging files, if set.
+	ErrorC chan<- error
+	// Snapshotter, if set, purges the chunks of the chunked snapshots that
+	// were purged.
+	Snapshotter *snap.Snapshotter
 }
 
 func NewServerAttach(waldir, snapdir string, stop, done chan struct{}) *ServerAttach {
@@ -44,7 +51,7 @@ func (s *ServerAttach) GoAttach(f func()) {
 	defer s.WgMu.RUnlock()
 	select {
 	case <-s.Stopping:
-		logtool.NLog.Warn("server has stopped; skipping goAttach")
+		kvLog.Warn("server has stopped; skipping goAttach", map[string]interface{}{})
 		return
 	default:
 	}
@@ -62,18 +69,50 @@ func (s *ServerAttach) PurgeFile() {
 	var serrc, werrc <-chan error
 	if s.MaxSnapFiles > 0 {
 		//dberrc = fileutil.PurgeFile(logtool.RLog, s.SnapDir, "snap.db", s.MaxSnapFiles, purgeFileInterval, s.Done)
-		serrc = fileutil.PurgeFile(logtool.RLog, s.SnapDir, "snap", s.MaxSnapFiles, purgeFileInterval, s.Done)
+		serrc = fileutil.PurgeFile(logtool.Logger(logtool.SubsystemSnap), s.SnapDir, "snap", s.MaxSnapFiles, purgeFileInterval, s.Done)
 	}
 	if s.MaxWALFiles > 0 {
-		werrc = fileutil.PurgeFile(logtool.RLog, s.WalDir, "wal", s.MaxWALFiles, purgeFileInterval, s.Done)
+		werrc = fileutil.PurgeFile(logtool.Logger(logtool.SubsystemWAL), s.WalDir, "wal", s.MaxWALFiles, purgeFileInterval, s.Done)
+	}
+	if s.Snapshotter != nil {
+		go s.purgeChunks()
 	}
 
+	var err error
 	select {
-	case e := <-serrc:
-		logtool.RLog.Fatal("failed to purge snap file", map[string]interface{}{"error": e.Error()})
-	case e := <-werrc:
-		logtool.RLog.Fatal("failed to purge wal file", map[string]interface{}{"error": e.Error()})
+	case err = <-serrc:
+		kvLog.Error("failed to purge snap file", map[string]interface{}{"error": err})
+	case err = <-werrc:
+		kvLog.Error("failed to purge wal file", map[string]interface{}{"error": err})
 	case <-s.Stopping:
 		return
 	}
+	if s.ErrorC == nil {
+		return
+	}
+	select {
+	case s.ErrorC <- errhandle.NewError(errhandle.E_DATA_DIR, err):
+	case <-s.Stopping:
+	case <-s.Done:
+	}
+}
+
+// purgeChunks purges the unused snapshot chunks every purgeFileInterval.
+// A failure is retried: it may come from a snap file purged while it was
+// read.
+func (s *ServerAttach) purgeChunks() {
+	t := time.NewTicker(purgeFileInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.Stopping:
+			return
+		case <-s.Done:
+			return
+		}
+		if _, err := s.Snapshotter.PurgeChunks(); err != nil {
+			kvLog.Warn("failed to purge snapshot chunks", map[string]interface{}{"error": err})
+		}
+	}
 }
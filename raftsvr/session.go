@@ -0,0 +1,97 @@
+package raftsvr
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+// Headers of a client session on the requests that write keys. A request
+// with the same ClientIDHeader and SequenceHeader as an applied one is not
+// applied again but answered like it, so a client may retry a request that
+// timed out without writing twice. The client ID is the ID of a lease, and
+// the session ends with it.
+const (
+	ClientIDHeader = "X-Client-ID"
+	SequenceHeader = "X-Sequence"
+)
+
+// clientSession is the last request applied for a client session, with its
+// response or error, after the client sessions of section 6.3 of the raft
+// thesis. User is the user that made it while auth was enabled.
+type clientSession struct {
+	Seq      uint64          `json:"seq"`
+	User     string          `json:"user,omitempty"`
+	Response *TxnResponse    `json:"response,omitempty"`
+	Err      *errhandle.Body `json:"error,omitempty"`
+}
+
+func (cs *clientSession) result() interface{} {
+	if cs.Err != nil {
+		return cs.Err.Err()
+	}
+	return cs.Response
+}
+
+// applySessionTxn applies the committed txn of a client session with Mu
+// held, unless it is the last one applied for the session whose result is
+// returned again. Only the owner of the lease of a session may use it, so
+// that no one else reads its results or moves its sequence on.
+func (s *Kvstore) applySessionTxn(kv *Kv, c *Commit) interface{} {
+	l := s.leases[kv.Client]
+	if l == nil {
+		return errhandle.NewError(errhandle.E_LEASE_NOT_FOUND, fmt.Errorf("client session %d", kv.Client))
+	}
+	if !s.auth.ownsLease(kv.User, l) {
+		return errPermissionDenied
+	}
+	if cs := s.sessions[kv.Client]; cs != nil {
+		switch {
+		case s.auth.Enabled && kv.User != "" && cs.User != kv.User:
+			return errPermissionDenied
+		case kv.Seq == cs.Seq:
+			kvLog.Debug("skipping duplicate request", map[string]interface{}{
+				"client":   kv.Client,
+				"sequence": kv.Seq,
+				"index":    c.Index,
+			})
+			return cs.result()
+		case kv.Seq < cs.Seq:
+			return errhandle.NewError(errhandle.E_STALE_SEQUENCE, fmt.Errorf("sequence %d, last applied %d", kv.Seq, cs.Seq))
+		}
+	}
+	result := s.applyTxn(kv.Txn, kv.User, c)
+	cs := &clientSession{Seq: kv.Seq, User: kv.User}
+	if err, ok := result.(error); ok {
+		b := apiError(err).Body()
+		cs.Err = &b
+	} else {
+		cs.Response = result.(*TxnResponse)
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[int64]*clientSession)
+	}
+	s.sessions[kv.Client] = cs
+	return result
+}
+
+// clientSeq returns the client session and sequence number of r, or zeros
+// if it has none.
+func clientSeq(r *http.Request) (int64, uint64, error) {
+	id := r.Header.Get(ClientIDHeader)
+	if id == "" {
+		return 0, 0, nil
+	}
+	client, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, 0, errhandle.NewError(errhandle.E_INVALID_REQUEST, err)
+	}
+	seq, err := strconv.ParseUint(r.Header.Get(SequenceHeader), 10, 64)
+	if err != nil {
+		return 0, 0, errhandle.NewError(errhandle.E_INVALID_REQUEST, errors.New(SequenceHeader+" must be set along with "+ClientIDHeader))
+	}
+	return client, seq, nil
+}
@@ -0,0 +1,164 @@
+package raftsvr
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+func TestSessionTxn(t *testing.T) {
+	h, _, stop := newTestServer(t)
+	defer stop()
+	s := h.Store
+	ctx := context.Background()
+
+	put := func(v string) *Txn {
+		return &Txn{Success: []Op{{Type: OpPut, Key: "/counter", Value: v}}}
+	}
+	if _, err := s.SessionTxn(ctx, 1, 1, put("1")); errhandle.Code(err) != errhandle.E_LEASE_NOT_FOUND {
+		t.Errorf("txn without a lease error = %v, want code %d", err, errhandle.E_LEASE_NOT_FOUND)
+	}
+	if _, err := s.SessionTxn(ctx, 1, 0, put("1")); errhandle.Code(err) != errhandle.E_INVALID_REQUEST {
+		t.Errorf("txn without a sequence error = %v, want code %d", err, errhandle.E_INVALID_REQUEST)
+	}
+	lr, err := s.Grant(ctx, 0, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := lr.ID
+
+	first, err := s.SessionTxn(ctx, client, 1, put("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a retry is answered like the first attempt without being applied
+	again, err := s.SessionTxn(ctx, client, 1, put("1"))
+	if err != nil || again.Revision != first.Revision {
+		t.Errorf("retry = %+v, %v; want the response at revision %d", again, err, first.Revision)
+	}
+	if kv, _, _ := s.Get("/counter", 0); kv.Version != 1 {
+		t.Errorf("version after a retry = %d, want 1", kv.Version)
+	}
+
+	// errors are cached too
+	bad := &Txn{Success: []Op{{Type: OpPut, Key: "/x", Lease: client + 1}}}
+	if _, err = s.SessionTxn(ctx, client, 2, bad); errhandle.Code(err) != errhandle.E_LEASE_NOT_FOUND {
+		t.Errorf("txn error = %v, want code %d", err, errhandle.E_LEASE_NOT_FOUND)
+	}
+	if _, err = s.SessionTxn(ctx, client, 2, put("2")); errhandle.Code(err) != errhandle.E_LEASE_NOT_FOUND {
+		t.Errorf("retried txn error = %v, want the cached code %d", err, errhandle.E_LEASE_NOT_FOUND)
+	}
+	if _, err = s.SessionTxn(ctx, client, 1, put("1")); errhandle.Code(err) != errhandle.E_STALE_SEQUENCE {
+		t.Errorf("stale txn error = %v, want code %d", err, errhandle.E_STALE_SEQUENCE)
+	}
+	if _, err = s.SessionTxn(ctx, client, 3, put("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	// sessions survive snapshots
+	data, err := s.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r Kvstore
+	if err = r.RecoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if cs := r.sessions[client]; cs == nil || cs.Seq != 3 || cs.Response == nil {
+		t.Errorf("recovered session = %+v, want sequence 3 with its response", cs)
+	}
+
+	// and end with their lease
+	if _, err = s.Revoke(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	s.Mu.RLock()
+	n := len(s.sessions)
+	s.Mu.RUnlock()
+	if n != 0 {
+		t.Errorf("%d sessions left after the revoke of their lease", n)
+	}
+}
+
+func TestServeSessionPut(t *testing.T) {
+	h, srv, stop := newTestServer(t)
+	defer stop()
+	if _, err := h.Store.Grant(context.Background(), 5, 60); err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(client, seq string) int {
+		req, err := http.NewRequest("PUT", srv.URL+"/foo", strings.NewReader("bar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(ClientIDHeader, client)
+		if seq != "" {
+			req.Header.Set(SequenceHeader, seq)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for i := 0; i < 2; i++ {
+		if code := put("5", "1"); code != http.StatusNoContent {
+			t.Fatalf("PUT #%d = %d, want %d", i, code, http.StatusNoContent)
+		}
+	}
+	if kv, _, _ := h.Store.Get("/foo", 0); kv.Version != 1 {
+		t.Errorf("version after a retried PUT = %d, want 1", kv.Version)
+	}
+	if code := put("5", ""); code != http.StatusBadRequest {
+		t.Errorf("PUT without a sequence = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := put("6", "1"); code != http.StatusNotFound {
+		t.Errorf("PUT in a missing session = %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestSessionTxnOwner(t *testing.T) {
+	h, _, stop := newTestServer(t)
+	defer stop()
+	s := h.Store
+	s.Mu.Lock()
+	s.auth.apply(&AuthRequest{Op: AuthPutRole, Role: &Role{Name: "app", Permissions: []Permission{{Prefix: "/", Read: true, Write: true}}}})
+	for _, name := range []string{"alice", "bob"} {
+		s.auth.apply(&AuthRequest{Op: AuthPutUser, User: &User{Name: name, Password: "hash", Roles: []string{"app"}}})
+	}
+	s.auth.apply(&AuthRequest{Op: AuthPutUser, User: &User{Name: "root", Password: "hash", Roles: []string{RootRole}}})
+	s.auth.apply(&AuthRequest{Op: AuthEnable})
+	s.Mu.Unlock()
+	alice := context.WithValue(context.Background(), userKey{}, "alice")
+	bob := context.WithValue(context.Background(), userKey{}, "bob")
+
+	lr, err := s.Grant(alice, 0, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := &Txn{Success: []Op{{Type: OpPut, Key: "/secret/x", Value: "1"}, {Type: OpGet, Key: "/secret/x"}}}
+	if _, err = s.SessionTxn(alice, lr.ID, 1, put); err != nil {
+		t.Fatal(err)
+	}
+	// another user can neither read the results of the session nor move
+	// its sequence on
+	for _, seq := range []uint64{1, 2} {
+		if resp, err := s.SessionTxn(bob, lr.ID, seq, put); errhandle.Code(err) != errhandle.E_PERMISSION_DENIED {
+			t.Errorf("txn of another user at sequence %d = %+v, %v; want code %d", seq, resp, err, errhandle.E_PERMISSION_DENIED)
+		}
+	}
+	if _, err = s.SessionTxn(alice, lr.ID, 2, put); err != nil {
+		t.Errorf("txn of the owner after the others = %v, want success", err)
+	}
+	s.Mu.RLock()
+	cs := s.sessions[lr.ID]
+	s.Mu.RUnlock()
+	if cs.User != "alice" || cs.Seq != 2 {
+		t.Errorf("session = %+v, want alice at sequence 2", cs)
+	}
+}
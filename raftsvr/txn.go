@@ -0,0 +1,223 @@
+package raftsvr
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+// Targets of a Compare.
+const (
+	CompareValue          = "value"
+	CompareVersion        = "version"
+	CompareModRevision    = "modRevision"
+	CompareCreateRevision = "createRevision"
+)
+
+// Results of a Compare.
+const (
+	CompareEqual    = "="
+	CompareNotEqual = "!="
+	CompareLess     = "<"
+	CompareGreater  = ">"
+)
+
+// Compare is a condition of a Txn on the latest version of a key. Target
+// names the field of the version compared with the field of the same name
+// of the Compare. A key that does not exist has a version and revisions
+// of 0, and fails every comparison of its value.
+type Compare struct {
+	Key            string `json:"key"`
+	Target         string `json:"target"`
+	Result         string `json:"result"`
+	Value          string `json:"value,omitempty"`
+	Version        int64  `json:"version,omitempty"`
+	ModRevision    uint64 `json:"modRevision,omitempty"`
+	CreateRevision uint64 `json:"createRevision,omitempty"`
+}
+
+// Types of an Op.
+const (
+	OpGet    = "get"
+	OpPut    = "put"
+	OpDelete = "delete"
+)
+
+// Op reads, writes or deletes keys in a Txn.
+type Op struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	// RangeEnd makes a get or a delete cover the keys from Key up to
+	// RangeEnd excluded instead of Key alone.
+	RangeEnd string `json:"rangeEnd,omitempty"`
+	// Value is written by a put.
+	Value string `json:"value,omitempty"`
+	// Lease attaches the key written by a put to a lease, which must
+	// exist when the txn is applied.
+	Lease int64 `json:"lease,omitempty"`
+}
+
+// Txn runs the Success ops if all of the Compares hold, and the Failure ops
+// otherwise. It is proposed and applied through raft as a whole: the ops
+// see the writes of the ops before them, and their writes share one
+// revision.
+type Txn struct {
+	Compare []Compare `json:"compare,omitempty"`
+	Success []Op      `json:"success,omitempty"`
+	Failure []Op      `json:"failure,omitempty"`
+}
+
+// TxnResponse is the result of an applied Txn.
+type TxnResponse struct {
+	// Succeeded tells whether the Success ops ran.
+	Succeeded bool `json:"succeeded"`
+	// Revision is the revision the txn was applied at.
+	Revision uint64 `json:"revision"`
+	// Responses has one entry per op that ran.
+	Responses []OpResponse `json:"responses"`
+}
+
+// OpResponse is the result of an Op.
+type OpResponse struct {
+	// KVs are the keys read by a get.
+	KVs []KeyValue `json:"kvs,omitempty"`
+	// Deleted is the number of keys deleted by a delete.
+	Deleted int `json:"deleted,omitempty"`
+}
+
+func invalidTxn(msg string) error {
+	return errhandle.NewError(errhandle.E_INVALID_REQUEST, errors.New(msg))
+}
+
+// validate returns the error applying t would fail with whatever the state
+// of the store.
+func (t *Txn) validate() error {
+	for _, c := range t.Compare {
+		if c.Key == "" {
+			return invalidTxn("compare key is empty")
+		}
+		switch c.Target {
+		case CompareValue, CompareVersion, CompareModRevision, CompareCreateRevision:
+		default:
+			return invalidTxn("unknown compare target " + c.Target)
+		}
+		switch c.Result {
+		case CompareEqual, CompareNotEqual, CompareLess, CompareGreater:
+		default:
+			return invalidTxn("unknown compare result " + c.Result)
+		}
+	}
+	for _, ops := range [][]Op{t.Success, t.Failure} {
+		for _, op := range ops {
+			if op.Key == "" {
+				return invalidTxn("op key is empty")
+			}
+			switch op.Type {
+			case OpGet, OpDelete:
+				if op.RangeEnd != "" && op.RangeEnd <= op.Key {
+					return invalidTxn("range end must be above the key")
+				}
+				if op.Lease != 0 {
+					return invalidTxn("only a put takes a lease")
+				}
+			case OpPut:
+				if op.RangeEnd != "" {
+					return invalidTxn("a put has no range end")
+				}
+			default:
+				return invalidTxn("unknown op type " + op.Type)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *mvccStore) compare(c *Compare) bool {
+	kv := m.latest(c.Key)
+	if kv == nil {
+		if c.Target == CompareValue {
+			return false
+		}
+		kv = &KeyValue{}
+	}
+	var r int
+	switch c.Target {
+	case CompareValue:
+		r = strings.Compare(kv.Value, c.Value)
+	case CompareVersion:
+		r = compareUint(uint64(kv.Version), uint64(c.Version))
+	case CompareModRevision:
+		r = compareUint(kv.ModRevision, c.ModRevision)
+	case CompareCreateRevision:
+		r = compareUint(kv.CreateRevision, c.CreateRevision)
+	}
+	switch c.Result {
+	case CompareEqual:
+		return r == 0
+	case CompareNotEqual:
+		return r != 0
+	case CompareLess:
+		return r < 0
+	case CompareGreater:
+		return r > 0
+	}
+	return false
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// txn applies a validated txn at revision rev and returns its response and
+// the events of its writes, without their term. It fails without applying
+// anything if a put of the branch that runs takes a lease missing from
+// leases.
+func (m *mvccStore) txn(t *Txn, rev uint64, leases map[int64]*Lease) (*TxnResponse, []Event, error) {
+	resp := &TxnResponse{Succeeded: true, Revision: rev}
+	for i := range t.Compare {
+		if !m.compare(&t.Compare[i]) {
+			resp.Succeeded = false
+			break
+		}
+	}
+	ops := t.Success
+	if !resp.Succeeded {
+		ops = t.Failure
+	}
+	for _, op := range ops {
+		if op.Lease != 0 && leases[op.Lease] == nil {
+			return nil, nil, leaseNotFound(op.Lease)
+		}
+	}
+	var evs []Event
+	for _, op := range ops {
+		var r OpResponse
+		switch op.Type {
+		case OpGet:
+			for _, k := range m.keys(op.Key, op.RangeEnd) {
+				r.KVs = append(r.KVs, *m.latest(k))
+			}
+		case OpPut:
+			ev := Event{Type: EventPut, Index: rev, Key: op.Key, Value: op.Value}
+			if prev := m.put(op.Key, op.Value, op.Lease, rev); prev != nil {
+				ev.OldValue = &prev.Value
+			}
+			evs = append(evs, ev)
+		case OpDelete:
+			for _, k := range m.keys(op.Key, op.RangeEnd) {
+				prev := m.del(k, rev)
+				evs = append(evs, Event{Type: EventDelete, Index: rev, Key: k, OldValue: &prev.Value})
+				r.Deleted++
+			}
+		}
+		resp.Responses = append(resp.Responses, r)
+	}
+	return resp, evs, nil
+}
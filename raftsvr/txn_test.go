@@ -0,0 +1,238 @@
+package raftsvr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+func TestTxnValidate(t *testing.T) {
+	tests := []struct {
+		txn Txn
+		w   bool
+	}{
+		{Txn{}, true},
+		{Txn{Compare: []Compare{{Key: "/a", Target: CompareValue, Result: CompareEqual}}, Success: []Op{{Type: OpPut, Key: "/a"}}}, true},
+		{Txn{Failure: []Op{{Type: OpDelete, Key: "/a", RangeEnd: "/b"}}}, true},
+		{Txn{Compare: []Compare{{Key: "/a", Target: "lease", Result: CompareEqual}}}, false},
+		{Txn{Compare: []Compare{{Key: "/a", Target: CompareValue, Result: "~"}}}, false},
+		{Txn{Compare: []Compare{{Target: CompareValue, Result: CompareEqual}}}, false},
+		{Txn{Success: []Op{{Type: "incr", Key: "/a"}}}, false},
+		{Txn{Success: []Op{{Type: OpPut}}}, false},
+		{Txn{Success: []Op{{Type: OpPut, Key: "/a", RangeEnd: "/b"}}}, false},
+		{Txn{Failure: []Op{{Type: OpGet, Key: "/b", RangeEnd: "/a"}}}, false},
+	}
+	for i, tt := range tests {
+		err := tt.txn.validate()
+		if (err == nil) != tt.w {
+			t.Errorf("#%d: error = %v, want valid %v", i, err, tt.w)
+		}
+		if err != nil && errhandle.Code(err) != errhandle.E_INVALID_REQUEST {
+			t.Errorf("#%d: error = %v, want code %d", i, err, errhandle.E_INVALID_REQUEST)
+		}
+	}
+}
+
+func TestMVCCTxn(t *testing.T) {
+	var m mvccStore
+	m.put("/a", "1", 0, 1)
+	m.put("/b", "x", 0, 2)
+
+	// compare fails: the failure branch runs
+	resp, evs, err := m.txn(&Txn{
+		Compare: []Compare{{Key: "/a", Target: CompareValue, Result: CompareEqual, Value: "0"}},
+		Success: []Op{{Type: OpPut, Key: "/a", Value: "2"}},
+		Failure: []Op{{Type: OpGet, Key: "/", RangeEnd: PrefixEnd("/")}},
+	}, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Succeeded || len(evs) != 0 || len(resp.Responses) != 1 || len(resp.Responses[0].KVs) != 2 {
+		t.Errorf("failed txn = %+v, events %+v", resp, evs)
+	}
+
+	// compares hold: puts and deletes share the revision
+	resp, evs, err = m.txn(&Txn{
+		Compare: []Compare{
+			{Key: "/a", Target: CompareModRevision, Result: CompareEqual, ModRevision: 1},
+			{Key: "/c", Target: CompareVersion, Result: CompareEqual},
+			{Key: "/b", Target: CompareCreateRevision, Result: CompareLess, CreateRevision: 3},
+		},
+		Success: []Op{
+			{Type: OpPut, Key: "/a", Value: "2"},
+			{Type: OpDelete, Key: "/b"},
+			{Type: OpGet, Key: "/a"},
+		},
+	}, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Succeeded || resp.Revision != 4 || resp.Responses[1].Deleted != 1 || resp.Responses[2].KVs[0].Value != "2" {
+		t.Errorf("txn = %+v", resp)
+	}
+	wevs := []Event{
+		{Type: EventPut, Index: 4, Key: "/a", Value: "2"},
+		{Type: EventDelete, Index: 4, Key: "/b"},
+	}
+	for i := range evs {
+		if evs[i].OldValue == nil {
+			t.Fatalf("event %d has no old value", i)
+		}
+		evs[i].OldValue = nil
+	}
+	if !reflect.DeepEqual(evs, wevs) {
+		t.Errorf("events = %+v, want %+v", evs, wevs)
+	}
+
+	if _, err := m.get("/b", 0); errhandle.Code(err) != errhandle.E_KEY_NOT_FOUND {
+		t.Errorf("deleted key error = %v, want code %d", err, errhandle.E_KEY_NOT_FOUND)
+	}
+	if kv, err := m.get("/b", 3); err != nil || kv.Value != "x" {
+		t.Errorf("/b before its delete = %+v, %v", kv, err)
+	}
+	// a missing key fails value compares
+	if m.compare(&Compare{Key: "/b", Target: CompareValue, Result: CompareNotEqual, Value: "x"}) {
+		t.Error("value compare on a deleted key holds")
+	}
+
+	// a key created again starts a new version history
+	m.put("/b", "y", 0, 5)
+	if kv, _ := m.get("/b", 0); kv.Version != 1 || kv.CreateRevision != 5 {
+		t.Errorf("recreated key = %+v, want version 1 created at 5", kv)
+	}
+
+	// compacting after a delete drops the tombstone
+	m.del("/b", 6)
+	m.compact(6)
+	if _, ok := m.Keys["/b"]; ok {
+		t.Errorf("versions of a deleted key = %+v, want none after compaction", m.Keys["/b"])
+	}
+}
+
+func TestKvstoreTxn(t *testing.T) {
+	h, _, stop := newTestServer(t)
+	defer stop()
+	s := h.Store
+	ctx := context.Background()
+
+	rev, err := s.CompareAndSwap(ctx, "/lock", Compare{Target: CompareVersion, Result: CompareEqual}, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.CompareAndSwap(ctx, "/lock", Compare{Target: CompareVersion, Result: CompareEqual}, "b"); errhandle.Code(err) != errhandle.E_CAS_MISMATCH {
+		t.Errorf("second create error = %v, want code %d", err, errhandle.E_CAS_MISMATCH)
+	}
+	if _, err = s.CompareAndSwap(ctx, "/lock", Compare{Target: CompareModRevision, Result: CompareEqual, ModRevision: rev}, "c"); err != nil {
+		t.Errorf("swap at the current revision error = %v", err)
+	}
+	if v, _ := s.Lookup("/lock"); v != "c" {
+		t.Errorf("/lock = %q, want %q", v, "c")
+	}
+
+	s.Propose("/dir/a", "1")
+	s.Propose("/dir/b", "2")
+	if ok, err := s.Delete(ctx, "/lock"); !ok || err != nil {
+		t.Errorf("delete = %v, %v; want true", ok, err)
+	}
+	if ok, err := s.Delete(ctx, "/lock"); ok || err != nil {
+		t.Errorf("delete twice = %v, %v; want false", ok, err)
+	}
+	if n, err := s.DeleteRange(ctx, "/dir/", PrefixEnd("/dir/")); n != 2 || err != nil {
+		t.Errorf("delete range = %d, %v; want 2", n, err)
+	}
+
+	// nobody reads the proposals of this store
+	stalled := &Kvstore{ProposeC: make(chan string)}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err = stalled.Txn(ctx, &Txn{}); errhandle.Code(err) != errhandle.E_TIMEOUT {
+		t.Errorf("stalled txn error = %v, want code %d", err, errhandle.E_TIMEOUT)
+	}
+}
+
+func TestServeTxn(t *testing.T) {
+	_, srv, stop := newTestServer(t)
+	defer stop()
+
+	do := func(method, path, body string, header map[string]string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	expect := func(method, path, body string, header map[string]string, wstatus int) *http.Response {
+		resp := do(method, path, body, header)
+		resp.Body.Close()
+		if resp.StatusCode != wstatus {
+			t.Fatalf("%s %s %v = %d, want %d", method, path, header, resp.StatusCode, wstatus)
+		}
+		return resp
+	}
+
+	resp := expect("PUT", "/foo", "1", map[string]string{"If-None-Match": "*"}, http.StatusNoContent)
+	tag := resp.Header.Get("ETag")
+	if g := expect("GET", "/foo", "", nil, http.StatusOK).Header.Get("ETag"); g != tag {
+		t.Errorf("GET ETag = %s, want %s", g, tag)
+	}
+	expect("PUT", "/foo", "2", map[string]string{"If-None-Match": "*"}, http.StatusPreconditionFailed)
+	expect("PUT", "/foo", "2", map[string]string{"If-Match": `"999"`}, http.StatusPreconditionFailed)
+	expect("PUT", "/foo", "2", map[string]string{"If-Match": "W/" + tag}, http.StatusBadRequest)
+	expect("PUT", "/foo", "2", map[string]string{"If-Match": tag}, http.StatusNoContent)
+	expect("PUT", "/foo?prevValue=1", "3", nil, http.StatusPreconditionFailed)
+	expect("PUT", "/foo?prevValue=2", "3", nil, http.StatusNoContent)
+	expect("PUT", "/missing", "x", map[string]string{"If-Match": "*"}, http.StatusPreconditionFailed)
+
+	expect("DELETE", "/foo", "", map[string]string{"If-Match": tag}, http.StatusPreconditionFailed)
+	expect("DELETE", "/foo", "", nil, http.StatusNoContent)
+	expect("DELETE", "/foo", "", nil, http.StatusNotFound)
+	expect("GET", "/foo", "", nil, http.StatusNotFound)
+
+	// numeric keys are deleted like any other
+	expect("PUT", "/2", "x", nil, http.StatusNoContent)
+	expect("DELETE", "/2", "", nil, http.StatusNoContent)
+	expect("GET", "/2", "", nil, http.StatusNotFound)
+
+	txn := Txn{
+		Compare: []Compare{{Key: "/dir/a", Target: CompareVersion, Result: CompareEqual}},
+		Success: []Op{{Type: OpPut, Key: "/dir/a", Value: "1"}, {Type: OpPut, Key: "/dir/b", Value: "2"}},
+	}
+	b, _ := json.Marshal(txn)
+	resp = do("POST", TxnPath, string(b), nil)
+	var tr TxnResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !tr.Succeeded || len(tr.Responses) != 2 {
+		t.Errorf("txn = %+v", tr)
+	}
+	resp = do("POST", TxnPath, string(b), nil)
+	tr = TxnResponse{}
+	json.NewDecoder(resp.Body).Decode(&tr)
+	resp.Body.Close()
+	if tr.Succeeded {
+		t.Errorf("txn on an existing key = %+v, want it to fail", tr)
+	}
+
+	resp = do("DELETE", "/dir/?prefix=true", "", nil)
+	var or OpResponse
+	json.NewDecoder(resp.Body).Decode(&or)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || or.Deleted != 2 {
+		t.Errorf("prefix delete = %d %+v, want 2 deleted", resp.StatusCode, or)
+	}
+}
@@ -0,0 +1,141 @@
+package raftsvr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+// TxnPath runs the Txn posted to it and answers with its TxnResponse.
+const TxnPath = "/txn"
+
+// requestTimeout bounds the wait for a proposed txn to be applied.
+const requestTimeout = 5 * time.Second
+
+// etag returns the entity tag of the version of a key written at rev.
+func etag(rev uint64) string {
+	return `"` + strconv.FormatUint(rev, 10) + `"`
+}
+
+// conditions returns the compares on key made by the If-Match and
+// If-None-Match headers and the prevValue query parameter of r. If-Match
+// takes the ETag of the expected version, or * for any, and If-None-Match
+// only * for a key that must not exist.
+func conditions(r *http.Request, key string) ([]Compare, error) {
+	var cmps []Compare
+	switch m := r.Header.Get("If-Match"); {
+	case m == "":
+	case m == "*":
+		cmps = append(cmps, Compare{Key: key, Target: CompareVersion, Result: CompareGreater})
+	case len(m) > 2 && m[0] == '"' && m[len(m)-1] == '"':
+		rev, err := strconv.ParseUint(m[1:len(m)-1], 10, 64)
+		if err != nil {
+			return nil, errhandle.NewError(errhandle.E_INVALID_REQUEST, err)
+		}
+		cmps = append(cmps, Compare{Key: key, Target: CompareModRevision, Result: CompareEqual, ModRevision: rev})
+	default:
+		return nil, errhandle.NewError(errhandle.E_INVALID_REQUEST, errors.New("If-Match takes a single ETag or *"))
+	}
+	switch m := r.Header.Get("If-None-Match"); m {
+	case "":
+	case "*":
+		cmps = append(cmps, Compare{Key: key, Target: CompareVersion, Result: CompareEqual})
+	default:
+		return nil, errhandle.NewError(errhandle.E_INVALID_REQUEST, errors.New("If-None-Match only takes *"))
+	}
+	if v, ok := r.URL.Query()["prevValue"]; ok {
+		cmps = append(cmps, Compare{Key: key, Target: CompareValue, Result: CompareEqual, Value: v[0]})
+	}
+	return cmps, nil
+}
+
+// txn authorizes and runs txn for r, in the client session of r if it has
+// one.
+func (h *HttpKVAPI) txn(r *http.Request, txn *Txn) (*TxnResponse, error) {
+	if err := h.authorizeTxn(r, txn); err != nil {
+		return nil, err
+	}
+	client, seq, err := clientSeq(r)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := h.withUser(r.Context(), r)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	if client != 0 {
+		return h.Store.SessionTxn(ctx, client, seq, txn)
+	}
+	return h.Store.Txn(ctx, txn)
+}
+
+func (h *HttpKVAPI) serveTxn(w http.ResponseWriter, r *http.Request) {
+	var txn Txn
+	if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+		writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, err))
+		return
+	}
+	resp, err := h.txn(r, &txn)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// serveConditionalPut puts value in key, attached to lease unless it is 0,
+// if the compares hold, and answers with the ETag of the new version once
+// it is applied.
+func (h *HttpKVAPI) serveConditionalPut(w http.ResponseWriter, r *http.Request, key, value string, lease int64, cmps []Compare) {
+	resp, err := h.txn(r, &Txn{
+		Compare: cmps,
+		Success: []Op{{Type: OpPut, Key: key, Value: value, Lease: lease}},
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !resp.Succeeded {
+		writeError(w, errhandle.NewError(errhandle.E_CAS_MISMATCH, nil))
+		return
+	}
+	w.Header().Set("ETag", etag(resp.Revision))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveDelete deletes key, or with ?prefix=true the keys starting with key
+// and answers with the number of keys deleted in an OpResponse.
+func (h *HttpKVAPI) serveDelete(w http.ResponseWriter, r *http.Request, key string) {
+	cmps, err := conditions(r, key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix") == "true"
+	op := Op{Type: OpDelete, Key: key}
+	if prefix {
+		op.RangeEnd = PrefixEnd(key)
+	}
+	resp, err := h.txn(r, &Txn{Compare: cmps, Success: []Op{op}})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	switch {
+	case !resp.Succeeded:
+		writeError(w, errhandle.NewError(errhandle.E_CAS_MISMATCH, nil))
+	case prefix:
+		writeJSON(w, resp.Responses[0])
+	case resp.Responses[0].Deleted == 0:
+		writeError(w, errhandle.NewError(errhandle.E_KEY_NOT_FOUND, nil))
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,257 @@
+package raftsvr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+// WatchPath serves the watch API: GET WatchPath+key streams the committed
+// changes of key as server-sent events. With ?prefix=true every key
+// starting with key is watched. ?index=N starts at raft index N, possibly
+// in the past; a Last-Event-ID header resumes after the given index.
+// Without either only new changes are sent.
+const WatchPath = "/watch"
+
+const (
+	// watchHistorySize is the number of recent events kept for watchers
+	// starting or resuming in the past.
+	watchHistorySize = 1000
+	// watchKeepAlive is how often an idle stream gets a comment, so that
+	// proxies do not close it.
+	watchKeepAlive = 30 * time.Second
+)
+
+// Types of an Event.
+const (
+	EventPut    = "put"
+	EventDelete = "delete"
+)
+
+// Event is a committed change of a key.
+type Event struct {
+	Type  string `json:"type"`
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Key   string `json:"key"`
+	// Value is empty for a delete.
+	Value string `json:"value"`
+	// OldValue is nil if the key was created.
+	OldValue *string `json:"oldValue,omitempty"`
+}
+
+// watchHub keeps the recent events of a Kvstore and the watchers waiting
+// for new ones. It is fed by the apply path and never blocks it: a watcher
+// that falls more than watchHistorySize events behind is cancelled, and can
+// resume by index.
+type watchHub struct {
+	mu      sync.Mutex
+	history []Event
+	// compacted is the highest index whose events may have been dropped.
+	compacted uint64
+	watchers  map[*watcher]struct{}
+}
+
+type watcher struct {
+	key    string
+	prefix bool
+	start  uint64
+
+	mu      sync.Mutex
+	pending []Event
+	err     error
+	notifyc chan struct{}
+}
+
+func (w *watcher) matches(ev Event) bool {
+	if ev.Index < w.start {
+		return false
+	}
+	if w.prefix {
+		return strings.HasPrefix(ev.Key, w.key)
+	}
+	return ev.Key == w.key
+}
+
+func (w *watcher) push(ev Event) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) >= watchHistorySize {
+		return false
+	}
+	w.pending = append(w.pending, ev)
+	w.notify()
+	return true
+}
+
+func (w *watcher) cancel(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = nil
+	w.err = err
+	w.notify()
+}
+
+func (w *watcher) notify() {
+	select {
+	case w.notifyc <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the events not yet taken, and the error that cancelled the
+// watcher once they are all taken.
+func (w *watcher) take() ([]Event, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	evs := w.pending
+	w.pending = nil
+	return evs, w.err
+}
+
+func compactedError(index, compacted uint64) error {
+	return errhandle.NewError(errhandle.E_COMPACTED, fmt.Errorf("index %d is compacted, resume from %d or later", index, compacted+1))
+}
+
+// watch registers a watcher of key, or of the keys starting with key if
+// prefix is set, from index start on. A start of 0 only watches changes
+// committed from now on.
+func (h *watchHub) watch(key string, prefix bool, start uint64) (*watcher, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if start != 0 && start <= h.compacted {
+		return nil, compactedError(start, h.compacted)
+	}
+	w := &watcher{key: key, prefix: prefix, start: start, notifyc: make(chan struct{}, 1)}
+	if start != 0 {
+		for _, ev := range h.history {
+			if w.matches(ev) {
+				w.push(ev)
+			}
+		}
+	}
+	if h.watchers == nil {
+		h.watchers = make(map[*watcher]struct{})
+	}
+	h.watchers[w] = struct{}{}
+	return w, nil
+}
+
+func (h *watchHub) unwatch(w *watcher) {
+	h.mu.Lock()
+	delete(h.watchers, w)
+	h.mu.Unlock()
+}
+
+// publish records a committed event and passes it to its watchers.
+func (h *watchHub) publish(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.history) >= watchHistorySize {
+		h.compacted = h.history[0].Index
+		h.history = h.history[1:]
+	}
+	h.history = append(h.history, ev)
+	for w := range h.watchers {
+		if w.matches(ev) && !w.push(ev) {
+			delete(h.watchers, w)
+			w.cancel(compactedError(ev.Index, h.compacted))
+		}
+	}
+}
+
+// reset drops the history once the store was replaced by a snapshot at
+// index, and cancels every watcher since they may have missed events.
+func (h *watchHub) reset(index uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.history = nil
+	h.compacted = index
+	for w := range h.watchers {
+		delete(h.watchers, w)
+		w.cancel(compactedError(index, index))
+	}
+}
+
+// stop cancels every watcher with err.
+func (h *watchHub) stop(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		delete(h.watchers, w)
+		w.cancel(err)
+	}
+}
+
+// serveWatch streams the events of a watch as server-sent events until
+// the client goes away or the watcher is cancelled, which is reported in
+// a final "error" event.
+func (h *HttpKVAPI) serveWatch(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.EscapedPath(), WatchPath)
+	prefix := r.URL.Query().Get("prefix") == "true"
+	if err := h.authorize(r, key, permRead); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var start uint64
+	var err error
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		start, err = strconv.ParseUint(id, 10, 64)
+		start++
+	} else if index := r.URL.Query().Get("index"); index != "" {
+		start, err = strconv.ParseUint(index, 10, 64)
+	}
+	if err != nil {
+		writeError(w, errhandle.NewError(errhandle.E_INVALID_REQUEST, err))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errhandle.NewError(errhandle.E_INTERNAL, fmt.Errorf("streaming is not supported")))
+		return
+	}
+
+	wr, err := h.Store.watches.watch(key, prefix, start)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer h.Store.watches.unwatch(wr)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ":\n\n")
+			flusher.Flush()
+		case <-wr.notifyc:
+			evs, err := wr.take()
+			for _, ev := range evs {
+				b, _ := json.Marshal(ev)
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Index, ev.Type, b)
+			}
+			if err != nil {
+				b, _ := json.Marshal(apiError(err).Body())
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", b)
+				flusher.Flush()
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
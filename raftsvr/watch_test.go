@@ -0,0 +1,201 @@
+package raftsvr
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fearblackcat/swiftRaft/utils/errhandle"
+)
+
+func TestWatchHub(t *testing.T) {
+	var h watchHub
+	old := "v1"
+	h.publish(Event{Index: 1, Term: 1, Key: "/a", Value: "v1"})
+	h.publish(Event{Index: 2, Term: 1, Key: "/b", Value: "x"})
+	h.publish(Event{Index: 3, Term: 2, Key: "/a", Value: "v2", OldValue: &old})
+
+	tests := []struct {
+		key    string
+		prefix bool
+		start  uint64
+		windex []uint64
+	}{
+		{"/a", false, 1, []uint64{1, 3}},
+		{"/a", false, 2, []uint64{3}},
+		{"/", true, 1, []uint64{1, 2, 3}},
+		{"/a", false, 0, nil},
+		{"/c", false, 1, nil},
+	}
+	for i, tt := range tests {
+		w, err := h.watch(tt.key, tt.prefix, tt.start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		evs, _ := w.take()
+		var index []uint64
+		for _, ev := range evs {
+			index = append(index, ev.Index)
+		}
+		if !reflect.DeepEqual(index, tt.windex) {
+			t.Errorf("#%d: indexes = %v, want %v", i, index, tt.windex)
+		}
+		h.unwatch(w)
+	}
+
+	w, err := h.watch("/a", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.publish(Event{Index: 4, Term: 2, Key: "/a", Value: "v3"})
+	if evs, _ := w.take(); len(evs) != 1 || evs[0].Index != 4 {
+		t.Errorf("events = %+v, want index 4", evs)
+	}
+
+	// a watcher that does not keep up is cancelled once history moves on
+	for i := uint64(5); i <= 5+watchHistorySize; i++ {
+		h.publish(Event{Index: i, Key: "/a"})
+	}
+	if evs, err := w.take(); len(evs) != 0 || errhandle.Code(err) != errhandle.E_COMPACTED {
+		t.Errorf("got %d events, error %v; want a compacted error", len(evs), err)
+	}
+	if _, err = h.watch("/a", false, 2); errhandle.Code(err) != errhandle.E_COMPACTED {
+		t.Errorf("watch from a compacted index error = %v, want code %d", err, errhandle.E_COMPACTED)
+	}
+
+	w, err = h.watch("/a", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.reset(5000)
+	if _, err = w.take(); errhandle.Code(err) != errhandle.E_COMPACTED {
+		t.Errorf("error after reset = %v, want code %d", err, errhandle.E_COMPACTED)
+	}
+	if _, err = h.watch("/a", false, 5000); errhandle.Code(err) != errhandle.E_COMPACTED {
+		t.Errorf("watch from the snapshot index error = %v, want code %d", err, errhandle.E_COMPACTED)
+	}
+	if _, err = h.watch("/a", false, 5001); err != nil {
+		t.Errorf("watch after the snapshot index error = %v", err)
+	}
+}
+
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+func readSSE(t *testing.T, r *bufio.Reader) sseEvent {
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if ev.event != "" {
+				return ev
+			}
+		case strings.HasPrefix(line, "id: "):
+			ev.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestServeWatch(t *testing.T) {
+	h, srv, stop := newTestServer(t)
+	defer stop()
+
+	put := func(key, val string) {
+		req, err := http.NewRequest("PUT", srv.URL+key, strings.NewReader(val))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	watch := func(path, lastID string) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := watch(WatchPath+"/app/?prefix=true", "")
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("watch = %d %s, want 200 text/event-stream", resp.StatusCode, ct)
+	}
+	put("/app/a", "1")
+	put("/other", "x")
+	put("/app/a", "2")
+
+	r := bufio.NewReader(resp.Body)
+	var evs []Event
+	for i := 0; i < 2; i++ {
+		sse := readSSE(t, r)
+		var ev Event
+		if err := json.Unmarshal([]byte(sse.data), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if sse.event != "put" || sse.id != strconv.FormatUint(ev.Index, 10) {
+			t.Errorf("event %+v does not match %+v", sse, ev)
+		}
+		evs = append(evs, ev)
+	}
+	if evs[0].Key != "/app/a" || evs[0].Value != "1" || evs[0].OldValue != nil || evs[0].Term != 1 {
+		t.Errorf("first event = %+v", evs[0])
+	}
+	if evs[1].Value != "2" || evs[1].OldValue == nil || *evs[1].OldValue != "1" || evs[1].Index <= evs[0].Index {
+		t.Errorf("second event = %+v", evs[1])
+	}
+
+	// resuming after the first event replays the second one
+	resp2 := watch(WatchPath+"/app/a", strconv.FormatUint(evs[0].Index, 10))
+	defer resp2.Body.Close()
+	var ev Event
+	if err := json.Unmarshal([]byte(readSSE(t, bufio.NewReader(resp2.Body)).data), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Index != evs[1].Index {
+		t.Errorf("resumed event index = %d, want %d", ev.Index, evs[1].Index)
+	}
+
+	// a snapshot cancels the watchers and compacts the history
+	h.Store.watches.reset(100)
+	sse := readSSE(t, r)
+	if sse.event != "error" || !strings.Contains(sse.data, strconv.Itoa(errhandle.E_COMPACTED)) {
+		t.Errorf("event after reset = %+v, want a compacted error", sse)
+	}
+	resp3 := watch(WatchPath+"/app/a?index=50", "")
+	resp3.Body.Close()
+	if resp3.StatusCode != http.StatusGone {
+		t.Errorf("watch from a compacted index = %d, want %d", resp3.StatusCode, http.StatusGone)
+	}
+	resp4 := watch(WatchPath+"/app/a?index=x", "")
+	resp4.Body.Close()
+	if resp4.StatusCode != http.StatusBadRequest {
+		t.Errorf("watch from an invalid index = %d, want %d", resp4.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"path"
@@ -35,9 +36,13 @@ var (
 	ProbingPrefix      = path.Join(RaftPrefix, "probing")
 	RaftStreamPrefix   = path.Join(RaftPrefix, "stream")
 	RaftSnapshotPrefix = path.Join(RaftPrefix, "snapshot")
+	// RaftSnapshotChunksPrefix answers the chunks of a chunked snapshot
+	// that the member lacks.
+	RaftSnapshotChunksPrefix = path.Join(RaftSnapshotPrefix, "chunks")
 
 	errIncompatibleVersion = errors.New("incompatible version")
 	errClusterIDMismatch   = errors.New("cluster ID mismatch")
+	errInvalidStreamPath   = errors.New("invalid path")
 )
 
 type peerGetter interface {
@@ -251,8 +256,14 @@ func (h *snapshotHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		plog.Infof("receiving database snapshot [index:%d, from %s] ...", m.Snapshot.Metadata.Index, types.ID(m.From))
 	}
 
-	// save incoming database snapshot.
-	n, err := h.snapshotter.SaveDBFrom(r.Body, m.Snapshot.Metadata.Index)
+	// save incoming database snapshot, or the chunks of a chunked snapshot
+	// that were missing.
+	var n int64
+	if snap.IsManifest(m.Snapshot.Data) {
+		n, err = h.saveChunks(r.Body, m.Snapshot.Data)
+	} else {
+		n, err = h.snapshotter.SaveDBFrom(r.Body, m.Snapshot.Metadata.Index)
+	}
 	if err != nil {
 		msg := fmt.Sprintf("failed to save KV snapshot (%v)", err)
 		if h.lg != nil {
@@ -315,6 +326,83 @@ func (h *snapshotHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	snapshotReceiveSeconds.WithLabelValues(from).Observe(time.Since(start).Seconds())
 }
 
+// saveChunks saves the chunks of the chunked snapshot data from r, and
+// checks that no chunk of it is missing.
+func (h *snapshotHandler) saveChunks(r io.Reader, data []byte) (int64, error) {
+	m, err := snap.ParseManifest(data)
+	if err != nil {
+		return 0, err
+	}
+	n, err := h.snapshotter.SaveChunksFrom(r)
+	if err != nil {
+		return n, err
+	}
+	if missing := h.snapshotter.MissingChunks(m); len(missing) > 0 {
+		return n, fmt.Errorf("%d chunks of the snapshot are missing", len(missing))
+	}
+	return n, nil
+}
+
+type snapshotChunksHandler struct {
+	lg          *logtool.RLogHandle
+	tr          Transporter
+	snapshotter *snap.Snapshotter
+
+	localID types.ID
+	cid     types.ID
+}
+
+func newSnapshotChunksHandler(t *Transport, snapshotter *snap.Snapshotter, cid types.ID) http.Handler {
+	return &snapshotChunksHandler{
+		lg:          t.Logger,
+		tr:          t,
+		snapshotter: snapshotter,
+		localID:     t.ID,
+		cid:         cid,
+	}
+}
+
+// ServeHTTP answers the Manifest of the chunks of the posted chunked
+// snapshot that are missing, before the snapshot is sent with them only.
+func (h *snapshotChunksHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("X-Etcd-Cluster-ID", h.cid.String())
+
+	if err := checkClusterCompatibilityFromHeader(h.lg, h.localID, r.Header, h.cid); err != nil {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
+	addRemoteFromRequest(h.tr, r)
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, snap.MaxChunkBytes))
+	if err != nil {
+		http.Error(w, "error reading manifest body", http.StatusBadRequest)
+		return
+	}
+	m, err := snap.ParseManifest(data)
+	if err != nil {
+		if h.lg != nil {
+			h.lg.Warn("failed to parse snapshot manifest", map[string]interface{}{
+				"local-member-id": h.localID.String(),
+				"error":           err,
+			})
+		} else {
+			plog.Errorf("failed to parse snapshot manifest (%v)", err)
+		}
+		http.Error(w, "error parsing manifest", http.StatusBadRequest)
+		return
+	}
+	missing := snap.Manifest{Chunks: h.snapshotter.MissingChunks(m)}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(missing.Marshal())
+}
+
 type streamHandler struct {
 	lg         *logtool.RLogHandle
 	tr         *Transport
@@ -354,6 +442,8 @@ func (h *streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch path.Dir(r.URL.Path) {
 	case streamTypeMsgAppV2.endpoint():
 		t = streamTypeMsgAppV2
+	case streamTypeMsgAppV2Compressed.endpoint():
+		t = streamTypeMsgAppV2Compressed
 	case streamTypeMessage.endpoint():
 		t = streamTypeMessage
 	default:
@@ -366,7 +456,7 @@ func (h *streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		} else {
 			plog.Debugf("ignored unexpected streaming request path %s", r.URL.Path)
 		}
-		http.Error(w, "invalid path", http.StatusNotFound)
+		http.Error(w, errInvalidStreamPath.Error(), http.StatusNotFound)
 		return
 	}
 
@@ -170,6 +170,10 @@ func TestServeRaftStreamPrefix(t *testing.T) {
 			RaftStreamPrefix + "/msgapp/1",
 			streamTypeMsgAppV2,
 		},
+		{
+			RaftStreamPrefix + "/msgappz/1",
+			streamTypeMsgAppV2Compressed,
+		},
 	}
 	for i, tt := range tests {
 		req, err := http.NewRequest("GET", "http://localhost:2380"+tt.path, nil)
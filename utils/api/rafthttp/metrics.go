@@ -39,6 +39,24 @@ var (
 		[]string{"From"},
 	)
 
+	sentCompressedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "etcd",
+		Subsystem: "network",
+		Name:      "peer_sent_compressed_bytes_total",
+		Help:      "The total number of bytes sent to peers on compressed streams, as compressed. peer_sent_bytes_total counts them uncompressed.",
+	},
+		[]string{"To"},
+	)
+
+	receivedCompressedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "etcd",
+		Subsystem: "network",
+		Name:      "peer_received_compressed_bytes_total",
+		Help:      "The total number of bytes received from peers on compressed streams, as compressed. peer_received_bytes_total counts them uncompressed.",
+	},
+		[]string{"From"},
+	)
+
 	sentFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "etcd",
 		Subsystem: "network",
@@ -138,6 +156,8 @@ func init() {
 	prometheus.MustRegister(disconnectedPeers)
 	prometheus.MustRegister(sentBytes)
 	prometheus.MustRegister(receivedBytes)
+	prometheus.MustRegister(sentCompressedBytes)
+	prometheus.MustRegister(receivedCompressedBytes)
 	prometheus.MustRegister(sentFailures)
 	prometheus.MustRegister(recvFailures)
 
@@ -195,10 +195,14 @@ func startPeer(t *Transport, urls types.URLs, peerID types.ID, fs *stats.Followe
 		}
 	}()
 
+	msgAppV2Type := streamTypeMsgAppV2
+	if t.CompressStreams {
+		msgAppV2Type = streamTypeMsgAppV2Compressed
+	}
 	p.msgAppV2Reader = &streamReader{
 		lg:     t.Logger,
 		peerID: peerID,
-		typ:    streamTypeMsgAppV2,
+		typ:    msgAppV2Type,
 		tr:     t,
 		picker: picker,
 		status: status,
@@ -233,6 +237,12 @@ func (p *peer) send(m raftpb.Message) {
 		return
 	}
 
+	// a chunked snapshot is sent along the chunks the remote lacks
+	if isMsgSnap(m) && p.snapSender.tr.Snapshotter != nil && snap.IsManifest(m.Snapshot.Data) {
+		go p.snapSender.sendChunks(m, p.pipeline.msgc)
+		return
+	}
+
 	writec, name := p.pick(m)
 	select {
 	case writec <- m:
@@ -283,7 +293,7 @@ func (p *peer) update(urls types.URLs) {
 func (p *peer) attachOutgoingConn(conn *outgoingConn) {
 	var ok bool
 	switch conn.t {
-	case streamTypeMsgAppV2:
+	case streamTypeMsgAppV2, streamTypeMsgAppV2Compressed:
 		ok = p.msgAppV2Writer.attach(conn)
 	case streamTypeMessage:
 		ok = p.writer.attach(conn)
@@ -3,12 +3,16 @@ package rafthttp
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/fearblackcat/swiftRaft/raft"
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
 	"github.com/fearblackcat/swiftRaft/utils/api/snap"
 	"github.com/fearblackcat/swiftRaft/utils/logtool"
 	"github.com/fearblackcat/swiftRaft/utils/pkg/httputil"
@@ -21,6 +25,8 @@ import (
 var (
 	// timeout for reading snapshot response body
 	snapResponseReadTimeout = 5 * time.Second
+
+	errChunksUnsupported = errors.New("snapshot chunks are not supported by the remote")
 )
 
 type snapshotSender struct {
@@ -89,21 +95,7 @@ func (s *snapshotSender) send(merged snap.Message) {
 			plog.Warningf("database snapshot [index: %d, to: %s] failed to be sent out (%v)", m.Snapshot.Metadata.Index, types.ID(m.To), err)
 		}
 
-		// errMemberRemoved is a critical error since a removed member should
-		// always be stopped. So we use reportCriticalError to report it to errorc.
-		if err == errMemberRemoved {
-			reportCriticalError(err, s.errorc)
-		}
-
-		s.picker.unreachable(u)
-		s.status.deactivate(failureType{source: sendSnap, action: "post"}, err.Error())
-		s.r.ReportUnreachable(m.To)
-		// report SnapshotFailure to raft state machine. After raft state
-		// machine knows about it, it would pause a while and retry sending
-		// new snapshot message.
-		s.r.ReportSnapshot(m.To, raft.SnapshotFailure)
-		sentFailures.WithLabelValues(to).Inc()
-		snapshotSendFailures.WithLabelValues(to).Inc()
+		s.fail(m, u, err)
 		return
 	}
 	s.status.activate()
@@ -126,9 +118,139 @@ func (s *snapshotSender) send(merged snap.Message) {
 	snapshotSendSeconds.WithLabelValues(to).Observe(time.Since(start).Seconds())
 }
 
+// sendChunks sends the MsgSnap m of a chunked snapshot: it asks the remote
+// for the chunks of the snapshot it lacks, and sends m with them only. A
+// remote that does not know chunks is sent m in one piece over full.
+func (s *snapshotSender) sendChunks(m raftpb.Message, full chan<- raftpb.Message) {
+	to := types.ID(m.To).String()
+	manifest, err := snap.ParseManifest(m.Snapshot.Data)
+	if err != nil {
+		// taken by this member, it cannot be malformed
+		plog.Panicf("parse snapshot manifest error (%v)", err)
+	}
+
+	u := s.picker.pick()
+	req := createPostRequest(u, RaftSnapshotChunksPrefix, bytes.NewReader(m.Snapshot.Data), "application/octet-stream", s.tr.URLs, s.from, s.cid)
+	missing, err := s.postManifest(req)
+	if err == errChunksUnsupported {
+		s.sendExpanded(m, u, full)
+		return
+	}
+	if err != nil {
+		if s.tr.Logger != nil {
+			s.tr.Logger.Warn("failed to query the missing snapshot chunks", map[string]interface{}{
+				"snapshot-index": m.Snapshot.Metadata.Index,
+				"remote-peer-id": to,
+				"error":          err,
+			})
+		} else {
+			plog.Warningf("failed to query the chunks of snapshot [index: %d] missing on %s (%v)", m.Snapshot.Metadata.Index, types.ID(m.To), err)
+		}
+		s.fail(m, u, err)
+		return
+	}
+	if s.tr.Logger != nil {
+		s.tr.Logger.Info("sending missing snapshot chunks", map[string]interface{}{
+			"snapshot-index": m.Snapshot.Metadata.Index,
+			"remote-peer-id": to,
+			"chunks":         len(manifest.Chunks),
+			"missing-chunks": len(missing.Chunks),
+		})
+	}
+
+	rc, size := s.tr.Snapshotter.NewChunkReader(missing.Chunks)
+	s.send(*snap.NewMessage(m, rc, size))
+}
+
+// sendExpanded sends the MsgSnap m of a chunked snapshot in one piece over
+// full, as other snapshots are, to a remote that does not know chunks.
+func (s *snapshotSender) sendExpanded(m raftpb.Message, u url.URL, full chan<- raftpb.Message) {
+	err := errChunksUnsupported
+	var data []byte
+	if s.tr.ExpandSnapshot != nil {
+		data, err = s.tr.ExpandSnapshot(m.Snapshot.Data)
+	}
+	if err != nil {
+		if s.tr.Logger != nil {
+			s.tr.Logger.Warn("failed to expand snapshot for a peer without chunks", map[string]interface{}{
+				"snapshot-index": m.Snapshot.Metadata.Index,
+				"remote-peer-id": types.ID(m.To).String(),
+				"error":          err,
+			})
+		} else {
+			plog.Warningf("failed to expand snapshot [index: %d] for %s (%v)", m.Snapshot.Metadata.Index, types.ID(m.To), err)
+		}
+		s.fail(m, u, err)
+		return
+	}
+	if s.tr.Logger != nil {
+		s.tr.Logger.Info("sending snapshot in one piece to a peer without chunks", map[string]interface{}{
+			"snapshot-index": m.Snapshot.Metadata.Index,
+			"remote-peer-id": types.ID(m.To).String(),
+			"bytes":          len(data),
+		})
+	}
+	m.Snapshot.Data = data
+	select {
+	case full <- m:
+	case <-s.stopc:
+	default:
+		s.fail(m, u, errors.New("sending buffer is full"))
+	}
+}
+
+// fail reports that sending the snapshot m to u failed with err.
+func (s *snapshotSender) fail(m raftpb.Message, u url.URL, err error) {
+	to := types.ID(m.To).String()
+	// errMemberRemoved is a critical error since a removed member should
+	// always be stopped. So we use reportCriticalError to report it to errorc.
+	if err == errMemberRemoved {
+		reportCriticalError(err, s.errorc)
+	}
+
+	s.picker.unreachable(u)
+	s.status.deactivate(failureType{source: sendSnap, action: "post"}, err.Error())
+	s.r.ReportUnreachable(m.To)
+	// report SnapshotFailure to raft state machine. After raft state
+	// machine knows about it, it would pause a while and retry sending
+	// new snapshot message.
+	s.r.ReportSnapshot(m.To, raft.SnapshotFailure)
+	sentFailures.WithLabelValues(to).Inc()
+	snapshotSendFailures.WithLabelValues(to).Inc()
+}
+
 // post posts the given request.
 // It returns nil when request is sent out and processed successfully.
-func (s *snapshotSender) post(req *http.Request) (err error) {
+func (s *snapshotSender) post(req *http.Request) error {
+	resp, body, err := s.roundTrip(req)
+	if err != nil {
+		return err
+	}
+	return checkPostResponse(resp, body, req, s.to)
+}
+
+// postManifest posts the manifest of a chunked snapshot, and returns the
+// manifest of its chunks the remote lacks.
+func (s *snapshotSender) postManifest(req *http.Request) (*snap.Manifest, error) {
+	resp, body, err := s.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return snap.ParseManifest(body)
+	case http.StatusNotFound:
+		// a member from before chunked snapshots
+		return nil, errChunksUnsupported
+	}
+	if err = checkPostResponse(resp, body, req, s.to); err == nil {
+		err = fmt.Errorf("unexpected http status %s while posting to %q", http.StatusText(resp.StatusCode), req.URL.String())
+	}
+	return nil, err
+}
+
+// roundTrip sends the given request, and returns its response and body.
+func (s *snapshotSender) roundTrip(req *http.Request) (*http.Response, []byte, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	req = req.WithContext(ctx)
 	defer cancel()
@@ -157,12 +279,9 @@ func (s *snapshotSender) post(req *http.Request) (err error) {
 
 	select {
 	case <-s.stopc:
-		return errStopped
+		return nil, nil, errStopped
 	case r := <-result:
-		if r.err != nil {
-			return r.err
-		}
-		return checkPostResponse(r.resp, r.body, req, s.to)
+		return r.resp, r.body, r.err
 	}
 }
 
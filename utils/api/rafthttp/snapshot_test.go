@@ -1,6 +1,7 @@
 package rafthttp
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -130,3 +131,103 @@ func (sh *syncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	sh.h.ServeHTTP(w, r)
 	sh.ch <- struct{}{}
 }
+
+func TestSnapshotSendChunks(t *testing.T) {
+	ld, err := ioutil.TempDir(os.TempDir(), "snapdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(ld)
+	fd, err := ioutil.TempDir(os.TempDir(), "snapdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(fd)
+
+	leader, follower := snap.New(logtool.RLog, ld), snap.New(logtool.RLog, fd)
+	var manifest snap.Manifest
+	for _, data := range []string{"a", "b", "c"} {
+		ref, err := leader.SaveChunk([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest.Chunks = append(manifest.Chunks, ref)
+	}
+	// the follower has a chunk already
+	if _, err = follower.SaveChunk([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	recvc := make(chan raftpb.Message, 1)
+	r := &fakeRaft{recvc: recvc}
+	tr := &Transport{pipelineRt: &http.Transport{}, ClusterID: types.ID(1), Raft: r, Snapshotter: leader}
+	mux := http.NewServeMux()
+	mux.Handle(RaftSnapshotPrefix, newSnapshotHandler(tr, r, follower, types.ID(1)))
+	mux.Handle(RaftSnapshotChunksPrefix, newSnapshotChunksHandler(tr, follower, types.ID(1)))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	picker := mustNewURLPicker(t, []string{srv.URL})
+	snapsend := newSnapshotSender(tr, picker, types.ID(1), newPeerStatus(logtool.RLog, types.ID(0), types.ID(1)))
+	defer snapsend.stop()
+
+	m := raftpb.Message{Type: raftpb.MsgSnap, To: 1}
+	m.Snapshot.Data = manifest.Marshal()
+	snapsend.sendChunks(m, nil)
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatalf("timed out sending snapshot")
+	case <-recvc:
+	}
+	if missing := follower.MissingChunks(&manifest); len(missing) != 0 {
+		t.Errorf("missing chunks = %v, want none", missing)
+	}
+}
+
+// TestSnapshotSendChunksFallback sends a chunked snapshot to a member from
+// before chunked snapshots, which is sent it in one piece.
+func TestSnapshotSendChunksFallback(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "snapdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	leader := snap.New(logtool.RLog, d)
+	ref, err := leader.SaveChunk([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := snap.Manifest{Chunks: []snap.ChunkRef{ref}}
+
+	r := &fakeRaft{}
+	tr := &Transport{pipelineRt: &http.Transport{}, ClusterID: types.ID(1), Raft: r, Snapshotter: leader}
+	tr.ExpandSnapshot = func(data []byte) ([]byte, error) {
+		if !bytes.Equal(data, manifest.Marshal()) {
+			t.Errorf("expanded %q, want the manifest", data)
+		}
+		return []byte("whole"), nil
+	}
+	// no chunks handler
+	srv := httptest.NewServer(http.NewServeMux())
+	defer srv.Close()
+
+	picker := mustNewURLPicker(t, []string{srv.URL})
+	snapsend := newSnapshotSender(tr, picker, types.ID(1), newPeerStatus(logtool.RLog, types.ID(0), types.ID(1)))
+	defer snapsend.stop()
+
+	m := raftpb.Message{Type: raftpb.MsgSnap, To: 1}
+	m.Snapshot.Data = manifest.Marshal()
+	full := make(chan raftpb.Message, 1)
+	snapsend.sendChunks(m, full)
+
+	select {
+	case g := <-full:
+		if string(g.Snapshot.Data) != "whole" {
+			t.Errorf("snapshot data = %q, want %q", g.Snapshot.Data, "whole")
+		}
+	default:
+		t.Fatal("snapshot not sent in one piece")
+	}
+}
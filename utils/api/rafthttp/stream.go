@@ -14,6 +14,7 @@ import (
 	"github.com/fearblackcat/swiftRaft/raft/raftpb"
 	stats "github.com/fearblackcat/swiftRaft/utils/api/v2stats"
 	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/compressutil"
 	"github.com/fearblackcat/swiftRaft/utils/pkg/httputil"
 	"github.com/fearblackcat/swiftRaft/utils/pkg/transport"
 	"github.com/fearblackcat/swiftRaft/utils/pkg/types"
@@ -26,6 +27,12 @@ import (
 const (
 	streamTypeMessage  streamType = "message"
 	streamTypeMsgAppV2 streamType = "msgappv2"
+	// streamTypeMsgAppV2Compressed is streamTypeMsgAppV2 compressed by a
+	// compressutil.Writer, which a reader asks for if
+	// Transport.CompressStreams is set. Peers that do not know it answer
+	// its endpoint with errInvalidStreamPath, and the reader falls back to
+	// streamTypeMsgAppV2.
+	streamTypeMsgAppV2Compressed streamType = "msgappv2-deflate"
 
 	streamBufSize = 4096
 )
@@ -52,6 +59,8 @@ func (t streamType) endpoint() string {
 	switch t {
 	case streamTypeMsgAppV2:
 		return path.Join(RaftStreamPrefix, "msgapp")
+	case streamTypeMsgAppV2Compressed:
+		return path.Join(RaftStreamPrefix, "msgappz")
 	case streamTypeMessage:
 		return path.Join(RaftStreamPrefix, "message")
 	default:
@@ -64,6 +73,8 @@ func (t streamType) String() string {
 	switch t {
 	case streamTypeMsgAppV2:
 		return "stream MsgApp v2"
+	case streamTypeMsgAppV2Compressed:
+		return "stream MsgApp v2 compressed"
 	case streamTypeMessage:
 		return "stream Message"
 	default:
@@ -223,8 +234,15 @@ func (cw *streamWriter) run() {
 			switch conn.t {
 			case streamTypeMsgAppV2:
 				enc = newMsgAppV2Encoder(conn.Writer, cw.fs)
+				flusher = conn.Flusher
+			case streamTypeMsgAppV2Compressed:
+				cnt := &countingWriter{w: conn.Writer, c: sentCompressedBytes.WithLabelValues(cw.peerID.String())}
+				zw := compressutil.NewWriter(cnt, conn.Flusher)
+				enc = newMsgAppV2Encoder(zw, cw.fs)
+				flusher = zw
 			case streamTypeMessage:
 				enc = &messageEncoder{w: conn.Writer}
+				flusher = conn.Flusher
 			default:
 				plog.Panicf("unhandled stream type %s", conn.t)
 			}
@@ -235,7 +253,6 @@ func (cw *streamWriter) run() {
 					"stream-type": t.String(),
 				})
 			}
-			flusher = conn.Flusher
 			unflushed = 0
 			cw.status.activate()
 			cw.closer = conn.Closer
@@ -393,6 +410,16 @@ func (cr *streamReader) run() {
 		if err != nil {
 			if err != errUnsupportedStreamType {
 				cr.status.deactivate(failureType{source: t.String(), action: "dial"}, err.Error())
+			} else if t == streamTypeMsgAppV2Compressed {
+				if cr.lg != nil {
+					cr.lg.Info("remote peer does not support compressed streams", map[string]interface{}{
+						"local-member-id": cr.tr.ID.String(),
+						"remote-peer-id":  cr.peerID.String(),
+					})
+				} else {
+					plog.Infof("peer %s does not support compressed streams", cr.peerID)
+				}
+				t = streamTypeMsgAppV2
 			}
 		} else {
 			cr.status.activate()
@@ -459,6 +486,9 @@ func (cr *streamReader) decodeLoop(rc io.ReadCloser, t streamType) error {
 	switch t {
 	case streamTypeMsgAppV2:
 		dec = newMsgAppV2Decoder(rc, cr.tr.ID, cr.peerID)
+	case streamTypeMsgAppV2Compressed:
+		cnt := &countingReader{r: rc, c: receivedCompressedBytes.WithLabelValues(cr.peerID.String())}
+		dec = newMsgAppV2Decoder(compressutil.NewReader(cnt), cr.tr.ID, cr.peerID)
 	case streamTypeMessage:
 		dec = &messageDecoder{r: rc}
 	default:
@@ -619,7 +649,11 @@ func (cr *streamReader) dial(t streamType) (io.ReadCloser, error) {
 		return resp.Body, nil
 
 	case http.StatusNotFound:
+		b, _ := ioutil.ReadAll(resp.Body)
 		httputil.GracefulClose(resp)
+		if t == streamTypeMsgAppV2Compressed && strings.TrimSuffix(string(b), "\n") == errInvalidStreamPath.Error() {
+			return nil, errUnsupportedStreamType
+		}
 		cr.picker.unreachable(u)
 		return nil, fmt.Errorf("peer %s failed to find local node %s", cr.peerID, cr.tr.ID)
 
@@ -97,7 +97,7 @@ func TestStreamWriterAttachBadOutgoingConn(t *testing.T) {
 }
 
 func TestStreamReaderDialRequest(t *testing.T) {
-	for i, tt := range []streamType{streamTypeMessage, streamTypeMsgAppV2} {
+	for i, tt := range []streamType{streamTypeMessage, streamTypeMsgAppV2, streamTypeMsgAppV2Compressed} {
 		tr := &roundTripperRecorder{rec: &testutil.RecorderBuffered{}}
 		sr := &streamReader{
 			peerID: types.ID(2),
@@ -284,6 +284,11 @@ func TestStream(t *testing.T) {
 			msgapp,
 			recvc,
 		},
+		{
+			streamTypeMsgAppV2Compressed,
+			msgapp,
+			recvc,
+		},
 	}
 	for i, tt := range tests {
 		h := &fakeStreamHandler{t: tt.t}
@@ -334,6 +339,61 @@ func TestStream(t *testing.T) {
 	}
 }
 
+// TestStreamReaderFallbackUncompressed tests that a reader asking for a
+// compressed stream reads the uncompressed one of a peer that does not
+// know compressed streams.
+func TestStreamReaderFallbackUncompressed(t *testing.T) {
+	recvc := make(chan raftpb.Message, streamBufSize)
+	h := &fakeStreamHandler{t: streamTypeMsgAppV2}
+	mux := http.NewServeMux()
+	mux.HandleFunc(streamTypeMsgAppV2Compressed.endpoint()+"/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Server-Version", version.Version)
+		http.Error(w, errInvalidStreamPath.Error(), http.StatusNotFound)
+	})
+	mux.Handle(streamTypeMsgAppV2.endpoint()+"/", h)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	sw := startStreamWriter(logtool.RLog, types.ID(0), types.ID(1), newPeerStatus(logtool.RLog, types.ID(0), types.ID(1)), &stats.FollowerStats{}, &fakeRaft{})
+	defer sw.stop()
+	h.sw = sw
+
+	sr := &streamReader{
+		peerID: types.ID(2),
+		typ:    streamTypeMsgAppV2Compressed,
+		tr:     &Transport{streamRt: &http.Transport{}, ClusterID: types.ID(1)},
+		picker: mustNewURLPicker(t, []string{srv.URL}),
+		status: newPeerStatus(logtool.RLog, types.ID(0), types.ID(2)),
+		recvc:  recvc,
+		propc:  make(chan raftpb.Message, streamBufSize),
+		rl:     rate.NewLimiter(rate.Every(time.Millisecond), 1),
+	}
+	sr.start()
+	defer sr.stop()
+
+	var writec chan<- raftpb.Message
+	for deadline := time.Now().Add(time.Second); ; {
+		var ok bool
+		if writec, ok = sw.writec(); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the reader did not fall back to the uncompressed stream")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	m := raftpb.Message{Type: raftpb.MsgApp, From: 2, To: 1, Term: 1, LogTerm: 1, Index: 3, Entries: []raftpb.Entry{{Term: 1, Index: 4}}}
+	writec <- m
+	select {
+	case g := <-recvc:
+		if !reflect.DeepEqual(g, m) {
+			t.Errorf("message = %+v, want %+v", g, m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("failed to receive message from the channel")
+	}
+}
+
 func TestCheckStreamSupport(t *testing.T) {
 	tests := []struct {
 		v *semver.Version
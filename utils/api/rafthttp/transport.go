@@ -94,6 +94,16 @@ type Transport struct {
 
 	TLSInfo transport.TLSInfo // TLS information used when creating connection
 
+	// CompressStreams asks the peers to compress the MsgApp streams they
+	// send to this member, which carry the entries. Peers that cannot are
+	// read uncompressed.
+	CompressStreams bool
+
+	// ExpandSnapshot, if set, returns the data of a chunked snapshot in one
+	// piece, for the peers that do not serve RaftSnapshotChunksPrefix.
+	// Chunked snapshots cannot be sent to them without it.
+	ExpandSnapshot func(data []byte) ([]byte, error)
+
 	ID          types.ID   // local member ID
 	URLs        types.URLs // local peer URLs
 	ClusterID   types.ID   // raft cluster ID for request validation
@@ -152,6 +162,10 @@ func (t *Transport) Handler() http.Handler {
 	mux.Handle(RaftPrefix, pipelineHandler)
 	mux.Handle(RaftStreamPrefix+"/", streamHandler)
 	mux.Handle(RaftSnapshotPrefix, snapHandler)
+	if t.Snapshotter != nil {
+		// without it, peers send snapshots in one piece
+		mux.Handle(RaftSnapshotChunksPrefix, newSnapshotChunksHandler(t, t.Snapshotter, t.ClusterID))
+	}
 	mux.Handle(ProbingPrefix, probing.NewHandler())
 	return mux
 }
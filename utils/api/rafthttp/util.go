@@ -14,6 +14,7 @@ import (
 	"github.com/fearblackcat/swiftRaft/version"
 
 	"github.com/coreos/go-semver/semver"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
@@ -174,3 +175,27 @@ func addRemoteFromRequest(tr Transporter, r *http.Request) {
 		}
 	}
 }
+
+// countingWriter adds the bytes written to w to a counter.
+type countingWriter struct {
+	w io.Writer
+	c prometheus.Counter
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.c.Add(float64(n))
+	return n, err
+}
+
+// countingReader adds the bytes read from r to a counter.
+type countingReader struct {
+	r io.Reader
+	c prometheus.Counter
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.c.Add(float64(n))
+	return n, err
+}
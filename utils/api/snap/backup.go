@@ -0,0 +1,43 @@
+package snap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+// ErrBackupHashMismatch is returned when the sha256 trailer of a backup
+// does not match its contents.
+var ErrBackupHashMismatch = errors.New("snap: backup hash mismatch")
+
+// WriteBackup writes the state machine snapshot data to w, followed by its
+// sha256 hash so that a truncated or corrupted copy is detected on restore.
+func WriteBackup(w io.Writer, data []byte) (int64, error) {
+	sum := sha256.Sum256(data)
+	n, err := w.Write(data)
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(sum[:])
+	return int64(n + m), err
+}
+
+// ReadBackup checks the sha256 trailer of a backup written by WriteBackup
+// and returns the state machine snapshot data.
+func ReadBackup(b []byte) ([]byte, error) {
+	if len(b) < sha256.Size {
+		return nil, ErrBackupHashMismatch
+	}
+	data, sum := b[:len(b)-sha256.Size], b[len(b)-sha256.Size:]
+	if h := sha256.Sum256(data); !bytes.Equal(h[:], sum) {
+		return nil, ErrBackupHashMismatch
+	}
+	return data, nil
+}
+
+// BackupSize returns the number of bytes WriteBackup writes for data of
+// the given length.
+func BackupSize(n int) int64 {
+	return int64(n + sha256.Size)
+}
@@ -0,0 +1,35 @@
+package snap
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	data := []byte(`{"foo":"bar"}`)
+	var buf bytes.Buffer
+	n, err := WriteBackup(&buf, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != BackupSize(len(data)) || int64(buf.Len()) != n {
+		t.Fatalf("wrote %d bytes, buffer holds %d, want %d", n, buf.Len(), BackupSize(len(data)))
+	}
+
+	got, err := ReadBackup(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("data = %q, want %q", got, data)
+	}
+
+	b := buf.Bytes()
+	b[0] ^= 0xff
+	if _, err = ReadBackup(b); err != ErrBackupHashMismatch {
+		t.Errorf("err = %v, want %v", err, ErrBackupHashMismatch)
+	}
+	if _, err = ReadBackup(b[:10]); err != ErrBackupHashMismatch {
+		t.Errorf("err = %v, want %v", err, ErrBackupHashMismatch)
+	}
+}
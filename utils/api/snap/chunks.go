@@ -0,0 +1,335 @@
+package snap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/utils/pkg/fileutil"
+	pioutil "github.com/fearblackcat/swiftRaft/utils/pkg/ioutil"
+)
+
+const (
+	// chunkDir is the directory of the snapshot directory that holds the
+	// chunks of the chunked snapshots, in files named by their hash.
+	chunkDir    = "chunks"
+	chunkSuffix = ".chunk"
+
+	// MaxChunkBytes bounds the chunks a Snapshotter accepts from a peer.
+	MaxChunkBytes = 64 * 1024 * 1024
+)
+
+// manifestMagic starts the data of a chunked snapshot, followed by its
+// Manifest in JSON. The data of the other snapshots never starts with a 0
+// byte.
+var manifestMagic = []byte("\x00swchunks")
+
+var (
+	ErrChunkMismatch = errors.New("snap: chunk does not match its hash")
+	ErrMissingChunk  = errors.New("snap: chunk not found")
+)
+
+// ChunkRef names a chunk of a chunked snapshot by the sha256 hash of its
+// data, which is checked whenever the chunk is read.
+type ChunkRef struct {
+	Hash string `json:"hash"` // hex
+	Size int64  `json:"size"`
+}
+
+// Manifest is the data of a chunked snapshot: the state machine is the
+// concatenation of its chunks, in order, which are kept apart by the
+// Snapshotter. A chunk that did not change between two snapshots is saved
+// once, and sent once to a follower.
+type Manifest struct {
+	Chunks []ChunkRef `json:"chunks"`
+}
+
+// IsManifest reports whether the data of a snapshot is a Manifest.
+func IsManifest(data []byte) bool {
+	return bytes.HasPrefix(data, manifestMagic)
+}
+
+// Marshal returns the data of the snapshot m describes.
+func (m *Manifest) Marshal() []byte {
+	b, err := json.Marshal(m)
+	if err != nil {
+		plog.Panicf("marshal manifest should never fail (%v)", err)
+	}
+	return append(append([]byte{}, manifestMagic...), b...)
+}
+
+// ParseManifest returns the Manifest of the data of a chunked snapshot.
+func ParseManifest(data []byte) (*Manifest, error) {
+	if !IsManifest(data) {
+		return nil, errors.New("snap: not a chunked snapshot")
+	}
+	var m Manifest
+	if err := json.Unmarshal(data[len(manifestMagic):], &m); err != nil {
+		return nil, err
+	}
+	for _, c := range m.Chunks {
+		if b, err := hex.DecodeString(c.Hash); err != nil || len(b) != sha256.Size || c.Size < 0 {
+			return nil, errors.New("snap: malformed chunk reference")
+		}
+	}
+	return &m, nil
+}
+
+func (s *Snapshotter) chunkPath(hash string) string {
+	return filepath.Join(s.dir, chunkDir, hash+chunkSuffix)
+}
+
+// SaveChunk saves data as a chunk unless a chunk of the same hash exists,
+// which it keeps as KeepChunk does, and returns its reference. The chunk is
+// durable once SyncChunks returns.
+func (s *Snapshotter) SaveChunk(data []byte) (ChunkRef, error) {
+	sum := sha256.Sum256(data)
+	ref := ChunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+	s.chunkMu.RLock()
+	defer s.chunkMu.RUnlock()
+	if s.keepChunk(ref) {
+		return ref, nil
+	}
+	fpath := s.chunkPath(ref.Hash)
+	if err := os.MkdirAll(filepath.Dir(fpath), fileutil.PrivateDirMode); err != nil {
+		return ref, err
+	}
+	b, err := s.wrap(data, sum[:])
+	if err != nil {
+		return ref, err
+	}
+	// written aside and renamed, so that a chunk file is never partial
+	tmp := fpath + ".tmp"
+	if err = pioutil.WriteAndSyncFile(tmp, b, fileutil.PrivateFileMode); err != nil {
+		os.Remove(tmp)
+		return ref, err
+	}
+	if err = os.Rename(tmp, fpath); err != nil {
+		os.Remove(tmp)
+		return ref, err
+	}
+	return ref, nil
+}
+
+// SyncChunks makes the chunks saved so far durable, before the snapshot
+// that names them is saved.
+func (s *Snapshotter) SyncChunks() error {
+	d, err := fileutil.OpenDir(filepath.Join(s.dir, chunkDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return fileutil.Fsync(d)
+}
+
+// ReadChunk returns the data of the chunk ref. It fails with
+// ErrMissingChunk if the chunk was not saved, and with ErrChunkMismatch if
+// its data does not match ref.
+func (s *Snapshotter) ReadChunk(ref ChunkRef) ([]byte, error) {
+	b, err := ioutil.ReadFile(s.chunkPath(ref.Hash))
+	if os.IsNotExist(err) {
+		return nil, ErrMissingChunk
+	}
+	if err != nil {
+		return nil, err
+	}
+	sum, err := hex.DecodeString(ref.Hash)
+	if err != nil {
+		return nil, ErrChunkMismatch
+	}
+	data, err := unwrap(b, sum, s.sealer)
+	if err == ErrNoKeys {
+		return nil, err
+	}
+	if err != nil {
+		if s.lg != nil {
+			s.lg.Warn("failed to decrypt or decompress a snapshot chunk", map[string]interface{}{
+				"hash":  ref.Hash,
+				"error": err,
+			})
+		}
+		return nil, ErrChunkMismatch
+	}
+	if got := sha256.Sum256(data); !bytes.Equal(got[:], sum) || int64(len(data)) != ref.Size {
+		if s.lg != nil {
+			s.lg.Warn("snapshot chunk is corrupt", map[string]interface{}{
+				"hash": ref.Hash,
+			})
+		} else {
+			plog.Errorf("corrupted snapshot chunk %s", ref.Hash)
+		}
+		return nil, ErrChunkMismatch
+	}
+	return data, nil
+}
+
+// MissingChunks returns the chunks of m that were not saved, and keeps the
+// others as KeepChunk does.
+func (s *Snapshotter) MissingChunks(m *Manifest) []ChunkRef {
+	s.chunkMu.RLock()
+	defer s.chunkMu.RUnlock()
+	var missing []ChunkRef
+	for _, c := range m.Chunks {
+		if !s.keepChunk(c) {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
+
+// KeepChunk reports whether the chunk ref was saved, and marks it as used
+// if so: PurgeChunks keeps it until a snapshot names it.
+func (s *Snapshotter) KeepChunk(ref ChunkRef) bool {
+	s.chunkMu.RLock()
+	defer s.chunkMu.RUnlock()
+	return s.keepChunk(ref)
+}
+
+func (s *Snapshotter) keepChunk(ref ChunkRef) bool {
+	now := time.Now()
+	return os.Chtimes(s.chunkPath(ref.Hash), now, now) == nil
+}
+
+// PurgeChunks removes the chunks no snapshot of the snapshot directory
+// names, except those saved or marked by MissingChunks since the last
+// snapshot was saved, which may belong to a snapshot being taken or
+// received. It returns the number of chunks it removed.
+func (s *Snapshotter) PurgeChunks() (int, error) {
+	s.chunkMu.Lock()
+	defer s.chunkMu.Unlock()
+	names, err := s.snapNames()
+	if err == ErrNoSnapshot {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	// the newest snapshot first
+	fi, err := os.Stat(filepath.Join(s.dir, names[0]))
+	if err != nil {
+		return 0, err
+	}
+	since := fi.ModTime()
+	used := make(map[string]bool)
+	for _, name := range names {
+		snap, err := s.Read(filepath.Join(s.dir, name))
+		if err != nil {
+			// its chunks cannot be told apart
+			return 0, err
+		}
+		if !IsManifest(snap.Data) {
+			continue
+		}
+		m, err := ParseManifest(snap.Data)
+		if err != nil {
+			return 0, err
+		}
+		for _, c := range m.Chunks {
+			used[c.Hash] = true
+		}
+	}
+
+	dir := filepath.Join(s.dir, chunkDir)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, f := range files {
+		hash := strings.TrimSuffix(f.Name(), chunkSuffix)
+		if used[hash] || !f.ModTime().Before(since) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(dir, f.Name())); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if n > 0 && s.lg != nil {
+		s.lg.Info("purged snapshot chunks", map[string]interface{}{
+			"chunks": n,
+		})
+	}
+	return n, nil
+}
+
+// NewChunkReader returns the chunks refs framed for SaveChunksFrom, and
+// the number of bytes it reads:
+//
+//	sha256 (32 bytes) | len(data) (8 bytes) | data
+//
+// A chunk that cannot be read fails the reader.
+func (s *Snapshotter) NewChunkReader(refs []ChunkRef) (io.ReadCloser, int64) {
+	var size int64
+	for _, c := range refs {
+		size += sha256.Size + 8 + c.Size
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		w := bufio.NewWriter(pw)
+		hdr := make([]byte, sha256.Size+8)
+		for _, c := range refs {
+			data, err := s.ReadChunk(c)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			hex.Decode(hdr, []byte(c.Hash))
+			binary.BigEndian.PutUint64(hdr[sha256.Size:], uint64(len(data)))
+			w.Write(hdr)
+			if _, err = w.Write(data); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(w.Flush())
+	}()
+	return pr, size
+}
+
+// SaveChunksFrom saves the chunks framed into r by NewChunkReader, and
+// returns the number of bytes it read. A chunk that does not match its
+// hash fails it with ErrChunkMismatch.
+func (s *Snapshotter) SaveChunksFrom(r io.Reader) (int64, error) {
+	var n int64
+	hdr := make([]byte, sha256.Size+8)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if err == io.EOF {
+				return n, s.SyncChunks()
+			}
+			return n, err
+		}
+		size := binary.BigEndian.Uint64(hdr[sha256.Size:])
+		if size > MaxChunkBytes {
+			return n, ErrChunkMismatch
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return n, err
+		}
+		n += int64(len(hdr)) + int64(size)
+		if sum := sha256.Sum256(data); !bytes.Equal(sum[:], hdr[:sha256.Size]) {
+			return n, ErrChunkMismatch
+		}
+		if _, err := s.SaveChunk(data); err != nil {
+			return n, err
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package snap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/fileutil"
+)
+
+func newChunkTestDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir(os.TempDir(), "snapchunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"a", "b"} {
+		if err = os.Mkdir(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestChunks(t *testing.T) {
+	dir, cleanup := newChunkTestDir(t)
+	defer cleanup()
+	keys := testKeys(t, dir, "k1=000102030405060708090a0b0c0d0e0f\n")
+	chunks := [][]byte{[]byte(`{"/a":"1"}`), bytes.Repeat([]byte(`{"/b":"2"}`), 100), []byte(`{"/a":"1"}`)}
+
+	for i, opts := range []Options{{}, {Compress: true, Keys: keys}} {
+		s := NewWithOptions(logtool.RLog, filepath.Join(dir, "a"), opts)
+		var m Manifest
+		for _, c := range chunks {
+			ref, err := s.SaveChunk(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Chunks = append(m.Chunks, ref)
+		}
+		if m.Chunks[0] != m.Chunks[2] {
+			t.Errorf("#%d: equal chunks got refs %v and %v", i, m.Chunks[0], m.Chunks[2])
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, "a", chunkDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 2 {
+			t.Errorf("#%d: %d chunk files, want 2", i, len(files))
+		}
+
+		gm, err := ParseManifest(m.Marshal())
+		if err != nil || !reflect.DeepEqual(*gm, m) {
+			t.Fatalf("#%d: manifest = %+v, %v, want %+v", i, gm, err, m)
+		}
+
+		// the missing chunks are sent to another snapshotter
+		s2 := NewWithOptions(logtool.RLog, filepath.Join(dir, "b"), opts)
+		if _, err = s2.SaveChunk(chunks[1]); err != nil {
+			t.Fatal(err)
+		}
+		missing := s2.MissingChunks(&m)
+		if len(missing) != 2 || missing[0] != m.Chunks[0] {
+			t.Fatalf("#%d: missing = %v, want chunk 0 twice", i, missing)
+		}
+		rc, size := s.NewChunkReader(missing[:1])
+		n, err := s2.SaveChunksFrom(rc)
+		rc.Close()
+		if err != nil || n != size {
+			t.Fatalf("#%d: saved %d bytes of %d, %v", i, n, size, err)
+		}
+		for j, c := range m.Chunks {
+			g, err := s2.ReadChunk(c)
+			if err != nil || !bytes.Equal(g, chunks[j]) {
+				t.Errorf("#%d: chunk %d = %q, %v", i, j, g, err)
+			}
+		}
+
+		// a corrupt chunk is detected
+		fpath := s.chunkPath(m.Chunks[1].Hash)
+		b, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[len(b)-1] ^= 1
+		if err = ioutil.WriteFile(fpath, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.ReadChunk(m.Chunks[1]); err != ErrChunkMismatch {
+			t.Errorf("#%d: err = %v, want ErrChunkMismatch", i, err)
+		}
+		os.Remove(fpath)
+		if _, err = s.ReadChunk(m.Chunks[1]); err != ErrMissingChunk {
+			t.Errorf("#%d: err = %v, want ErrMissingChunk", i, err)
+		}
+		// as is a chunk that does not match its hash on the way
+		rc, _ = s2.NewChunkReader(m.Chunks[1:2])
+		frame, _ := ioutil.ReadAll(rc)
+		frame[len(frame)-1] ^= 1
+		if _, err = s.SaveChunksFrom(bytes.NewReader(frame)); err != ErrChunkMismatch {
+			t.Errorf("#%d: err = %v, want ErrChunkMismatch", i, err)
+		}
+
+		os.RemoveAll(filepath.Join(dir, "a", chunkDir))
+		os.RemoveAll(filepath.Join(dir, "b", chunkDir))
+	}
+}
+
+func TestPurgeChunks(t *testing.T) {
+	dir, cleanup := newChunkTestDir(t)
+	defer cleanup()
+	s := New(logtool.RLog, filepath.Join(dir, "a"))
+
+	save := func(index uint64, chunks ...string) {
+		var m Manifest
+		for _, c := range chunks {
+			ref, err := s.SaveChunk([]byte(c))
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Chunks = append(m.Chunks, ref)
+		}
+		snap := raftpb.Snapshot{
+			Data:     m.Marshal(),
+			Metadata: raftpb.SnapshotMetadata{Index: index, Term: 1, ConfState: raftpb.ConfState{Nodes: []uint64{1}}},
+		}
+		if err := s.SaveSnap(snap); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save(1, "old", "kept", "reused")
+	save(2, "kept", "new")
+	// the first snapshot is purged
+	if err := os.Remove(filepath.Join(dir, "a", "0000000000000001-0000000000000001.snap")); err != nil {
+		t.Fatal(err)
+	}
+	// and chunks are being saved for the next one
+	future := time.Now().Add(time.Hour)
+	next, err := s.SaveChunk([]byte("next"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(s.chunkPath(next.Hash), future, future)
+	past := time.Now().Add(-time.Hour)
+	for _, c := range []string{"old", "kept", "new", "reused"} {
+		ref, _ := s.SaveChunk([]byte(c))
+		os.Chtimes(s.chunkPath(ref.Hash), past, past)
+	}
+	// a chunk of the purged snapshot is saved again for the next one
+	if _, err = s.SaveChunk([]byte("reused")); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.PurgeChunks()
+	if err != nil || n != 1 {
+		t.Fatalf("purged %d, %v, want 1", n, err)
+	}
+	for c, want := range map[string]bool{"old": false, "kept": true, "new": true, "next": true, "reused": true} {
+		sum := sha256.Sum256([]byte(c))
+		if exists := fileutil.Exist(s.chunkPath(hex.EncodeToString(sum[:]))); exists != want {
+			t.Errorf("chunk %q exists = %v, want %v", c, exists, want)
+		}
+	}
+}
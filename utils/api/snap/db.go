@@ -1,6 +1,8 @@
 package snap
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +11,7 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/fearblackcat/swiftRaft/utils/pkg/cryptutil"
 	"github.com/fearblackcat/swiftRaft/utils/pkg/fileutil"
 
 	humanize "github.com/dustin/go-humanize"
@@ -16,8 +19,13 @@ import (
 
 var ErrNoDBSnapshot = errors.New("snap: snapshot file doesn't exist")
 
+// encryptedDBMagic starts an encrypted database snapshot, followed by the
+// stream sealed by cryptutil.NewWriter.
+var encryptedDBMagic = []byte("\x00swdbenc")
+
 // SaveDBFrom saves snapshot of the database from the given reader. It
-// guarantees the save operation is atomic.
+// guarantees the save operation is atomic. A Snapshotter with keys
+// encrypts it.
 func (s *Snapshotter) SaveDBFrom(r io.Reader, id uint64) (int64, error) {
 	start := time.Now()
 
@@ -26,7 +34,11 @@ func (s *Snapshotter) SaveDBFrom(r io.Reader, id uint64) (int64, error) {
 		return 0, err
 	}
 	var n int64
-	n, err = io.Copy(f, r)
+	if s.sealer == nil {
+		n, err = io.Copy(f, r)
+	} else {
+		n, err = s.copySealed(f, r)
+	}
 	if err == nil {
 		fsyncStart := time.Now()
 		err = fileutil.Fsync(f)
@@ -62,6 +74,48 @@ func (s *Snapshotter) SaveDBFrom(r io.Reader, id uint64) (int64, error) {
 	return n, nil
 }
 
+func (s *Snapshotter) copySealed(f *os.File, r io.Reader) (int64, error) {
+	if _, err := f.Write(encryptedDBMagic); err != nil {
+		return 0, err
+	}
+	w := cryptutil.NewWriter(f, s.sealer)
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return n, err
+	}
+	return n, w.Close()
+}
+
+// OpenDB opens the snapshot of the database with given id for reading,
+// decrypting it if it is encrypted.
+func (s *Snapshotter) OpenDB(id uint64) (io.ReadCloser, error) {
+	fn, err := s.DBFilePath(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, len(encryptedDBMagic))
+	if _, err = io.ReadFull(f, magic); err != nil || !bytes.Equal(magic, encryptedDBMagic) {
+		// a plain database
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	if s.sealer == nil {
+		f.Close()
+		return nil, ErrNoKeys
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{cryptutil.NewReader(bufio.NewReader(f), s.sealer), f}, nil
+}
+
 // DBFilePath returns the file path for the snapshot of the database with
 // given id. If the snapshot does not exist, it returns error.
 func (s *Snapshotter) DBFilePath(id uint64) (string, error) {
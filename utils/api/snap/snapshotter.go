@@ -1,6 +1,7 @@
 package snap
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
@@ -9,12 +10,15 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fearblackcat/swiftRaft/raft"
 	"github.com/fearblackcat/swiftRaft/raft/raftpb"
 	"github.com/fearblackcat/swiftRaft/utils/api/snap/snappb"
 	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/compressutil"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/cryptutil"
 	pioutil "github.com/fearblackcat/swiftRaft/utils/pkg/ioutil"
 	"github.com/fearblackcat/swiftRaft/utils/pkg/pbutil"
 
@@ -23,23 +27,51 @@ import (
 
 const snapSuffix = ".snap"
 
+// The markers start the data of a snapshot file that is not a plain
+// marshaled raftpb.Snapshot, which never starts with them as no protobuf
+// field is numbered 0. encryptedMarker is followed by the sealed data, and
+// compressedMarker by the compressed marshaled snapshot. A snapshot is
+// compressed before it is sealed.
+const (
+	encryptedMarker  = 0
+	compressedMarker = 1
+)
+
 var (
 	plog = capnslog.NewPackageLogger("github.com/fearblackcat/swiftRaft", "snap")
 
 	ErrNoSnapshot    = errors.New("snap: no available snapshot")
 	ErrEmptySnapshot = errors.New("snap: empty snapshot")
 	ErrCRCMismatch   = errors.New("snap: crc mismatch")
+	ErrNoKeys        = errors.New("snap: encrypted snapshot found without a key provider")
 	crcTable         = crc32.MakeTable(crc32.Castagnoli)
 
 	// A map of valid files that can be present in the snap folder.
 	validFiles = map[string]bool{
-		"db": true,
+		"db":     true,
+		chunkDir: true,
 	}
 )
 
 type Snapshotter struct {
 	lg  *logtool.RLogHandle
 	dir string
+	// sealer encrypts and decrypts the snapshots, nil without keys
+	sealer   *cryptutil.Sealer
+	compress bool
+	// chunkMu is held by PurgeChunks, and shared by the calls that save or
+	// keep a chunk, so that a chunk is not purged as it is used again.
+	chunkMu sync.RWMutex
+}
+
+// Options are the options of a Snapshotter.
+type Options struct {
+	// Keys, if set, encrypts the snapshots with AES-GCM under its current
+	// key, see NewWithKeys.
+	Keys cryptutil.KeyProvider
+	// Compress compresses the snapshots. Compressed snapshots are read
+	// whatever Compress.
+	Compress bool
 }
 
 func New(lg *logtool.RLogHandle, dir string) *Snapshotter {
@@ -49,6 +81,25 @@ func New(lg *logtool.RLogHandle, dir string) *Snapshotter {
 	}
 }
 
+// NewWithKeys returns a Snapshotter that encrypts the snapshots it saves
+// with AES-GCM under the current key of keys. The ID of the key is stored
+// in each file, so snapshots saved under earlier keys are read as long as
+// keys still has them. Plain snapshots are still read, and nil keys save
+// plain snapshots as New does.
+func NewWithKeys(lg *logtool.RLogHandle, dir string, keys cryptutil.KeyProvider) *Snapshotter {
+	return NewWithOptions(lg, dir, Options{Keys: keys})
+}
+
+// NewWithOptions returns a Snapshotter that saves its snapshots with opts.
+func NewWithOptions(lg *logtool.RLogHandle, dir string, opts Options) *Snapshotter {
+	s := New(lg, dir)
+	if opts.Keys != nil {
+		s.sealer = cryptutil.NewSealer(opts.Keys)
+	}
+	s.compress = opts.Compress
+	return s
+}
+
 func (s *Snapshotter) SaveSnap(snapshot raftpb.Snapshot) error {
 	if raft.IsEmptySnap(snapshot) {
 		return nil
@@ -60,7 +111,11 @@ func (s *Snapshotter) save(snapshot *raftpb.Snapshot) error {
 	start := time.Now()
 
 	fname := fmt.Sprintf("%016x-%016x%s", snapshot.Metadata.Term, snapshot.Metadata.Index, snapSuffix)
-	b := pbutil.MustMarshal(snapshot)
+	b, err := s.wrap(pbutil.MustMarshal(snapshot), snapAD(snapshot.Metadata.Term, snapshot.Metadata.Index))
+	if err != nil {
+		return err
+	}
+	// the crc covers the data as stored, so that it is checked without keys
 	crc := crc32.Update(0, crcTable, b)
 	snap := snappb.Snapshot{Crc: crc, Data: b}
 	d, err := snap.Marshal()
@@ -107,9 +162,13 @@ func (s *Snapshotter) Load() (*raftpb.Snapshot, error) {
 	}
 	var snap *raftpb.Snapshot
 	for _, name := range names {
-		if snap, err = loadSnap(s.lg, s.dir, name); err == nil {
+		if snap, err = loadSnap(s.lg, s.dir, name, s.sealer); err == nil {
 			break
 		}
+		if err == ErrNoKeys || err == cryptutil.ErrKeyNotFound {
+			// an older snapshot would not match the WAL
+			return nil, err
+		}
 	}
 	if err != nil {
 		return nil, ErrNoSnapshot
@@ -117,9 +176,19 @@ func (s *Snapshotter) Load() (*raftpb.Snapshot, error) {
 	return snap, nil
 }
 
-func loadSnap(lg *logtool.RLogHandle, dir, name string) (*raftpb.Snapshot, error) {
+func loadSnap(lg *logtool.RLogHandle, dir, name string, sealer *cryptutil.Sealer) (*raftpb.Snapshot, error) {
 	fpath := filepath.Join(dir, name)
-	snap, err := Read(lg, fpath)
+	snap, err := read(lg, fpath, sealer)
+	if err == ErrNoKeys || err == cryptutil.ErrKeyNotFound {
+		// the file is fine, the keys are missing
+		if lg != nil {
+			lg.Warn("failed to decrypt a snap file", map[string]interface{}{
+				"path":  fpath,
+				"error": err,
+			})
+		}
+		return nil, err
+	}
 	if err != nil {
 		brokenPath := fpath + ".broken"
 		if lg != nil {
@@ -150,8 +219,19 @@ func loadSnap(lg *logtool.RLogHandle, dir, name string) (*raftpb.Snapshot, error
 	return snap, err
 }
 
-// Read reads the snapshot named by snapname and returns the snapshot.
+// Read reads the snapshot named by snapname and returns the snapshot. It
+// checks the crc of an encrypted snapshot, then fails with ErrNoKeys.
 func Read(lg *logtool.RLogHandle, snapname string) (*raftpb.Snapshot, error) {
+	return read(lg, snapname, nil)
+}
+
+// Read is Read with the keys of s, which decrypt the snapshot if it is
+// encrypted.
+func (s *Snapshotter) Read(snapname string) (*raftpb.Snapshot, error) {
+	return read(s.lg, snapname, s.sealer)
+}
+
+func read(lg *logtool.RLogHandle, snapname string, sealer *cryptutil.Sealer) (*raftpb.Snapshot, error) {
 	b, err := ioutil.ReadFile(snapname)
 	if err != nil {
 		if lg != nil {
@@ -214,8 +294,29 @@ func Read(lg *logtool.RLogHandle, snapname string) (*raftpb.Snapshot, error) {
 		return nil, ErrCRCMismatch
 	}
 
+	var ad []byte
+	var term, index uint64
+	if _, err = fmt.Sscanf(filepath.Base(snapname), "%016x-%016x"+snapSuffix, &term, &index); err == nil {
+		ad = snapAD(term, index)
+	}
+	data, err := unwrap(serializedSnap.Data, ad, sealer)
+	if err == ErrNoKeys {
+		return nil, err
+	}
+	if err != nil {
+		if lg != nil {
+			lg.Warn("failed to decrypt or decompress a snap file", map[string]interface{}{
+				"path":  snapname,
+				"error": err,
+			})
+		} else {
+			plog.Errorf("cannot decrypt or decompress snapshot file %v: %v", snapname, err)
+		}
+		return nil, err
+	}
+
 	var snap raftpb.Snapshot
-	if err = snap.Unmarshal(serializedSnap.Data); err != nil {
+	if err = snap.Unmarshal(data); err != nil {
 		if lg != nil {
 			lg.Warn("failed to unmarshal raftpb.Snapshot", map[string]interface{}{
 				"path":  snapname,
@@ -229,6 +330,48 @@ func Read(lg *logtool.RLogHandle, snapname string) (*raftpb.Snapshot, error) {
 	return &snap, nil
 }
 
+// snapAD binds a sealed snapshot to its term and index, as named by its
+// file, so that it cannot be replaced by another one.
+func snapAD(term, index uint64) []byte {
+	ad := make([]byte, 16)
+	binary.BigEndian.PutUint64(ad, index)
+	binary.BigEndian.PutUint64(ad[8:], term)
+	return ad
+}
+
+// wrap compresses and seals b with ad as the options of s ask.
+func (s *Snapshotter) wrap(b, ad []byte) ([]byte, error) {
+	if s.compress {
+		b = append([]byte{compressedMarker}, compressutil.Compress(b)...)
+	}
+	if s.sealer != nil {
+		sealed, err := s.sealer.Seal(b, ad)
+		if err != nil {
+			return nil, err
+		}
+		b = append([]byte{encryptedMarker}, sealed...)
+	}
+	return b, nil
+}
+
+// unwrap returns the data wrapped into b, whatever the options it was
+// wrapped with.
+func unwrap(b, ad []byte, sealer *cryptutil.Sealer) ([]byte, error) {
+	var err error
+	if len(b) > 0 && b[0] == encryptedMarker {
+		if sealer == nil {
+			return nil, ErrNoKeys
+		}
+		if b, err = sealer.Open(b[1:], ad); err != nil {
+			return nil, err
+		}
+	}
+	if len(b) > 0 && b[0] == compressedMarker {
+		return compressutil.Decompress(b[1:])
+	}
+	return b, nil
+}
+
 // snapNames returns the filename of the snapshots in logical time order (from newest to oldest).
 // If there is no available snapshots, an ErrNoSnapshot will be returned.
 func (s *Snapshotter) snapNames() ([]string, error) {
@@ -1,6 +1,7 @@
 package snap
 
 import (
+	"bytes"
 	"fmt"
 	"hash/crc32"
 	"io/ioutil"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/fearblackcat/swiftRaft/raft/raftpb"
 	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/cryptutil"
 )
 
 var testSnap = &raftpb.Snapshot{
@@ -215,3 +217,168 @@ func TestAllSnapshotBroken(t *testing.T) {
 		t.Errorf("err = %v, want %v", err, ErrNoSnapshot)
 	}
 }
+
+func testKeys(t *testing.T, dir, lines string) cryptutil.KeyProvider {
+	p := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(p, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := cryptutil.NewFileKeyProvider(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestEncryptedSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapdir := filepath.Join(dir, "snap")
+	if err = os.Mkdir(snapdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	k1 := "k1=000102030405060708090a0b0c0d0e0f\n"
+	k2 := "k2=101112131415161718191a1b1c1d1e1f\n"
+
+	if err = NewWithKeys(logtool.RLog, snapdir, testKeys(t, dir, k1)).save(testSnap); err != nil {
+		t.Fatal(err)
+	}
+	fpath := filepath.Join(snapdir, fmt.Sprintf("%016x-%016x.snap", 1, 1))
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, testSnap.Data) {
+		t.Fatal("the snapshot file holds its data in plaintext")
+	}
+
+	// the crc is checked without the keys
+	if _, err = Read(logtool.RLog, fpath); err != ErrNoKeys {
+		t.Errorf("err = %v, want ErrNoKeys", err)
+	}
+	// a missing key leaves the file in place
+	if _, err = NewWithKeys(logtool.RLog, snapdir, testKeys(t, dir, k2)).Load(); err != cryptutil.ErrKeyNotFound {
+		t.Errorf("err = %v, want ErrKeyNotFound", err)
+	}
+	g, err := NewWithKeys(logtool.RLog, snapdir, testKeys(t, dir, k1+k2)).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, testSnap) {
+		t.Errorf("snap = %#v, want %#v", g, testSnap)
+	}
+
+	// a sealed snapshot cannot replace another one
+	newer := filepath.Join(snapdir, fmt.Sprintf("%016x-%016x.snap", 1, 2))
+	if err = os.Rename(fpath, newer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewWithKeys(logtool.RLog, snapdir, testKeys(t, dir, k1)).Read(newer); err == nil {
+		t.Error("read a snapshot moved to another index")
+	}
+	if err = os.Rename(newer, fpath); err != nil {
+		t.Fatal(err)
+	}
+
+	// plain snapshots are still read
+	if err = os.Remove(fpath); err != nil {
+		t.Fatal(err)
+	}
+	if err = New(logtool.RLog, snapdir).save(testSnap); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewWithKeys(logtool.RLog, snapdir, testKeys(t, dir, k1)).Load(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedDB(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapdir := filepath.Join(dir, "snap")
+	if err = os.Mkdir(snapdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	db := bytes.Repeat([]byte("secret db page "), 10000)
+
+	for i, ss := range []*Snapshotter{
+		New(logtool.RLog, snapdir),
+		NewWithKeys(logtool.RLog, snapdir, testKeys(t, dir, "k1=000102030405060708090a0b0c0d0e0f\n")),
+	} {
+		id := uint64(i + 1)
+		n, err := ss.SaveDBFrom(bytes.NewReader(db), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(db)) {
+			t.Errorf("#%d: saved %d bytes, want %d", i, n, len(db))
+		}
+		fn, err := ss.DBFilePath(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encrypted := !bytes.Contains(b, []byte("secret db page")); encrypted != (ss.sealer != nil) {
+			t.Errorf("#%d: encrypted = %v, want %v", i, encrypted, ss.sealer != nil)
+		}
+		rc, err := ss.OpenDB(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(g, db) {
+			t.Errorf("#%d: read %d bytes, %v, want the %d saved", i, len(g), err, len(db))
+		}
+	}
+	if _, err = New(logtool.RLog, snapdir).OpenDB(2); err != ErrNoKeys {
+		t.Errorf("err = %v, want ErrNoKeys", err)
+	}
+}
+
+func TestCompressedSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapdir := filepath.Join(dir, "snap")
+	if err = os.Mkdir(snapdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	keys := testKeys(t, dir, "k1=000102030405060708090a0b0c0d0e0f\n")
+	snap := *testSnap
+	snap.Data = bytes.Repeat([]byte(`{"/app/a":"1"}`), 1000)
+	fpath := filepath.Join(snapdir, fmt.Sprintf("%016x-%016x.snap", 1, 1))
+
+	for i, opts := range []Options{{Compress: true}, {Compress: true, Keys: keys}} {
+		if err = NewWithOptions(logtool.RLog, snapdir, opts).save(&snap); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() >= int64(len(snap.Data)/2) {
+			t.Errorf("#%d: snapshot file of %d bytes for %d bytes of data", i, fi.Size(), len(snap.Data))
+		}
+		// compressed snapshots are read without Options.Compress
+		g, err := NewWithKeys(logtool.RLog, snapdir, opts.Keys).Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*g, snap) {
+			t.Errorf("#%d: snapshot changed", i)
+		}
+		os.Remove(fpath)
+	}
+}
@@ -3,10 +3,15 @@ package v2stats
 import (
 	"encoding/json"
 	"math"
+	"sort"
 	"sync"
 	"time"
 )
 
+// latencyWindow is the number of most recent send latencies that follower
+// latency percentiles are computed from.
+const latencyWindow = queueCapacity
+
 // LeaderStats is used by the leader in an etcd cluster, and encapsulates
 // statistics about communication with its followers
 type LeaderStats struct {
@@ -33,9 +38,9 @@ func NewLeaderStats(id string) *LeaderStats {
 
 func (ls *LeaderStats) JSON() []byte {
 	ls.Lock()
-	stats := ls.leaderStats
+	// followers are marshalled under the lock since the map is shared
+	b, err := json.Marshal(ls.leaderStats)
 	ls.Unlock()
-	b, err := json.Marshal(stats)
 	// TODO(jonboulle): appropriate error handling?
 	if err != nil {
 		plog.Errorf("error marshalling leader stats (%v)", err)
@@ -59,6 +64,16 @@ func (ls *LeaderStats) Follower(name string) *FollowerStats {
 type FollowerStats struct {
 	Latency LatencyStats `json:"latency"`
 	Counts  CountsStats  `json:"counts"`
+	// RequestRate is the number of requests per second sent to the
+	// follower over the most recent requests; see statsQueue.Rate. It is
+	// updated on every send and when the stats are marshalled.
+	RequestRate float64 `json:"requestRate"`
+
+	// samples holds the last latencyWindow latencies in milliseconds,
+	// nextSample is the position the next one is written to
+	samples    []float64
+	nextSample int
+	reqQueue   *statsQueue
 
 	sync.Mutex
 }
@@ -71,6 +86,15 @@ type LatencyStats struct {
 	StandardDeviation float64 `json:"standardDeviation"`
 	Minimum           float64 `json:"minimum"`
 	Maximum           float64 `json:"maximum"`
+	// Percentiles are computed over the most recent latencyWindow sends.
+	Percentiles LatencyPercentiles `json:"percentiles"`
+}
+
+// LatencyPercentiles encapsulates latency percentiles in milliseconds.
+type LatencyPercentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
 }
 
 // CountsStats encapsulates raft statistics.
@@ -104,6 +128,14 @@ func (fs *FollowerStats) Succ(d time.Duration) {
 
 	// sdv = sqrt(avg(x^2) - avg(x)^2)
 	fs.Latency.StandardDeviation = math.Sqrt(fs.Latency.averageSquare - fs.Latency.Average*fs.Latency.Average)
+
+	if len(fs.samples) < latencyWindow {
+		fs.samples = append(fs.samples, fs.Latency.Current)
+	} else {
+		fs.samples[fs.nextSample] = fs.Latency.Current
+	}
+	fs.nextSample = (fs.nextSample + 1) % latencyWindow
+	fs.insertRequest()
 }
 
 // Fail updates the FollowerStats with an unsuccessful send
@@ -111,4 +143,51 @@ func (fs *FollowerStats) Fail() {
 	fs.Lock()
 	defer fs.Unlock()
 	fs.Counts.Fail++
+	fs.insertRequest()
+}
+
+func (fs *FollowerStats) insertRequest() {
+	if fs.reqQueue == nil {
+		fs.reqQueue = &statsQueue{back: -1}
+	}
+	fs.reqQueue.Insert(&RequestStats{SendingTime: time.Now()})
+	fs.RequestRate, _ = fs.reqQueue.Rate()
+}
+
+// MarshalJSON computes the latency percentiles and request rate of the
+// follower at the time of marshalling.
+func (fs *FollowerStats) MarshalJSON() ([]byte, error) {
+	fs.Lock()
+	latency, counts := fs.Latency, fs.Counts
+	latency.Percentiles = percentiles(fs.samples)
+	if fs.reqQueue != nil {
+		// the rate falls to zero once the follower is no longer sent to
+		fs.RequestRate, _ = fs.reqQueue.Rate()
+	}
+	rate := fs.RequestRate
+	fs.Unlock()
+
+	return json.Marshal(struct {
+		Latency     LatencyStats `json:"latency"`
+		Counts      CountsStats  `json:"counts"`
+		RequestRate float64      `json:"requestRate"`
+	}{latency, counts, rate})
+}
+
+// percentiles returns the nearest-rank percentiles of samples.
+func percentiles(samples []float64) LatencyPercentiles {
+	if len(samples) == 0 {
+		return LatencyPercentiles{}
+	}
+	sorted := make([]float64, len(samples))
+	copy(sorted, samples)
+	sort.Float64s(sorted)
+	rank := func(p float64) float64 {
+		i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return sorted[i]
+	}
+	return LatencyPercentiles{P50: rank(50), P90: rank(90), P99: rank(99)}
 }
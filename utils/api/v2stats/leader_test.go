@@ -0,0 +1,96 @@
+package v2stats
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestFollowerStatsPercentiles(t *testing.T) {
+	var fs FollowerStats
+	for i := 1; i <= 100; i++ {
+		fs.Succ(time.Duration(i) * time.Millisecond)
+	}
+	fs.Fail()
+	if fs.RequestRate <= 0 {
+		t.Errorf("RequestRate = %v, want > 0 after sends", fs.RequestRate)
+	}
+
+	var got struct {
+		Latency     LatencyStats `json:"latency"`
+		Counts      CountsStats  `json:"counts"`
+		RequestRate float64      `json:"requestRate"`
+	}
+	b, err := json.Marshal(&fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Counts.Success != 100 || got.Counts.Fail != 1 {
+		t.Errorf("counts = %+v, want 100 success and 1 fail", got.Counts)
+	}
+	want := LatencyPercentiles{P50: 50, P90: 90, P99: 99}
+	if got.Latency.Percentiles != want {
+		t.Errorf("percentiles = %+v, want %+v", got.Latency.Percentiles, want)
+	}
+	if got.RequestRate <= 0 {
+		t.Errorf("request rate = %v, want > 0", got.RequestRate)
+	}
+}
+
+func TestFollowerStatsWindow(t *testing.T) {
+	var fs FollowerStats
+	for i := 0; i < latencyWindow; i++ {
+		fs.Succ(time.Second)
+	}
+	for i := 0; i < latencyWindow; i++ {
+		fs.Succ(time.Millisecond)
+	}
+	if len(fs.samples) != latencyWindow {
+		t.Fatalf("samples = %d, want %d", len(fs.samples), latencyWindow)
+	}
+	// every slow sample has been overwritten
+	if p := percentiles(fs.samples); p.P99 != 1 {
+		t.Errorf("p99 = %v, want the slow samples to have left the window", p.P99)
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	tests := []struct {
+		samples []float64
+		want    LatencyPercentiles
+	}{
+		{nil, LatencyPercentiles{}},
+		{[]float64{3}, LatencyPercentiles{P50: 3, P90: 3, P99: 3}},
+		{[]float64{4, 1, 3, 2}, LatencyPercentiles{P50: 2, P90: 4, P99: 4}},
+	}
+	for i, tt := range tests {
+		if got := percentiles(tt.samples); got != tt.want {
+			t.Errorf("#%d: percentiles = %+v, want %+v", i, got, tt.want)
+		}
+	}
+}
+
+func TestLeaderStatsJSON(t *testing.T) {
+	ls := NewLeaderStats("1")
+	ls.Follower("2").Succ(time.Millisecond)
+
+	var got struct {
+		Leader    string `json:"leader"`
+		Followers map[string]struct {
+			Latency     LatencyStats `json:"latency"`
+			RequestRate float64      `json:"requestRate"`
+		} `json:"followers"`
+	}
+	if err := json.Unmarshal(ls.JSON(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Leader != "1" {
+		t.Errorf("leader = %q, want %q", got.Leader, "1")
+	}
+	if _, ok := got.Followers["2"]; !ok {
+		t.Errorf("followers = %v, want follower 2", got.Followers)
+	}
+}
@@ -77,6 +77,11 @@ func (q *statsQueue) Rate() (float64, float64) {
 	}
 
 	sampleDuration := back.SendingTime.Sub(front.SendingTime)
+	if sampleDuration <= 0 {
+		// a single request, or several within the clock resolution, gives
+		// no rate to speak of
+		return 0, 0
+	}
 
 	pr := float64(q.Len()) / float64(sampleDuration) * float64(time.Second)
 
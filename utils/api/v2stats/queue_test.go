@@ -0,0 +1,52 @@
+package v2stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsQueueRate(t *testing.T) {
+	q := &statsQueue{back: -1}
+	if pr, br := q.Rate(); pr != 0 || br != 0 {
+		t.Errorf("empty rate = %v, %v, want 0, 0", pr, br)
+	}
+
+	now := time.Now()
+	q.Insert(&RequestStats{SendingTime: now, Size: 10})
+	if pr, br := q.Rate(); pr != 0 || br != 0 {
+		t.Errorf("single request rate = %v, %v, want 0, 0", pr, br)
+	}
+
+	q.Insert(&RequestStats{SendingTime: now.Add(500 * time.Millisecond), Size: 10})
+	pr, br := q.Rate()
+	if pr != 4 || br != 40 {
+		t.Errorf("rate = %v, %v, want 4, 40", pr, br)
+	}
+}
+
+func TestStatsQueueWraps(t *testing.T) {
+	q := &statsQueue{back: -1}
+	now := time.Now()
+	for i := 0; i < queueCapacity+10; i++ {
+		q.Insert(&RequestStats{SendingTime: now, Size: 1})
+	}
+	if q.Len() != queueCapacity {
+		t.Errorf("len = %d, want %d", q.Len(), queueCapacity)
+	}
+	if q.ReqSize() != queueCapacity {
+		t.Errorf("size = %d, want %d", q.ReqSize(), queueCapacity)
+	}
+}
+
+func TestStatsQueueStale(t *testing.T) {
+	q := &statsQueue{back: -1}
+	old := time.Now().Add(-2 * time.Second)
+	q.Insert(&RequestStats{SendingTime: old})
+	q.Insert(&RequestStats{SendingTime: old.Add(time.Millisecond)})
+	if pr, _ := q.Rate(); pr != 0 {
+		t.Errorf("rate = %v, want 0", pr)
+	}
+	if q.Len() != 0 {
+		t.Errorf("len = %d, want 0 after stale rate", q.Len())
+	}
+}
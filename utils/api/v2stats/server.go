@@ -2,7 +2,6 @@ package v2stats
 
 import (
 	"encoding/json"
-	"log"
 	"sync"
 	"time"
 
@@ -67,7 +66,7 @@ func (ss *ServerStats) JSON() []byte {
 	b, err := json.Marshal(stats)
 	// TODO(jonboulle): appropriate error handling?
 	if err != nil {
-		log.Printf("stats: error marshalling server stats: %v", err)
+		plog.Errorf("error marshalling server stats: %v", err)
 	}
 	return b
 }
@@ -119,6 +118,40 @@ func (ss *ServerStats) BecomeLeader() {
 	ss.becomeLeader()
 }
 
+// BecomeFollower records that this server no longer leads the cluster.
+func (ss *ServerStats) BecomeFollower() {
+	ss.Lock()
+	defer ss.Unlock()
+	ss.State = raft.StateFollower
+}
+
+// FollowLeader records that this server follows leader, or has no leader
+// if leader is empty.
+func (ss *ServerStats) FollowLeader(leader string) {
+	ss.Lock()
+	defer ss.Unlock()
+	ss.State = raft.StateFollower
+	if leader != ss.LeaderInfo.Name {
+		ss.LeaderInfo.Name = leader
+		ss.LeaderInfo.StartTime = time.Now()
+	}
+}
+
+// Leader returns the ID of the last leader this server heard of, or an
+// empty string if it knows it has none.
+func (ss *ServerStats) Leader() string {
+	ss.Lock()
+	defer ss.Unlock()
+	return ss.LeaderInfo.Name
+}
+
+// IsLeader reports whether this server last recorded itself as leader.
+func (ss *ServerStats) IsLeader() bool {
+	ss.Lock()
+	defer ss.Unlock()
+	return ss.State == raft.StateLeader
+}
+
 func (ss *ServerStats) becomeLeader() {
 	if ss.State != raft.StateLeader {
 		ss.State = raft.StateLeader
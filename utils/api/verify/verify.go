@@ -0,0 +1,324 @@
+// Package verify checks the WAL and snapshot directories of a stopped
+// raft member for corruption and applies the fixes that cannot lose
+// committed data.
+package verify
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/fearblackcat/swiftRaft/utils/api/snap"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal/walpb"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/fileutil"
+)
+
+// Kinds of problems reported by Verify.
+const (
+	KindWALCorrupt     = "wal-corrupt"
+	KindWALTornTail    = "wal-torn-tail"
+	KindWALChainBroken = "wal-crc-chain-broken"
+	KindWALSequenceGap = "wal-sequence-gap"
+	KindWALSegmentName = "wal-segment-name"
+	KindWALEntryGap    = "wal-entry-gap"
+	KindCommitPastLast = "commit-past-last-index"
+	KindSnapCorrupt    = "snap-corrupt"
+	KindSnapOrphan     = "snap-orphan"
+	KindSnapMismatch   = "snap-term-mismatch"
+	KindSnapMissing    = "snap-missing"
+)
+
+// Severities of problems reported by Verify.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+const (
+	snapSuffix         = ".snap"
+	snapFileNameFormat = "%016x-%016x.snap"
+
+	// OrphanSuffix is appended to snapshot files that Fix moves aside.
+	OrphanSuffix = ".orphan"
+)
+
+// Problem is a single finding of Verify.
+type Problem struct {
+	Kind     string `json:"kind"`
+	Severity string `json:"severity"`
+	Path     string `json:"path,omitempty"`
+	Detail   string `json:"detail"`
+	// Fixable is set if Fix knows a remedy that keeps every record that
+	// could have been acknowledged.
+	Fixable bool `json:"fixable"`
+}
+
+// Report is the machine-readable result of Verify.
+type Report struct {
+	WALDir    string    `json:"walDir"`
+	SnapDir   string    `json:"snapDir"`
+	Segments  int       `json:"segments"`
+	LastIndex uint64    `json:"lastIndex"`
+	Commit    uint64    `json:"commit"`
+	Problems  []Problem `json:"problems"`
+
+	summary *wal.Summary
+}
+
+// OK reports whether no error-level problem was found.
+func (r *Report) OK() bool {
+	for _, p := range r.Problems {
+		if p.Severity == SeverityError {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Report) add(p Problem) {
+	r.Problems = append(r.Problems, p)
+}
+
+// Verify walks the WAL in walDir and the snapshot files in snapDir without
+// modifying either of them.
+func Verify(lg *logtool.RLogHandle, walDir, snapDir string) (*Report, error) {
+	s, err := wal.Scan(lg, walDir)
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{
+		WALDir:    walDir,
+		SnapDir:   snapDir,
+		Segments:  len(s.Segments),
+		LastIndex: s.LastIndex,
+		Commit:    s.HardState.Commit,
+		Problems:  []Problem{},
+		summary:   s,
+	}
+
+	chainOK := true
+	for i, seg := range s.Segments {
+		path := filepath.Join(walDir, seg.Name)
+		if seg.ChainBroken {
+			chainOK = false
+			r.add(Problem{
+				Kind:     KindWALChainBroken,
+				Severity: SeverityError,
+				Path:     path,
+				Detail:   "leading crc does not match the previous segment",
+			})
+		}
+		switch {
+		case seg.Err == nil:
+		case seg.Err == io.ErrUnexpectedEOF && i == len(s.Segments)-1:
+			r.add(Problem{
+				Kind:     KindWALTornTail,
+				Severity: SeverityError,
+				Path:     path,
+				Detail:   fmt.Sprintf("partially written record after offset %d", seg.LastOffset),
+				Fixable:  true,
+			})
+		default:
+			chainOK = false
+			r.add(Problem{
+				Kind:     KindWALCorrupt,
+				Severity: SeverityError,
+				Path:     path,
+				Detail:   fmt.Sprintf("undecodable record after offset %d: %v", seg.LastOffset, seg.Err),
+			})
+		}
+		if i > 0 && seg.Seq != s.Segments[i-1].Seq+1 {
+			r.add(Problem{
+				Kind:     KindWALSequenceGap,
+				Severity: SeverityError,
+				Path:     path,
+				Detail:   fmt.Sprintf("sequence %d follows %d", seg.Seq, s.Segments[i-1].Seq),
+			})
+		}
+	}
+	for _, seg := range s.Segments {
+		if seg.Name != seg.ExpectedName {
+			r.add(Problem{
+				Kind:     KindWALSegmentName,
+				Severity: SeverityError,
+				Path:     filepath.Join(walDir, seg.Name),
+				Detail:   fmt.Sprintf("contents expect segment name %s", seg.ExpectedName),
+				Fixable:  chainOK,
+			})
+		}
+	}
+	// a gap in sequence numbers is harmless if the crc chain proves that
+	// no segment is missing; renaming the segments closes it
+	if chainOK {
+		for i := range r.Problems {
+			if r.Problems[i].Kind == KindWALSequenceGap {
+				r.Problems[i].Fixable = true
+			}
+		}
+	}
+	for _, index := range s.EntryGaps {
+		r.add(Problem{
+			Kind:     KindWALEntryGap,
+			Severity: SeverityError,
+			Detail:   fmt.Sprintf("entry %d does not follow its predecessor", index),
+		})
+	}
+	if s.HardState.Commit > s.LastIndex {
+		r.add(Problem{
+			Kind:     KindCommitPastLast,
+			Severity: SeverityError,
+			Detail:   fmt.Sprintf("commit %d is past last index %d", s.HardState.Commit, s.LastIndex),
+		})
+	}
+
+	if err = verifySnapshots(lg, r, s); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func verifySnapshots(lg *logtool.RLogHandle, r *Report, s *wal.Summary) error {
+	names, err := fileutil.ReadDir(r.SnapDir, fileutil.WithExt(snapSuffix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	markers := make(map[uint64]walpb.Snapshot, len(s.Snapshots))
+	var latest walpb.Snapshot
+	for _, m := range s.Snapshots {
+		markers[m.Index] = m
+		if m.Index > latest.Index {
+			latest = m
+		}
+	}
+	// markers of snapshots older than the first remaining segment may have
+	// been purged along with their segment
+	var covered uint64
+	if len(s.Segments) > 0 {
+		covered = s.Segments[0].Index
+	}
+
+	// found maps the index of every readable snapshot file to its term
+	found := make(map[uint64]uint64, len(names))
+	for _, name := range names {
+		path := filepath.Join(r.SnapDir, name)
+		var term, index uint64
+		if _, err := fmt.Sscanf(name, snapFileNameFormat, &term, &index); err != nil {
+			r.add(Problem{
+				Kind:     KindSnapCorrupt,
+				Severity: SeverityWarning,
+				Path:     path,
+				Detail:   "unrecognized snapshot file name",
+			})
+			continue
+		}
+		// the crc of an encrypted snapshot is checked without the keys
+		if _, err := snap.Read(lg, path); err != nil && err != snap.ErrNoKeys {
+			r.add(Problem{
+				Kind:     KindSnapCorrupt,
+				Severity: SeverityError,
+				Path:     path,
+				Detail:   err.Error(),
+			})
+			continue
+		}
+		found[index] = term
+
+		m, ok := markers[index]
+		switch {
+		case ok && m.Term != term:
+			r.add(Problem{
+				Kind:     KindSnapMismatch,
+				Severity: SeverityError,
+				Path:     path,
+				Detail:   fmt.Sprintf("term %d, WAL recorded term %d", term, m.Term),
+			})
+		case !ok && index >= covered:
+			r.add(Problem{
+				Kind:     KindSnapOrphan,
+				Severity: SeverityError,
+				Path:     path,
+				Detail:   fmt.Sprintf("no WAL snapshot marker at index %d", index),
+				Fixable:  true,
+			})
+		}
+	}
+
+	if term, ok := found[latest.Index]; latest.Index != 0 && (!ok || term != latest.Term) {
+		// saveSnap records the marker before writing the file, so a crash
+		// in between leaves a marker without a file behind
+		r.add(Problem{
+			Kind:     KindSnapMissing,
+			Severity: SeverityWarning,
+			Path:     filepath.Join(r.SnapDir, fmt.Sprintf(snapFileNameFormat, latest.Term, latest.Index)),
+			Detail:   "latest WAL snapshot marker has no snapshot file",
+		})
+	}
+	return nil
+}
+
+// Fix applies the remedies of every fixable problem in r: it truncates a
+// torn WAL tail, moves orphaned snapshot files aside and renames WAL
+// segments to match their contents. It returns the problems it fixed.
+// Verify should be run again afterwards.
+func Fix(lg *logtool.RLogHandle, r *Report) ([]Problem, error) {
+	if err := ensureOffline(r); err != nil {
+		return nil, err
+	}
+
+	var (
+		fixed  []Problem
+		rename bool
+	)
+	for _, p := range r.Problems {
+		if !p.Fixable {
+			continue
+		}
+		switch p.Kind {
+		case KindWALTornTail:
+			if !wal.Repair(lg, r.WALDir) {
+				return fixed, fmt.Errorf("verify: failed to repair %s", p.Path)
+			}
+		case KindSnapOrphan:
+			if err := os.Rename(p.Path, p.Path+OrphanSuffix); err != nil {
+				return fixed, err
+			}
+			if lg != nil {
+				lg.Warn("moved orphaned snapshot file aside", map[string]interface{}{
+					"path": p.Path + OrphanSuffix,
+				})
+			}
+		case KindWALSegmentName, KindWALSequenceGap:
+			rename = true
+		default:
+			continue
+		}
+		fixed = append(fixed, p)
+	}
+	if rename {
+		if err := wal.RenameSegments(lg, r.WALDir, r.summary); err != nil {
+			return fixed, err
+		}
+	}
+	return fixed, nil
+}
+
+// ensureOffline fails with fileutil.ErrLocked if a running member holds
+// the WAL.
+func ensureOffline(r *Report) error {
+	if len(r.summary.Segments) == 0 {
+		return nil
+	}
+	last := r.summary.Segments[len(r.summary.Segments)-1].Name
+	l, err := fileutil.TryLockFile(filepath.Join(r.WALDir, last), os.O_RDWR, fileutil.PrivateFileMode)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
@@ -0,0 +1,152 @@
+package verify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/utils/api/snap"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal/walpb"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+)
+
+func newDataDir(t *testing.T) (string, string, string) {
+	p, err := ioutil.TempDir(os.TempDir(), "verifytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waldir, snapdir := filepath.Join(p, "wal"), filepath.Join(p, "snap")
+	if err = os.Mkdir(snapdir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := wal.Create(logtool.RLog, waldir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ents := []raftpb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}}
+	if err = w.Save(raftpb.HardState{Term: 1, Commit: 3}, ents); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveSnapshot(walpb.Snapshot{Index: 2, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	return p, waldir, snapdir
+}
+
+func saveSnap(t *testing.T, snapdir string, index, term uint64) {
+	s := raftpb.Snapshot{
+		Data:     []byte("state"),
+		Metadata: raftpb.SnapshotMetadata{Index: index, Term: term},
+	}
+	if err := snap.New(logtool.RLog, snapdir).SaveSnap(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func kinds(r *Report) map[string]bool {
+	m := make(map[string]bool)
+	for _, p := range r.Problems {
+		m[p.Kind] = true
+	}
+	return m
+}
+
+func TestVerifyClean(t *testing.T) {
+	p, waldir, snapdir := newDataDir(t)
+	defer os.RemoveAll(p)
+	saveSnap(t, snapdir, 2, 1)
+
+	r, err := Verify(logtool.RLog, waldir, snapdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() || len(r.Problems) != 0 {
+		t.Fatalf("problems = %+v, want none", r.Problems)
+	}
+	if r.LastIndex != 3 || r.Commit != 3 {
+		t.Errorf("last index = %d, commit = %d, want 3, 3", r.LastIndex, r.Commit)
+	}
+}
+
+func TestVerifySnapshots(t *testing.T) {
+	p, waldir, snapdir := newDataDir(t)
+	defer os.RemoveAll(p)
+	saveSnap(t, snapdir, 2, 2)
+	saveSnap(t, snapdir, 3, 1)
+	if err := ioutil.WriteFile(filepath.Join(snapdir, "0000000000000001-0000000000000001.snap"), []byte("junk"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Verify(logtool.RLog, waldir, snapdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := kinds(r)
+	for _, k := range []string{KindSnapMismatch, KindSnapOrphan, KindSnapCorrupt, KindSnapMissing} {
+		if !got[k] {
+			t.Errorf("missing problem %q in %+v", k, r.Problems)
+		}
+	}
+}
+
+func TestFix(t *testing.T) {
+	p, waldir, snapdir := newDataDir(t)
+	defer os.RemoveAll(p)
+	saveSnap(t, snapdir, 2, 1)
+	saveSnap(t, snapdir, 3, 1)
+
+	r, err := Verify(logtool.RLog, waldir, snapdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.OK() {
+		t.Fatal("OK = true, want false")
+	}
+	fixed, err := Fix(logtool.RLog, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixed) != 1 || fixed[0].Kind != KindSnapOrphan {
+		t.Fatalf("fixed = %+v, want the orphaned snapshot", fixed)
+	}
+
+	if r, err = Verify(logtool.RLog, waldir, snapdir); err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() {
+		t.Fatalf("problems = %+v, want none", r.Problems)
+	}
+	if _, err = os.Stat(fixed[0].Path + OrphanSuffix); err != nil {
+		t.Errorf("orphaned snapshot was not moved aside: %v", err)
+	}
+}
+
+func TestVerifyCommitPastLastIndex(t *testing.T) {
+	p, waldir, snapdir := newDataDir(t)
+	defer os.RemoveAll(p)
+
+	w, err := wal.Open(logtool.RLog, waldir, walpb.Snapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(raftpb.HardState{Term: 1, Commit: 5}, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	r, err := Verify(logtool.RLog, waldir, snapdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !kinds(r)[KindCommitPastLast] {
+		t.Fatalf("problems = %+v, want %q", r.Problems, KindCommitPastLast)
+	}
+}
@@ -0,0 +1,73 @@
+package wal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal/walpb"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+)
+
+func TestCompressedEntries(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "wal")
+	keys := testKeys(t, dir, "k1=000102030405060708090a0b0c0d0e0f\n")
+	value := bytes.Repeat([]byte(`{"key":"/app/a","value":"1"}`), 100)
+
+	for i, opts := range []Options{{Compress: true}, {Compress: true, Keys: keys}} {
+		os.RemoveAll(p)
+		w, err := CreateWithOptions(logtool.RLog, p, []byte("metadata"), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ents := []raftpb.Entry{
+			{Index: 1, Term: 1, Data: value},
+			{Index: 2, Term: 1, Data: []byte("short")},
+			{Index: 3, Term: 1},
+		}
+		if err = w.Save(raftpb.HardState{Term: 1, Commit: 3}, ents); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+
+		b, err := ioutil.ReadFile(filepath.Join(p, walName(0, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(b, value[:200]) {
+			t.Errorf("#%d: an entry is stored uncompressed", i)
+		}
+
+		// compressed entries are read without Options.Compress
+		opts.Compress = false
+		w, err = OpenWithOptions(logtool.RLog, p, walpb.Snapshot{}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, gents, err := w.ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		if !reflect.DeepEqual(gents, ents) {
+			t.Errorf("#%d: entries = %+v, want %+v", i, gents, ents)
+		}
+
+		s, err := Scan(logtool.RLog, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.LastIndex != 3 {
+			t.Errorf("#%d: scanned last index %d, want 3", i, s.LastIndex)
+		}
+	}
+}
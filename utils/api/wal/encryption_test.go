@@ -0,0 +1,116 @@
+package wal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal/walpb"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/cryptutil"
+)
+
+func testKeys(t *testing.T, dir string, lines string) cryptutil.KeyProvider {
+	p := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(p, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := cryptutil.NewFileKeyProvider(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestEncryptedEntries(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "wal")
+	k1 := "k1=000102030405060708090a0b0c0d0e0f\n"
+	k2 := "k2=101112131415161718191a1b1c1d1e1f\n"
+	secret := []byte("password=hunter2")
+
+	w, err := CreateWithOptions(logtool.RLog, p, []byte("metadata"), Options{Keys: testKeys(t, dir, k1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := []raftpb.Entry{{Index: 1, Term: 1, Data: secret}, {Index: 2, Term: 1}}
+	if err = w.Save(raftpb.HardState{Term: 1, Commit: 2}, ents); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// a rotated key encrypts the entries saved after it
+	w, err = OpenWithOptions(logtool.RLog, p, walpb.Snapshot{}, Options{Keys: testKeys(t, dir, k1+k2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	ents = append(ents, raftpb.Entry{Index: 3, Term: 2, Data: secret})
+	if err = w.Save(raftpb.HardState{Term: 2, Commit: 3}, ents[2:]); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	names, err := readWALNames(logtool.RLog, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(p, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(b, secret) {
+			t.Errorf("%s holds an entry in plaintext", name)
+		}
+	}
+
+	w, err = OpenWithOptions(logtool.RLog, p, walpb.Snapshot{}, Options{Keys: testKeys(t, dir, k1+k2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, state, gents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gents, ents) || state.Commit != 3 {
+		t.Errorf("entries = %+v, commit %d, want %+v, 3", gents, state.Commit, ents)
+	}
+	w.Close()
+
+	// the keys are needed to read the entries
+	for _, opts := range []Options{{}, {Keys: testKeys(t, dir, k2)}} {
+		w, err = OpenWithOptions(logtool.RLog, p, walpb.Snapshot{}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err = w.ReadAll(); err == nil {
+			t.Error("read encrypted entries without their key")
+		}
+		w.Close()
+	}
+
+	// but not to check the WAL
+	s, err := Scan(logtool.RLog, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seg := range s.Segments {
+		if seg.Err != nil {
+			t.Errorf("scan of %s: %v", seg.Name, seg.Err)
+		}
+	}
+	if s.LastIndex != 3 || s.HardState.Commit != 3 {
+		t.Errorf("scanned last index %d, commit %d, want 3, 3", s.LastIndex, s.HardState.Commit)
+	}
+}
@@ -17,6 +17,10 @@ type filePipeline struct {
 	dir string
 	// size of files to make, in bytes
 	size int64
+	// preallocate the files to size
+	prealloc bool
+	// mode of the files
+	mode os.FileMode
 	// count number of files generated
 	count int
 
@@ -25,14 +29,16 @@ type filePipeline struct {
 	donec chan struct{}
 }
 
-func newFilePipeline(lg *logtool.RLogHandle, dir string, fileSize int64) *filePipeline {
+func newFilePipeline(lg *logtool.RLogHandle, dir string, opts Options) *filePipeline {
 	fp := &filePipeline{
-		lg:    lg,
-		dir:   dir,
-		size:  fileSize,
-		filec: make(chan *fileutil.LockedFile),
-		errc:  make(chan error, 1),
-		donec: make(chan struct{}),
+		lg:       lg,
+		dir:      dir,
+		size:     opts.segmentSize(),
+		prealloc: !opts.NoPreallocate,
+		mode:     opts.fileMode(),
+		filec:    make(chan *fileutil.LockedFile),
+		errc:     make(chan error, 1),
+		donec:    make(chan struct{}),
 	}
 	go fp.run()
 	return fp
@@ -56,9 +62,13 @@ func (fp *filePipeline) Close() error {
 func (fp *filePipeline) alloc() (f *fileutil.LockedFile, err error) {
 	// count % 2 so this file isn't the same as the one last published
 	fpath := filepath.Join(fp.dir, fmt.Sprintf("%d.tmp", fp.count%2))
-	if f, err = fileutil.LockFile(fpath, os.O_CREATE|os.O_WRONLY, fileutil.PrivateFileMode); err != nil {
+	if f, err = fileutil.LockFile(fpath, os.O_CREATE|os.O_WRONLY, fp.mode); err != nil {
 		return nil, err
 	}
+	if !fp.prealloc {
+		fp.count++
+		return f, nil
+	}
 	if err = fileutil.Preallocate(f.File, fp.size, true); err != nil {
 		if fp.lg != nil {
 			fp.lg.Warn("failed to preallocate space when creating a new WAL", map[string]interface{}{
@@ -16,7 +16,7 @@ func TestFilePipeline(t *testing.T) {
 	}
 	defer os.RemoveAll(tdir)
 
-	fp := newFilePipeline(logtool.RLog, tdir, SegmentSizeBytes)
+	fp := newFilePipeline(logtool.RLog, tdir, Options{})
 	defer fp.Close()
 
 	f, ferr := fp.Open()
@@ -33,7 +33,7 @@ func TestFilePipelineFailPreallocate(t *testing.T) {
 	}
 	defer os.RemoveAll(tdir)
 
-	fp := newFilePipeline(logtool.RLog, tdir, math.MaxInt64)
+	fp := newFilePipeline(logtool.RLog, tdir, Options{SegmentSizeBytes: math.MaxInt64})
 	defer fp.Close()
 
 	f, ferr := fp.Open()
@@ -49,7 +49,7 @@ func TestFilePipelineFailLockFile(t *testing.T) {
 	}
 	os.RemoveAll(tdir)
 
-	fp := newFilePipeline(logtool.RLog, tdir, math.MaxInt64)
+	fp := newFilePipeline(logtool.RLog, tdir, Options{SegmentSizeBytes: math.MaxInt64})
 	defer fp.Close()
 
 	f, ferr := fp.Open()
@@ -0,0 +1,147 @@
+package wal
+
+import (
+	"time"
+)
+
+// SyncPolicy tells when the WAL fsyncs the records that raft must persist.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs in every Save that must sync, before it returns.
+	SyncAlways SyncPolicy = iota
+	// SyncBatch returns from Save without fsyncing, and fsyncs the records
+	// saved meanwhile as a group at most SyncOptions.MaxDelay after the
+	// first of them. Callers wait for the group on Sync.
+	SyncBatch
+	// SyncNone never fsyncs. A crash may lose acknowledged records, so it
+	// is only fit for tests.
+	SyncNone
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncBatch:
+		return "batch"
+	case SyncNone:
+		return "none"
+	}
+	return "unknown"
+}
+
+// SyncOptions tune the fsyncs of a WAL.
+type SyncOptions struct {
+	Policy SyncPolicy
+	// MaxDelay is how long SyncBatch waits for more records to join a
+	// group, 0 to fsync as soon as the syncer runs.
+	MaxDelay time.Duration
+	// WarnDuration is the duration beyond which an fsync is slow, 1s if 0.
+	// Slow fsyncs are logged and counted by wal_slow_fsyncs_total.
+	WarnDuration time.Duration
+	// OnSync, if set, is called after every fsync with its duration and
+	// whether it was slow. It is called with the WAL locked, and must not
+	// call the WAL.
+	OnSync func(took time.Duration, slow bool)
+}
+
+// SetSyncOptions changes how the WAL fsyncs. It is meant to be called once,
+// right after Create or Open.
+func (w *WAL) SetSyncOptions(o SyncOptions) {
+	w.stopSyncer()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if o.WarnDuration <= 0 {
+		o.WarnDuration = warnSyncDuration
+	}
+	w.syncOpts = o
+	if o.Policy == SyncBatch {
+		w.syncc = make(chan struct{}, 1)
+		w.syncStopc = make(chan struct{})
+		w.syncDonec = make(chan struct{})
+		go w.runSyncer(o.MaxDelay, w.syncc, w.syncStopc, w.syncDonec)
+	}
+}
+
+// Sync returns a channel that receives the result of the fsync which makes
+// the records saved so far durable. Under SyncAlways and SyncNone, or when
+// there is nothing to sync, the result is ready at once.
+func (w *WAL) Sync() <-chan error {
+	c := make(chan error, 1)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty {
+		c <- nil
+		return c
+	}
+	w.waiters = append(w.waiters, c)
+	// retry a group whose fsync failed
+	w.markDirty()
+	return c
+}
+
+// markDirty records that records which must be durable were saved without
+// an fsync, and wakes the syncer for them.
+func (w *WAL) markDirty() {
+	w.dirty = true
+	select {
+	case w.syncc <- struct{}{}:
+	default:
+	}
+}
+
+// runSyncer fsyncs the groups of records saved under SyncBatch until stopc
+// is closed.
+func (w *WAL) runSyncer(maxDelay time.Duration, syncc, stopc, donec chan struct{}) {
+	defer close(donec)
+	for {
+		select {
+		case <-syncc:
+		case <-stopc:
+			return
+		}
+		if maxDelay > 0 {
+			// let more records join the group
+			t := time.NewTimer(maxDelay)
+			select {
+			case <-t.C:
+			case <-stopc:
+				t.Stop()
+				return
+			}
+		}
+		w.mu.Lock()
+		if w.dirty && w.tail() != nil {
+			// the error reaches the waiters of the group; the next Save
+			// fails on its own
+			w.sync()
+		}
+		w.mu.Unlock()
+	}
+}
+
+// stopSyncer stops the syncer of SyncBatch, if it runs.
+func (w *WAL) stopSyncer() {
+	w.mu.Lock()
+	stopc, donec := w.syncStopc, w.syncDonec
+	w.syncStopc, w.syncDonec = nil, nil
+	w.mu.Unlock()
+	if stopc != nil {
+		close(stopc)
+		<-donec
+	}
+}
+
+// synced hands the result of an fsync to the waiters of the group it made
+// durable.
+func (w *WAL) synced(err error) {
+	if err == nil {
+		w.dirty = false
+	}
+	for _, c := range w.waiters {
+		c <- err
+	}
+	w.waiters = nil
+}
@@ -0,0 +1,110 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal/walpb"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+)
+
+// syncCounter counts the fsyncs reported to SyncOptions.OnSync.
+type syncCounter struct {
+	mu   sync.Mutex
+	n    int
+	slow int
+}
+
+func (c *syncCounter) onSync(took time.Duration, slow bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n++
+	if slow {
+		c.slow++
+	}
+}
+
+func (c *syncCounter) counts() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n, c.slow
+}
+
+func TestSyncPolicy(t *testing.T) {
+	tests := []struct {
+		policy SyncPolicy
+		warn   time.Duration
+
+		wsyncs int
+		wslow  bool
+	}{
+		// an fsync per Save
+		{SyncAlways, 0, 3, false},
+		// the three Saves share one
+		{SyncBatch, 0, 1, false},
+		{SyncNone, 0, 0, false},
+		{SyncAlways, time.Nanosecond, 3, true},
+	}
+	for i, tt := range tests {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := Create(logtool.RLog, p, []byte("metadata"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c syncCounter
+		w.SetSyncOptions(SyncOptions{Policy: tt.policy, MaxDelay: 50 * time.Millisecond, WarnDuration: tt.warn, OnSync: c.onSync})
+
+		var ents []raftpb.Entry
+		var syncs []<-chan error
+		for j := uint64(1); j <= 3; j++ {
+			e := raftpb.Entry{Index: j, Term: 1, Data: []byte{byte(j)}}
+			if err = w.Save(raftpb.HardState{Term: 1, Commit: j}, []raftpb.Entry{e}); err != nil {
+				t.Fatal(err)
+			}
+			ents = append(ents, e)
+			syncs = append(syncs, w.Sync())
+		}
+		for j, s := range syncs {
+			select {
+			case err := <-s:
+				if err != nil {
+					t.Errorf("#%d.%d: sync error = %v", i, j, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("#%d.%d: sync took too long", i, j)
+			}
+		}
+		n, slow := c.counts()
+		if n != tt.wsyncs {
+			t.Errorf("#%d: fsyncs = %d, want %d", i, n, tt.wsyncs)
+		}
+		if (slow > 0) != tt.wslow {
+			t.Errorf("#%d: slow fsyncs = %d, want slow %v", i, slow, tt.wslow)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		w, err = Open(logtool.RLog, p, walpb.Snapshot{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, gents, err := w.ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(gents, ents) {
+			t.Errorf("#%d: entries = %+v, want %+v", i, gents, ents)
+		}
+		w.Close()
+		os.RemoveAll(p)
+	}
+}
@@ -13,8 +13,15 @@ var (
 		// highest bucket start of 0.001 sec * 2^13 == 8.192 sec
 		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
 	})
+	walSlowFsyncs = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "etcd",
+		Subsystem: "disk",
+		Name:      "wal_slow_fsyncs_total",
+		Help:      "The total number of fsyncs called by WAL that took longer than the warning threshold.",
+	})
 )
 
 func init() {
 	prometheus.MustRegister(walFsyncSec)
+	prometheus.MustRegister(walSlowFsyncs)
 }
@@ -0,0 +1,102 @@
+package wal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal/walpb"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+)
+
+// TestOptionsAcrossRestarts appends to a WAL reopened with a different
+// segment size, preallocation and file mode each time. Every entry must be
+// read back, and the segments cut by each run must follow its options.
+func TestOptionsAcrossRestarts(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	runs := []Options{
+		{SegmentSizeBytes: 4 * 1024},
+		{SegmentSizeBytes: 16 * 1024, NoPreallocate: true, FileMode: 0640},
+		{SegmentSizeBytes: 2 * 1024},
+	}
+	data := bytes.Repeat([]byte("a"), 500)
+
+	var ents []raftpb.Entry
+	for i, opts := range runs {
+		var w *WAL
+		if i == 0 {
+			w, err = CreateWithOptions(logtool.RLog, p, nil, opts)
+		} else {
+			w, err = OpenWithOptions(logtool.RLog, p, walpb.Snapshot{}, opts)
+			if err == nil {
+				_, _, _, err = w.ReadAll()
+			}
+		}
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		before, err := readWALNames(logtool.RLog, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 100; j++ {
+			e := raftpb.Entry{Index: uint64(len(ents) + 1), Term: 1, Data: data}
+			if err = w.Save(raftpb.HardState{Term: 1, Commit: e.Index}, []raftpb.Entry{e}); err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			ents = append(ents, e)
+		}
+		tail := filepath.Base(w.tail().Name())
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		names, err := readWALNames(logtool.RLog, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cut := names[len(before):]
+		if len(cut) < 2 {
+			t.Fatalf("#%d: cut %d segments, want more", i, len(cut))
+		}
+		for _, name := range cut {
+			fi, err := os.Stat(filepath.Join(p, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != opts.fileMode() {
+				t.Errorf("#%d: mode of %s = %v, want %v", i, name, fi.Mode().Perm(), opts.fileMode())
+			}
+			// a full segment holds one entry beyond the size, which it
+			// is cut after
+			if name != tail && fi.Size() > opts.SegmentSizeBytes+1024 {
+				t.Errorf("#%d: size of %s = %d, want about %d", i, name, fi.Size(), opts.SegmentSizeBytes)
+			}
+			if name == tail && opts.NoPreallocate && fi.Size() >= opts.SegmentSizeBytes {
+				t.Errorf("#%d: size of the tail %s = %d, want it not preallocated", i, name, fi.Size())
+			}
+		}
+	}
+
+	w, err := Open(logtool.RLog, p, walpb.Snapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, gents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gents, ents) {
+		t.Errorf("read %d entries, want the %d saved", len(gents), len(ents))
+	}
+}
@@ -0,0 +1,194 @@
+package wal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal/walpb"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/fileutil"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/pbutil"
+)
+
+// SegmentStatus is the result of decoding a single WAL segment file.
+type SegmentStatus struct {
+	Name string
+	Seq  uint64
+	// Index is the raft index section of the segment file name.
+	Index uint64
+	// ExpectedName is the name the segment would have been given by cut,
+	// derived from its position and the records preceding it.
+	ExpectedName string
+
+	Records int
+	// LastOffset is the file offset following the last valid record.
+	LastOffset int64
+	// ChainBroken is set if the leading crc record of the segment does not
+	// match the rolling crc of the previous segment.
+	ChainBroken bool
+	// Err is the first decoding error of the segment; io.ErrUnexpectedEOF
+	// indicates a torn write.
+	Err error
+}
+
+// Summary is the result of walking every record of a WAL directory
+// without locking or modifying any file.
+type Summary struct {
+	Segments  []SegmentStatus
+	Snapshots []walpb.Snapshot
+	HardState raftpb.HardState
+	// LastIndex is the index of the last entry or snapshot marker
+	// decoded from the WAL.
+	LastIndex uint64
+	// EntryGaps holds the indexes at which an entry did not follow its
+	// predecessor.
+	EntryGaps []uint64
+}
+
+// TornTail reports whether the only decoding failure of the WAL is a
+// partially written record at the end of the last segment, which Repair
+// can truncate safely.
+func (s *Summary) TornTail() bool {
+	n := len(s.Segments)
+	if n == 0 || s.Segments[n-1].Err != io.ErrUnexpectedEOF {
+		return false
+	}
+	for _, seg := range s.Segments[:n-1] {
+		if seg.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Scan decodes every segment in dirpath independently, checking the crc of
+// each record and the crc chain between segments. It keeps going after a
+// corrupt segment so that all problems of the directory are reported.
+func Scan(lg *logtool.RLogHandle, dirpath string) (*Summary, error) {
+	names, err := readWALNames(lg, dirpath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Summary{}
+	var (
+		firstSeq uint64
+		prevCrc  uint32
+		enti     uint64
+	)
+	for i, name := range names {
+		seq, index, err := parseWALName(name)
+		if err != nil {
+			return nil, err
+		}
+		seg := SegmentStatus{Name: name, Seq: seq, Index: index}
+		if i == 0 {
+			// older segments may have been purged; keep the first name
+			firstSeq = seq
+			seg.ExpectedName = name
+		} else {
+			seg.ExpectedName = walName(firstSeq+uint64(i), enti+1)
+		}
+
+		f, err := os.OpenFile(filepath.Join(dirpath, name), os.O_RDONLY, fileutil.PrivateFileMode)
+		if err != nil {
+			return nil, err
+		}
+		decoder := newDecoder(f)
+		rec := &walpb.Record{}
+		for err = decoder.decode(rec); err == nil; err = decoder.decode(rec) {
+			seg.Records++
+			// the indexes of encrypted entries are not encrypted
+			switch rec.Type &^ recordFlags {
+			case entryType:
+				e := mustUnmarshalEntry(rec.Data)
+				if enti != 0 && e.Index > enti+1 {
+					s.EntryGaps = append(s.EntryGaps, e.Index)
+				}
+				enti = e.Index
+
+			case stateType:
+				s.HardState = mustUnmarshalState(rec.Data)
+
+			case crcType:
+				if seg.Records == 1 && i > 0 && rec.Crc != prevCrc {
+					seg.ChainBroken = true
+				}
+				crc := decoder.crc.Sum32()
+				if crc != 0 && rec.Validate(crc) != nil {
+					err = ErrCRCMismatch
+				} else {
+					decoder.updateCRC(rec.Crc)
+				}
+
+			case snapshotType:
+				var snap walpb.Snapshot
+				pbutil.MustUnmarshal(&snap, rec.Data)
+				s.Snapshots = append(s.Snapshots, snap)
+				if enti < snap.Index {
+					enti = snap.Index
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err != io.EOF {
+			seg.Err = err
+		}
+		seg.LastOffset = decoder.lastOffset()
+		prevCrc = decoder.lastCRC()
+		f.Close()
+
+		if seg.Err != nil && lg != nil {
+			lg.Warn("failed to decode WAL segment", map[string]interface{}{
+				"path":   name,
+				"offset": seg.LastOffset,
+				"error":  seg.Err,
+			})
+		}
+		s.Segments = append(s.Segments, seg)
+	}
+	s.LastIndex = enti
+	return s, nil
+}
+
+// RenameSegments renames every segment whose name differs from its
+// ExpectedName in s. It refuses to touch the directory unless every
+// segment decoded cleanly and the crc chain is intact, since only then
+// the contents prove that no segment is missing.
+func RenameSegments(lg *logtool.RLogHandle, dirpath string, s *Summary) error {
+	for _, seg := range s.Segments {
+		if seg.ChainBroken || (seg.Err != nil && seg.Err != io.ErrUnexpectedEOF) {
+			return ErrCRCMismatch
+		}
+	}
+	// expected sequence numbers never exceed the current ones, so renaming
+	// in order never collides with a segment that has not been moved yet
+	for _, seg := range s.Segments {
+		if seg.Name == seg.ExpectedName {
+			continue
+		}
+		from, to := filepath.Join(dirpath, seg.Name), filepath.Join(dirpath, seg.ExpectedName)
+		if fileutil.Exist(to) {
+			return os.ErrExist
+		}
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+		if lg != nil {
+			lg.Info("renamed WAL segment", map[string]interface{}{
+				"from": seg.Name,
+				"to":   seg.ExpectedName,
+			})
+		}
+	}
+	df, err := fileutil.OpenDir(dirpath)
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+	return fileutil.Fsync(df)
+}
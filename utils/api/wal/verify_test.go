@@ -0,0 +1,176 @@
+package wal
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fearblackcat/swiftRaft/raft/raftpb"
+	"github.com/fearblackcat/swiftRaft/utils/api/wal/walpb"
+	"github.com/fearblackcat/swiftRaft/utils/logtool"
+)
+
+// createCutWAL creates a WAL holding entries 1..n with a cut after every
+// entry, and a hard state committing the last entry.
+func createCutWAL(t *testing.T, p string, n int) {
+	w, err := Create(logtool.RLog, p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for i, es := range makeEnts(n) {
+		if err = w.Save(raftpb.HardState{Term: 1, Commit: uint64(i + 1)}, es); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.cut(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	createCutWAL(t, p, 3)
+
+	s, err := Scan(logtool.RLog, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Segments) != 4 {
+		t.Fatalf("len(segments) = %d, want 4", len(s.Segments))
+	}
+	for _, seg := range s.Segments {
+		if seg.Err != nil || seg.ChainBroken {
+			t.Errorf("segment %s: err = %v, chain broken = %v", seg.Name, seg.Err, seg.ChainBroken)
+		}
+		if seg.Name != seg.ExpectedName {
+			t.Errorf("expected name = %s, want %s", seg.ExpectedName, seg.Name)
+		}
+	}
+	if s.LastIndex != 3 || s.HardState.Commit != 3 {
+		t.Errorf("last index = %d, commit = %d, want 3, 3", s.LastIndex, s.HardState.Commit)
+	}
+	if len(s.Snapshots) != 1 || s.Snapshots[0].Index != 0 {
+		t.Errorf("snapshots = %+v, want the initial empty snapshot", s.Snapshots)
+	}
+	if s.TornTail() {
+		t.Error("torn tail = true, want false")
+	}
+}
+
+func TestScanTornTail(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(logtool.RLog, p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, es := range makeEnts(10) {
+		if err = w.Save(raftpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offset, err := w.tail().Seek(0, io.SeekCurrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	f, err := openLast(logtool.RLog, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Truncate(offset - 4); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s, err := Scan(logtool.RLog, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.TornTail() {
+		t.Fatalf("torn tail = false, want true (err = %v)", s.Segments[0].Err)
+	}
+	if s.LastIndex != 9 {
+		t.Errorf("last index = %d, want 9", s.LastIndex)
+	}
+}
+
+// TestRenameSegments ensures a gap in the sequence numbers is closed when
+// the crc chain shows that no segment is missing.
+func TestRenameSegments(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	createCutWAL(t, p, 3)
+	if err = os.Rename(filepath.Join(p, walName(2, 3)), filepath.Join(p, walName(5, 3))); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(filepath.Join(p, walName(3, 4)), filepath.Join(p, walName(6, 4))); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Scan(logtool.RLog, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = RenameSegments(logtool.RLog, p, s); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := readWALNames(logtool.RLog, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isValidSeq(logtool.RLog, names) {
+		t.Fatalf("names = %v, want continuous sequence", names)
+	}
+	w, err := Open(logtool.RLog, p, walpb.Snapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, _, ents, err := w.ReadAll(); err != nil || len(ents) != 3 {
+		t.Fatalf("len(ents) = %d, err = %v, want 3, nil", len(ents), err)
+	}
+}
+
+func TestRenameSegmentsBrokenChain(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	createCutWAL(t, p, 3)
+	// losing a segment breaks the chain; renaming would hide the loss
+	if err = os.Remove(filepath.Join(p, walName(2, 3))); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Scan(logtool.RLog, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Segments[2].ChainBroken {
+		t.Fatalf("chain broken = false, want true")
+	}
+	if err = RenameSegments(logtool.RLog, p, s); err != ErrCRCMismatch {
+		t.Fatalf("err = %v, want %v", err, ErrCRCMismatch)
+	}
+}
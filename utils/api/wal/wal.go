@@ -2,6 +2,7 @@ package wal
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
@@ -15,6 +16,8 @@ import (
 	"github.com/fearblackcat/swiftRaft/raft/raftpb"
 	"github.com/fearblackcat/swiftRaft/utils/api/wal/walpb"
 	"github.com/fearblackcat/swiftRaft/utils/logtool"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/compressutil"
+	"github.com/fearblackcat/swiftRaft/utils/pkg/cryptutil"
 	"github.com/fearblackcat/swiftRaft/utils/pkg/fileutil"
 	"github.com/fearblackcat/swiftRaft/utils/pkg/pbutil"
 
@@ -28,16 +31,27 @@ const (
 	crcType
 	snapshotType
 
-	// warnSyncDuration is the amount of time allotted to an fsync before
-	// logging a warning
+	// encryptedFlag is set in the type of an entry record whose data is
+	// sealed, see Options.Keys.
+	encryptedFlag int64 = 1 << 8
+	// compressedFlag is set in the type of an entry record whose data is
+	// compressed, see Options.Compress. Data is compressed before it is
+	// sealed.
+	compressedFlag int64 = 1 << 9
+	// recordFlags are the flags of a record type.
+	recordFlags = encryptedFlag | compressedFlag
+
+	// warnSyncDuration is the default amount of time allotted to an fsync
+	// before logging a warning
 	warnSyncDuration = time.Second
 )
 
 var (
-	// SegmentSizeBytes is the preallocated size of each wal segment file.
-	// The actual size might be larger than this. In general, the default
-	// value should be used, but this is defined as an exported variable
-	// so that tests can set a different segment size.
+	// SegmentSizeBytes is the default preallocated size of each wal
+	// segment file, see Options. The actual size might be larger than
+	// this. In general, the default value should be used, but this is
+	// defined as an exported variable so that tests can set a different
+	// segment size.
 	SegmentSizeBytes int64 = 64 * 1000 * 1000 // 64MB
 
 	plog = capnslog.NewPackageLogger("github.com/fearblackcat/swiftRaft", "wal")
@@ -47,6 +61,7 @@ var (
 	ErrCRCMismatch      = errors.New("wal: crc mismatch")
 	ErrSnapshotMismatch = errors.New("wal: snapshot mismatch")
 	ErrSnapshotNotFound = errors.New("wal: snapshot not found")
+	ErrNoKeys           = errors.New("wal: encrypted entry found without a key provider")
 	crcTable            = crc32.MakeTable(crc32.Castagnoli)
 )
 
@@ -76,11 +91,72 @@ type WAL struct {
 
 	locks []*fileutil.LockedFile // the locked files the WAL holds (the name is increasing)
 	fp    *filePipeline
+	opts  Options
+	// sealer encrypts and decrypts the data of entries, nil without
+	// Options.Keys
+	sealer *cryptutil.Sealer
+
+	syncOpts SyncOptions
+	dirty    bool         // records that must be durable were saved since the last fsync
+	waiters  []chan error // Sync callers waiting for the next fsync
+	// the syncer of SyncBatch
+	syncc                chan struct{}
+	syncStopc, syncDonec chan struct{}
+}
+
+// Options are the options of a single WAL. Zero values take the defaults.
+type Options struct {
+	// SegmentSizeBytes is the size beyond which a segment file is cut,
+	// and to which new ones are preallocated; SegmentSizeBytes if 0.
+	SegmentSizeBytes int64
+	// NoPreallocate grows the segment files as they are written instead
+	// of preallocating them, which saves disk space but may make writes
+	// slower.
+	NoPreallocate bool
+	// FileMode is the mode of the segment files the WAL creates,
+	// fileutil.PrivateFileMode if 0.
+	FileMode os.FileMode
+	// Keys, if set, encrypts the data of the entries the WAL saves with
+	// AES-GCM under its current key. The ID of the key is stored with each
+	// entry, so entries saved under earlier keys are read as long as Keys
+	// still has them. Entry indexes and terms, hard states and crcs stay
+	// readable without the keys, so that Repair and Scan work.
+	Keys cryptutil.KeyProvider
+	// Compress compresses the data of the entries the WAL saves when it
+	// makes them smaller. Compressed entries are read whatever Compress.
+	Compress bool
+}
+
+func (o Options) sealer() *cryptutil.Sealer {
+	if o.Keys == nil {
+		return nil
+	}
+	return cryptutil.NewSealer(o.Keys)
+}
+
+func (o Options) segmentSize() int64 {
+	if o.SegmentSizeBytes <= 0 {
+		return SegmentSizeBytes
+	}
+	return o.SegmentSizeBytes
+}
+
+func (o Options) fileMode() os.FileMode {
+	if o.FileMode == 0 {
+		return fileutil.PrivateFileMode
+	}
+	return o.FileMode
 }
 
 // Create creates a WAL ready for appending records. The given metadata is
 // recorded at the head of each WAL file, and can be retrieved with ReadAll.
 func Create(lg *logtool.RLogHandle, dirpath string, metadata []byte) (*WAL, error) {
+	return CreateWithOptions(lg, dirpath, metadata, Options{})
+}
+
+// CreateWithOptions is Create for a WAL with the given options. They apply
+// until the WAL is closed; a WAL may be reopened with other ones.
+func CreateWithOptions(lg *logtool.RLogHandle, dirpath string, metadata []byte, opts Options) (*WAL, error) {
 	if Exist(dirpath) {
 		return nil, os.ErrExist
 	}
@@ -103,7 +179,7 @@ func Create(lg *logtool.RLogHandle, dirpath string, metadata []byte) (*WAL, erro
 	}
 
 	p := filepath.Join(tmpdirpath, walName(0, 0))
-	f, err := fileutil.LockFile(p, os.O_WRONLY|os.O_CREATE, fileutil.PrivateFileMode)
+	f, err := fileutil.LockFile(p, os.O_WRONLY|os.O_CREATE, opts.fileMode())
 	if err != nil {
 		if lg != nil {
 			lg.Warn("failed to flock an initial WAL file", map[string]interface{}{
@@ -122,21 +198,25 @@ func Create(lg *logtool.RLogHandle, dirpath string, metadata []byte) (*WAL, erro
 		}
 		return nil, err
 	}
-	if err = fileutil.Preallocate(f.File, SegmentSizeBytes, true); err != nil {
-		if lg != nil {
-			lg.Warn("failed to preallocate an initial WAL file", map[string]interface{}{
-				"path":          p,
-				"segment-bytes": SegmentSizeBytes,
-				"error":         err,
-			})
+	if !opts.NoPreallocate {
+		if err = fileutil.Preallocate(f.File, opts.segmentSize(), true); err != nil {
+			if lg != nil {
+				lg.Warn("failed to preallocate an initial WAL file", map[string]interface{}{
+					"path":          p,
+					"segment-bytes": opts.segmentSize(),
+					"error":         err,
+				})
+			}
+			return nil, err
 		}
-		return nil, err
 	}
 
 	w := &WAL{
 		lg:       lg,
 		dir:      dirpath,
 		metadata: metadata,
+		opts:     opts,
+		sealer:   opts.sealer(),
 	}
 	w.encoder, err = newFileEncoder(f.File, 0)
 	if err != nil {
@@ -215,7 +295,7 @@ func (w *WAL) renameWAL(tmpdirpath string) (*WAL, error) {
 		}
 		return nil, err
 	}
-	w.fp = newFilePipeline(w.lg, w.dir, SegmentSizeBytes)
+	w.fp = newFilePipeline(w.lg, w.dir, w.opts)
 	df, err := fileutil.OpenDir(w.dir)
 	w.dirFile = df
 	return w, err
@@ -239,7 +319,7 @@ func (w *WAL) renameWALUnlock(tmpdirpath string) (*WAL, error) {
 	}
 
 	// reopen and relock
-	newWAL, oerr := Open(w.lg, w.dir, walpb.Snapshot{})
+	newWAL, oerr := OpenWithOptions(w.lg, w.dir, walpb.Snapshot{}, w.opts)
 	if oerr != nil {
 		return nil, oerr
 	}
@@ -257,6 +337,12 @@ func (w *WAL) renameWALUnlock(tmpdirpath string) (*WAL, error) {
 // the given snap. The WAL cannot be appended to before reading out all of its
 // previous records.
 func Open(lg *logtool.RLogHandle, dirpath string, snap walpb.Snapshot) (*WAL, error) {
+	return OpenWithOptions(lg, dirpath, snap, Options{})
+}
+
+// OpenWithOptions is Open for a WAL appended to with the given options.
+// The segments written before keep their size.
+func OpenWithOptions(lg *logtool.RLogHandle, dirpath string, snap walpb.Snapshot, opts Options) (*WAL, error) {
 	w, err := openAtIndex(lg, dirpath, snap, true)
 	if err != nil {
 		return nil, err
@@ -264,6 +350,9 @@ func Open(lg *logtool.RLogHandle, dirpath string, snap walpb.Snapshot) (*WAL, er
 	if w.dirFile, err = fileutil.OpenDir(w.dir); err != nil {
 		return nil, err
 	}
+	w.opts = opts
+	w.sealer = opts.sealer()
+	w.fp = newFilePipeline(w.lg, w.dir, w.opts)
 	return w, nil
 }
 
@@ -330,7 +419,6 @@ func openAtIndex(lg *logtool.RLogHandle, dirpath string, snap walpb.Snapshot, wr
 			closer()
 			return nil, err
 		}
-		w.fp = newFilePipeline(w.lg, w.dir, SegmentSizeBytes)
 	}
 
 	return w, nil
@@ -355,9 +443,21 @@ func (w *WAL) ReadAll() (metadata []byte, state raftpb.HardState, ents []raftpb.
 
 	var match bool
 	for err = decoder.decode(rec); err == nil; err = decoder.decode(rec) {
-		switch rec.Type {
+		switch rec.Type &^ recordFlags {
 		case entryType:
 			e := mustUnmarshalEntry(rec.Data)
+			if rec.Type&encryptedFlag != 0 {
+				if e.Data, err = w.openEntry(&e); err != nil {
+					state.Reset()
+					return nil, state, nil, err
+				}
+			}
+			if rec.Type&compressedFlag != 0 {
+				if e.Data, err = compressutil.Decompress(e.Data); err != nil {
+					state.Reset()
+					return nil, state, nil, err
+				}
+			}
 			if e.Index > w.start.Index {
 				ents = append(ents[:e.Index-w.start.Index-1], e)
 			}
@@ -521,7 +621,7 @@ func (w *WAL) cut() error {
 	// reopen newTail with its new path so calls to Name() match the wal filename format
 	newTail.Close()
 
-	if newTail, err = fileutil.LockFile(fpath, os.O_WRONLY, fileutil.PrivateFileMode); err != nil {
+	if newTail, err = fileutil.LockFile(fpath, os.O_WRONLY, w.opts.fileMode()); err != nil {
 		return err
 	}
 	if _, err = newTail.Seek(off, io.SeekStart); err != nil {
@@ -552,21 +652,34 @@ func (w *WAL) sync() error {
 			return err
 		}
 	}
+	if w.syncOpts.Policy == SyncNone {
+		return nil
+	}
 	start := time.Now()
 	err := fileutil.Fdatasync(w.tail().File)
 
 	took := time.Since(start)
-	if took > warnSyncDuration {
+	warn := w.syncOpts.WarnDuration
+	if warn <= 0 {
+		warn = warnSyncDuration
+	}
+	slow := took > warn
+	if slow {
 		if w.lg != nil {
 			w.lg.Warn("slow fdatasync", map[string]interface{}{
 				"took":              took,
-				"expected-duration": warnSyncDuration,
+				"expected-duration": warn,
 			})
 		} else {
-			plog.Warningf("sync duration of %v, expected less than %v", took, warnSyncDuration)
+			plog.Warningf("sync duration of %v, expected less than %v", took, warn)
 		}
+		walSlowFsyncs.Inc()
 	}
 	walFsyncSec.Observe(took.Seconds())
+	if w.syncOpts.OnSync != nil {
+		w.syncOpts.OnSync(took, slow)
+	}
+	w.synced(err)
 
 	return err
 }
@@ -620,6 +733,8 @@ func (w *WAL) ReleaseLockTo(index uint64) error {
 
 // Close closes the current WAL file and directory.
 func (w *WAL) Close() error {
+	w.stopSyncer()
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -652,9 +767,30 @@ func (w *WAL) Close() error {
 }
 
 func (w *WAL) saveEntry(e *raftpb.Entry) error {
-	// TODO: add MustMarshalTo to reduce one allocation.
-	b := pbutil.MustMarshal(e)
-	rec := &walpb.Record{Type: entryType, Data: b}
+	rec := &walpb.Record{Type: entryType}
+	data := e.Data
+	if w.opts.Compress {
+		var ok bool
+		if data, ok = compressutil.Shrink(data); ok {
+			rec.Type |= compressedFlag
+		}
+	}
+	if w.sealer != nil && len(data) > 0 {
+		sealed, err := w.sealer.Seal(data, entryAD(e))
+		if err != nil {
+			return err
+		}
+		data = sealed
+		rec.Type |= encryptedFlag
+	}
+	if rec.Type != entryType {
+		se := *e
+		se.Data = data
+		rec.Data = pbutil.MustMarshal(&se)
+	} else {
+		// TODO: add MustMarshalTo to reduce one allocation.
+		rec.Data = pbutil.MustMarshal(e)
+	}
 	if err := w.encoder.encode(rec); err != nil {
 		return err
 	}
@@ -662,6 +798,23 @@ func (w *WAL) saveEntry(e *raftpb.Entry) error {
 	return nil
 }
 
+// openEntry decrypts the data of e, read from an encrypted entry record.
+func (w *WAL) openEntry(e *raftpb.Entry) ([]byte, error) {
+	if w.sealer == nil {
+		return nil, ErrNoKeys
+	}
+	return w.sealer.Open(e.Data, entryAD(e))
+}
+
+// entryAD binds the sealed data of e to its index and term, so that it
+// cannot be moved to another entry.
+func entryAD(e *raftpb.Entry) []byte {
+	ad := make([]byte, 16)
+	binary.BigEndian.PutUint64(ad, e.Index)
+	binary.BigEndian.PutUint64(ad[8:], e.Term)
+	return ad
+}
+
 func (w *WAL) saveState(s *raftpb.HardState) error {
 	if raft.IsEmptyHardState(*s) {
 		return nil
@@ -697,11 +850,19 @@ func (w *WAL) Save(st raftpb.HardState, ents []raftpb.Entry) error {
 	if err != nil {
 		return err
 	}
-	if curOff < SegmentSizeBytes {
-		if mustSync {
-			return w.sync()
+	if curOff < w.opts.segmentSize() {
+		if !mustSync {
+			return nil
 		}
-		return nil
+		if w.syncOpts.Policy == SyncBatch {
+			// flush now, so that the fsync of the group holds the records
+			if err := w.encoder.flush(); err != nil {
+				return err
+			}
+			w.markDirty()
+			return nil
+		}
+		return w.sync()
 	}
 
 	return w.cut()
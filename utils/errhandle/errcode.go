@@ -6,4 +6,41 @@ const (
 	E_REMOVE_RAFT_NODE_FAIL = 633001
 	E_ELECTION_ERROR        = 633002
 	E_LEADER_DOWN           = 633003
+
+	// fatal: the member stops after reporting one of these
+	E_DATA_DIR        = 633100
+	E_WAL_SAVE        = 633101
+	E_SNAPSHOT_SAVE   = 633102
+	E_STORAGE         = 633103
+	E_SNAPSHOT_CREATE = 633104
+	E_APPLY           = 633105
+	E_TRANSPORT       = 633106
+	E_KV_SERVE        = 633107
+	E_TLS             = 633108
+
+	// api: returned to clients, see HTTPStatus
+	E_NOT_LEADER           = 634000
+	E_NO_LEADER            = 634001
+	E_PROPOSAL_DROPPED     = 634002
+	E_TIMEOUT              = 634003
+	E_KEY_NOT_FOUND        = 634004
+	E_CAS_MISMATCH         = 634005
+	E_MEMBER_NOT_FOUND     = 634006
+	E_MEMBER_EXISTS        = 634007
+	E_UNSAFE_CONF_CHANGE   = 634008
+	E_INVALID_REQUEST      = 634009
+	E_METHOD_NOT_ALLOWED   = 634010
+	E_COMPACTED            = 634011
+	E_SNAPSHOT_OUT_OF_DATE = 634012
+	E_STOPPED              = 634013
+	E_INTERNAL             = 634014
+	E_AUTH_FAILED          = 634015
+	E_PERMISSION_DENIED    = 634016
+	E_USER_NOT_FOUND       = 634017
+	E_ROLE_NOT_FOUND       = 634018
+	E_FUTURE_REV           = 634019
+	E_LEASE_NOT_FOUND      = 634020
+	E_LEASE_EXISTS         = 634021
+	E_STALE_SEQUENCE       = 634022
+	E_TOO_MANY_REQUESTS    = 634023
 )
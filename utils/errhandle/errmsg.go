@@ -8,6 +8,43 @@ var Msg = map[int]string{
 	E_REMOVE_RAFT_NODE_FAIL: "remove raft node failed",
 	E_ELECTION_ERROR:        "exit the election",
 	E_LEADER_DOWN:           "leader down error",
+
+	// fatal
+	E_DATA_DIR:        "failed to load data dir",
+	E_WAL_SAVE:        "failed to save to wal",
+	E_SNAPSHOT_SAVE:   "failed to save snapshot",
+	E_STORAGE:         "failed to update raft storage",
+	E_SNAPSHOT_CREATE: "failed to create snapshot of the state machine",
+	E_APPLY:           "failed to apply committed entries",
+	E_TRANSPORT:       "raft transport failed",
+	E_KV_SERVE:        "failed to serve key-value api",
+	E_TLS:             "invalid tls configuration",
+
+	// api
+	E_NOT_LEADER:           "member is not the leader",
+	E_NO_LEADER:            "cluster has no leader",
+	E_PROPOSAL_DROPPED:     "proposal dropped",
+	E_TIMEOUT:              "request timed out",
+	E_KEY_NOT_FOUND:        "key not found",
+	E_CAS_MISMATCH:         "compare failed",
+	E_MEMBER_NOT_FOUND:     "member not found",
+	E_MEMBER_EXISTS:        "member already exists",
+	E_UNSAFE_CONF_CHANGE:   "unsafe conf change",
+	E_INVALID_REQUEST:      "invalid request",
+	E_METHOD_NOT_ALLOWED:   "method not allowed",
+	E_COMPACTED:            "requested index is compacted",
+	E_SNAPSHOT_OUT_OF_DATE: "requested snapshot is out of date",
+	E_STOPPED:              "member is stopped",
+	E_INTERNAL:             "internal error",
+	E_AUTH_FAILED:          "authentication failed",
+	E_PERMISSION_DENIED:    "permission denied",
+	E_USER_NOT_FOUND:       "user not found",
+	E_ROLE_NOT_FOUND:       "role not found",
+	E_FUTURE_REV:           "requested revision is not applied yet",
+	E_LEASE_NOT_FOUND:      "lease not found",
+	E_LEASE_EXISTS:         "lease already exists",
+	E_STALE_SEQUENCE:       "sequence number is older than the last one of the client session",
+	E_TOO_MANY_REQUESTS:    "too many requests",
 }
 
 func FormatCode(code int) string {
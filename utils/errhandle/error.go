@@ -0,0 +1,35 @@
+package errhandle
+
+// Error is an error identified by one of the codes above. Cause is the
+// error that led to it, if any.
+type Error struct {
+	Code  int
+	Cause error
+	// Leader is a hint for E_NOT_LEADER, the ID of the leader if known.
+	Leader string
+}
+
+func NewError(code int, cause error) *Error {
+	return &Error{Code: code, Cause: cause}
+}
+
+func (e *Error) Error() string {
+	s := FormatCode(e.Code)
+	if e.Leader != "" {
+		s += "||leader=" + e.Leader
+	}
+	if e.Cause != nil {
+		s += "||cause=" + e.Cause.Error()
+	}
+	return s
+}
+
+func (e *Error) Unwrap() error { return e.Cause }
+
+// Code returns the code of err, or 0 if err is not an *Error.
+func Code(err error) int {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return 0
+}
@@ -0,0 +1,27 @@
+package errhandle
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	cause := errors.New("disk full")
+	err := error(NewError(E_WAL_SAVE, cause))
+
+	if want := "errno=633101||errmsg=failed to save to wal||cause=disk full"; err.Error() != want {
+		t.Errorf("error = %q, want %q", err.Error(), want)
+	}
+	if Code(err) != E_WAL_SAVE {
+		t.Errorf("code = %d, want %d", Code(err), E_WAL_SAVE)
+	}
+	if errors.Unwrap(err) != cause {
+		t.Errorf("cause = %v, want %v", errors.Unwrap(err), cause)
+	}
+	if Code(cause) != 0 {
+		t.Errorf("code of a plain error = %d, want 0", Code(cause))
+	}
+	if s := NewError(E_LEADER_DOWN, nil).Error(); s != FormatCode(E_LEADER_DOWN) {
+		t.Errorf("error = %q, want %q", s, FormatCode(E_LEADER_DOWN))
+	}
+}
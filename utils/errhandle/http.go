@@ -0,0 +1,70 @@
+package errhandle
+
+import (
+	"errors"
+	"net/http"
+)
+
+// httpStatus maps the api codes to the status of the responses carrying
+// them. Other codes are sent as 500.
+var httpStatus = map[int]int{
+	E_NOT_LEADER:           http.StatusForbidden,
+	E_NO_LEADER:            http.StatusServiceUnavailable,
+	E_PROPOSAL_DROPPED:     http.StatusServiceUnavailable,
+	E_TIMEOUT:              http.StatusGatewayTimeout,
+	E_KEY_NOT_FOUND:        http.StatusNotFound,
+	E_CAS_MISMATCH:         http.StatusPreconditionFailed,
+	E_MEMBER_NOT_FOUND:     http.StatusNotFound,
+	E_MEMBER_EXISTS:        http.StatusConflict,
+	E_UNSAFE_CONF_CHANGE:   http.StatusConflict,
+	E_INVALID_REQUEST:      http.StatusBadRequest,
+	E_METHOD_NOT_ALLOWED:   http.StatusMethodNotAllowed,
+	E_COMPACTED:            http.StatusGone,
+	E_SNAPSHOT_OUT_OF_DATE: http.StatusGone,
+	E_STOPPED:              http.StatusServiceUnavailable,
+	E_AUTH_FAILED:          http.StatusUnauthorized,
+	E_PERMISSION_DENIED:    http.StatusForbidden,
+	E_USER_NOT_FOUND:       http.StatusNotFound,
+	E_ROLE_NOT_FOUND:       http.StatusNotFound,
+	E_FUTURE_REV:           http.StatusBadRequest,
+	E_LEASE_NOT_FOUND:      http.StatusNotFound,
+	E_LEASE_EXISTS:         http.StatusConflict,
+	E_STALE_SEQUENCE:       http.StatusConflict,
+	E_TOO_MANY_REQUESTS:    http.StatusTooManyRequests,
+}
+
+// HTTPStatus returns the status of a response carrying code.
+func HTTPStatus(code int) int {
+	if s, ok := httpStatus[code]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+// Body is the JSON body of an error response.
+type Body struct {
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
+	Cause     string `json:"cause,omitempty"`
+	// Leader is the ID of the current leader, if known, in E_NOT_LEADER
+	// responses.
+	Leader string `json:"leader,omitempty"`
+}
+
+// Body returns the response body of e.
+func (e *Error) Body() Body {
+	b := Body{ErrorCode: e.Code, Message: Msg[e.Code], Leader: e.Leader}
+	if e.Cause != nil {
+		b.Cause = e.Cause.Error()
+	}
+	return b
+}
+
+// Err returns the error described by b.
+func (b Body) Err() *Error {
+	e := &Error{Code: b.ErrorCode, Leader: b.Leader}
+	if b.Cause != "" {
+		e.Cause = errors.New(b.Cause)
+	}
+	return e
+}
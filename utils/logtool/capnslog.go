@@ -0,0 +1,89 @@
+package logtool
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/coreos/pkg/capnslog"
+)
+
+// capnslog package loggers are still used where no logger is passed in.
+// Their messages are sent to the subsystem logger of their package, whose
+// level Configure and SetLevel give to them.
+func init() {
+	capnslog.SetFormatter(capnslogFormatter{})
+}
+
+// capnslogRepo is the repository of the capnslog package loggers.
+const capnslogRepo = "github.com/fearblackcat/swiftRaft"
+
+// capnslogSubsystems maps the capnslog package names to subsystems; the
+// other packages log to SubsystemNode.
+var capnslogSubsystems = map[string]string{
+	"wal":                SubsystemWAL,
+	"snap":               SubsystemSnap,
+	"utils/api/rafthttp": SubsystemTransport,
+	"utils/api/v2stats":  SubsystemTransport,
+}
+
+type capnslogFormatter struct{}
+
+func (capnslogFormatter) Format(pkg string, level capnslog.LogLevel, depth int, entries ...interface{}) {
+	subsystem, ok := capnslogSubsystems[pkg]
+	if !ok {
+		subsystem = SubsystemNode
+	}
+	e := logrus.NewEntry(subsystemLogger(subsystem)).WithFields(logrus.Fields{
+		"subsystem": subsystem,
+		"pkg":       pkg,
+	})
+	msg := strings.TrimSuffix(fmt.Sprint(entries...), "\n")
+	switch level {
+	// capnslog exits or panics by itself after Fatal and Panic
+	case capnslog.CRITICAL, capnslog.ERROR:
+		e.Error(msg)
+	case capnslog.WARNING:
+		e.Warn(msg)
+	case capnslog.NOTICE, capnslog.INFO:
+		e.Info(msg)
+	default:
+		e.Debug(msg)
+	}
+}
+
+func (capnslogFormatter) Flush() {}
+
+// setCapnslogLevels gives the capnslog package loggers the levels of their
+// subsystems, so that they skip the messages those would drop.
+func setCapnslogLevels() {
+	repo, err := capnslog.GetRepoLogger(capnslogRepo)
+	if err != nil {
+		// no package logger yet
+		return
+	}
+	levels := make(map[string]capnslog.LogLevel, len(repo))
+	for pkg := range repo {
+		subsystem, ok := capnslogSubsystems[pkg]
+		if !ok {
+			subsystem = SubsystemNode
+		}
+		levels[pkg] = capnslogLevel(subsystemLogger(subsystem).GetLevel())
+	}
+	repo.SetLogLevel(levels)
+}
+
+func capnslogLevel(l logrus.Level) capnslog.LogLevel {
+	switch l {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return capnslog.CRITICAL
+	case logrus.ErrorLevel:
+		return capnslog.ERROR
+	case logrus.WarnLevel:
+		return capnslog.WARNING
+	case logrus.InfoLevel:
+		return capnslog.INFO
+	default:
+		return capnslog.DEBUG
+	}
+}
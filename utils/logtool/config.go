@@ -0,0 +1,214 @@
+package logtool
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Subsystems with a log level of their own. Every message carries its
+// subsystem in the "subsystem" field.
+const (
+	SubsystemRaft      = "raft"
+	SubsystemNode      = "node"
+	SubsystemTransport = "transport"
+	SubsystemWAL       = "wal"
+	SubsystemSnap      = "snap"
+	SubsystemKV        = "kv"
+)
+
+// Subsystems lists every subsystem known to Configure and SetLevel.
+var Subsystems = []string{
+	SubsystemRaft,
+	SubsystemNode,
+	SubsystemTransport,
+	SubsystemWAL,
+	SubsystemSnap,
+	SubsystemKV,
+}
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Config configures the output of every subsystem logger.
+type Config struct {
+	// Level is the level of the subsystems missing from Levels; "info" if
+	// empty.
+	Level string
+	// Levels overrides Level per subsystem.
+	Levels map[string]string
+	// Format is FormatText or FormatJSON; FormatText if empty.
+	Format string
+	// Output defaults to os.Stderr.
+	Output io.Writer
+}
+
+// loggers holds one logrus logger per subsystem. The loggers are created
+// once and reconfigured in place, since the handles returned by Logger are
+// kept by the components they are passed to.
+var loggers = struct {
+	sync.Mutex
+	m map[string]*logrus.Logger
+}{m: make(map[string]*logrus.Logger)}
+
+var (
+	memberID    atomic.Value // string
+	currentTerm uint64
+)
+
+func subsystemLogger(name string) *logrus.Logger {
+	loggers.Lock()
+	defer loggers.Unlock()
+	if l, ok := loggers.m[name]; ok {
+		return l
+	}
+	l := logrus.New()
+	l.Out = os.Stderr
+	l.Formatter = newFormatter(FormatText)
+	l.Level = logrus.InfoLevel
+	l.AddHook(fieldsHook{})
+	loggers.m[name] = l
+	return l
+}
+
+// Logger returns the structured logger of a subsystem.
+func Logger(subsystem string) *RLogHandle {
+	return &RLogHandle{logrus.NewEntry(subsystemLogger(subsystem)).WithField("subsystem", subsystem)}
+}
+
+// PrintfLogger returns the printf style logger of a subsystem, e.g. for
+// raft.Config.Logger.
+func PrintfLogger(subsystem string) *NLogHandle {
+	return &NLogHandle{logrus.NewEntry(subsystemLogger(subsystem)).WithField("subsystem", subsystem)}
+}
+
+// Configure sets the format, output and levels of every subsystem.
+func Configure(cfg Config) error {
+	if cfg.Level == "" {
+		cfg.Level = "info"
+	}
+	level, err := logrus.ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	levels := make(map[string]logrus.Level, len(cfg.Levels))
+	for name, l := range cfg.Levels {
+		if !isSubsystem(name) {
+			return fmt.Errorf("logtool: unknown subsystem %q", name)
+		}
+		if levels[name], err = logrus.ParseLevel(l); err != nil {
+			return err
+		}
+	}
+	switch cfg.Format {
+	case "":
+		cfg.Format = FormatText
+	case FormatText, FormatJSON:
+	default:
+		return fmt.Errorf("logtool: unknown format %q", cfg.Format)
+	}
+	if cfg.Output == nil {
+		cfg.Output = os.Stderr
+	}
+
+	for _, name := range Subsystems {
+		l := subsystemLogger(name)
+		l.SetOutput(cfg.Output)
+		l.SetFormatter(newFormatter(cfg.Format))
+		if sl, ok := levels[name]; ok {
+			l.SetLevel(sl)
+		} else {
+			l.SetLevel(level)
+		}
+	}
+	setCapnslogLevels()
+	return nil
+}
+
+// SetLevel changes the level of one subsystem, or of all of them if
+// subsystem is empty, while the process runs.
+func SetLevel(subsystem, level string) error {
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	if subsystem == "" {
+		for _, name := range Subsystems {
+			subsystemLogger(name).SetLevel(l)
+		}
+		setCapnslogLevels()
+		return nil
+	}
+	if !isSubsystem(subsystem) {
+		return fmt.Errorf("logtool: unknown subsystem %q", subsystem)
+	}
+	subsystemLogger(subsystem).SetLevel(l)
+	setCapnslogLevels()
+	return nil
+}
+
+// Levels returns the current level of every subsystem.
+func Levels() map[string]string {
+	levels := make(map[string]string, len(Subsystems))
+	for _, name := range Subsystems {
+		levels[name] = subsystemLogger(name).GetLevel().String()
+	}
+	return levels
+}
+
+// SetMemberID sets the "member" field added to every message.
+func SetMemberID(id string) {
+	memberID.Store(id)
+}
+
+// SetTerm sets the "term" field added to every message.
+func SetTerm(term uint64) {
+	atomic.StoreUint64(&currentTerm, term)
+}
+
+func isSubsystem(name string) bool {
+	for _, s := range Subsystems {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func newFormatter(format string) logrus.Formatter {
+	if format == FormatJSON {
+		return &logrus.JSONFormatter{}
+	}
+	return &logrus.TextFormatter{FullTimestamp: true}
+}
+
+// fieldsHook adds the member ID and the current term to every message once
+// they are known.
+type fieldsHook struct{}
+
+func (fieldsHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (fieldsHook) Fire(e *logrus.Entry) error {
+	id, _ := memberID.Load().(string)
+	term := atomic.LoadUint64(&currentTerm)
+	if id == "" && term == 0 {
+		return nil
+	}
+	// the map is shared with the entry the message was logged on
+	data := make(logrus.Fields, len(e.Data)+2)
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	if id != "" {
+		data["member"] = id
+	}
+	data["term"] = term
+	e.Data = data
+	return nil
+}
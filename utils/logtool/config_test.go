@@ -0,0 +1,134 @@
+package logtool
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/coreos/pkg/capnslog"
+)
+
+func TestConfigure(t *testing.T) {
+	var buf bytes.Buffer
+	err := Configure(Config{
+		Level:  "warn",
+		Levels: map[string]string{SubsystemWAL: "debug"},
+		Format: FormatJSON,
+		Output: &buf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(Config{})
+
+	Logger(SubsystemNode).Info("dropped", map[string]interface{}{})
+	Logger(SubsystemWAL).Debug("kept", map[string]interface{}{"index": 1})
+
+	var m map[string]interface{}
+	if err = json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("output %q is not one JSON message: %v", buf.String(), err)
+	}
+	if m["msg"] != "kept" || m["subsystem"] != SubsystemWAL || m["index"] != float64(1) {
+		t.Errorf("message = %v, want the wal debug message", m)
+	}
+
+	for _, cfg := range []Config{
+		{Level: "loud"},
+		{Format: "xml"},
+		{Levels: map[string]string{"disk": "info"}},
+	} {
+		if err = Configure(cfg); err == nil {
+			t.Errorf("Configure(%+v) error = nil, want error", cfg)
+		}
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	defer Configure(Config{})
+
+	if err := SetLevel(SubsystemRaft, "debug"); err != nil {
+		t.Fatal(err)
+	}
+	if l := Levels()[SubsystemRaft]; l != "debug" {
+		t.Errorf("raft level = %s, want debug", l)
+	}
+	if l := Levels()[SubsystemKV]; l != "info" {
+		t.Errorf("kv level = %s, want info", l)
+	}
+	if err := SetLevel("", "error"); err != nil {
+		t.Fatal(err)
+	}
+	for name, l := range Levels() {
+		if l != "error" {
+			t.Errorf("%s level = %s, want error", name, l)
+		}
+	}
+	if err := SetLevel("disk", "info"); err == nil {
+		t.Errorf("SetLevel of unknown subsystem error = nil, want error")
+	}
+}
+
+func TestMemberAndTermFields(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Configure(Config{Format: FormatJSON, Output: &buf}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		SetMemberID("")
+		SetTerm(0)
+		Configure(Config{})
+	}()
+
+	SetMemberID("8e9e05c52164694d")
+	SetTerm(3)
+	PrintfLogger(SubsystemRaft).Infof("became leader at term %d", 3)
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["member"] != "8e9e05c52164694d" || m["term"] != float64(3) || m["msg"] != "became leader at term 3" {
+		t.Errorf("message = %v, want member and term fields", m)
+	}
+}
+
+func TestCapnslogBridge(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Configure(Config{Output: &buf, Levels: map[string]string{SubsystemSnap: "error"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(Config{})
+
+	capnslog.NewPackageLogger("github.com/fearblackcat/swiftRaft", "wal").Warningf("torn tail at %d", 7)
+	capnslog.NewPackageLogger("github.com/fearblackcat/swiftRaft", "snap").Infof("dropped")
+
+	out := buf.String()
+	if !strings.Contains(out, "torn tail at 7") || !strings.Contains(out, "subsystem=wal") {
+		t.Errorf("output = %q, want the wal warning", out)
+	}
+	if strings.Contains(out, "dropped") {
+		t.Errorf("output = %q, want snap info filtered", out)
+	}
+}
+
+func TestCapnslogLevels(t *testing.T) {
+	wal := capnslog.NewPackageLogger(capnslogRepo, "wal")
+	snap := capnslog.NewPackageLogger(capnslogRepo, "snap")
+	if err := Configure(Config{Level: "warning", Levels: map[string]string{SubsystemSnap: "debug"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(Config{})
+	if wal.LevelAt(capnslog.INFO) || !wal.LevelAt(capnslog.WARNING) {
+		t.Error("wal logs at another level than warning")
+	}
+	if !snap.LevelAt(capnslog.DEBUG) {
+		t.Error("snap does not log at debug")
+	}
+	if err := SetLevel(SubsystemSnap, "error"); err != nil {
+		t.Fatal(err)
+	}
+	if snap.LevelAt(capnslog.WARNING) {
+		t.Error("snap logs at warning once set to error")
+	}
+}
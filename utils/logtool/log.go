@@ -7,8 +7,10 @@ import (
 type DLTag string
 
 var (
-	RLog = &RLogHandle{logrus.NewEntry(logrus.New())}
-	NLog = &NLogHandle{logrus.NewEntry(logrus.New())}
+	// RLog logs the structured messages of the node subsystem.
+	RLog = Logger(SubsystemNode)
+	// NLog logs the printf style messages of the raft subsystem.
+	NLog = PrintfLogger(SubsystemRaft)
 )
 
 type RLogHandle struct {
@@ -61,82 +63,49 @@ type NLogHandle struct {
 }
 
 func (nLog *NLogHandle) Debug(v ...interface{}) {
-	nLog.Entry.Debug(v)
+	nLog.Entry.Debug(v...)
 }
 
 func (nLog *NLogHandle) Debugf(format string, v ...interface{}) {
-	nLog.Entry.Debugf(format, v)
+	nLog.Entry.Debugf(format, v...)
 }
 
 func (nLog *NLogHandle) Error(v ...interface{}) {
-	nLog.Entry.Error(v)
+	nLog.Entry.Error(v...)
 }
 
 func (nLog *NLogHandle) Errorf(format string, v ...interface{}) {
-	nLog.Entry.Errorf(format, v)
+	nLog.Entry.Errorf(format, v...)
 }
 
 func (nLog *NLogHandle) Info(v ...interface{}) {
-	nLog.Entry.Info(v)
+	nLog.Entry.Info(v...)
 }
 
 func (nLog *NLogHandle) Infof(format string, v ...interface{}) {
-	nLog.Entry.Infof(format, v)
+	nLog.Entry.Infof(format, v...)
 }
 
 func (nLog *NLogHandle) Warning(v ...interface{}) {
-	nLog.Entry.Warning(v)
+	nLog.Entry.Warning(v...)
 }
 
 func (nLog *NLogHandle) Warningf(format string, v ...interface{}) {
-	nLog.Entry.Warningf(format, v)
+	nLog.Entry.Warningf(format, v...)
 }
 
 func (nLog *NLogHandle) Fatal(v ...interface{}) {
-	nLog.Entry.Fatal(v)
+	nLog.Entry.Fatal(v...)
 }
 
 func (nLog *NLogHandle) Fatalf(format string, v ...interface{}) {
-	nLog.Logger.Fatalf(format, v)
+	nLog.Entry.Fatalf(format, v...)
 }
 
 func (nLog *NLogHandle) Panic(v ...interface{}) {
-	nLog.Entry.Panic(v)
+	nLog.Entry.Panic(v...)
 }
 
 func (nLog *NLogHandle) Panicf(format string, v ...interface{}) {
-	nLog.Entry.Panicf(format, v)
-}
-
-// InitLogger creates the logger instance
-func InitRaftLogger(logLevel string, node string) {
-	formattedLogger := logrus.New()
-	formattedLogger.Formatter = &logrus.TextFormatter{FullTimestamp: true}
-
-	level, err := logrus.ParseLevel(logLevel)
-	if err != nil {
-		logrus.WithError(err).Error("Error parsing log level, using: info")
-		level = logrus.InfoLevel
-	}
-
-	formattedLogger.Level = level
-	logger := logrus.NewEntry(formattedLogger).WithField("node", node)
-
-	RLog = &RLogHandle{logger}
-}
-
-func InitNodeMsgLogger(logLevel string, node string) {
-	formattedLogger := logrus.New()
-	formattedLogger.Formatter = &logrus.TextFormatter{FullTimestamp: true}
-
-	level, err := logrus.ParseLevel(logLevel)
-	if err != nil {
-		logrus.WithError(err).Error("Error parsing log level, using: info")
-		level = logrus.InfoLevel
-	}
-
-	formattedLogger.Level = level
-	logger := logrus.NewEntry(formattedLogger).WithField("node", node)
-
-	NLog = &NLogHandle{logger}
+	nLog.Entry.Panicf(format, v...)
 }
@@ -0,0 +1,91 @@
+// Package compressutil compresses payloads with DEFLATE, which the
+// standard library implements in pure Go, at the speed of the fastest
+// level: the payloads are written on the path of every commit.
+package compressutil
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// MinBytes is the size below which a payload is not worth compressing.
+const MinBytes = 128
+
+var writers = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// Compress returns the compressed b.
+func Compress(b []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(len(b) / 2)
+	w := writers.Get().(*flate.Writer)
+	w.Reset(&buf)
+	// writes to a bytes.Buffer do not fail
+	w.Write(b)
+	w.Close()
+	writers.Put(w)
+	return buf.Bytes()
+}
+
+// Shrink returns the compressed b and true if it is smaller than b, and b
+// and false if b is shorter than MinBytes or does not compress.
+func Shrink(b []byte) ([]byte, bool) {
+	if len(b) < MinBytes {
+		return b, false
+	}
+	c := Compress(b)
+	if len(c) >= len(b) {
+		return b, false
+	}
+	return c, true
+}
+
+// Decompress returns the data compressed into b by Compress.
+func Decompress(b []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Writer compresses what is written to it into an underlying writer, and
+// is flushed like an http.Flusher.
+type Writer struct {
+	zw  *flate.Writer
+	f   interface{ Flush() }
+	err error // of the last Flush
+}
+
+// NewWriter returns a Writer compressing into w. f, if not nil, is flushed
+// after w on Flush.
+func NewWriter(w io.Writer, f interface{ Flush() }) *Writer {
+	zw, _ := flate.NewWriter(w, flate.BestSpeed)
+	return &Writer{zw: zw, f: f}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.zw.Write(p)
+}
+
+// Flush makes what was written so far readable by a Reader, then flushes
+// f. Flush cannot fail, as http.Flusher does not: the next Write returns
+// its error.
+func (w *Writer) Flush() {
+	if w.err = w.zw.Flush(); w.err == nil && w.f != nil {
+		w.f.Flush()
+	}
+}
+
+// NewReader returns a reader of the stream written into r by a Writer.
+func NewReader(r io.Reader) io.ReadCloser {
+	return flate.NewReader(r)
+}
@@ -0,0 +1,82 @@
+package compressutil
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestShrink(t *testing.T) {
+	json := bytes.Repeat([]byte(`{"key":"/app/a","value":"1"}`), 20)
+	tests := []struct {
+		b []byte
+
+		wok bool
+	}{
+		{nil, false},
+		{json[:MinBytes-1], false},
+		{json, true},
+		// random-looking data does not compress
+		{[]byte("\x9f\x13\x87\x02\xee\x51\x0c\x44\xb8\x6a\x20\xd1\x7e\x35\xc9\xfa"), false},
+	}
+	for i, tt := range tests {
+		c, ok := Shrink(tt.b)
+		if ok != tt.wok {
+			t.Fatalf("#%d: compressed = %v, want %v", i, ok, tt.wok)
+		}
+		if !ok {
+			if !bytes.Equal(c, tt.b) {
+				t.Errorf("#%d: data changed though not compressed", i)
+			}
+			continue
+		}
+		if len(c) >= len(tt.b) {
+			t.Errorf("#%d: compressed to %d bytes from %d", i, len(c), len(tt.b))
+		}
+		d, err := Decompress(c)
+		if err != nil || !bytes.Equal(d, tt.b) {
+			t.Errorf("#%d: decompressed %q, %v", i, d, err)
+		}
+	}
+	if _, err := Decompress(Compress(json)[:10]); err == nil {
+		t.Error("decompressed truncated data")
+	}
+}
+
+type flushCounter struct{ n int }
+
+func (f *flushCounter) Flush() { f.n++ }
+
+func TestStream(t *testing.T) {
+	pr, pw := io.Pipe()
+	f := &flushCounter{}
+	w := NewWriter(pw, f)
+	r := NewReader(pr)
+	defer r.Close()
+
+	// every flushed message is readable before the next one is written,
+	// as on a stream of raft messages
+	for _, msg := range []string{"first message", "second message"} {
+		donec := make(chan struct{})
+		go func() {
+			w.Write([]byte(msg))
+			w.Flush()
+			close(donec)
+		}()
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(r, b); err != nil || string(b) != msg {
+			t.Fatalf("read %q, %v, want %q", b, err, msg)
+		}
+		<-donec
+	}
+	if f.n != 2 {
+		t.Errorf("flushed %d times, want 2", f.n)
+	}
+
+	pr.Close()
+	w.Write([]byte("lost"))
+	w.Flush()
+	if _, err := w.Write([]byte("more")); err == nil {
+		t.Error("write after a failed flush succeeded")
+	}
+}
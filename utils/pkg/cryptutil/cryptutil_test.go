@@ -0,0 +1,166 @@
+package cryptutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testKey1 = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKey2 = "202122232425262728292a2b2c2d2e2f"
+)
+
+func writeKeyFile(t *testing.T, dir string, lines ...string) string {
+	p := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(p, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		lines []string
+
+		wcur string
+		werr bool
+	}{
+		{[]string{"k1=" + testKey1}, "k1", false},
+		{[]string{"# keys", "k1=" + testKey1, "", "k2=" + testKey2}, "k2", false},
+		{nil, "", true},
+		{[]string{"k1"}, "", true},
+		{[]string{"k1=zz"}, "", true},
+		{[]string{"k1=0001"}, "", true},
+		{[]string{"k1=" + testKey1, "k1=" + testKey2}, "", true},
+	}
+	for i, tt := range tests {
+		p, err := NewFileKeyProvider(writeKeyFile(t, dir, tt.lines...))
+		if (err != nil) != tt.werr {
+			t.Fatalf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+		if err != nil {
+			continue
+		}
+		if id, _, _ := p.CurrentKey(); id != tt.wcur {
+			t.Errorf("#%d: current key = %q, want %q", i, id, tt.wcur)
+		}
+	}
+}
+
+func TestSealerRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p1, err := NewFileKeyProvider(writeKeyFile(t, dir, "k1="+testKey1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ad := []byte("secret value"), []byte("index 1")
+	sealed, err := NewSealer(p1).Seal(data, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, data) {
+		t.Fatal("sealed data holds the plaintext")
+	}
+	if id, err := KeyID(sealed); err != nil || id != "k1" {
+		t.Fatalf("key ID = %q, %v, want k1", id, err)
+	}
+
+	// data sealed under the previous key opens after a rotation
+	p2, err := NewFileKeyProvider(writeKeyFile(t, dir, "k1="+testKey1, "k2="+testKey2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSealer(p2)
+	if g, err := s.Open(sealed, ad); err != nil || !bytes.Equal(g, data) {
+		t.Fatalf("open = %q, %v, want %q", g, err, data)
+	}
+	resealed, err := s.Seal(data, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := KeyID(resealed); id != "k2" {
+		t.Errorf("key ID after rotation = %q, want k2", id)
+	}
+
+	if _, err = s.Open(sealed, []byte("index 2")); err == nil {
+		t.Error("opened with other associated data")
+	}
+	altered := append([]byte{}, sealed...)
+	altered[len(altered)-1] ^= 1
+	if _, err = s.Open(altered, ad); err == nil {
+		t.Error("opened altered data")
+	}
+	if _, err = s.Open([]byte{9, 9}, ad); err != ErrMalformed {
+		t.Errorf("err = %v, want ErrMalformed", err)
+	}
+
+	// data sealed under a removed key cannot be opened
+	p3, err := NewFileKeyProvider(writeKeyFile(t, dir, "k2="+testKey2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewSealer(p3).Open(sealed, ad); err != ErrKeyNotFound {
+		t.Errorf("err = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p, err := NewFileKeyProvider(writeKeyFile(t, dir, "k1="+testKey1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSealer(p)
+
+	for _, size := range []int{0, 1, streamChunkBytes, streamChunkBytes + 1, 3*streamChunkBytes + 7} {
+		data := bytes.Repeat([]byte{'x'}, size)
+		var b bytes.Buffer
+		w := NewWriter(&b, s)
+		// in uneven writes
+		for rest := data; len(rest) > 0; {
+			n := 1000
+			if n > len(rest) {
+				n = len(rest)
+			}
+			if _, err = w.Write(rest[:n]); err != nil {
+				t.Fatal(err)
+			}
+			rest = rest[n:]
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		sealed := b.Bytes()
+
+		g, err := ioutil.ReadAll(NewReader(bytes.NewReader(sealed), s))
+		if err != nil || !bytes.Equal(g, data) {
+			t.Fatalf("size %d: read %d bytes, %v", size, len(g), err)
+		}
+		// dropping the last chunk is detected
+		if size > streamChunkBytes {
+			first := 5 + int(uint32(sealed[1])<<24|uint32(sealed[2])<<16|uint32(sealed[3])<<8|uint32(sealed[4]))
+			if _, err = ioutil.ReadAll(NewReader(bytes.NewReader(sealed[:first]), s)); err != ErrTruncated {
+				t.Errorf("size %d: err = %v, want ErrTruncated", size, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Package cryptutil encrypts data at rest with AES-GCM, under keys named by
+// an ID that is stored with the data so that keys can be rotated.
+package cryptutil
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	ErrKeyNotFound = errors.New("cryptutil: key not found")
+	ErrNoKey       = errors.New("cryptutil: no current key")
+)
+
+// KeyProvider supplies the keys of a Sealer.
+type KeyProvider interface {
+	// CurrentKey returns the key new data is encrypted with, and its ID.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key of the given ID, to decrypt data encrypted with
+	// it, or ErrKeyNotFound.
+	Key(id string) ([]byte, error)
+}
+
+// FileKeyProvider reads its keys from a file with one "id=hexkey" line per
+// key, where the key is 16, 24 or 32 bytes long to select AES-128, AES-192
+// or AES-256. The last key is the current one: a key is rotated by adding
+// a line, and the previous keys are kept for as long as data encrypted
+// with them may be read. Empty lines and lines starting with # are
+// skipped.
+type FileKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewFileKeyProvider reads the keys of the file at path.
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &FileKeyProvider{keys: make(map[string][]byte)}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || len(kv[0]) > maxKeyIDBytes {
+			return nil, fmt.Errorf("cryptutil: %s:%d: want id=hexkey with an id of 1 to %d bytes", path, n, maxKeyIDBytes)
+		}
+		key, err := hex.DecodeString(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("cryptutil: %s:%d: %v", path, n, err)
+		}
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("cryptutil: %s:%d: key of %d bytes, want 16, 24 or 32", path, n, len(key))
+		}
+		if _, ok := p.keys[kv[0]]; ok {
+			return nil, fmt.Errorf("cryptutil: %s:%d: duplicate key id %q", path, n, kv[0])
+		}
+		p.keys[kv[0]] = key
+		p.current = kv[0]
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if p.current == "" {
+		return nil, ErrNoKey
+	}
+	return p, nil
+}
+
+func (p *FileKeyProvider) CurrentKey() (string, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *FileKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return key, nil
+}
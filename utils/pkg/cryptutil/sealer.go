@@ -0,0 +1,111 @@
+package cryptutil
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	// sealVersion is the first byte of the data sealed by a Sealer.
+	sealVersion = 1
+	// maxKeyIDBytes bounds key IDs, whose length is stored in a byte.
+	maxKeyIDBytes = 255
+)
+
+var ErrMalformed = errors.New("cryptutil: malformed sealed data")
+
+// Sealer encrypts and authenticates data with AES-GCM under the current
+// key of its KeyProvider. Sealed data starts with a header naming the key,
+// so that it can be opened after the key was rotated:
+//
+//	version (1 byte) | len(key ID) (1 byte) | key ID | nonce | ciphertext
+type Sealer struct {
+	keys KeyProvider
+
+	mu    sync.Mutex
+	aeads map[string]cipher.AEAD // by key ID
+}
+
+func NewSealer(keys KeyProvider) *Sealer {
+	return &Sealer{keys: keys, aeads: make(map[string]cipher.AEAD)}
+}
+
+// Seal encrypts plaintext, and authenticates it together with ad, which
+// Open must be given again.
+func (s *Sealer) Seal(plaintext, ad []byte) ([]byte, error) {
+	id, key, err := s.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if id == "" || len(id) > maxKeyIDBytes {
+		return nil, ErrNoKey
+	}
+	aead, err := s.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+	hdr := 2 + len(id)
+	b := make([]byte, hdr+aead.NonceSize(), hdr+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	b[0] = sealVersion
+	b[1] = byte(len(id))
+	copy(b[2:], id)
+	nonce := b[hdr:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(b, nonce, plaintext, ad), nil
+}
+
+// Open decrypts data sealed by Seal with the same ad. It fails with
+// ErrKeyNotFound if the KeyProvider lost the key, and with an error of
+// cipher.AEAD if the data was altered.
+func (s *Sealer) Open(sealed, ad []byte) ([]byte, error) {
+	id, err := KeyID(sealed)
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := s.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+	hdr := 2 + len(id)
+	if len(sealed) < hdr+aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	nonce := sealed[hdr : hdr+aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[hdr+aead.NonceSize():], ad)
+}
+
+// KeyID returns the ID of the key sealed was encrypted with.
+func KeyID(sealed []byte) (string, error) {
+	if len(sealed) < 2 || sealed[0] != sealVersion || len(sealed) < 2+int(sealed[1]) {
+		return "", ErrMalformed
+	}
+	return string(sealed[2 : 2+int(sealed[1])]), nil
+}
+
+func (s *Sealer) aead(id string, key []byte) (cipher.AEAD, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if aead, ok := s.aeads[id]; ok {
+		return aead, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s.aeads[id] = aead
+	return aead, nil
+}
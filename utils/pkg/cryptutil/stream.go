@@ -0,0 +1,141 @@
+package cryptutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// streamChunkBytes is the size of the chunks a stream is sealed in.
+const streamChunkBytes = 64 * 1024
+
+// maxSealedChunkBytes bounds the frames a stream reader accepts.
+const maxSealedChunkBytes = streamChunkBytes + 1024
+
+var ErrTruncated = errors.New("cryptutil: truncated stream")
+
+// A sealed stream is a sequence of frames, each holding a sealed chunk:
+//
+//	last (1 byte) | len(sealed chunk) (4 bytes) | sealed chunk
+//
+// Every chunk is authenticated with its sequence number and last flag, so
+// that chunks cannot be reordered, dropped or appended.
+func chunkAD(seq uint64, last byte) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, seq)
+	ad[8] = last
+	return ad
+}
+
+type streamWriter struct {
+	w   io.Writer
+	s   *Sealer
+	buf []byte
+	seq uint64
+}
+
+// NewWriter returns a writer that seals what is written to it into w. It
+// must be closed to write the last chunk.
+func NewWriter(w io.Writer, s *Sealer) io.WriteCloser {
+	return &streamWriter{w: w, s: s, buf: make([]byte, 0, streamChunkBytes)}
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		m := copy(sw.buf[len(sw.buf):cap(sw.buf)], p)
+		sw.buf = sw.buf[:len(sw.buf)+m]
+		p = p[m:]
+		n += m
+		// keep a full chunk buffered until more data comes, so that the
+		// last chunk is never empty unless the stream is
+		if len(sw.buf) == cap(sw.buf) && len(p) > 0 {
+			if err := sw.writeChunk(0); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the last chunk. It does not close the underlying writer.
+func (sw *streamWriter) Close() error {
+	return sw.writeChunk(1)
+}
+
+func (sw *streamWriter) writeChunk(last byte) error {
+	sealed, err := sw.s.Seal(sw.buf, chunkAD(sw.seq, last))
+	if err != nil {
+		return err
+	}
+	hdr := make([]byte, 5)
+	hdr[0] = last
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(sealed)))
+	if _, err = sw.w.Write(hdr); err != nil {
+		return err
+	}
+	if _, err = sw.w.Write(sealed); err != nil {
+		return err
+	}
+	sw.seq++
+	sw.buf = sw.buf[:0]
+	return nil
+}
+
+type streamReader struct {
+	r    io.Reader
+	s    *Sealer
+	buf  []byte
+	seq  uint64
+	done bool
+}
+
+// NewReader returns a reader of the stream sealed into r by NewWriter. It
+// fails with ErrTruncated if r ends before the last chunk.
+func NewReader(r io.Reader, s *Sealer) io.Reader {
+	return &streamReader{r: r, s: s}
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	for len(sr.buf) == 0 {
+		if sr.done {
+			return 0, io.EOF
+		}
+		if err := sr.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
+}
+
+func (sr *streamReader) readChunk() error {
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(sr.r, hdr); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+	last := hdr[0]
+	size := binary.BigEndian.Uint32(hdr[1:])
+	if last > 1 || size > maxSealedChunkBytes {
+		return ErrMalformed
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(sr.r, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+	b, err := sr.s.Open(sealed, chunkAD(sr.seq, last))
+	if err != nil {
+		return err
+	}
+	sr.buf = b
+	sr.seq++
+	sr.done = last == 1
+	return nil
+}
@@ -74,6 +74,13 @@ type TLSInfo struct {
 	// AllowedCN is a CN which must be provided by a client.
 	AllowedCN string
 
+	// AllowedCNs and AllowedHostnames are allow-lists for the verified
+	// certificate of the other side: it is accepted if its CN is in
+	// AllowedCNs (or is AllowedCN), or if one of its DNS or IP SANs is in
+	// AllowedHostnames. Every certificate is accepted if all are empty.
+	AllowedCNs       []string
+	AllowedHostnames []string
+
 	// Logger logs TLS errors.
 	// If nil, all logs are discarded.
 	Logger *zap.Logger
@@ -123,12 +130,15 @@ func SelfCert(lg *zap.Logger, dirpath string, hosts []string) (info TLSInfo, err
 		NotAfter:     time.Now().Add(365 * (24 * time.Hour)),
 
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
 	}
 
 	for _, host := range hosts {
-		h, _, _ := net.SplitHostPort(host)
+		h, _, err := net.SplitHostPort(host)
+		if err != nil {
+			h = host
+		}
 		if ip := net.ParseIP(h); ip != nil {
 			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
 		} else {
@@ -160,11 +170,13 @@ func SelfCert(lg *zap.Logger, dirpath string, hosts []string) (info TLSInfo, err
 
 	certOut, err := os.Create(certPath)
 	if err != nil {
-		info.Logger.Warn(
-			"cannot cert file",
-			zap.String("path", certPath),
-			zap.Error(err),
-		)
+		if info.Logger != nil {
+			info.Logger.Warn(
+				"cannot cert file",
+				zap.String("path", certPath),
+				zap.Error(err),
+			)
+		}
 		return
 	}
 	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
@@ -238,16 +250,14 @@ func (info TLSInfo) baseConfig() (*tls.Config, error) {
 		cfg.CipherSuites = info.CipherSuites
 	}
 
-	if info.AllowedCN != "" {
+	if info.AllowedCN != "" || len(info.AllowedCNs) > 0 || len(info.AllowedHostnames) > 0 {
 		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 			for _, chains := range verifiedChains {
-				if len(chains) != 0 {
-					if info.AllowedCN == chains[0].Subject.CommonName {
-						return nil
-					}
+				if len(chains) != 0 && info.allowed(chains[0]) {
+					return nil
 				}
 			}
-			return errors.New("CommonName authentication failed")
+			return errors.New("certificate is not in the allowed CNs or hostnames")
 		}
 	}
 
@@ -302,6 +312,34 @@ func (info TLSInfo) baseConfig() (*tls.Config, error) {
 	return cfg, nil
 }
 
+// allowed reports whether cert matches the CN or hostname allow-lists.
+func (info TLSInfo) allowed(cert *x509.Certificate) bool {
+	cn := cert.Subject.CommonName
+	if info.AllowedCN != "" && info.AllowedCN == cn {
+		return true
+	}
+	for _, allowed := range info.AllowedCNs {
+		if allowed == cn {
+			return true
+		}
+	}
+	for _, h := range info.AllowedHostnames {
+		for _, name := range cert.DNSNames {
+			if strings.EqualFold(h, name) {
+				return true
+			}
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			for _, certIP := range cert.IPAddresses {
+				if ip.Equal(certIP) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
 // cafiles returns a list of CA file paths.
 func (info TLSInfo) cafiles() []string {
 	cs := make([]string, 0)
@@ -335,6 +373,28 @@ func (info TLSInfo) ServerConfig() (*tls.Config, error) {
 	// "h2" NextProtos is necessary for enabling HTTP2 for go's HTTP server
 	cfg.NextProtos = []string{"h2"}
 
+	// like the certificate, the trusted CAs are reloaded on every handshake
+	// so that they can be rotated without a restart
+	if len(cs) > 0 {
+		base := cfg.Clone()
+		cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cp, err := tlsutil.NewCertPool(cs)
+			if err != nil {
+				if info.Logger != nil {
+					info.Logger.Warn(
+						"failed to reload trusted CA files",
+						zap.Strings("ca-files", cs),
+						zap.Error(err),
+					)
+				}
+				return nil, err
+			}
+			c := base.Clone()
+			c.ClientCAs = cp
+			return c, nil
+		}
+	}
+
 	return cfg, nil
 }
 
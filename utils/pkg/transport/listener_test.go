@@ -2,13 +2,17 @@ package transport
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/fearblackcat/swiftRaft/utils/pkg/testutil"
+
 	"go.uber.org/zap"
 )
 
@@ -268,3 +272,137 @@ func TestIsClosedConnError(t *testing.T) {
 		t.Fatalf("expect true, got false (%v)", err)
 	}
 }
+
+// tlsExchange dials ln with the client config of cli and reads one byte
+// written by the server, so that the server's verification of the client
+// certificate is part of the result. It returns the server certificate.
+func tlsExchange(ln net.Listener, cli TLSInfo) (*x509.Certificate, error) {
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Write([]byte("x"))
+			conn.Close()
+		}
+	}()
+	cfg, err := cli.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tls.Dial("tcp", ln.Addr().String(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != nil {
+		return nil, err
+	}
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestTLSListenerAllowedPeers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, err := testutil.NewCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(name, cn string, hosts ...string) TLSInfo {
+		cert, key, err := ca.Issue(name, cn, hosts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return TLSInfo{CertFile: cert, KeyFile: key, TrustedCAFile: ca.CertFile}
+	}
+	srv := issue("server", "server", "127.0.0.1")
+	srv.ClientCertAuth = true
+	srv.AllowedCNs = []string{"peer1"}
+	srv.AllowedHostnames = []string{"peer2.example.com", "10.0.0.3"}
+
+	tests := []struct {
+		cli TLSInfo
+		ok  bool
+	}{
+		{issue("peer1", "peer1"), true},
+		{issue("peer2", "other", "peer2.example.com"), true},
+		{issue("peer3", "other", "10.0.0.3"), true},
+		{issue("peer4", "other", "10.0.0.4", "peer4.example.com"), false},
+		// no client certificate
+		{TLSInfo{TrustedCAFile: ca.CertFile}, false},
+	}
+	for i, tt := range tests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ln, err = NewTLSListener(ln, &srv); err != nil {
+			t.Fatal(err)
+		}
+		_, err = tlsExchange(ln, tt.cli)
+		if (err == nil) != tt.ok {
+			t.Errorf("#%d: err = %v, want ok %v", i, err, tt.ok)
+		}
+		ln.Close()
+	}
+}
+
+// TestTLSListenerReload ensures that rotated certificate and CA files are
+// used by new connections without restarting the listener.
+func TestTLSListenerReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, err := testutil.NewCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key, err := ca.Issue("server", "server-1", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccert, ckey, err := ca.Issue("client", "client", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := TLSInfo{CertFile: cert, KeyFile: key, TrustedCAFile: ca.CertFile, ClientCertAuth: true}
+	cli := TLSInfo{CertFile: ccert, KeyFile: ckey, TrustedCAFile: ca.CertFile}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ln, err = NewTLSListener(ln, &srv); err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	got, err := tlsExchange(ln, cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Subject.CommonName != "server-1" {
+		t.Fatalf("server CN = %q, want server-1", got.Subject.CommonName)
+	}
+
+	// rotate the CA and every certificate in place
+	ca, err = testutil.NewCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ca.Issue("server", "server-2", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ca.Issue("client", "client", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = tlsExchange(ln, cli); err != nil {
+		t.Fatal(err)
+	}
+	if got.Subject.CommonName != "server-2" {
+		t.Errorf("server CN = %q, want server-2", got.Subject.CommonName)
+	}
+}